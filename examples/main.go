@@ -2,48 +2,48 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"monitor"
+	"net/http"
+	"net/netip"
 	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
-func generateLogs(path string) {
+// Puts the terminal in raw mode, returns a function restoring it
+func rawTerminal() (func(), error) {
 
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal(err)
+	stty := func(args ...string) error {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
 	}
-	defer f.Close()
 
-	sections := []string{
-		"contact", "help", "admin", "support", "pricing", "team",
+	if err := stty("raw", "-echo"); err != nil {
+		return nil, err
 	}
 
-	rand.Seed(time.Now().Unix())
-
-	for {
-
-		var lines []byte
-
-		for i := 0; i < 5000; i++ {
+	return func() { stty("-raw", "echo") }, nil
+}
 
-			j := rand.Intn(len(sections))
-			size := rand.Intn(40)
-			ip := rand.Intn(10) + 1
+func readConfigFile(path string) *monitor.ConfigFile {
 
-			line := fmt.Sprintf("127.0.0.%d - - [%s] \"GET /%s HTTP/1.1\" 200 %d\n", ip,
-				time.Now().Format("02/Jan/2006:15:04:05 -0700"), sections[j], size)
-			lines = append(lines, []byte(line)...)
-		}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
 
-		f.Write(lines)
-		j := rand.Intn(3)
-		time.Sleep(time.Duration(j) * time.Second)
+	cf, err := monitor.ReadConfigFile(f)
+	if err != nil {
+		log.Fatal(err)
 	}
+	return cf
 }
 
 func main() {
@@ -60,9 +60,24 @@ func main() {
 	trafficWindow := flag.Int("traffic-window", 120,
 		"Sliding window for alerting (in seconds)")
 
-	threshold := flag.Int("treshold", 250,
+	threshold := flag.Int("threshold", 250,
 		"Value for which an alert is triggered (in bytes)")
 
+	windowGranularity := flag.Int("window-granularity", 1,
+		"Resolution in seconds of the traffic window")
+
+	allowedLateness := flag.Int("allowed-lateness", 0,
+		"Seconds to wait for out of order entries (delays alerts and metrics)")
+
+	latePolicy := flag.String("late-policy", "drop",
+		"Entries arriving after their period was emitted: drop, count or correct")
+
+	outputBuffer := flag.Int("output-buffer", 64,
+		"Number of metrics and alert batches queued for display")
+
+	outputPolicy := flag.String("output-policy", "drop-oldest",
+		"When the display lags: drop-oldest, drop-newest, block or coalesce")
+
 	bufferPoolSize := flag.Int("buffer-pool-size", 20,
 		"number of buffers in buffer pool")
 
@@ -75,11 +90,61 @@ func main() {
 	delay := flag.Int("delay", 0,
 		"delay to retrieve logs (in milliseconds)")
 
+	jsonOutput := flag.Bool("json", false,
+		"Display metrics and alerts as NDJSON events")
+
+	tui := flag.Bool("tui", false,
+		"Display a full-screen dashboard")
+
+	httpAddr := flag.String("http", "",
+		"Address serving /metrics (Prometheus), /silences and /history (e.g. :8080)")
+
+	web := flag.Bool("web", false,
+		"Serve a live web dashboard on / (requires -http)")
+
+	filter := flag.String("filter", "",
+		"Only monitor entries matching the expression (e.g. 'method == \"POST\" && status >= 500')")
+
+	bots := flag.String("bots", "",
+		"File of bot signatures replacing the shipped ones (see monitor/bots.txt)")
+
+	trustedProxies := flag.String("trusted-proxies", "",
+		"Comma separated CIDRs of trusted proxies (e.g. 10.0.0.0/8)")
+
+	forwardedField := flag.Int("forwarded-field", 0,
+		"Position of the quoted field after the user agent holding X-Forwarded-For")
+
+	geoCountry := flag.String("geoip-country", "",
+		"GeoLite2 Country database (MMDB) ranking top countries")
+
+	geoASN := flag.String("geoip-asn", "",
+		"GeoLite2 ASN database (MMDB) ranking top ASNs")
+
+	sessionTimeout := flag.Int("session-timeout", 0,
+		"Track visitor sessions ending after this many minutes of inactivity")
+
+	topK := flag.Int("top-k", 0,
+		"Report the top K sections, resources, clients and user agents")
+
+	configPath := flag.String("config", "",
+		"JSON configuration file replacing the flags it covers, reloaded on "+
+			"SIGHUP or change")
+
 	flag.Parse()
 
-	os.Remove(*path)
+	var cf *monitor.ConfigFile
+	if *configPath != "" {
+		cf = readConfigFile(*configPath)
+		*path = cf.Source.Path
+		*jsonOutput = cf.Outputs.Display == "json"
+		*tui = cf.Outputs.Display == "tui"
+		*web = cf.Outputs.Display == "web"
+		*httpAddr = cf.Outputs.HTTPAddr
+	}
 
-	f, err := os.OpenFile(*path, os.O_CREATE|os.O_RDONLY, 0644)
+	// Read only, the log being written by the HTTP server (see httpmonitor
+	// gen to generate one)
+	f, err := os.Open(*path)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -101,11 +166,144 @@ func main() {
 		Delay:            time.Duration(*delay) * time.Millisecond,
 		AlertsChan:       alertsChan,
 		MetricsChan:      metricsChan,
+
+		WindowGranularity: time.Duration(*windowGranularity) * time.Second,
+		AllowedLateness:   time.Duration(*allowedLateness) * time.Second,
+		OutputBuffer:      *outputBuffer,
+	}
+
+	conf.LatePolicy, err = monitor.ParseLatePolicy(*latePolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conf.OutputPolicy, err = monitor.ParseOutputPolicy(*outputPolicy)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	//go generateLogs(*path)
-	go monitor.Display(os.Stdout, alertsChan, metricsChan)
-	monitor.Monitor(conf)
+	if *bots != "" {
+		sf, err := os.Open(*bots)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		conf.Bots = &monitor.BotClassifier{}
+		err = conf.Bots.Update(sf)
+		sf.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *trustedProxies != "" {
+		conf.Clients = &monitor.Clients{ForwardedField: *forwardedField}
+
+		for _, cidr := range strings.Split(*trustedProxies, ",") {
+			p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+			if err != nil {
+				log.Fatal(err)
+			}
+			conf.Clients.TrustedProxies = append(conf.Clients.TrustedProxies, p)
+		}
+	}
+
+	if *geoCountry != "" || *geoASN != "" {
+		conf.GeoIP = &monitor.GeoIP{CountryDB: *geoCountry, ASNDB: *geoASN}
+		defer conf.GeoIP.Close()
+	}
+
+	if *sessionTimeout > 0 {
+		conf.Sessions = &monitor.SessionTracker{
+			Timeout: time.Duration(*sessionTimeout) * time.Minute,
+		}
+	}
+
+	if *topK > 0 {
+		conf.TopK = &monitor.TopK{K: *topK}
+	}
+
+	if *filter != "" {
+		conf.Filter, err = monitor.CompileFilter(*filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cf != nil {
+		if err := cf.Apply(conf); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	m := &monitor.Monitor{Config: conf}
+
+	if *configPath != "" {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		go m.WatchConfigFile(*configPath, time.Second, sighup)
+	}
+
+	// Alerts go through the alert manager before being displayed
+	am := &monitor.AlertManager{}
+	managedAlertsChan := make(chan []*monitor.Alert)
+
+	// Metrics are recorded in the history before being displayed
+	history := &monitor.History{}
+	recordedMetricsChan := make(chan *monitor.Metrics)
+
+	mux := http.NewServeMux()
+	if *httpAddr != "" {
+		// Unless configured by the outputs prometheus section
+		if conf.Exporter == nil {
+			conf.Exporter = &monitor.PrometheusExporter{}
+		}
+		mux.Handle("/metrics", conf.Exporter)
+		mux.Handle("/silences", am.SilencesHandler())
+		mux.Handle("/history", history)
+
+		go func() {
+			log.Fatal(http.ListenAndServe(*httpAddr, mux))
+		}()
+	}
+
+	go am.Run(alertsChan, managedAlertsChan)
+	go history.Run(metricsChan, recordedMetricsChan)
+
+	switch {
+
+	case *web && *httpAddr != "":
+		wd := &monitor.WebDashboard{}
+		mux.Handle("/", wd)
+		go wd.Run(managedAlertsChan, recordedMetricsChan)
+
+	case *tui:
+		restore, err := rawTerminal()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := m.Run(); err != nil {
+				restore()
+				log.Fatal(err)
+			}
+		}()
+		d := &monitor.Dashboard{}
+		d.Run(os.Stdout, os.Stdin, managedAlertsChan, recordedMetricsChan)
+		restore()
+		return
+
+	case *jsonOutput:
+		go monitor.DisplayJSON(os.Stdout, managedAlertsChan, recordedMetricsChan)
+
+	default:
+		go monitor.Display(os.Stdout, managedAlertsChan, recordedMetricsChan)
+	}
+
+	if err := m.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // echo "- - - [`date "+%d/%b/%Y:%H:%M:%S %z"`] \"GET /twiki/ HTTP/1.1\" 401 12846" >> access.log
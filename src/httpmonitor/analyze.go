@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"monitor"
+)
+
+// Metrics or alert, ordered by the time it refers to
+type event struct {
+	at      time.Time
+	metrics *monitor.Metrics
+	alert   *monitor.Alert
+}
+
+// Prints metrics and alerts as they arrive in chronological order (alerts
+// first when a period ends at the same time), events being held until the
+// metrics of the next period arrive: metrics and alerts being delivered by
+// distinct queues, an alert arriving later than that is printed late
+type streamer struct {
+	p *printer
+
+	mu      sync.Mutex
+	pending []event
+	last    time.Time
+	periods int
+	alerts  int
+}
+
+func (s *streamer) add(e event) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = append(s.pending, e)
+
+	// Corrections refer to periods already printed
+	if e.metrics != nil && e.at.After(s.last) {
+		s.flush(s.last)
+		s.last = e.at
+	}
+}
+
+// Prints the pending events up to until (every one if zero)
+func (s *streamer) flush(until time.Time) {
+
+	sort.SliceStable(s.pending, func(i, j int) bool {
+		if s.pending[i].at.Equal(s.pending[j].at) {
+			return s.pending[i].alert != nil && s.pending[j].alert == nil
+		}
+		return s.pending[i].at.Before(s.pending[j].at)
+	})
+
+	n := 0
+	for ; n < len(s.pending); n++ {
+
+		e := s.pending[n]
+		if !until.IsZero() && e.at.After(until) {
+			break
+		}
+
+		if e.metrics != nil {
+			s.p.printMetrics(e.metrics)
+			s.periods++
+		} else {
+			s.p.printAlerts([]*monitor.Alert{e.alert})
+			s.alerts++
+		}
+	}
+
+	s.pending = append([]event{}, s.pending[n:]...)
+}
+
+// Processes FILEs (concatenated, "-" being the standard input) as a single
+// log, writing metrics and alerts in chronological order as they come (see
+// streamer) and a summary to stderr
+func analyze(ctx context.Context, args []string, stdout,
+	stderr io.Writer) int {
+
+	fs := newFlagSet("analyze", "FILE...", stderr)
+
+	s := &settings{}
+	s.register(fs)
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	cf, conf, err := s.configFile(fs)
+	if err != nil {
+		return usageError(fs, "%v", err)
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		if s.config == "" {
+			return usageError(fs, "FILE is required")
+		}
+		paths = []string{cf.Source.Path}
+	}
+
+	readers := []io.Reader{}
+	for _, path := range paths {
+
+		if path == "-" {
+			readers = append(readers, os.Stdin, strings.NewReader("\n"))
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return failure(stderr, "analyze", err)
+		}
+		defer f.Close()
+
+		// Files not ending with a new line
+		readers = append(readers, f, strings.NewReader("\n"))
+	}
+
+	var rd io.Reader = &contextReader{ctx, io.MultiReader(readers...)}
+	conf.AccessLog = &rd
+
+	m := &monitor.Monitor{Config: conf}
+
+	st := &streamer{p: &printer{w: stdout,
+		json: cf.Outputs.Display == "json"}}
+
+	var mu sync.Mutex
+	parseErrors := 0
+
+	m.SubscribeMetrics(&monitor.MetricsSubscriber{
+		Handler: func(metrics *monitor.Metrics) {
+			st.add(event{at: metrics.PeriodEnd, metrics: metrics})
+		},
+		Policy: monitor.OutputBlock,
+	})
+	m.SubscribeAlerts(&monitor.AlertsSubscriber{
+		Handler: func(alerts []*monitor.Alert) {
+			for _, a := range alerts {
+				st.add(event{at: a.Timestamp, alert: a})
+			}
+		},
+		Policy: monitor.OutputBlock,
+	})
+	m.SubscribeParseErrors(&monitor.ParseErrorsSubscriber{
+		Handler: func(errs []*monitor.ParseError) {
+			mu.Lock()
+			parseErrors += len(errs)
+			mu.Unlock()
+		},
+		Policy: monitor.OutputBlock,
+	})
+
+	err = m.Analyze()
+
+	// Every subscriber got its items
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.flush(time.Time{})
+
+	if err != nil {
+		return failure(stderr, "analyze", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	fmt.Fprintf(stderr, "%d metrics periods, %d alerts, %d parse errors\n",
+		st.periods, st.alerts, parseErrors)
+
+	if ctx.Err() != nil {
+		fmt.Fprintln(stderr, "httpmonitor analyze: interrupted")
+	}
+
+	return exitOK
+}
+
+// Reader ending (io.EOF) once ctx is done, so that an interrupted analysis
+// reports what was read
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+
+	if cr.ctx.Err() != nil {
+		return 0, io.EOF
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const analyzeTestLogs = `10.0.0.1 - - [01/Jan/1970:00:00:01 +0000] "GET /toto HTTP/1.1" 200 100
+10.0.0.2 - - [01/Jan/1970:00:00:02 +0000] "GET /toto HTTP/1.1" 200 100
+not a log line
+10.0.0.1 - - [01/Jan/1970:00:00:12 +0000] "GET /test HTTP/1.1" 404 10`
+
+// Fields of the NDJSON events of both metrics and alerts
+type testEvent struct {
+	Type     string `json:"type"`
+	Requests int    `json:"requests"`
+	Status   string `json:"status"`
+}
+
+func TestAnalyze(t *testing.T) {
+
+	// The first file does not end with a new line
+	first := writeTempFile(t, "first.log", analyzeTestLogs)
+	second := writeTempFile(t, "second.log",
+		`10.0.0.1 - - [01/Jan/1970:00:00:25 +0000] "GET /toto HTTP/1.1" 200 10`+
+			"\n")
+
+	code, stdout, stderr := runCommand(context.Background(), "analyze",
+		"-json", "-threshold", "150", "-traffic-window", "10s",
+		"-entry-pool-size", "10", first, second)
+	if code != exitOK {
+		t.Fatalf("Exit code differs. Want %d, got %d (%s)", exitOK, code,
+			stderr)
+	}
+
+	requests := []int{}
+	statuses := []string{}
+
+	sc := bufio.NewScanner(strings.NewReader(stdout))
+	for sc.Scan() {
+
+		e := testEvent{}
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid event %q: %v", sc.Text(), err)
+		}
+
+		if e.Type == "metrics" {
+			requests = append(requests, e.Requests)
+		} else {
+			statuses = append(statuses, e.Status)
+		}
+	}
+
+	if want := []int{2, 1, 1}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("Requests differ. Want %v, got %v", want, requests)
+	}
+
+	if want := []string{"exceed", "recovered"}; !reflect.DeepEqual(statuses,
+		want) {
+		t.Errorf("Alerts differ. Want %v, got %v", want, statuses)
+	}
+
+	want := "3 metrics periods, 2 alerts, 1 parse errors\n"
+	if stderr != want {
+		t.Errorf("Summary differs. Want %q, got %q", want, stderr)
+	}
+
+	// Input logs are only read
+	if b, _ := os.ReadFile(first); string(b) != analyzeTestLogs {
+		t.Errorf("Analyzed file was modified: %q", b)
+	}
+}
+
+func TestAnalyzeUsage(t *testing.T) {
+
+	config := writeTempFile(t, "httpmonitor.json", `{}`)
+	log := writeTempFile(t, "access.log", analyzeTestLogs)
+
+	tests := [][]string{
+		// -config is exclusive with the settings it covers
+		{"-config", config, "-threshold", "10", log},
+		{"-read-frequency", "0s", log},
+		{"-late-policy", "ignore", log},
+		{"-filter", "status >>= 500", log},
+		{"-entry-pool-size", "10"},
+	}
+
+	for _, args := range tests {
+
+		code, _, stderr := runCommand(context.Background(),
+			append([]string{"analyze"}, args...)...)
+		if code != exitUsage {
+			t.Errorf("Exit code of %v differs. Want %d, got %d (%s)",
+				args, exitUsage, code, stderr)
+		}
+	}
+
+	code, _, stderr := runCommand(context.Background(), "analyze",
+		"-entry-pool-size", "10", log+".missing")
+	if code != exitFailure {
+		t.Errorf("Exit code differs. Want %d, got %d (%s)", exitFailure, code,
+			stderr)
+	}
+}
+
+func TestAnalyzeNotifiers(t *testing.T) {
+
+	var mu sync.Mutex
+	statuses := []string{}
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			payload := struct {
+				Status string `json:"status"`
+			}{}
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &payload)
+
+			mu.Lock()
+			statuses = append(statuses, payload.Status)
+			mu.Unlock()
+		}))
+	defer ts.Close()
+
+	config := writeTempFile(t, "httpmonitor.json", `{
+		"source": {"entry_pool_size": 10},
+		"alerts": {"traffic_window": "10s", "threshold": 150},
+		"outputs": {
+			"display": "json",
+			"webhooks": [{"name": "hook", "url": "`+ts.URL+`"}]
+		}
+	}`)
+	log := writeTempFile(t, "access.log", analyzeTestLogs)
+
+	code, _, stderr := runCommand(context.Background(), "analyze",
+		"-config", config, log)
+	if code != exitOK {
+		t.Fatalf("Exit code differs. Want %d, got %d (%s)", exitOK, code,
+			stderr)
+	}
+
+	// Delivered before analyze returns
+	mu.Lock()
+	defer mu.Unlock()
+
+	if want := []string{"exceed", "recovered"}; !reflect.DeepEqual(statuses,
+		want) {
+		t.Errorf("Notified statuses differ. Want %v, got %v", want, statuses)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// Interval between two batches of generated lines
+const genInterval = 100 * time.Millisecond
+
+// Line of the client, section and status, stamped with t
+func genLine(rnd *rand.Rand, t time.Time, sections []string, clients int,
+	errorRate float64) string {
+
+	status := 200
+	if rnd.Float64() < errorRate {
+		status = []int{404, 500, 503}[rnd.Intn(3)]
+	}
+
+	client := rnd.Intn(clients) + 1
+
+	return fmt.Sprintf("10.%d.%d.%d - - [%s] \"GET /%s/%d HTTP/1.1\" %d %d\n",
+		client>>16&255, client>>8&255, client&255, t.Format(timestampLayout),
+		sections[rnd.Intn(len(sections))], rnd.Intn(100), status,
+		rnd.Intn(4096))
+}
+
+// Writes -rate lines per second stamped with the current time to -out
+// (appending) or stdout, for -duration or until interrupted
+func gen(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+
+	fs := newFlagSet("gen", "", stderr)
+
+	rate := fs.Float64("rate", 100, "Lines per second")
+	duration := fs.Duration("duration", 0,
+		"Generation time (until interrupted if 0)")
+	out := fs.String("out", "",
+		"File the lines are appended to (standard output if empty)")
+	sections := fs.String("sections", "contact,help,admin,support,pricing,team",
+		"Comma separated sections of the requested resources")
+	clients := fs.Int("clients", 10, "Number of distinct clients")
+	errorRate := fs.Float64("error-rate", 0.01,
+		"Fraction of requests answered with an error status")
+	seed := fs.Int64("seed", 0, "Random seed (current time if 0)")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	switch {
+	case fs.NArg() != 0:
+		return usageError(fs, "unexpected arguments %v", fs.Args())
+	case *rate <= 0:
+		return usageError(fs, "-rate must be positive")
+	case *duration < 0:
+		return usageError(fs, "-duration must not be negative")
+	case *clients <= 0:
+		return usageError(fs, "-clients must be positive")
+	case *errorRate < 0 || *errorRate > 1:
+		return usageError(fs, "-error-rate must be between 0 and 1")
+	}
+
+	names := strings.Split(*sections, ",")
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+		if names[i] == "" {
+			return usageError(fs, "-sections must not have empty entries")
+		}
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(*seed))
+
+	w := stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return failure(stderr, "gen", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	bw := bufio.NewWriter(w)
+
+	var end <-chan time.Time
+	if *duration > 0 {
+		end = time.After(*duration)
+	}
+
+	ticker := time.NewTicker(genInterval)
+	defer ticker.Stop()
+
+	// Fractions of lines carried over to the next batch
+	pending := 0.0
+
+	for {
+
+		now := time.Now()
+		pending += *rate * genInterval.Seconds()
+
+		for ; pending >= 1; pending-- {
+			bw.WriteString(genLine(rnd, now, names, *clients, *errorRate))
+		}
+
+		if err := bw.Flush(); err != nil {
+			return failure(stderr, "gen", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-end:
+			return exitOK
+		case <-ctx.Done():
+			return exitOK
+		}
+	}
+}
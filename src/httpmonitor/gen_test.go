@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"w3chttpd"
+)
+
+func TestGenLine(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(1))
+	ts := time.Date(2024, 3, 5, 10, 20, 30, 0, time.UTC)
+	e := &w3chttpd.Entry{}
+
+	for i := 0; i < 100; i++ {
+
+		line := genLine(rnd, ts, []string{"toto", "test"}, 1000, 0.5)
+		if err := w3chttpd.ParseLine([]byte(strings.TrimSuffix(line, "\n")),
+			e); err != nil {
+			t.Fatalf("Generated line %q cannot be parsed: %v", line, err)
+		}
+
+		if !e.Timestamp.Equal(ts) {
+			t.Errorf("Timestamp differs. Want %v, got %v", ts, e.Timestamp)
+		}
+	}
+}
+
+func TestGen(t *testing.T) {
+
+	out := writeTempFile(t, "access.log", "")
+
+	code, _, stderr := runCommand(context.Background(), "gen", "-rate", "100",
+		"-duration", "250ms", "-seed", "1", "-out", out)
+	if code != exitOK {
+		t.Fatalf("Exit code differs. Want %d, got %d (%s)", exitOK, code,
+			stderr)
+	}
+
+	// 10 lines per batch of 100ms, the first one being written at once
+	code, stdout, stderr := runCommand(context.Background(), "analyze",
+		"-json", "-entry-pool-size", "100", out)
+	if code != exitOK {
+		t.Fatalf("Exit code differs. Want %d, got %d (%s)", exitOK, code,
+			stderr)
+	}
+
+	if !strings.Contains(stderr, " 0 parse errors") || stdout == "" {
+		t.Errorf("Generated lines should be analyzed, got %q", stderr)
+	}
+}
+
+func TestGenUsage(t *testing.T) {
+
+	tests := [][]string{
+		{"-rate", "0"},
+		{"-duration", "-1s"},
+		{"-clients", "0"},
+		{"-error-rate", "2"},
+		{"-sections", " "},
+		{"-sections", "a,,b"},
+		{"extra"},
+	}
+
+	for _, args := range tests {
+
+		code, _, stderr := runCommand(context.Background(),
+			append([]string{"gen"}, args...)...)
+		if code != exitUsage {
+			t.Errorf("Exit code of %v differs. Want %d, got %d (%s)",
+				args, exitUsage, code, stderr)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Command httpmonitor monitors HTTP access logs (W3C common log format)
+//
+//	httpmonitor watch [flags] FILE        tail a live log
+//	httpmonitor analyze [flags] FILE...   process logs offline
+//	httpmonitor replay [flags] FILE       re-emit a log at N times speed
+//	httpmonitor validate FILE...          check configuration files
+//	httpmonitor gen [flags]               generate load
+//
+// watch follows FILE from its end (unless -from-start) across rotations
+// and truncations, serving Prometheus metrics with -http. analyze drives
+// the reads by log time, - reading the standard input. -config cannot be
+// combined with the settings flags it covers
+//
+// Exits with 0 on success (or when interrupted), 1 on failure and 2 on
+// invalid usage. Input logs are only ever opened for reading
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string, stdout, stderr io.Writer) int
+}
+
+var commands = []command{
+	{"watch", "tail a live log, reporting metrics and alerts", watch},
+	{"analyze", "process logs offline, log time driving the reads", analyze},
+	{"replay", "re-emit a log at N times its original speed", replay},
+	{"validate", "check configuration files", validate},
+	{"gen", "generate log lines at a given rate", gen},
+}
+
+func usage(w io.Writer) {
+
+	fmt.Fprintln(w, "Usage: httpmonitor COMMAND [flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'httpmonitor COMMAND -h' for the flags of a command")
+}
+
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+
+	if len(args) == 0 {
+		usage(stderr)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return exitOK
+	}
+
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(ctx, args[1:], stdout, stderr)
+		}
+	}
+
+	fmt.Fprintf(stderr, "httpmonitor: unknown command %q\n\n", args[0])
+	usage(stderr)
+	return exitUsage
+}
+
+func main() {
+
+	// Interrupted commands stop cleanly, SIGHUP being handled by watch
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+
+	stop()
+	os.Exit(code)
+}
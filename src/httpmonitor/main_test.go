@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs the command line args, returning the exit code, stdout and stderr
+func runCommand(ctx context.Context, args ...string) (int, string, string) {
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := run(ctx, args, stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func writeTempFile(t *testing.T, name, content string) string {
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRun(t *testing.T) {
+
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{}, exitUsage},
+		{[]string{"help"}, exitOK},
+		{[]string{"monitor"}, exitUsage},
+		{[]string{"analyze", "-h"}, exitOK},
+		{[]string{"analyze", "-unknown"}, exitUsage},
+	}
+
+	for _, test := range tests {
+
+		code, _, stderr := runCommand(context.Background(), test.args...)
+		if code != test.code {
+			t.Errorf("Exit code of %v differs. Want %d, got %d (%s)",
+				test.args, test.code, code, stderr)
+		}
+	}
+
+	_, _, stderr := runCommand(context.Background(), "monitor")
+	if !strings.Contains(stderr, "unknown command") {
+		t.Errorf("Unknown command not reported, got %q", stderr)
+	}
+}
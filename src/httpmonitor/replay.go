@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"w3chttpd"
+)
+
+// Layout of W3C log timestamps
+const timestampLayout = "02/Jan/2006:15:04:05 -0700"
+
+// Replaces the timestamp of a log line (between the first brackets)
+func rewriteTimestamp(line []byte, t time.Time) []byte {
+
+	start := bytes.IndexByte(line, '[')
+	if start == -1 {
+		return line
+	}
+
+	end := bytes.IndexByte(line[start:], ']')
+	if end == -1 {
+		return line
+	}
+
+	res := make([]byte, 0, len(line))
+	res = append(res, line[:start+1]...)
+	res = append(res, t.Format(timestampLayout)...)
+	return append(res, line[start+end:]...)
+}
+
+// Writes the lines of FILE to -out (appending) or stdout, paced by their
+// timestamps divided by -speed and stamped with the replay time (unless
+// -keep-timestamps), lines that cannot be parsed being written with the
+// previous one
+func replay(ctx context.Context, args []string, stdout,
+	stderr io.Writer) int {
+
+	fs := newFlagSet("replay", "FILE", stderr)
+
+	speed := fs.Float64("speed", 1,
+		"Replay speed (2 replays an hour of logs in 30 minutes)")
+	out := fs.String("out", "",
+		"File the lines are appended to (standard output if empty)")
+	keep := fs.Bool("keep-timestamps", false,
+		"Keep the original timestamps instead of the replay time")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *speed <= 0 {
+		return usageError(fs, "-speed must be positive")
+	}
+
+	if fs.NArg() != 1 {
+		return usageError(fs, "a single FILE is replayed")
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return failure(stderr, "replay", err)
+	}
+	defer in.Close()
+
+	w := stdout
+	if *out != "" {
+
+		// The replayed log is never written
+		if fi, err := os.Stat(*out); err == nil {
+			if ifi, err := in.Stat(); err == nil && os.SameFile(fi, ifi) {
+				return usageError(fs, "-out must differ from FILE")
+			}
+		}
+
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return failure(stderr, "replay", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	e := &w3chttpd.Entry{}
+	started := time.Now()
+	var first, ts time.Time
+
+	for sc.Scan() {
+
+		line := sc.Bytes()
+
+		if w3chttpd.ParseLine(line, e) == nil {
+
+			if first.IsZero() {
+				first = e.Timestamp
+			}
+
+			// Out of order lines are not delayed, keeping the last timestamp
+			elapsed := time.Duration(float64(e.Timestamp.Sub(first)) / *speed)
+			if next := started.Add(elapsed); next.After(ts) {
+				ts = next
+			}
+
+			if wait := time.Until(ts); wait > 0 {
+
+				if err := bw.Flush(); err != nil {
+					return failure(stderr, "replay", err)
+				}
+
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return exitOK
+				}
+			}
+
+			if !*keep {
+				line = rewriteTimestamp(line, ts)
+			}
+		}
+
+		if ctx.Err() != nil {
+			return exitOK
+		}
+
+		bw.Write(line)
+		if err := bw.WriteByte('\n'); err != nil {
+			return failure(stderr, "replay", err)
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return failure(stderr, "replay", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return failure(stderr, "replay", err)
+	}
+
+	return exitOK
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewriteTimestamp(t *testing.T) {
+
+	ts := time.Date(2024, 3, 5, 10, 20, 30, 0, time.UTC)
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{
+			`10.0.0.1 - - [01/Jan/1970:00:00:01 +0000] "GET /toto HTTP/1.1" 200 100`,
+			`10.0.0.1 - - [05/Mar/2024:10:20:30 +0000] "GET /toto HTTP/1.1" 200 100`,
+		},
+		{`no timestamp`, `no timestamp`},
+		{`[unterminated`, `[unterminated`},
+	}
+
+	for _, test := range tests {
+
+		got := string(rewriteTimestamp([]byte(test.line), ts))
+		if got != test.want {
+			t.Errorf("Rewritten line differs. Want %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+
+	log := writeTempFile(t, "access.log", analyzeTestLogs+"\n")
+	out := log + ".replayed"
+
+	// 11 seconds of logs
+	code, _, stderr := runCommand(context.Background(), "replay",
+		"-speed", "1000", "-keep-timestamps", "-out", out, log)
+	if code != exitOK {
+		t.Fatalf("Exit code differs. Want %d, got %d (%s)", exitOK, code,
+			stderr)
+	}
+
+	if b, _ := os.ReadFile(out); string(b) != analyzeTestLogs+"\n" {
+		t.Errorf("Replayed lines differ. Want %q, got %q",
+			analyzeTestLogs+"\n", b)
+	}
+
+	code, stdout, stderr := runCommand(context.Background(), "replay",
+		"-speed", "1000", log)
+	if code != exitOK {
+		t.Fatalf("Exit code differs. Want %d, got %d (%s)", exitOK, code,
+			stderr)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 4 || strings.Contains(stdout, "01/Jan/1970") ||
+		lines[2] != "not a log line" {
+		t.Errorf("Replayed lines should be stamped with the replay time, "+
+			"got %q", stdout)
+	}
+}
+
+func TestReplayOutOfOrder(t *testing.T) {
+
+	log := writeTempFile(t, "access.log", analyzeTestLogs+"\n"+
+		`10.0.0.1 - - [01/Jan/1970:00:00:00 +0000] "GET /toto HTTP/1.1" 200 1`+
+		"\n")
+
+	// 1.1 seconds between the first and the last but one line
+	code, stdout, stderr := runCommand(context.Background(), "replay",
+		"-speed", "10", log)
+	if code != exitOK {
+		t.Fatalf("Exit code differs. Want %d, got %d (%s)", exitOK, code,
+			stderr)
+	}
+
+	stamp := func(line string) string {
+		return line[strings.IndexByte(line, '['):strings.IndexByte(line, ']')]
+	}
+
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 5 || stamp(lines[4]) != stamp(lines[3]) {
+		t.Errorf("Line before the first should keep the last timestamp, "+
+			"got %q", stdout)
+	}
+}
+
+func TestReplayUsage(t *testing.T) {
+
+	log := writeTempFile(t, "access.log", analyzeTestLogs+"\n")
+
+	tests := [][]string{
+		{"-speed", "0", log},
+		{},
+		{log, log},
+		// The replayed log is never written
+		{"-out", log, log},
+	}
+
+	for _, args := range tests {
+
+		code, _, stderr := runCommand(context.Background(),
+			append([]string{"replay"}, args...)...)
+		if code != exitUsage {
+			t.Errorf("Exit code of %v differs. Want %d, got %d (%s)",
+				args, exitUsage, code, stderr)
+		}
+	}
+
+	if b, _ := os.ReadFile(log); string(b) != analyzeTestLogs+"\n" {
+		t.Errorf("Replayed file was modified: %q", b)
+	}
+}
+
+func TestReplayInterrupted(t *testing.T) {
+
+	log := writeTempFile(t, "access.log", analyzeTestLogs+"\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	code, stdout, _ := runCommand(ctx, "replay", log)
+	if code != exitOK {
+		t.Errorf("Exit code differs. Want %d, got %d", exitOK, code)
+	}
+
+	if n := strings.Count(stdout, "\n"); n != 1 {
+		t.Errorf("Replayed lines differ. Want %d, got %d", 1, n)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"monitor"
+)
+
+// Monitor settings shared by watch and analyze, defaulting to those of
+// configuration files and exclusive with -config
+type settings struct {
+	config string
+
+	readFrequency     time.Duration
+	metricsFrequency  time.Duration
+	trafficWindow     time.Duration
+	windowGranularity time.Duration
+	allowedLateness   time.Duration
+	threshold         int
+	latePolicy        string
+	filter            string
+	metricsFilter     string
+	outputBuffer      int
+	outputPolicy      string
+	bufferPoolSize    int
+	bufferSize        int
+	entryPoolSize     int
+	json              bool
+}
+
+// Flags covered by configuration files
+var settingsFlags = []string{
+	"read-frequency", "metrics-frequency", "traffic-window",
+	"window-granularity", "allowed-lateness", "threshold", "late-policy",
+	"filter", "metrics-filter", "output-buffer", "output-policy",
+	"buffer-pool-size", "buffer-size", "entry-pool-size", "json",
+}
+
+func defaultConfigFile() *monitor.ConfigFile {
+
+	cf, err := monitor.ReadConfigFile(strings.NewReader("{}"))
+	if err != nil {
+		panic(err)
+	}
+	return cf
+}
+
+func (s *settings) register(fs *flag.FlagSet) {
+
+	d := defaultConfigFile()
+
+	fs.StringVar(&s.config, "config", "",
+		"JSON configuration file (exclusive with the flags it covers)")
+
+	fs.DurationVar(&s.readFrequency, "read-frequency",
+		time.Duration(d.Source.ReadFrequency), "Interval between two reads")
+	fs.DurationVar(&s.metricsFrequency, "metrics-frequency",
+		time.Duration(d.Metrics.Frequency),
+		"Length of metrics periods (multiple of -read-frequency)")
+	fs.DurationVar(&s.trafficWindow, "traffic-window",
+		time.Duration(d.Alerts.TrafficWindow), "Sliding window for alerting")
+	fs.DurationVar(&s.windowGranularity, "window-granularity",
+		time.Duration(d.Alerts.WindowGranularity),
+		"Resolution of the traffic window")
+	fs.DurationVar(&s.allowedLateness, "allowed-lateness",
+		time.Duration(d.Source.AllowedLateness),
+		"Time to wait for out of order entries (delays alerts and metrics)")
+	fs.IntVar(&s.threshold, "threshold", d.Alerts.Threshold,
+		"Bytes in the traffic window triggering an alert")
+	fs.StringVar(&s.latePolicy, "late-policy", d.Source.LatePolicy,
+		"Entries arriving after their period was emitted: drop, count or correct")
+	fs.StringVar(&s.filter, "filter", d.Source.Filter,
+		"Only monitor entries matching the expression (e.g. 'status >= 500')")
+	fs.StringVar(&s.metricsFilter, "metrics-filter", d.Metrics.Filter,
+		"Only count entries matching the expression in metrics")
+	fs.IntVar(&s.outputBuffer, "output-buffer", d.Outputs.Buffer,
+		"Number of metrics and alert batches queued for display")
+	fs.StringVar(&s.outputPolicy, "output-policy", d.Outputs.Policy,
+		"When the display lags: drop-oldest, drop-newest, block or coalesce")
+	fs.IntVar(&s.bufferPoolSize, "buffer-pool-size", d.Source.BufferPoolSize,
+		"Number of buffers in the buffer pool")
+	fs.IntVar(&s.bufferSize, "buffer-size", d.Source.BufferSize,
+		"Size of the buffers (in bytes)")
+	fs.IntVar(&s.entryPoolSize, "entry-pool-size", d.Source.EntryPoolSize,
+		"Number of entries in the entry pools")
+	fs.BoolVar(&s.json, "json", d.Outputs.Display == "json",
+		"Write metrics and alerts as NDJSON events")
+}
+
+func readConfigFile(path string) (*monitor.ConfigFile, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return monitor.ReadConfigFile(f)
+}
+
+// Configuration file of the settings (read from -config or made of the
+// flags) and the validated monitor configuration it builds, without access
+// log
+func (s *settings) configFile(fs *flag.FlagSet) (*monitor.ConfigFile,
+	*monitor.Config, error) {
+
+	if s.config != "" {
+
+		set := []string{}
+		fs.Visit(func(f *flag.Flag) {
+			for _, name := range settingsFlags {
+				if f.Name == name {
+					set = append(set, "-"+name)
+				}
+			}
+		})
+
+		if len(set) != 0 {
+			sort.Strings(set)
+			return nil, nil, fmt.Errorf("%s cannot be combined with -config",
+				strings.Join(set, ", "))
+		}
+
+		cf, err := readConfigFile(s.config)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if cf.Outputs.Display != "text" && cf.Outputs.Display != "json" {
+			return nil, nil, fmt.Errorf("display %q is only available to "+
+				"library users (text or json)", cf.Outputs.Display)
+		}
+
+		conf, err := cf.Config()
+		return cf, conf, err
+	}
+
+	cf := defaultConfigFile()
+
+	cf.Source.ReadFrequency = monitor.Duration(s.readFrequency)
+	cf.Source.AllowedLateness = monitor.Duration(s.allowedLateness)
+	cf.Source.LatePolicy = s.latePolicy
+	cf.Source.Filter = s.filter
+	cf.Source.BufferPoolSize = s.bufferPoolSize
+	cf.Source.BufferSize = s.bufferSize
+	cf.Source.EntryPoolSize = s.entryPoolSize
+
+	cf.Alerts.TrafficWindow = monitor.Duration(s.trafficWindow)
+	cf.Alerts.WindowGranularity = monitor.Duration(s.windowGranularity)
+	cf.Alerts.Threshold = s.threshold
+
+	cf.Metrics.Frequency = monitor.Duration(s.metricsFrequency)
+	cf.Metrics.Filter = s.metricsFilter
+
+	cf.Outputs.Buffer = s.outputBuffer
+	cf.Outputs.Policy = s.outputPolicy
+	if s.json {
+		cf.Outputs.Display = "json"
+	}
+
+	conf, err := cf.Config()
+	return cf, conf, err
+}
+
+// Writes metrics and alerts as text (alerts seen so far being repeated
+// after metrics if history is set) or NDJSON
+type printer struct {
+	w       io.Writer
+	json    bool
+	history bool
+
+	mu     sync.Mutex
+	alerts []*monitor.Alert
+}
+
+func (p *printer) printMetrics(m *monitor.Metrics) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.json {
+		json.NewEncoder(p.w).Encode(m)
+		return
+	}
+
+	fmt.Fprintln(p.w, m)
+	if p.history {
+		for _, a := range p.alerts {
+			fmt.Fprintln(p.w, a)
+		}
+	}
+}
+
+func (p *printer) printAlerts(alerts []*monitor.Alert) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, a := range alerts {
+		if p.json {
+			json.NewEncoder(p.w).Encode(a)
+		} else {
+			fmt.Fprintln(p.w, a)
+		}
+	}
+
+	if p.history {
+		p.alerts = append(p.alerts, alerts...)
+	}
+}
+
+// Flag set reporting errors and usage to stderr
+func newFlagSet(name, args string, stderr io.Writer) *flag.FlagSet {
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: httpmonitor %s [flags] %s\n\n",
+			name, args)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// Returns false with the exit code if the command should not run (-h
+// not being an error)
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+
+	switch err := fs.Parse(args); {
+
+	case err == flag.ErrHelp:
+		return exitOK, false
+
+	case err != nil:
+		return exitUsage, false
+	}
+
+	return exitOK, true
+}
+
+// Usage error of a command
+func usageError(fs *flag.FlagSet, format string, args ...interface{}) int {
+
+	fmt.Fprintf(fs.Output(), "httpmonitor %s: %s\n", fs.Name(),
+		fmt.Sprintf(format, args...))
+	return exitUsage
+}
+
+// Runtime failure of a command
+func failure(stderr io.Writer, name string, err error) int {
+
+	fmt.Fprintf(stderr, "httpmonitor %s: %v\n", name, err)
+	return exitFailure
+}
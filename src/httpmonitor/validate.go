@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Checks every configuration FILE, failing if one is invalid
+func validate(ctx context.Context, args []string, stdout,
+	stderr io.Writer) int {
+
+	fs := newFlagSet("validate", "FILE...", stderr)
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if fs.NArg() == 0 {
+		return usageError(fs, "FILE is required")
+	}
+
+	code := exitOK
+
+	for _, path := range fs.Args() {
+
+		cf, err := readConfigFile(path)
+		if err == nil {
+			err = cf.Validate()
+		}
+
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", path, err)
+			code = exitFailure
+			continue
+		}
+
+		fmt.Fprintf(stdout, "%s: ok\n", path)
+	}
+
+	return code
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+
+	valid := writeTempFile(t, "valid.json",
+		`{"alerts": {"traffic_window": "1m", "threshold": 100}}`)
+	unknown := writeTempFile(t, "unknown.json", `{"alert": {}}`)
+	invalid := writeTempFile(t, "invalid.json",
+		`{"source": {"read_frequency": "0s"}}`)
+	// Rules scoped by country need a GeoIP country database
+	country := writeTempFile(t, "country.json",
+		`{"alerts": {"rules": [{"name": "countries", "scope": "country",
+			"traffic_window": "1m", "threshold": 100}]}}`)
+
+	code, stdout, _ := runCommand(context.Background(), "validate", valid)
+	if code != exitOK || stdout != valid+": ok\n" {
+		t.Errorf("Validation differs. Want %d and %q, got %d and %q",
+			exitOK, valid+": ok\n", code, stdout)
+	}
+
+	for _, path := range []string{unknown, invalid, country,
+		valid + ".missing"} {
+
+		code, _, stderr := runCommand(context.Background(), "validate", valid,
+			path)
+		if code != exitFailure || !strings.HasPrefix(stderr, path) {
+			t.Errorf("Validation of %s differs. Want %d, got %d (%s)",
+				path, exitFailure, code, stderr)
+		}
+	}
+
+	code, _, _ = runCommand(context.Background(), "validate")
+	if code != exitUsage {
+		t.Errorf("Exit code differs. Want %d, got %d", exitUsage, code)
+	}
+}
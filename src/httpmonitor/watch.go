@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"monitor"
+)
+
+// Reader of a log file following it across rotations (the path being
+// reopened from its start once it names another file) and truncations
+// (the file being read from its start again), the end of the current file
+// being io.EOF
+// A truncation is seen when the file gets smaller than last observed,
+// unless refilled past that size between two reads
+type follower struct {
+	path string
+	f    *os.File
+
+	// Internal parameters
+	size int64 // Last observed size of f
+}
+
+// The current file is read until its end before switching to a rotated
+// one, so that its last lines are not lost
+func (fl *follower) Read(p []byte) (int, error) {
+
+	fi, err := fl.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if fi.Size() < fl.size {
+		if _, err := fl.f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+	fl.size = fi.Size()
+
+	n, err := fl.f.Read(p)
+	if n != 0 || err != io.EOF {
+		return n, err
+	}
+
+	// Being rotated when missing
+	fi, err = os.Stat(fl.path)
+	if err != nil {
+		return 0, io.EOF
+	}
+
+	current, err := fl.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+
+	case !os.SameFile(fi, current):
+		f, err := os.Open(fl.path)
+		if err != nil {
+			return 0, io.EOF
+		}
+		fl.f.Close()
+		fl.f = f
+		fl.size = 0
+
+	default:
+		offset, err := fl.f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+
+		if fi.Size() >= offset {
+			return 0, io.EOF
+		}
+
+		if _, err := fl.f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+
+	return fl.f.Read(p)
+}
+
+func (fl *follower) Close() error {
+	return fl.f.Close()
+}
+
+// Tails FILE (from its end unless -from-start) until interrupted, across
+// rotations and truncations, the configuration file being reloaded on
+// SIGHUP or change
+func watch(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+
+	fs := newFlagSet("watch", "[FILE]", stderr)
+
+	s := &settings{}
+	s.register(fs)
+
+	fromStart := fs.Bool("from-start", false,
+		"Process the lines already in the file")
+	httpAddr := fs.String("http", "",
+		"Address serving Prometheus /metrics (e.g. :8080)")
+
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	cf, conf, err := s.configFile(fs)
+	if err != nil {
+		return usageError(fs, "%v", err)
+	}
+
+	path := cf.Source.Path
+	switch {
+	case fs.NArg() == 1:
+		path = fs.Arg(0)
+	case fs.NArg() > 1:
+		return usageError(fs, "a single FILE is watched")
+	case s.config == "":
+		return usageError(fs, "FILE is required")
+	}
+
+	if *httpAddr == "" {
+		*httpAddr = cf.Outputs.HTTPAddr
+	}
+
+	// Read only, the file being written by the HTTP server
+	f, err := os.Open(path)
+	if err != nil {
+		return failure(stderr, "watch", err)
+	}
+	fl := &follower{path: path, f: f}
+	defer fl.Close()
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return failure(stderr, "watch", fmt.Errorf("%s is not a regular file",
+			path))
+	}
+	fl.size = fi.Size()
+
+	if !*fromStart {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return failure(stderr, "watch", err)
+		}
+	}
+
+	var rd io.Reader = fl
+	conf.AccessLog = &rd
+
+	var server *http.Server
+	if *httpAddr != "" {
+		// Unless configured by the outputs prometheus section
+		if conf.Exporter == nil {
+			conf.Exporter = &monitor.PrometheusExporter{}
+		}
+
+		// Listening first so that an unavailable address fails the command
+		ln, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			return failure(stderr, "watch", err)
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", conf.Exporter)
+		server = &http.Server{Handler: mux}
+		defer server.Close()
+
+		go func() {
+			if err := server.Serve(ln); err != http.ErrServerClosed {
+				fmt.Fprintf(stderr, "httpmonitor watch: %v\n", err)
+			}
+		}()
+	}
+
+	m := &monitor.Monitor{Config: conf}
+	if err := m.Start(); err != nil {
+		return failure(stderr, "watch", err)
+	}
+
+	// Stopping the configuration watch as well
+	defer m.Stop()
+
+	p := &printer{w: stdout, json: cf.Outputs.Display == "json", history: true}
+	err = m.SubscribeMetrics(&monitor.MetricsSubscriber{
+		Handler: p.printMetrics,
+		Buffer:  conf.OutputBuffer,
+		Policy:  conf.OutputPolicy,
+	})
+	if err != nil {
+		return failure(stderr, "watch", err)
+	}
+
+	err = m.SubscribeAlerts(&monitor.AlertsSubscriber{
+		Handler: p.printAlerts,
+		Buffer:  conf.OutputBuffer,
+		Policy:  conf.OutputPolicy,
+	})
+	if err != nil {
+		return failure(stderr, "watch", err)
+	}
+
+	if s.config != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+
+		go m.WatchConfigFile(s.config, time.Second, hup)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Run()
+	}()
+
+	select {
+	case <-ctx.Done():
+		m.Stop()
+		err = <-done
+	case err = <-done:
+	}
+
+	if err != nil {
+		return failure(stderr, "watch", err)
+	}
+
+	return exitOK
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+
+	// Lines already in the file are skipped
+	log := writeTempFile(t, "access.log", analyzeTestLogs+"\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int)
+
+	var stdout, stderr string
+	go func() {
+		var code int
+		code, stdout, stderr = runCommand(ctx, "watch", "-json",
+			"-read-frequency", "100ms", "-metrics-frequency", "1s",
+			"-entry-pool-size", "10", log)
+		done <- code
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	line := `10.0.0.1 - - [` + time.Now().Format(timestampLayout) +
+		`] "GET /toto HTTP/1.1" 200 100` + "\n"
+
+	f, err := os.OpenFile(log, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(line)
+	f.Close()
+
+	// Log timestamps having a resolution of one second, the period of the
+	// line ends within a second
+	time.Sleep(1500 * time.Millisecond)
+	cancel()
+
+	select {
+	case code := <-done:
+		if code != exitOK {
+			t.Fatalf("Exit code differs. Want %d, got %d (%s)", exitOK, code,
+				stderr)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Watch was not interrupted")
+	}
+
+	if !strings.Contains(stdout, `"requests":1`) ||
+		strings.Contains(stdout, `"requests":2`) {
+		t.Errorf("Metrics should count the appended line only, got %q",
+			stdout)
+	}
+
+	// The watched log is only read
+	if b, _ := os.ReadFile(log); string(b) != analyzeTestLogs+"\n"+line {
+		t.Errorf("Watched file was modified: %q", b)
+	}
+}
+
+func TestWatchUsage(t *testing.T) {
+
+	code, _, _ := runCommand(context.Background(), "watch")
+	if code != exitUsage {
+		t.Errorf("Exit code differs. Want %d, got %d", exitUsage, code)
+	}
+
+	log := writeTempFile(t, "access.log", "")
+
+	// Busy address
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// Missing GeoIP database
+	config := writeTempFile(t, "httpmonitor.json", `{
+		"source": {"entry_pool_size": 10},
+		"geoip": {"country_db": "`+log+`.missing"}
+	}`)
+
+	tests := [][]string{
+		{"-entry-pool-size", "10", t.TempDir()},
+		{"-entry-pool-size", "10", "-http", ln.Addr().String(), log},
+		{"-config", config, log},
+	}
+
+	for _, args := range tests {
+
+		code, _, stderr := runCommand(context.Background(),
+			append([]string{"watch"}, args...)...)
+		if code != exitFailure {
+			t.Errorf("Exit code of %v differs. Want %d, got %d (%s)",
+				args, exitFailure, code, stderr)
+		}
+	}
+}
+
+func TestFollower(t *testing.T) {
+
+	path := writeTempFile(t, "access.log", "a\n")
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl := &follower{path: path, f: f}
+	defer fl.Close()
+
+	appendFile := func(path, data string) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(data)
+		f.Close()
+	}
+
+	read := func(want string) {
+		b, err := io.ReadAll(fl)
+		if err != nil || string(b) != want {
+			t.Errorf("Read differs. Want %q, got %q (%v)", want, b, err)
+		}
+	}
+
+	read("a\n")
+	read("")
+
+	// Rotated, lines written to the old file before the switch being read
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	read("")
+	appendFile(path+".1", "b\n")
+	appendFile(path, "c\n")
+	read("b\nc\n")
+
+	// Truncated
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	read("")
+	appendFile(path, "d\n")
+	read("d\n")
+
+	// Truncated and refilled past the offset between two reads
+	appendFile(path, "efgh\n")
+	if n, err := fl.Read(make([]byte, 2)); n != 2 || err != nil {
+		t.Fatalf("Read differs. Want %d, got %d (%v)", 2, n, err)
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(path, "ijklm\n")
+	read("ijklm\n")
+}
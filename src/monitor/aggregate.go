@@ -0,0 +1,392 @@
+package monitor
+
+import (
+	"sort"
+	"time"
+	"w3chttpd"
+)
+
+type visitorSet map[string]struct{}
+
+func (vs visitorSet) merge(other visitorSet) {
+
+	for v := range other {
+		vs[v] = struct{}{}
+	}
+}
+
+type classAggregate struct {
+	requestCount int
+	totalTraffic int
+	visitors     visitorSet
+}
+
+func (ca *classAggregate) merge(other *classAggregate) {
+
+	ca.requestCount += other.requestCount
+	ca.totalTraffic += other.totalTraffic
+	ca.visitors.merge(other.visitors)
+}
+
+// Partial Metrics folded from entries as they are read, merged at the
+// period boundary so entries never need to be kept (memory depends on the
+// number of sections, visitors and origins, not on the number of requests)
+type metricsAggregate struct {
+	bots    *BotClassifier
+	clients *Clients
+	geo     *GeoIP
+
+	requestCount int
+	errorCount   int
+	totalTraffic int
+	hits         map[string]int
+	visitors     visitorSet
+	classes      []*classAggregate
+	networks     map[string]*classAggregate
+	countries    map[string]int
+	asns         map[uint64]int
+	orgs         map[uint64]string
+}
+
+func newMetricsAggregate(bots *BotClassifier, clients *Clients,
+	geo *GeoIP) *metricsAggregate {
+
+	ma := &metricsAggregate{
+		bots:      bots,
+		clients:   clients,
+		geo:       geo,
+		hits:      make(map[string]int),
+		visitors:  make(visitorSet),
+		classes:   make([]*classAggregate, trafficClasses),
+		networks:  make(map[string]*classAggregate),
+		countries: make(map[string]int),
+		asns:      make(map[uint64]int),
+		orgs:      make(map[uint64]string),
+	}
+
+	for c := range ma.classes {
+		ma.classes[c] = &classAggregate{visitors: make(visitorSet)}
+	}
+
+	if clients != nil {
+		for _, nl := range clients.Networks {
+			if !nl.Exclude {
+				ma.networks[nl.Name] = &classAggregate{visitors: make(visitorSet)}
+			}
+		}
+	}
+
+	return ma
+}
+
+// Entries from excluded network lists are ignored
+func (ma *metricsAggregate) add(e *w3chttpd.Entry) {
+
+	nl := ma.clients.network(e)
+	if nl != nil && nl.Exclude {
+		return
+	}
+
+	ma.totalTraffic += e.Size
+	ma.requestCount++
+	if e.StatusCode >= 400 {
+		ma.errorCount++
+	}
+
+	client := ma.clients.key(e)
+	ma.visitors[client] = struct{}{}
+
+	ca := ma.classes[ma.bots.Classify(e)]
+	ca.requestCount++
+	ca.totalTraffic += e.Size
+	ca.visitors[client] = struct{}{}
+
+	if nl != nil {
+		na := ma.networks[nl.Name]
+		na.requestCount++
+		na.totalTraffic += e.Size
+		na.visitors[client] = struct{}{}
+	}
+
+	if ma.geo != nil {
+
+		info := ma.geo.entry(e, ma.clients)
+
+		if info.country != "" {
+			ma.countries[info.country]++
+		}
+
+		if info.asn != 0 {
+			ma.asns[info.asn]++
+			ma.orgs[info.asn] = info.org
+		}
+	}
+
+	if section := getSection(e.Req.Resource); section != nil {
+		ma.hits[string(section)]++
+	}
+}
+
+func (ma *metricsAggregate) merge(other *metricsAggregate) {
+
+	ma.requestCount += other.requestCount
+	ma.errorCount += other.errorCount
+	ma.totalTraffic += other.totalTraffic
+	ma.visitors.merge(other.visitors)
+
+	for section, hitCount := range other.hits {
+		ma.hits[section] += hitCount
+	}
+
+	for c, ca := range other.classes {
+		ma.classes[c].merge(ca)
+	}
+
+	for name, na := range other.networks {
+		if _, ok := ma.networks[name]; !ok {
+			ma.networks[name] = &classAggregate{visitors: make(visitorSet)}
+		}
+		ma.networks[name].merge(na)
+	}
+
+	for country, hitCount := range other.countries {
+		ma.countries[country] += hitCount
+	}
+
+	for asn, hitCount := range other.asns {
+		ma.asns[asn] += hitCount
+		ma.orgs[asn] = other.orgs[asn]
+	}
+}
+
+func (ma *metricsAggregate) metrics(periodStart, periodEnd time.Time) *Metrics {
+
+	m := &Metrics{
+		RequestCount:   ma.requestCount,
+		ErrorCount:     ma.errorCount,
+		TotalTraffic:   ma.totalTraffic,
+		PeriodStart:    periodStart,
+		PeriodEnd:      periodEnd,
+		UniqueVisitors: len(ma.visitors),
+		Classes:        make([]ClassMetrics, trafficClasses),
+	}
+
+	m.AvgPageViews = float32(m.RequestCount) / float32(m.UniqueVisitors)
+
+	for c, ca := range ma.classes {
+		m.Classes[c] = ClassMetrics{
+			TrafficClass(c), ca.requestCount, len(ca.visitors), ca.totalTraffic,
+		}
+	}
+
+	// In the order of Clients.Networks
+	if ma.clients != nil {
+		for _, nl := range ma.clients.Networks {
+			if na, ok := ma.networks[nl.Name]; ok {
+				m.Networks = append(m.Networks, NetworkMetrics{
+					nl.Name, na.requestCount, len(na.visitors), na.totalTraffic,
+				})
+			}
+		}
+	}
+
+	if ma.geo != nil {
+		m.Countries, m.ASNs = ma.geo.rank(ma.countries, ma.asns, ma.orgs)
+	}
+
+	r := make(ranking, 0, len(ma.hits))
+	for section, hitCount := range ma.hits {
+		r = append(r, Rank{hitCount, section})
+	}
+
+	sort.Sort(r)
+	m.Rank = r
+
+	return m
+}
+
+// Start of the metrics period containing t, periods being aligned on the
+// Unix epoch like the reads
+func periodStart(t int64, frequency time.Duration) int64 {
+
+	start := t - t%int64(frequency)
+	if start > t {
+		start -= int64(frequency)
+	}
+	return start
+}
+
+// Partial aggregates of the periods not reported yet, one per read
+// Entries of reported periods are handled according to late, corrections
+// only being made for the periods reported since first
+type metricsPeriods struct {
+	frequency   time.Duration
+	filter      *Filter
+	bots        *BotClassifier
+	clients     *Clients
+	geo         *GeoIP
+	late        LatePolicy
+	topK        *TopK
+	health      *healthCounters
+	partials    map[int64][]*metricsAggregate
+	first       int64
+	reported    bool
+	corrections map[int64]*metricsAggregate
+}
+
+func newMetricsPeriods(conf *Config) *metricsPeriods {
+
+	return &metricsPeriods{
+		frequency: conf.MetricsFrequency,
+		filter:    conf.MetricsFilter,
+		bots:      conf.Bots,
+		clients:   conf.Clients,
+		geo:       conf.GeoIP,
+		late:      conf.LatePolicy,
+		topK:      conf.TopK,
+		health:    &conf.health,
+		partials:  make(map[int64][]*metricsAggregate),
+	}
+}
+
+// Folds the entries released at now into a partial of their period
+// (entries matching filter only), entries of periods beyond the next one
+// being ignored
+// Heavy hitters (with TopK) are folded in the same periods
+func (mp *metricsPeriods) fold(now int64, entries []*w3chttpd.Entry) {
+
+	open := periodStart(now-1, mp.frequency)
+	last := open + int64(mp.frequency)
+
+	var partials map[int64]*metricsAggregate
+	var periods map[int64][]*w3chttpd.Entry
+
+	for _, e := range entries {
+
+		if !mp.filter.Match(e) {
+			continue
+		}
+
+		start := periodStart(e.Timestamp.UnixNano(), mp.frequency)
+		if start > last {
+			continue
+		}
+
+		if start < open {
+			if !mp.foldLate(start, open, e) {
+				continue
+			}
+			start = open
+		}
+
+		if partials == nil {
+			partials = make(map[int64]*metricsAggregate)
+		}
+
+		ma, ok := partials[start]
+		if !ok {
+			ma = newMetricsAggregate(mp.bots, mp.clients, mp.geo)
+			partials[start] = ma
+			mp.partials[start] = append(mp.partials[start], ma)
+		}
+
+		ma.add(e)
+
+		if mp.topK != nil {
+			if periods == nil {
+				periods = make(map[int64][]*w3chttpd.Entry)
+			}
+			periods[start] = append(periods[start], e)
+		}
+	}
+
+	for start, entries := range periods {
+		mp.topK.observe(start, entries)
+	}
+}
+
+// Returns true if the entry of a reported period is to be counted in
+// the open one
+func (mp *metricsPeriods) foldLate(start, open int64,
+	e *w3chttpd.Entry) bool {
+
+	switch {
+
+	case mp.late == LateCount:
+		return true
+
+	case mp.late == LateCorrect && mp.reported && start >= mp.first:
+		if mp.corrections == nil {
+			mp.corrections = make(map[int64]*metricsAggregate)
+		}
+
+		ma, ok := mp.corrections[start]
+		if !ok {
+			ma = newMetricsAggregate(mp.bots, mp.clients, mp.geo)
+			mp.corrections[start] = ma
+		}
+		ma.add(e)
+
+	default:
+		if mp.health != nil {
+			mp.health.lateEntriesDropped.Add(1)
+		}
+	}
+
+	return false
+}
+
+// Partials of the period ending at now, dropped with the older ones
+func (mp *metricsPeriods) take(now int64) []*metricsAggregate {
+
+	start := now - int64(mp.frequency)
+	partials := mp.partials[start]
+
+	if !mp.reported {
+		mp.first = start
+		mp.reported = true
+	}
+
+	for s := range mp.partials {
+		if s <= start {
+			delete(mp.partials, s)
+		}
+	}
+
+	return partials
+}
+
+// Correction Metrics of the late entries folded since the previous call,
+// in chronological order
+func (mp *metricsPeriods) takeCorrections() []*Metrics {
+
+	starts := make([]int64, 0, len(mp.corrections))
+	for start := range mp.corrections {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	corrections := make([]*Metrics, 0, len(starts))
+	for _, start := range starts {
+
+		m := mp.corrections[start].metrics(time.Unix(0, start),
+			time.Unix(0, start+int64(mp.frequency)).Add(-time.Second))
+		m.Correction = true
+		corrections = append(corrections, m)
+	}
+
+	mp.corrections = nil
+
+	return corrections
+}
+
+// Metrics of the period from its partials
+func (mp *metricsPeriods) metrics(partials []*metricsAggregate,
+	start, end time.Time) *Metrics {
+
+	ma := newMetricsAggregate(mp.bots, mp.clients, mp.geo)
+	for _, p := range partials {
+		ma.merge(p)
+	}
+	return ma.metrics(start, end)
+}
@@ -0,0 +1,240 @@
+package monitor
+
+import (
+	"bufio"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"w3chttpd"
+)
+
+func TestPeriodStart(t *testing.T) {
+
+	frequency := 10 * time.Second
+
+	tests := []struct {
+		t     int64
+		start int64
+	}{
+		{0, 0},
+		{int64(5 * time.Second), 0},
+		{int64(10 * time.Second), int64(10 * time.Second)},
+		{int64(10*time.Second) - 1, 0},
+		{int64(-5 * time.Second), int64(-10 * time.Second)},
+		{int64(-10 * time.Second), int64(-10 * time.Second)},
+	}
+
+	for _, test := range tests {
+		if start := periodStart(test.t, frequency); start != test.start {
+			t.Errorf("Period start of %d differs. Want %d, got %d",
+				test.t, test.start, start)
+		}
+	}
+}
+
+func TestMetricsAggregateMerge(t *testing.T) {
+
+	clients := &Clients{
+		Networks: []*NetworkList{
+			&NetworkList{
+				Name:     "office",
+				Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			},
+			&NetworkList{
+				Name:     "monitoring",
+				Prefixes: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+				Exclude:  true,
+			},
+		},
+	}
+
+	entries := []*w3chttpd.Entry{
+		&w3chttpd.Entry{
+			Ip:         []byte("10.0.0.1"),
+			Req:        w3chttpd.Request{Resource: []byte("/toto/a")},
+			StatusCode: 200,
+			Size:       100,
+			UserAgent:  []byte("Mozilla/5.0"),
+		},
+		&w3chttpd.Entry{
+			Ip:         []byte("10.0.0.2"),
+			Req:        w3chttpd.Request{Resource: []byte("/toto/b")},
+			StatusCode: 404,
+			Size:       10,
+			UserAgent:  []byte("Googlebot/2.1"),
+		},
+		&w3chttpd.Entry{
+			Ip:         []byte("192.168.0.1"),
+			Req:        w3chttpd.Request{Resource: []byte("/health")},
+			StatusCode: 200,
+			Size:       5,
+		},
+		&w3chttpd.Entry{
+			Ip:         []byte("1.2.3.4"),
+			Req:        w3chttpd.Request{Resource: []byte("/test")},
+			StatusCode: 500,
+			Size:       20,
+			UserAgent:  []byte("Mozilla/5.0"),
+		},
+		&w3chttpd.Entry{
+			Ip:         []byte("10.0.0.1"),
+			Req:        w3chttpd.Request{Resource: []byte("/toto")},
+			StatusCode: 200,
+			Size:       100,
+			UserAgent:  []byte("Mozilla/5.0"),
+		},
+	}
+
+	start, end := time.Unix(0, 0), time.Unix(9, 0)
+	want := aggregateMetrics(entries, nil, clients, nil, start, end)
+
+	// Visitors seen by several partials are counted once
+	partials := []*metricsAggregate{}
+	for _, split := range [][]*w3chttpd.Entry{entries[:2], entries[2:4],
+		entries[4:]} {
+
+		ma := newMetricsAggregate(nil, clients, nil)
+		for _, e := range split {
+			ma.add(e)
+		}
+		partials = append(partials, ma)
+	}
+
+	mp := &metricsPeriods{clients: clients}
+	got := mp.metrics(partials, start, end)
+
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Merged metrics differ. Want %+v, got %+v", want, got)
+	}
+
+	if got.RequestCount != 4 {
+		t.Errorf("Request count differs. Want %d, got %d",
+			4, got.RequestCount)
+	}
+
+	if got.UniqueVisitors != 3 {
+		t.Errorf("Unique visitors differ. Want %d, got %d",
+			3, got.UniqueVisitors)
+	}
+
+	if len(got.Networks) != 1 || got.Networks[0].UniqueVisitors != 2 {
+		t.Errorf("Networks differ. Want 1 network with %d visitors, got %+v",
+			2, got.Networks)
+	}
+}
+
+func TestMetricsPeriodsFold(t *testing.T) {
+
+	mp := &metricsPeriods{
+		frequency: 10 * time.Second,
+		partials:  make(map[int64][]*metricsAggregate),
+	}
+
+	entry := func(sec int64) *w3chttpd.Entry {
+		return &w3chttpd.Entry{
+			Timestamp: time.Unix(sec, 0),
+			Req:       w3chttpd.Request{Resource: []byte("/toto")},
+		}
+	}
+
+	// Read at 15s: the period [10s - 20s[ is open, [0s - 10s[ reported
+	now := int64(15 * time.Second)
+	mp.fold(now, []*w3chttpd.Entry{entry(5), entry(12), entry(14), entry(21),
+		entry(35)})
+	mp.fold(int64(20*time.Second), []*w3chttpd.Entry{entry(19), entry(22)})
+
+	if len(mp.partials) != 2 {
+		t.Errorf("Length of periods differs. Want %d, got %d",
+			2, len(mp.partials))
+	}
+
+	partials := mp.take(int64(20 * time.Second))
+	if len(partials) != 2 {
+		t.Fatalf("Length of partials differs. Want %d, got %d",
+			2, len(partials))
+	}
+
+	m := mp.metrics(partials, time.Unix(10, 0), time.Unix(19, 0))
+	if m.RequestCount != 3 {
+		t.Errorf("Request count differs. Want %d, got %d", 3, m.RequestCount)
+	}
+
+	// Entries of a reported period are ignored
+	mp.fold(int64(25*time.Second), []*w3chttpd.Entry{entry(18), entry(26)})
+
+	partials = mp.take(int64(30 * time.Second))
+	m = mp.metrics(partials, time.Unix(20, 0), time.Unix(29, 0))
+	if m.RequestCount != 3 {
+		t.Errorf("Request count differs. Want %d, got %d", 3, m.RequestCount)
+	}
+
+	if len(mp.partials) != 0 {
+		t.Errorf("Length of periods differs. Want %d, got %d",
+			0, len(mp.partials))
+	}
+}
+
+func TestProcessLogMetricsBeyondTrafficWindow(t *testing.T) {
+
+	metricsChan := make(chan *Metrics, 1)
+	alertsChan := make(chan []*Alert, 10)
+
+	conf := &Config{
+		MetricsFrequency: 2 * time.Minute,
+		TrafficWindow:    10 * time.Second,
+		Threshold:        500,
+		BufferPoolSize:   10,
+		BufferSize:       1000,
+		EntryPoolSize:    10,
+		AlertsChan:       alertsChan,
+		MetricsChan:      metricsChan,
+	}
+
+	conf.bpool = &bufferPool{}
+	conf.bpool.init(conf.BufferPoolSize, conf.BufferSize)
+	conf.w.init(conf.TrafficWindow, conf.Threshold, conf.EntryPoolSize)
+
+	read := func(now int64, logs string) {
+		conf.brd = bufio.NewReaderSize(strings.NewReader(logs), conf.BufferSize)
+		processLog(now, nil, conf)
+	}
+
+	read(int64(10*time.Second),
+		`10.0.0.1 - - [01/Jan/1970:00:00:01 +0000] "GET /toto HTTP/1.1" 200 100
+10.0.0.2 - - [01/Jan/1970:00:00:05 +0000] "GET /toto/a HTTP/1.1" 200 100
+`)
+	read(int64(40*time.Second),
+		`10.0.0.1 - - [01/Jan/1970:00:00:30 +0000] "GET /test HTTP/1.1" 404 100
+`)
+	read(int64(60*time.Second),
+		`10.0.0.3 - - [01/Jan/1970:00:00:55 +0000] "GET /test HTTP/1.1" 200 100
+`)
+	read(int64(90*time.Second),
+		`10.0.0.3 - - [01/Jan/1970:00:01:25 +0000] "GET /test HTTP/1.1" 200 100
+`)
+	read(int64(100*time.Second), "")
+
+	// Processed entries are not kept
+	if len(conf.w.queue.entries) != 0 {
+		t.Errorf("Length of queue differs. Want %d, got %d",
+			0, len(conf.w.queue.entries))
+	}
+
+	read(int64(120*time.Second), "")
+	m := <-metricsChan
+
+	if m.RequestCount != 5 {
+		t.Errorf("Request count differs. Want %d, got %d", 5, m.RequestCount)
+	}
+
+	if m.UniqueVisitors != 3 {
+		t.Errorf("Unique visitors differ. Want %d, got %d",
+			3, m.UniqueVisitors)
+	}
+
+	if m.ErrorCount != 1 {
+		t.Errorf("Error count differs. Want %d, got %d", 1, m.ErrorCount)
+	}
+}
@@ -0,0 +1,417 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alerts passed to a notifier all belong to the same group
+type Notifier interface {
+	Notify(group string, alerts []*Alert) error
+}
+
+type NotifierFunc func(group string, alerts []*Alert) error
+
+func (f NotifierFunc) Notify(group string, alerts []*Alert) error {
+	return f(group, alerts)
+}
+
+// Empty Rule or Severity matches any value
+// Routes are evaluated in order, the first matching one wins unless
+// Continue is set
+type Route struct {
+	Rule     string
+	Severity string
+	Notifier Notifier
+	Continue bool
+}
+
+func (r *Route) matches(a *Alert) bool {
+
+	return (r.Rule == "" || r.Rule == a.Rule) &&
+		(r.Severity == "" || r.Severity == a.Severity)
+}
+
+// Label is one of "rule", "key", "severity" or "status"
+type Matcher struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+	Regex bool   `json:"regex"`
+
+	re *regexp.Regexp
+}
+
+func (m *Matcher) compile() error {
+
+	switch m.Label {
+	case "rule", "key", "severity", "status":
+	default:
+		return fmt.Errorf("unknown label %q", m.Label)
+	}
+
+	if !m.Regex {
+		return nil
+	}
+
+	re, err := regexp.Compile("^(?:" + m.Value + ")$")
+	if err != nil {
+		return fmt.Errorf("regexp.Compile: %v", err)
+	}
+	m.re = re
+
+	return nil
+}
+
+func (m *Matcher) matches(a *Alert) bool {
+
+	value := alertLabel(a, m.Label)
+
+	if m.re != nil {
+		return m.re.MatchString(value)
+	}
+	return value == m.Value
+}
+
+// A silence mutes every alert matching all of its matchers
+// between StartsAt and EndsAt
+type Silence struct {
+	ID       string    `json:"id"`
+	Matchers []Matcher `json:"matchers"`
+	StartsAt time.Time `json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+	Comment  string    `json:"comment"`
+
+	// Creation order
+	seq int
+}
+
+func (s *Silence) active(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+func (s *Silence) matches(a *Alert) bool {
+
+	for i := range s.Matchers {
+		if !s.Matchers[i].matches(a) {
+			return false
+		}
+	}
+	return true
+}
+
+func alertLabel(a *Alert, label string) string {
+
+	switch label {
+
+	case "rule":
+		return a.Rule
+
+	case "key":
+		return a.Key
+
+	case "severity":
+		return a.Severity
+
+	case "status":
+		if a.Status == StatusExceed {
+			return "exceed"
+		}
+		return "recovered"
+
+	default:
+		return ""
+	}
+}
+
+// Stage between the monitor alerts and their consumers:
+// alerts are deduplicated, silenced, grouped by the GroupBy labels
+// (defaults to "rule") and routed to notifiers
+type AlertManager struct {
+	GroupBy []string
+	Routes  []*Route
+
+	// Internal parameters
+	mu       sync.Mutex
+	silences map[string]*Silence
+	notified map[string]AlertStatus
+	nextID   int
+	added    int
+}
+
+func (am *AlertManager) init() {
+
+	if am.silences == nil {
+		am.silences = make(map[string]*Silence)
+		am.notified = make(map[string]AlertStatus)
+	}
+}
+
+// Returns the silence ID (generated if empty), IDs already used being
+// rejected
+func (am *AlertManager) AddSilence(s Silence) (string, error) {
+
+	if len(s.Matchers) == 0 {
+		return "", fmt.Errorf("silence without matchers")
+	}
+
+	if !s.EndsAt.After(s.StartsAt) {
+		return "", fmt.Errorf("silence ends before it starts")
+	}
+
+	s.Matchers = append([]Matcher{}, s.Matchers...)
+	for i := range s.Matchers {
+		if err := s.Matchers[i].compile(); err != nil {
+			return "", fmt.Errorf("Matcher.compile: %v", err)
+		}
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	am.init()
+
+	if _, ok := am.silences[s.ID]; ok {
+		return "", fmt.Errorf("silence %q already exists", s.ID)
+	}
+
+	// Skipping the IDs given by callers
+	for s.ID == "" {
+		am.nextID++
+		s.ID = fmt.Sprintf("%d", am.nextID)
+		if _, ok := am.silences[s.ID]; ok {
+			s.ID = ""
+		}
+	}
+
+	am.added++
+	s.seq = am.added
+	am.silences[s.ID] = &s
+
+	return s.ID, nil
+}
+
+func (am *AlertManager) RemoveSilence(id string) bool {
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, ok := am.silences[id]; !ok {
+		return false
+	}
+
+	delete(am.silences, id)
+	return true
+}
+
+// Silences in creation order
+func (am *AlertManager) Silences() []Silence {
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	res := make([]Silence, 0, len(am.silences))
+	for _, s := range am.silences {
+		res = append(res, *s)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].seq < res[j].seq })
+	return res
+}
+
+func (am *AlertManager) groupKey(a *Alert) string {
+
+	groupBy := am.GroupBy
+	if len(groupBy) == 0 {
+		groupBy = []string{"rule"}
+	}
+
+	labels := make([]string, len(groupBy))
+	for i, label := range groupBy {
+		labels[i] = label + "=" + alertLabel(a, label)
+	}
+
+	return strings.Join(labels, ",")
+}
+
+// Returns the alerts which are neither repeats nor silenced,
+// grouped by group key, silenced alerts not being recorded as notified
+// so that their recovery is not notified either
+func (am *AlertManager) process(alerts []*Alert,
+	now time.Time) (map[string][]*Alert, []string) {
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	am.init()
+
+	for id, s := range am.silences {
+		if !now.Before(s.EndsAt) {
+			delete(am.silences, id)
+		}
+	}
+
+	groups := make(map[string][]*Alert)
+	order := []string{}
+
+	for _, a := range alerts {
+
+		fingerprint := a.Rule + "\x00" + a.Key
+		status, ok := am.notified[fingerprint]
+
+		if (ok && status == a.Status) || (!ok && a.Status == StatusRecovered) {
+			continue
+		}
+
+		if am.silenced(a, now) {
+			continue
+		}
+
+		if a.Status == StatusRecovered {
+			delete(am.notified, fingerprint)
+		} else {
+			am.notified[fingerprint] = a.Status
+		}
+
+		group := am.groupKey(a)
+		if _, ok := groups[group]; !ok {
+			order = append(order, group)
+		}
+		groups[group] = append(groups[group], a)
+	}
+
+	return groups, order
+}
+
+func (am *AlertManager) silenced(a *Alert, now time.Time) bool {
+
+	for _, s := range am.silences {
+		if s.active(now) && s.matches(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func (am *AlertManager) route(group string, alerts []*Alert) {
+
+	byNotifier := make(map[*Route][]*Alert)
+
+	for _, a := range alerts {
+		for _, r := range am.Routes {
+
+			if !r.matches(a) {
+				continue
+			}
+
+			byNotifier[r] = append(byNotifier[r], a)
+			if !r.Continue {
+				break
+			}
+		}
+	}
+
+	for _, r := range am.Routes {
+
+		routed, ok := byNotifier[r]
+		if !ok || r.Notifier == nil {
+			continue
+		}
+
+		if err := r.Notifier.Notify(group, routed); err != nil {
+			log.Printf("Notify: %v", err)
+		}
+	}
+}
+
+// Routes the alerts remaining after deduplication and silencing,
+// returning them
+func (am *AlertManager) handle(alerts []*Alert) []*Alert {
+
+	groups, order := am.process(alerts, time.Now())
+
+	forwarded := []*Alert{}
+	for _, group := range order {
+		am.route(group, groups[group])
+		forwarded = append(forwarded, groups[group]...)
+	}
+
+	return forwarded
+}
+
+// Alerts remaining after deduplication and silencing are routed to
+// the notifiers then forwarded to out (if not nil, closed once in is)
+func (am *AlertManager) Run(in <-chan []*Alert, out chan<- []*Alert) {
+
+	if out != nil {
+		defer close(out)
+	}
+
+	for alerts := range in {
+
+		forwarded := am.handle(alerts)
+		if out != nil && len(forwarded) != 0 {
+			out <- forwarded
+		}
+	}
+}
+
+// Subscriber routing alerts to the notifiers (see
+// Monitor.SubscribeAlerts), none being dropped
+func (am *AlertManager) AlertsSubscriber() *AlertsSubscriber {
+
+	return &AlertsSubscriber{
+		Handler: func(alerts []*Alert) { am.handle(alerts) },
+		Buffer:  defaultOutputBuffer,
+		Policy:  OutputBlock,
+	}
+}
+
+// GET lists silences, POST creates one from a JSON body,
+// DELETE removes the one given by the id query parameter
+func (am *AlertManager) SilencesHandler() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		switch r.Method {
+
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(am.Silences())
+
+		case http.MethodPost:
+			var s Silence
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			id, err := am.AddSilence(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"id": id})
+
+		case http.MethodDelete:
+			if !am.RemoveSilence(r.URL.Query().Get("id")) {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
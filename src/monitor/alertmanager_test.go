@@ -0,0 +1,212 @@
+package monitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlertManagerProcess(t *testing.T) {
+
+	am := &AlertManager{}
+
+	alerts := []*Alert{
+		&Alert{Status: StatusExceed, Rule: "client", Key: "10.0.0.1"},
+		&Alert{Status: StatusExceed, Rule: "client", Key: "10.0.0.1"},
+		&Alert{Status: StatusExceed, Rule: "client", Key: "10.0.0.2"},
+		&Alert{Status: StatusExceed, Rule: "section", Key: "admin"},
+		&Alert{Status: StatusRecovered, Rule: "section", Key: "help"},
+	}
+
+	groups, order := am.process(alerts, time.Unix(0, 0))
+
+	if len(order) != 2 || order[0] != "rule=client" || order[1] != "rule=section" {
+		t.Errorf("Groups differ. Want %v, got %v",
+			[]string{"rule=client", "rule=section"}, order)
+	}
+
+	if len(groups["rule=client"]) != 2 {
+		t.Errorf("Length of group differs. Want %d, got %d",
+			2, len(groups["rule=client"]))
+	}
+
+	if len(groups["rule=section"]) != 1 {
+		t.Errorf("Length of group differs. Want %d, got %d",
+			1, len(groups["rule=section"]))
+	}
+
+	groups, _ = am.process([]*Alert{
+		&Alert{Status: StatusExceed, Rule: "client", Key: "10.0.0.1"},
+		&Alert{Status: StatusRecovered, Rule: "section", Key: "admin"},
+	}, time.Unix(1, 0))
+
+	if len(groups["rule=client"]) != 0 || len(groups["rule=section"]) != 1 {
+		t.Errorf("Repeated alerts should be deduplicated. Got %v", groups)
+	}
+}
+
+func TestAlertManagerSilences(t *testing.T) {
+
+	am := &AlertManager{}
+
+	_, err := am.AddSilence(Silence{
+		Matchers: []Matcher{{Label: "key", Value: "10\\.0\\..*", Regex: true}},
+		StartsAt: time.Unix(0, 0),
+		EndsAt:   time.Unix(10, 0),
+	})
+	if err != nil {
+		t.Fatalf("AddSilence: %v", err)
+	}
+
+	_, err = am.AddSilence(Silence{
+		Matchers: []Matcher{{Label: "unknown", Value: "x"}},
+		StartsAt: time.Unix(0, 0),
+		EndsAt:   time.Unix(10, 0),
+	})
+	if err == nil {
+		t.Error("Silence with an unknown label should be rejected")
+	}
+
+	groups, _ := am.process([]*Alert{
+		&Alert{Status: StatusExceed, Rule: "client", Key: "10.0.0.1"},
+		&Alert{Status: StatusExceed, Rule: "client", Key: "192.168.0.1"},
+	}, time.Unix(5, 0))
+
+	if len(groups["rule=client"]) != 1 ||
+		groups["rule=client"][0].Key != "192.168.0.1" {
+		t.Errorf("Silenced alert should be muted. Got %v", groups["rule=client"])
+	}
+
+	// Never notified as exceeding
+	groups, _ = am.process([]*Alert{
+		&Alert{Status: StatusRecovered, Rule: "client", Key: "10.0.0.1"},
+	}, time.Unix(20, 0))
+
+	if len(groups) != 0 {
+		t.Errorf("Recovery of a silenced alert should be muted. Got %v", groups)
+	}
+
+	am.process(nil, time.Unix(10, 0))
+
+	if len(am.Silences()) != 0 {
+		t.Errorf("Expired silences should be removed. Got %d",
+			len(am.Silences()))
+	}
+}
+
+func TestAlertManagerSilenceIDs(t *testing.T) {
+
+	am := &AlertManager{}
+
+	add := func(id string) (string, error) {
+		return am.AddSilence(Silence{
+			ID:       id,
+			Matchers: []Matcher{{Label: "rule", Value: "client"}},
+			StartsAt: time.Unix(0, 0),
+			EndsAt:   time.Now().Add(time.Hour),
+		})
+	}
+
+	if _, err := add("2"); err != nil {
+		t.Fatalf("AddSilence: %v", err)
+	}
+
+	if _, err := add("2"); err == nil {
+		t.Errorf("Silence with an existing ID should be rejected")
+	}
+
+	ids := []string{"2"}
+	for i := 0; i < 10; i++ {
+		id, err := add("")
+		if err != nil {
+			t.Fatalf("AddSilence: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Generated IDs skip 2, silences being listed in creation order
+	expected := []string{"2", "1", "3", "4", "5", "6", "7", "8", "9", "10",
+		"11"}
+	got := []string{}
+	for _, s := range am.Silences() {
+		got = append(got, s.ID)
+	}
+
+	if !reflect.DeepEqual(got, expected) || !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Silence IDs differ. Want %v, got %v (added %v)",
+			expected, got, ids)
+	}
+}
+
+func TestAlertManagerRoute(t *testing.T) {
+
+	received := map[string]int{}
+	notifier := func(name string) Notifier {
+		return NotifierFunc(func(group string, alerts []*Alert) error {
+			received[name] += len(alerts)
+			return nil
+		})
+	}
+
+	am := &AlertManager{
+		Routes: []*Route{
+			&Route{Severity: "critical", Notifier: notifier("pager"), Continue: true},
+			&Route{Rule: "client", Notifier: notifier("chat")},
+			&Route{Notifier: notifier("default")},
+		},
+	}
+
+	am.route("rule=client", []*Alert{
+		&Alert{Rule: "client", Severity: "critical"},
+		&Alert{Rule: "client"},
+		&Alert{Rule: "section"},
+	})
+
+	expected := map[string]int{"pager": 1, "chat": 2, "default": 1}
+	for name, count := range expected {
+		if received[name] != count {
+			t.Errorf("Alerts routed to %s differ. Want %d, got %d",
+				name, count, received[name])
+		}
+	}
+}
+
+func TestSilencesHandler(t *testing.T) {
+
+	am := &AlertManager{}
+	ts := httptest.NewServer(am.SilencesHandler())
+	defer ts.Close()
+
+	body := `{"matchers":[{"label":"rule","value":"client"}],` +
+		`"startsAt":"2004-03-07T16:00:00Z","endsAt":"2104-03-07T16:00:00Z"}`
+
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("http.Post: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Status code differs. Want %d, got %d",
+			http.StatusCreated, resp.StatusCode)
+	}
+
+	silences := am.Silences()
+	if len(silences) != 1 {
+		t.Fatalf("Number of silences differs. Want %d, got %d", 1, len(silences))
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"?id="+silences[0].ID, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http.Client.Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent || len(am.Silences()) != 0 {
+		t.Errorf("Silence should be removed. Got status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,93 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"w3chttpd"
+)
+
+// Processes AccessLog (a complete log) offline, log time driving the reads
+// instead of the clock: lines are read at every ReadFrequency of log time,
+// the alerts and Metrics of the periods ending after the last entry being
+// emitted at the end of the log (blank lines are ignored)
+// Returns once every subscriber got its items (see flushTimeout), their
+// channels being closed
+func (m *Monitor) Analyze() error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conf := m.Config
+	if err := conf.start(); err != nil {
+		return fmt.Errorf("monitor.Monitor.Analyze: %v", err)
+	}
+
+	// Lines up to the next read, read by processLog
+	feed := &bytes.Buffer{}
+	conf.brd = bufio.NewReaderSize(feed, conf.BufferSize)
+
+	sc := bufio.NewScanner(*conf.AccessLog)
+	sc.Buffer(make([]byte, 0, 64*1024), conf.BufferSize)
+
+	frequency := int64(conf.ReadFrequency)
+	e := &w3chttpd.Entry{}
+
+	var unprocessed []byte
+	var next, last int64
+	started := false
+
+	for sc.Scan() {
+
+		line := sc.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		if w3chttpd.ParseLine(line, e) == nil {
+
+			ts := e.Timestamp.UnixNano()
+			if !started {
+				next = periodStart(ts, conf.ReadFrequency) + frequency
+				started = true
+			}
+
+			for ts >= next {
+				unprocessed = processLog(next, unprocessed, conf)
+				next += frequency
+			}
+
+			if ts > last {
+				last = ts
+			}
+		}
+
+		feed.Write(line)
+		feed.WriteByte('\n')
+	}
+
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("monitor.Monitor.Analyze: %v", err)
+	}
+
+	// Released after the allowed lateness, the period of the last entry
+	// ending with the metrics period
+	end := next
+	if started {
+		end = periodStart(last, conf.MetricsFrequency) +
+			int64(conf.MetricsFrequency) + int64(conf.AllowedLateness)
+	}
+
+	for {
+		unprocessed = processLog(next, unprocessed, conf)
+		if next >= end {
+			break
+		}
+		next += frequency
+	}
+
+	conf.closeOutputs()
+	conf.closeComponents()
+
+	return nil
+}
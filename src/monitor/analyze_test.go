@@ -0,0 +1,140 @@
+package monitor
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMonitorAnalyze(t *testing.T) {
+
+	logs := strings.Join([]string{
+		`10.0.0.1 - - [01/Jan/1970:00:00:01 +0000] "GET /toto HTTP/1.1" 200 100`,
+		`10.0.0.2 - - [01/Jan/1970:00:00:02 +0000] "GET /toto HTTP/1.1" 200 100`,
+		``,
+		`not a log line`,
+		`10.0.0.1 - - [01/Jan/1970:00:00:12 +0000] "GET /test HTTP/1.1" 404 10`,
+		// Out of order, counted in the same read
+		`10.0.0.3 - - [01/Jan/1970:00:00:11 +0000] "GET /test HTTP/1.1" 200 10`,
+		`10.0.0.1 - - [01/Jan/1970:00:00:25 +0000] "GET /toto HTTP/1.1" 200 10`,
+	}, "\n")
+
+	accessLog := io.Reader(strings.NewReader(logs))
+
+	m := &Monitor{Config: &Config{
+		AccessLog:        &accessLog,
+		ReadFrequency:    time.Second,
+		MetricsFrequency: 10 * time.Second,
+		TrafficWindow:    10 * time.Second,
+		Threshold:        150,
+		BufferPoolSize:   2,
+		BufferSize:       1000,
+		EntryPoolSize:    10,
+	}}
+
+	var mu sync.Mutex
+	metrics := []*Metrics{}
+	alerts := []*Alert{}
+	parseErrors := []*ParseError{}
+
+	m.SubscribeMetrics(&MetricsSubscriber{
+		Handler: func(m *Metrics) {
+			mu.Lock()
+			metrics = append(metrics, m)
+			mu.Unlock()
+		},
+		Policy: OutputBlock,
+	})
+	m.SubscribeAlerts(&AlertsSubscriber{
+		Handler: func(a []*Alert) {
+			mu.Lock()
+			alerts = append(alerts, a...)
+			mu.Unlock()
+		},
+		Policy: OutputBlock,
+	})
+	m.SubscribeParseErrors(&ParseErrorsSubscriber{
+		Handler: func(errs []*ParseError) {
+			mu.Lock()
+			parseErrors = append(parseErrors, errs...)
+			mu.Unlock()
+		},
+	})
+
+	if err := m.Analyze(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Every period up to the one of the last entry
+	requests := []int{2, 2, 1}
+	if len(metrics) != len(requests) {
+		t.Fatalf("Length of metrics differs. Want %d, got %d",
+			len(requests), len(metrics))
+	}
+
+	for i, m := range metrics {
+
+		start := int64(10 * i)
+		if m.PeriodStart.Unix() != start || m.RequestCount != requests[i] {
+			t.Errorf("Metrics %d differ. Want %d requests from %d, got %d from %d",
+				i, requests[i], start, m.RequestCount, m.PeriodStart.Unix())
+		}
+	}
+
+	if len(alerts) != 2 || alerts[0].Status != StatusExceed ||
+		alerts[0].Timestamp.Unix() != 2 || alerts[1].Status != StatusRecovered {
+		t.Errorf("Alerts differ. Want exceed at %d then recovered, got %v",
+			2, alerts)
+	}
+
+	if len(parseErrors) != 1 || parseErrors[0].Line != "not a log line" {
+		t.Errorf("Parse errors differ. Want %q, got %v",
+			"not a log line", parseErrors)
+	}
+}
+
+func TestMonitorStop(t *testing.T) {
+
+	accessLog := io.Reader(strings.NewReader(""))
+	metricsChan := make(chan *Metrics)
+
+	m := &Monitor{Config: &Config{
+		AccessLog:        &accessLog,
+		ReadFrequency:    10 * time.Millisecond,
+		MetricsFrequency: 10 * time.Millisecond,
+		TrafficWindow:    time.Second,
+		Threshold:        150,
+		BufferPoolSize:   2,
+		BufferSize:       1000,
+		EntryPoolSize:    10,
+		MetricsChan:      metricsChan,
+	}}
+
+	done := make(chan struct{})
+	go func() {
+		if err := m.Run(); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+
+	// Run waits for the Metrics already queued
+	<-metricsChan
+	m.Stop()
+
+	for {
+		select {
+		case <-metricsChan:
+		case <-done:
+			m.Stop()
+			return
+		case <-time.After(time.Second):
+			t.Fatalf("Run did not return")
+		}
+	}
+}
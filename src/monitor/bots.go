@@ -0,0 +1,230 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"w3chttpd"
+)
+
+type TrafficClass int
+
+const (
+	ClassHuman      TrafficClass = iota
+	ClassGoodBot    TrafficClass = iota
+	ClassSuspicious TrafficClass = iota
+)
+
+// Number of traffic classes, Metrics.Classes being indexed by class
+const trafficClasses = 3
+
+func (c TrafficClass) String() string {
+
+	switch c {
+
+	case ClassHuman:
+		return "human"
+
+	case ClassGoodBot:
+		return "good_bot"
+
+	case ClassSuspicious:
+		return "suspicious"
+
+	default:
+		return fmt.Sprintf("class(%d)", int(c))
+	}
+}
+
+func parseTrafficClass(name string) (TrafficClass, error) {
+
+	for c := TrafficClass(0); c < trafficClasses; c++ {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown traffic class %q", name)
+}
+
+// Signature list shipped with the project (see bots.txt for the format)
+//
+//go:embed bots.txt
+var defaultBotSignatures []byte
+
+// Size above which the cache of classified user agents is reset
+const botCacheSize = 4096
+
+// Classifies entries from their User-Agent: good signatures first, then
+// suspicious ones, an empty user agent ("-") being suspicious as well
+// Entries without user agent (Common Log Format) are human
+// The zero value uses the signatures shipped with the project and a nil
+// classifier behaves as the zero value
+// Signatures (optional) is a file replacing the shipped signatures, read
+// when the monitor starts
+type BotClassifier struct {
+	Signatures string
+
+	// Internal parameters
+	once       sync.Once
+	mu         sync.RWMutex
+	good       []string
+	suspicious []string
+	cache      map[string]TrafficClass
+}
+
+var defaultBots = &BotClassifier{}
+
+func (bc *BotClassifier) init() {
+
+	bc.once.Do(func() {
+
+		bc.mu.Lock()
+		defer bc.mu.Unlock()
+
+		var err error
+		bc.good, bc.suspicious, err =
+			parseBotSignatures(bytes.NewReader(defaultBotSignatures))
+		if err != nil {
+			panic(fmt.Errorf("invalid shipped bot signatures: %v", err))
+		}
+		bc.cache = make(map[string]TrafficClass)
+	})
+}
+
+func parseBotSignatures(r io.Reader) ([]string, []string, error) {
+
+	good, suspicious := []string{}, []string{}
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+			return nil, nil, fmt.Errorf("line %d: expected <class> <signature>", n)
+		}
+
+		signature := strings.ToLower(strings.TrimSpace(fields[1]))
+
+		switch fields[0] {
+		case "good":
+			good = append(good, signature)
+		case "suspicious":
+			suspicious = append(suspicious, signature)
+		default:
+			return nil, nil, fmt.Errorf("line %d: unknown class %q", n, fields[0])
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, nil, fmt.Errorf("bufio.Scanner.Scan: %v", err)
+	}
+
+	return good, suspicious, nil
+}
+
+// Reads Signatures (if set)
+func (bc *BotClassifier) start() error {
+
+	if bc == nil || bc.Signatures == "" {
+		return nil
+	}
+
+	f, err := os.Open(bc.Signatures)
+	if err != nil {
+		return fmt.Errorf("bots: %v", err)
+	}
+	defer f.Close()
+
+	if err := bc.Update(f); err != nil {
+		return fmt.Errorf("bots: %v", err)
+	}
+
+	return nil
+}
+
+// Replaces the signatures by the ones read from r (same format as bots.txt)
+// The previous signatures are kept on error
+func (bc *BotClassifier) Update(r io.Reader) error {
+
+	bc.init()
+
+	good, suspicious, err := parseBotSignatures(r)
+	if err != nil {
+		return err
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.good = good
+	bc.suspicious = suspicious
+	bc.cache = make(map[string]TrafficClass)
+
+	return nil
+}
+
+func (bc *BotClassifier) Classify(e *w3chttpd.Entry) TrafficClass {
+
+	if bc == nil {
+		bc = defaultBots
+	}
+
+	if e.UserAgent == nil {
+		return ClassHuman
+	}
+
+	bc.init()
+
+	bc.mu.RLock()
+	c, ok := bc.cache[string(e.UserAgent)]
+	bc.mu.RUnlock()
+
+	if ok {
+		return c
+	}
+
+	ua := string(e.UserAgent)
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	c = bc.classify(strings.ToLower(strings.TrimSpace(ua)))
+
+	if len(bc.cache) >= botCacheSize {
+		bc.cache = make(map[string]TrafficClass)
+	}
+	bc.cache[ua] = c
+
+	return c
+}
+
+func (bc *BotClassifier) classify(ua string) TrafficClass {
+
+	if ua == "" || ua == "-" {
+		return ClassSuspicious
+	}
+
+	for _, signature := range bc.good {
+		if strings.Contains(ua, signature) {
+			return ClassGoodBot
+		}
+	}
+
+	for _, signature := range bc.suspicious {
+		if strings.Contains(ua, signature) {
+			return ClassSuspicious
+		}
+	}
+
+	return ClassHuman
+}
@@ -0,0 +1,169 @@
+package monitor
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"w3chttpd"
+)
+
+func TestBotClassifierClassify(t *testing.T) {
+
+	classTable := []struct {
+		userAgent []byte
+		class     TrafficClass
+	}{
+		{nil, ClassHuman},
+		{[]byte("Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"), ClassHuman},
+		{[]byte("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"), ClassGoodBot},
+		{[]byte("Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)"), ClassGoodBot},
+		{[]byte("curl/8.4.0"), ClassSuspicious},
+		{[]byte("python-requests/2.31.0"), ClassSuspicious},
+		{[]byte("SomeUnknownBot/1.0"), ClassSuspicious},
+		{[]byte("-"), ClassSuspicious},
+		{[]byte(""), ClassSuspicious},
+	}
+
+	bc := &BotClassifier{}
+
+	for _, rec := range classTable {
+
+		e := &w3chttpd.Entry{UserAgent: rec.userAgent}
+
+		// Twice to go through the cache
+		for i := 0; i < 2; i++ {
+			if c := bc.Classify(e); c != rec.class {
+				t.Errorf("Class of \"%s\" differs. Want %s, got %s",
+					rec.userAgent, rec.class, c)
+			}
+		}
+	}
+
+	var nilClassifier *BotClassifier
+	e := &w3chttpd.Entry{UserAgent: []byte("Googlebot/2.1")}
+	if c := nilClassifier.Classify(e); c != ClassGoodBot {
+		t.Errorf("A nil classifier should use the shipped signatures. Got %s", c)
+	}
+}
+
+func TestBotClassifierUpdate(t *testing.T) {
+
+	bc := &BotClassifier{}
+	e := &w3chttpd.Entry{UserAgent: []byte("InternalChecker/1.0")}
+
+	if c := bc.Classify(e); c != ClassHuman {
+		t.Errorf("Class differs. Want %s, got %s", ClassHuman, c)
+	}
+
+	err := bc.Update(strings.NewReader("# local list\ngood internalchecker\n"))
+	if err != nil {
+		t.Fatalf("BotClassifier.Update: %v", err)
+	}
+
+	if c := bc.Classify(e); c != ClassGoodBot {
+		t.Errorf("Class differs after update. Want %s, got %s", ClassGoodBot, c)
+	}
+
+	for _, invalid := range []string{"evil curl", "good", "suspicious  "} {
+		if err := bc.Update(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Signatures \"%s\" should be rejected", invalid)
+		}
+	}
+
+	if c := bc.Classify(e); c != ClassGoodBot {
+		t.Errorf("Signatures should be kept on error. Got %s", c)
+	}
+}
+
+func TestBotClassifierStart(t *testing.T) {
+
+	bc := &BotClassifier{Signatures: filepath.Join(t.TempDir(), "bots.txt")}
+	if err := bc.start(); err == nil {
+		t.Errorf("Missing signatures file should fail to start")
+	}
+
+	// Shipped signatures
+	if err := (*BotClassifier)(nil).start(); err != nil {
+		t.Errorf("Nil classifier should start: %v", err)
+	}
+}
+
+func TestMetricsClasses(t *testing.T) {
+
+	entries := []*w3chttpd.Entry{
+		&w3chttpd.Entry{Ip: []byte("10.0.0.1"), Size: 100,
+			UserAgent: []byte("Mozilla/5.0 Firefox/120.0")},
+		&w3chttpd.Entry{Ip: []byte("10.0.0.1"), Size: 100,
+			UserAgent: []byte("Mozilla/5.0 Firefox/120.0")},
+		&w3chttpd.Entry{Ip: []byte("66.249.66.1"), Size: 300,
+			UserAgent: []byte("Googlebot/2.1")},
+		&w3chttpd.Entry{Ip: []byte("10.0.0.9"), Size: 50,
+			UserAgent: []byte("curl/8.4.0")},
+		&w3chttpd.Entry{Ip: []byte("10.0.0.8"), Size: 50,
+			UserAgent: []byte("-")},
+	}
+
+	start := time.Date(2004, 3, 7, 16, 0, 0, 0, time.UTC)
+	m := aggregateMetrics(entries, nil, nil, nil, start, start.Add(10*time.Second))
+
+	expected := []ClassMetrics{
+		{ClassHuman, 2, 1, 200},
+		{ClassGoodBot, 1, 1, 300},
+		{ClassSuspicious, 2, 2, 100},
+	}
+
+	if !reflect.DeepEqual(m.Classes, expected) {
+		t.Errorf("Classes differ. Want %+v, got %+v", expected, m.Classes)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	decoded := &Metrics{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded.Classes, expected) {
+		t.Errorf("Decoded classes differ. Want %+v, got %+v",
+			expected, decoded.Classes)
+	}
+
+	merged := copyMetrics(m)
+	mergeMetrics(merged, m)
+
+	if merged.Classes[2] != (ClassMetrics{ClassSuspicious, 4, 2, 200}) ||
+		m.Classes[2].RequestCount != 2 {
+		t.Errorf("Merged classes differ. Got %+v", merged.Classes)
+	}
+}
+
+func TestAlertRuleExcludeBots(t *testing.T) {
+
+	rule := &AlertRule{
+		Name:          "humans",
+		TrafficWindow: 2 * time.Minute,
+		Threshold:     400,
+		ExcludeBots:   true,
+	}
+
+	sw := newScopedWindows(rule, "", newTestEntryPool(10))
+
+	sw.add([]*w3chttpd.Entry{
+		&w3chttpd.Entry{Timestamp: time.Unix(1, 0), Size: 300,
+			UserAgent: []byte("Googlebot/2.1")},
+		&w3chttpd.Entry{Timestamp: time.Unix(1, 0), Size: 300,
+			UserAgent: []byte("curl/8.4.0")},
+		&w3chttpd.Entry{Timestamp: time.Unix(2, 0), Size: 300,
+			UserAgent: []byte("Mozilla/5.0 Firefox/120.0")},
+	})
+
+	if alerts := sw.getNewAlerts(time.Unix(2, 0)); len(alerts) != 0 {
+		t.Errorf("Bot traffic should not trigger alerts. Got %v", alerts)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"sort"
 	"sync"
+	"time"
 	"unicode/utf8"
 	"w3chttpd"
 )
@@ -51,8 +52,39 @@ func (u *unprocessedBytes) concatenateAll() []byte {
 	return res
 }
 
+// Line that could not be parsed, read at Time
+type ParseError struct {
+	Time time.Time
+	Line string
+	Err  error
+}
+
+func (pe *ParseError) Error() string {
+	return pe.Err.Error()
+}
+
+// Parse errors collected by the parsing goroutines (none if nil)
+type parseErrors struct {
+	sync.Mutex
+	errs []*ParseError
+}
+
+func (pe *parseErrors) add(line []byte, err error) {
+
+	log.Printf("ParseLine: %v", err)
+
+	if pe == nil {
+		return
+	}
+
+	pe.Lock()
+	defer pe.Unlock()
+
+	pe.errs = append(pe.errs, &ParseError{Line: string(line), Err: err})
+}
+
 func processBuffer(brd *bufio.Reader, bpool *bufferPool,
-	queue *entryQueue, unprocessed []byte) []byte {
+	queue *entryQueue, unprocessed []byte, errs *parseErrors) []byte {
 
 	tempQueue := &entryQueue{
 		&sync.RWMutex{},
@@ -81,7 +113,7 @@ func processBuffer(brd *bufio.Reader, bpool *bufferPool,
 
 			defer wg.Done()
 
-			up := extractLines(buf, tempQueue)
+			up := extractLines(buf, tempQueue, errs)
 			ub.add(bufPos, append([]byte{}, up...))
 			bpool.recycle(buf)
 
@@ -93,8 +125,8 @@ func processBuffer(brd *bufio.Reader, bpool *bufferPool,
 	wg.Wait()
 
 	buf := ub.concatenateAll()
-	buf = extractLines(buf, tempQueue)
-	unprocessed = extractLine(buf, tempQueue)
+	buf = extractLines(buf, tempQueue, errs)
+	unprocessed = extractLine(buf, tempQueue, errs)
 
 	sort.Sort(tempQueue)
 	queue.entries = append(queue.entries, tempQueue.entries...)
@@ -121,7 +153,8 @@ func readBuffer(brd *bufio.Reader, bpool *bufferPool) ([]byte, error) {
 // Extract lines between first \n and last \n in the buffer
 // Since it is impossible to align buffer size with a log line sizes
 // (a log line having a variable size)
-func extractLines(buffer []byte, queue *entryQueue) []byte {
+func extractLines(buffer []byte, queue *entryQueue,
+	errs *parseErrors) []byte {
 
 	startBuf, endBuf := 0, 0
 
@@ -156,7 +189,7 @@ func extractLines(buffer []byte, queue *entryQueue) []byte {
 			err := w3chttpd.ParseLine(buffer[currentStart:i], e)
 
 			if err != nil {
-				log.Printf("ParseLine: %v", err)
+				errs.add(buffer[currentStart:i], err)
 				queue.epool.recycle(e)
 
 			} else {
@@ -175,7 +208,8 @@ func extractLines(buffer []byte, queue *entryQueue) []byte {
 	return append([]byte{}, buffer[:startBuf]...)
 }
 
-func extractLine(buffer []byte, queue *entryQueue) []byte {
+func extractLine(buffer []byte, queue *entryQueue,
+	errs *parseErrors) []byte {
 
 	if len(buffer) == 0 {
 		return nil
@@ -191,7 +225,7 @@ func extractLine(buffer []byte, queue *entryQueue) []byte {
 			err := w3chttpd.ParseLine(buffer[:i], e)
 
 			if err != nil {
-				log.Printf("ParseLine: %v", err)
+				errs.add(buffer[:i], err)
 				queue.epool.recycle(e)
 
 			} else {
@@ -182,7 +182,7 @@ func TestProcessBuffer(t *testing.T) {
 		rd := bytes.NewReader(midBuffer)
 		brd := bufio.NewReaderSize(rd, i)
 
-		unprocessed := processBuffer(brd, bpool, eq, truncated)
+		unprocessed := processBuffer(brd, bpool, eq, truncated, nil)
 
 		if len(eq.entries) != 299 {
 			t.Errorf("Lengh of queue differs. Want %d, got %d", 299, len(eq.entries))
@@ -191,7 +191,7 @@ func TestProcessBuffer(t *testing.T) {
 		buffer = buffer[len(buffer)-7:]
 		rd = bytes.NewReader(buffer)
 		brd = bufio.NewReaderSize(rd, i)
-		unprocessed = processBuffer(brd, bpool, eq, unprocessed)
+		unprocessed = processBuffer(brd, bpool, eq, unprocessed, nil)
 
 		if len(eq.entries) != 300 {
 			t.Errorf("Lengh of queue differs. Want %d, got %d", 300, len(eq.entries))
@@ -233,7 +233,7 @@ func benchmarkProcessBuffer(b *testing.B, bufferSize int) {
 
 		eq.epool.init(10)
 
-		processBuffer(brd, bpool, eq, nil)
+		processBuffer(brd, bpool, eq, nil, nil)
 	}
 }
 
@@ -265,7 +265,7 @@ func TestExtractLines(t *testing.T) {
 
 	buffer := bytes.Join(logSamples, []byte("\n"))
 	buffer = append(buffer, []byte("\n")...)
-	unprocessed := extractLines(buffer, eq)
+	unprocessed := extractLines(buffer, eq, nil)
 
 	expected := buffer[:len(logSamples[0])+1]
 
@@ -287,7 +287,7 @@ func TestExtractLines(t *testing.T) {
 	eq.epool.init(10)
 
 	buffer = bytes.Join(logSamples, []byte("\n"))
-	unprocessed = extractLines(buffer, eq)
+	unprocessed = extractLines(buffer, eq, nil)
 
 	expected = append(buffer[:len(logSamples[0])], []byte("\n")...)
 	expected = append(expected, logSamples[2]...)
@@ -310,7 +310,7 @@ func TestExtractLines(t *testing.T) {
 	eq.epool.init(10)
 
 	buffer = logSamples[0]
-	unprocessed = extractLines(buffer, eq)
+	unprocessed = extractLines(buffer, eq, nil)
 
 	expected = logSamples[0]
 
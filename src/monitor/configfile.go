@@ -0,0 +1,759 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// Duration written as a string in configuration files (e.g. "10s", see
+// time.ParseDuration)
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"10s\"")
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// Log source (common or combined format), Path being read at startup only
+type SourceConfig struct {
+	Path            string   `json:"path"`
+	Name            string   `json:"name,omitempty"`
+	ReadFrequency   Duration `json:"read_frequency"`
+	Filter          string   `json:"filter,omitempty"`
+	AllowedLateness Duration `json:"allowed_lateness,omitempty"`
+	LatePolicy      string   `json:"late_policy,omitempty"`
+	BufferPoolSize  int      `json:"buffer_pool_size,omitempty"`
+	BufferSize      int      `json:"buffer_size,omitempty"`
+	EntryPoolSize   int      `json:"entry_pool_size,omitempty"`
+}
+
+type AlertRuleConfig struct {
+	Name            string   `json:"name"`
+	Scope           string   `json:"scope"`
+	TrafficWindow   Duration `json:"traffic_window"`
+	Threshold       int      `json:"threshold"`
+	Severity        string   `json:"severity,omitempty"`
+	Filter          string   `json:"filter,omitempty"`
+	ExcludeBots     bool     `json:"exclude_bots,omitempty"`
+	ExcludeNetworks []string `json:"exclude_networks,omitempty"`
+	IdleTimeout     Duration `json:"idle_timeout,omitempty"`
+	MaxKeys         int      `json:"max_keys,omitempty"`
+}
+
+// Global traffic window and alert rules (names must be unique, rules being
+// matched by name on reload)
+type AlertsConfig struct {
+	TrafficWindow     Duration          `json:"traffic_window"`
+	Threshold         int               `json:"threshold"`
+	WindowGranularity Duration          `json:"window_granularity,omitempty"`
+	Rules             []AlertRuleConfig `json:"rules,omitempty"`
+}
+
+type MetricsConfig struct {
+	Frequency Duration `json:"frequency"`
+	Filter    string   `json:"filter,omitempty"`
+}
+
+// Named list of CIDR ranges (see NetworkList)
+type NetworkConfig struct {
+	Name     string   `json:"name"`
+	Prefixes []string `json:"prefixes"`
+	Exclude  bool     `json:"exclude,omitempty"`
+}
+
+// Client identification (see Clients), TrustedProxies being CIDR ranges
+type ClientsConfig struct {
+	IPv4Prefix     int             `json:"ipv4_prefix,omitempty"`
+	IPv6Prefix     int             `json:"ipv6_prefix,omitempty"`
+	Networks       []NetworkConfig `json:"networks,omitempty"`
+	TrustedProxies []string        `json:"trusted_proxies,omitempty"`
+	ForwardedField int             `json:"forwarded_field,omitempty"`
+}
+
+// GeoLite2 databases (see GeoIP), at least one being required
+type GeoIPConfig struct {
+	CountryDB       string   `json:"country_db,omitempty"`
+	ASNDB           string   `json:"asn_db,omitempty"`
+	ReloadFrequency Duration `json:"reload_frequency,omitempty"`
+	Top             int      `json:"top,omitempty"`
+}
+
+// File of bot signatures replacing the shipped ones (see BotClassifier)
+type BotsConfig struct {
+	Signatures string `json:"signatures"`
+}
+
+type SessionsConfig struct {
+	Timeout     Duration `json:"timeout,omitempty"`
+	MaxSessions int      `json:"max_sessions,omitempty"`
+}
+
+type TopKConfig struct {
+	K        int `json:"k,omitempty"`
+	Capacity int `json:"capacity,omitempty"`
+}
+
+// Exporter served by the application on HTTPAddr
+type PrometheusConfig struct {
+	MaxSections int `json:"max_sections,omitempty"`
+}
+
+// Format is "statsd" or "dogstatsd"
+type StatsdConfig struct {
+	Addr          string   `json:"addr"`
+	Format        string   `json:"format,omitempty"`
+	Prefix        string   `json:"prefix,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	MaxPacketSize int      `json:"max_packet_size,omitempty"`
+}
+
+// Protocol is "http" or "grpc"
+type OTLPConfig struct {
+	Endpoint           string            `json:"endpoint"`
+	Protocol           string            `json:"protocol,omitempty"`
+	Headers            map[string]string `json:"headers,omitempty"`
+	ServiceName        string            `json:"service_name,omitempty"`
+	ResourceAttributes map[string]string `json:"resource_attributes,omitempty"`
+	Timeout            Duration          `json:"timeout,omitempty"`
+}
+
+type WebhookConfig struct {
+	Name           string            `json:"name"`
+	URL            string            `json:"url"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	BodyTemplate   string            `json:"body_template,omitempty"`
+	QueueDir       string            `json:"queue_dir,omitempty"`
+	MaxQueue       int               `json:"max_queue,omitempty"`
+	InitialBackoff Duration          `json:"initial_backoff,omitempty"`
+	MaxBackoff     Duration          `json:"max_backoff,omitempty"`
+}
+
+// TLS is "none", "starttls" or "implicit", digests getting the last
+// Metrics of the monitor
+type EmailConfig struct {
+	Name            string   `json:"name"`
+	Addr            string   `json:"addr"`
+	Username        string   `json:"username,omitempty"`
+	Password        string   `json:"password,omitempty"`
+	From            string   `json:"from"`
+	To              []string `json:"to"`
+	TLS             string   `json:"tls,omitempty"`
+	SubjectTemplate string   `json:"subject_template,omitempty"`
+	BodyTemplate    string   `json:"body_template,omitempty"`
+	Digest          Duration `json:"digest,omitempty"`
+	Timeout         Duration `json:"timeout,omitempty"`
+}
+
+// Notifier is the name of a webhook or email notifier (see Route)
+type RouteConfig struct {
+	Rule     string `json:"rule,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Notifier string `json:"notifier"`
+	Continue bool   `json:"continue,omitempty"`
+}
+
+// Without routes, every alert is sent to every notifier
+type AlertManagerConfig struct {
+	GroupBy []string      `json:"group_by,omitempty"`
+	Routes  []RouteConfig `json:"routes,omitempty"`
+}
+
+// Display ("text", "json", "tui" or "web", the dashboards being run by
+// library users, not the httpmonitor command) and HTTPAddr are left to the
+// application, being read at startup only like the exporters and notifiers
+type OutputsConfig struct {
+	Buffer       int                 `json:"buffer,omitempty"`
+	Policy       string              `json:"policy,omitempty"`
+	Display      string              `json:"display,omitempty"`
+	HTTPAddr     string              `json:"http_addr,omitempty"`
+	Prometheus   *PrometheusConfig   `json:"prometheus,omitempty"`
+	Statsd       *StatsdConfig       `json:"statsd,omitempty"`
+	OTLP         *OTLPConfig         `json:"otlp,omitempty"`
+	Webhooks     []WebhookConfig     `json:"webhooks,omitempty"`
+	Emails       []EmailConfig       `json:"emails,omitempty"`
+	AlertManager *AlertManagerConfig `json:"alert_manager,omitempty"`
+}
+
+// Configuration file (JSON) of a monitor, missing settings having the
+// defaults of the example command
+// Clients, GeoIP, Bots, Sessions and TopK are optional (nil if absent)
+// and read at startup only
+type ConfigFile struct {
+	Source   SourceConfig    `json:"source"`
+	Clients  *ClientsConfig  `json:"clients,omitempty"`
+	GeoIP    *GeoIPConfig    `json:"geoip,omitempty"`
+	Bots     *BotsConfig     `json:"bots,omitempty"`
+	Sessions *SessionsConfig `json:"sessions,omitempty"`
+	TopK     *TopKConfig     `json:"top_k,omitempty"`
+	Alerts   AlertsConfig    `json:"alerts"`
+	Metrics  MetricsConfig   `json:"metrics"`
+	Outputs  OutputsConfig   `json:"outputs"`
+}
+
+func defaultConfigFile() *ConfigFile {
+
+	return &ConfigFile{
+		Source: SourceConfig{
+			Path:           "access.log",
+			ReadFrequency:  Duration(time.Second),
+			LatePolicy:     LateDrop.String(),
+			BufferPoolSize: 20,
+			BufferSize:     1024 * 1024,
+			EntryPoolSize:  12000000,
+		},
+		Alerts: AlertsConfig{
+			TrafficWindow:     Duration(120 * time.Second),
+			Threshold:         250,
+			WindowGranularity: Duration(time.Second),
+		},
+		Metrics: MetricsConfig{
+			Frequency: Duration(10 * time.Second),
+		},
+		Outputs: OutputsConfig{
+			Buffer:  defaultOutputBuffer,
+			Policy:  OutputDropOldest.String(),
+			Display: "text",
+		},
+	}
+}
+
+// Unknown settings are rejected, the other checks being made by Apply
+func ReadConfigFile(r io.Reader) (*ConfigFile, error) {
+
+	cf := defaultConfigFile()
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(cf); err != nil {
+		return nil, fmt.Errorf("monitor.ReadConfigFile: %v", err)
+	}
+
+	return cf, nil
+}
+
+func (cf *ConfigFile) rules() ([]*AlertRule, error) {
+
+	rules := make([]*AlertRule, 0, len(cf.Alerts.Rules))
+	names := make(map[string]bool, len(cf.Alerts.Rules))
+
+	for _, rc := range cf.Alerts.Rules {
+
+		if rc.Name == "" || names[rc.Name] {
+			return nil, fmt.Errorf("alert rules need a unique name (got %q)",
+				rc.Name)
+		}
+		names[rc.Name] = true
+
+		scope, err := ParseScope(rc.Scope)
+		if err != nil {
+			return nil, fmt.Errorf("alert rule %q: %v", rc.Name, err)
+		}
+
+		rule := &AlertRule{
+			Name:            rc.Name,
+			Scope:           scope,
+			TrafficWindow:   time.Duration(rc.TrafficWindow),
+			Threshold:       rc.Threshold,
+			Severity:        rc.Severity,
+			ExcludeBots:     rc.ExcludeBots,
+			ExcludeNetworks: rc.ExcludeNetworks,
+			IdleTimeout:     time.Duration(rc.IdleTimeout),
+			MaxKeys:         rc.MaxKeys,
+		}
+
+		if rc.Filter != "" {
+			rule.Filter, err = CompileFilter(rc.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("alert rule %q: %v", rc.Name, err)
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (cc *ClientsConfig) clients() (*Clients, error) {
+
+	c := &Clients{
+		IPv4Prefix:     cc.IPv4Prefix,
+		IPv6Prefix:     cc.IPv6Prefix,
+		ForwardedField: cc.ForwardedField,
+	}
+
+	for _, nc := range cc.Networks {
+
+		nl := &NetworkList{Name: nc.Name, Exclude: nc.Exclude}
+		for _, cidr := range nc.Prefixes {
+
+			p, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("network list %q: %v", nc.Name, err)
+			}
+			nl.Prefixes = append(nl.Prefixes, p)
+		}
+		c.Networks = append(c.Networks, nl)
+	}
+
+	for _, cidr := range cc.TrustedProxies {
+
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxies: %v", err)
+		}
+		c.TrustedProxies = append(c.TrustedProxies, p)
+	}
+
+	return c, nil
+}
+
+// Signatures are read when the monitor starts
+func (bc *BotsConfig) classifier() (*BotClassifier, error) {
+
+	if bc.Signatures == "" {
+		return nil, fmt.Errorf("bots needs a signatures file")
+	}
+
+	return &BotClassifier{Signatures: bc.Signatures}, nil
+}
+
+func (ec *EmailConfig) notifier() (*EmailNotifier, error) {
+
+	if ec.Addr == "" || ec.From == "" || len(ec.To) == 0 {
+		return nil, fmt.Errorf("email notifier %q needs addr, from and to",
+			ec.Name)
+	}
+
+	tls := TLSNone
+	if ec.TLS != "" {
+		var err error
+		if tls, err = ParseTLSMode(ec.TLS); err != nil {
+			return nil, fmt.Errorf("email notifier %q: %v", ec.Name, err)
+		}
+	}
+
+	return &EmailNotifier{
+		Addr:            ec.Addr,
+		Username:        ec.Username,
+		Password:        ec.Password,
+		From:            ec.From,
+		To:              ec.To,
+		TLS:             tls,
+		SubjectTemplate: ec.SubjectTemplate,
+		BodyTemplate:    ec.BodyTemplate,
+		Digest:          time.Duration(ec.Digest),
+		Timeout:         time.Duration(ec.Timeout),
+	}, nil
+}
+
+// Components built from the optional sections of a configuration file,
+// closers closing those owning goroutines or files
+type fileComponents struct {
+	clients  *Clients
+	geo      *GeoIP
+	bots     *BotClassifier
+	sessions *SessionTracker
+	topK     *TopK
+	exporter *PrometheusExporter
+	statsd   *StatsdSink
+	otlp     *OTLPExporter
+	webhooks []*WebhookNotifier
+	alerts   []*AlertsSubscriber
+	metrics  []*MetricsSubscriber
+	closers  []func()
+}
+
+// Nothing is started nor read, databases, signatures, notifiers and sinks
+// starting with the monitor or on first use, so that components never
+// started need no closing
+func (cf *ConfigFile) components() (*fileComponents, error) {
+
+	c := &fileComponents{}
+	var err error
+
+	if cf.Clients != nil {
+		if c.clients, err = cf.Clients.clients(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cf.GeoIP != nil {
+
+		if cf.GeoIP.CountryDB == "" && cf.GeoIP.ASNDB == "" {
+			return nil, fmt.Errorf("geoip needs a country or ASN database")
+		}
+
+		c.geo = &GeoIP{
+			CountryDB:       cf.GeoIP.CountryDB,
+			ASNDB:           cf.GeoIP.ASNDB,
+			ReloadFrequency: time.Duration(cf.GeoIP.ReloadFrequency),
+			Top:             cf.GeoIP.Top,
+		}
+		c.closers = append(c.closers, c.geo.Close)
+	}
+
+	if cf.Bots != nil {
+		if c.bots, err = cf.Bots.classifier(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cf.Sessions != nil {
+		c.sessions = &SessionTracker{
+			Timeout:     time.Duration(cf.Sessions.Timeout),
+			MaxSessions: cf.Sessions.MaxSessions,
+		}
+	}
+
+	if cf.TopK != nil {
+		c.topK = &TopK{K: cf.TopK.K, Capacity: cf.TopK.Capacity}
+	}
+
+	if err := cf.Outputs.components(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (oc *OutputsConfig) components(c *fileComponents) error {
+
+	if oc.Prometheus != nil {
+		c.exporter = &PrometheusExporter{MaxSections: oc.Prometheus.MaxSections}
+	}
+
+	if oc.Statsd != nil {
+
+		format := FormatStatsd
+		if oc.Statsd.Format != "" {
+			var err error
+			if format, err = ParseStatsdFormat(oc.Statsd.Format); err != nil {
+				return fmt.Errorf("statsd: %v", err)
+			}
+		}
+
+		c.statsd = &StatsdSink{
+			Addr:          oc.Statsd.Addr,
+			Format:        format,
+			Prefix:        oc.Statsd.Prefix,
+			Tags:          oc.Statsd.Tags,
+			MaxPacketSize: oc.Statsd.MaxPacketSize,
+		}
+		c.closers = append(c.closers, c.statsd.Close)
+	}
+
+	if oc.OTLP != nil {
+
+		protocol := OTLPHTTP
+		if oc.OTLP.Protocol != "" {
+			var err error
+			if protocol, err = ParseOTLPProtocol(oc.OTLP.Protocol); err != nil {
+				return fmt.Errorf("otlp: %v", err)
+			}
+		}
+
+		c.otlp = &OTLPExporter{
+			Endpoint:           oc.OTLP.Endpoint,
+			Protocol:           protocol,
+			Headers:            oc.OTLP.Headers,
+			ServiceName:        oc.OTLP.ServiceName,
+			ResourceAttributes: oc.OTLP.ResourceAttributes,
+			Timeout:            time.Duration(oc.OTLP.Timeout),
+		}
+		c.closers = append(c.closers, c.otlp.Close)
+	}
+
+	// Notifiers are named for routes, in order of declaration
+	notifiers := make(map[string]Notifier)
+	names := []string{}
+
+	addNotifier := func(name string, n Notifier, closer func()) error {
+
+		if name == "" || notifiers[name] != nil {
+			return fmt.Errorf("notifiers need a unique name (got %q)", name)
+		}
+
+		notifiers[name] = n
+		names = append(names, name)
+		c.closers = append(c.closers, closer)
+		return nil
+	}
+
+	for _, wc := range oc.Webhooks {
+
+		if wc.URL == "" {
+			return fmt.Errorf("webhook notifier %q needs a url", wc.Name)
+		}
+
+		wn := &WebhookNotifier{
+			URL:            wc.URL,
+			Headers:        wc.Headers,
+			BodyTemplate:   wc.BodyTemplate,
+			QueueDir:       wc.QueueDir,
+			MaxQueue:       wc.MaxQueue,
+			InitialBackoff: time.Duration(wc.InitialBackoff),
+			MaxBackoff:     time.Duration(wc.MaxBackoff),
+		}
+
+		if err := addNotifier(wc.Name, wn, wn.Close); err != nil {
+			return err
+		}
+		c.webhooks = append(c.webhooks, wn)
+	}
+
+	for i := range oc.Emails {
+
+		en, err := oc.Emails[i].notifier()
+		if err != nil {
+			return err
+		}
+
+		if err := addNotifier(oc.Emails[i].Name, en, en.Close); err != nil {
+			return err
+		}
+		c.metrics = append(c.metrics, en.MetricsSubscriber())
+	}
+
+	if len(notifiers) == 0 && oc.AlertManager == nil {
+		return nil
+	}
+
+	am := &AlertManager{}
+
+	amc := oc.AlertManager
+	if amc == nil {
+		amc = &AlertManagerConfig{}
+	}
+
+	for _, label := range amc.GroupBy {
+		switch label {
+		case "rule", "key", "severity", "status":
+		default:
+			return fmt.Errorf("alert manager: unknown group by label %q", label)
+		}
+	}
+	am.GroupBy = amc.GroupBy
+
+	for _, rc := range amc.Routes {
+
+		n, ok := notifiers[rc.Notifier]
+		if !ok {
+			return fmt.Errorf("alert manager: route to unknown notifier %q",
+				rc.Notifier)
+		}
+
+		am.Routes = append(am.Routes, &Route{
+			Rule:     rc.Rule,
+			Severity: rc.Severity,
+			Notifier: n,
+			Continue: rc.Continue,
+		})
+	}
+
+	if len(amc.Routes) == 0 {
+		for _, name := range names {
+			am.Routes = append(am.Routes,
+				&Route{Notifier: notifiers[name], Continue: true})
+		}
+	}
+
+	c.alerts = append(c.alerts, am.AlertsSubscriber())
+
+	return nil
+}
+
+// Set in conf, sections missing from the file keeping the components of
+// conf
+func (c *fileComponents) apply(conf *Config) {
+
+	if c.clients != nil {
+		conf.Clients = c.clients
+	}
+
+	if c.geo != nil {
+		conf.GeoIP = c.geo
+	}
+
+	if c.bots != nil {
+		conf.Bots = c.bots
+	}
+
+	if c.sessions != nil {
+		conf.Sessions = c.sessions
+	}
+
+	if c.topK != nil {
+		conf.TopK = c.topK
+	}
+
+	if c.exporter != nil {
+		conf.Exporter = c.exporter
+	}
+
+	if c.statsd != nil {
+		conf.Statsd = c.statsd
+	}
+
+	if c.otlp != nil {
+		conf.OTLP = c.otlp
+	}
+
+	for _, wn := range c.webhooks {
+		wn.health = &conf.health
+	}
+
+	conf.AlertsSubscribers = append(conf.AlertsSubscribers, c.alerts...)
+	conf.MetricsSubscribers = append(conf.MetricsSubscribers, c.metrics...)
+	conf.closers = append(conf.closers, c.closers...)
+}
+
+// Closes the components built from the configuration file, once the
+// outputs are flushed
+func (conf *Config) closeComponents() {
+
+	for _, closer := range conf.closers {
+		closer()
+	}
+	conf.closers = nil
+}
+
+// Sets the settings of the file in conf (the other ones are kept), conf
+// being left untouched if the file is invalid
+// The components of the optional sections are built without being
+// started, Run closing them when it returns
+func (cf *ConfigFile) Apply(conf *Config) error {
+
+	return cf.apply(conf, true)
+}
+
+// Components are left to conf unless build is set (see Monitor.Reload)
+func (cf *ConfigFile) apply(conf *Config, build bool) error {
+
+	switch cf.Outputs.Display {
+	case "text", "json", "tui", "web":
+	default:
+		return fmt.Errorf("monitor.ConfigFile.Apply: unknown display %q",
+			cf.Outputs.Display)
+	}
+
+	if cf.Source.ReadFrequency <= 0 || cf.Metrics.Frequency <= 0 ||
+		cf.Alerts.TrafficWindow <= 0 {
+		return fmt.Errorf("monitor.ConfigFile.Apply: read frequency, " +
+			"metrics frequency and traffic window must be positive")
+	}
+
+	if cf.Source.BufferPoolSize <= 0 || cf.Source.BufferSize <= 0 ||
+		cf.Source.EntryPoolSize <= 0 {
+		return fmt.Errorf("monitor.ConfigFile.Apply: pool and buffer sizes " +
+			"must be positive")
+	}
+
+	latePolicy, err := ParseLatePolicy(cf.Source.LatePolicy)
+	if err != nil {
+		return fmt.Errorf("monitor.ConfigFile.Apply: %v", err)
+	}
+
+	outputPolicy, err := ParseOutputPolicy(cf.Outputs.Policy)
+	if err != nil {
+		return fmt.Errorf("monitor.ConfigFile.Apply: %v", err)
+	}
+
+	var filter, metricsFilter *Filter
+
+	if cf.Source.Filter != "" {
+		if filter, err = CompileFilter(cf.Source.Filter); err != nil {
+			return fmt.Errorf("monitor.ConfigFile.Apply: %v", err)
+		}
+	}
+
+	if cf.Metrics.Filter != "" {
+		if metricsFilter, err = CompileFilter(cf.Metrics.Filter); err != nil {
+			return fmt.Errorf("monitor.ConfigFile.Apply: %v", err)
+		}
+	}
+
+	rules, err := cf.rules()
+	if err != nil {
+		return fmt.Errorf("monitor.ConfigFile.Apply: %v", err)
+	}
+
+	var components *fileComponents
+	if build {
+		if components, err = cf.components(); err != nil {
+			return fmt.Errorf("monitor.ConfigFile.Apply: %v", err)
+		}
+	}
+
+	conf.Source = cf.Source.Name
+	conf.ReadFrequency = time.Duration(cf.Source.ReadFrequency)
+	conf.Filter = filter
+	conf.AllowedLateness = time.Duration(cf.Source.AllowedLateness)
+	conf.LatePolicy = latePolicy
+	conf.BufferPoolSize = cf.Source.BufferPoolSize
+	conf.BufferSize = cf.Source.BufferSize
+	conf.EntryPoolSize = cf.Source.EntryPoolSize
+
+	conf.TrafficWindow = time.Duration(cf.Alerts.TrafficWindow)
+	conf.Threshold = cf.Alerts.Threshold
+	conf.WindowGranularity = time.Duration(cf.Alerts.WindowGranularity)
+	conf.AlertRules = rules
+
+	conf.MetricsFrequency = time.Duration(cf.Metrics.Frequency)
+	conf.MetricsFilter = metricsFilter
+
+	conf.OutputBuffer = cf.Outputs.Buffer
+	conf.OutputPolicy = outputPolicy
+
+	if components != nil {
+		components.apply(conf)
+	}
+
+	conf.file = cf
+
+	return nil
+}
+
+// New Config of cf checked as Monitor.Run would, without loading the
+// GeoIP databases nor the bot signatures (rules scoped by country
+// requiring the geoip section), AccessLog being left to the caller
+func (cf *ConfigFile) Config() (*Config, error) {
+
+	conf := &Config{}
+
+	if err := cf.Apply(conf); err != nil {
+		return nil, err
+	}
+
+	if err := conf.validate(); err != nil {
+		return nil, fmt.Errorf("monitor.ConfigFile.Config: %v", err)
+	}
+
+	return conf, nil
+}
+
+// Checks cf as Config does, its components being neither started nor read
+func (cf *ConfigFile) Validate() error {
+
+	_, err := cf.Config()
+	return err
+}
@@ -0,0 +1,276 @@
+package monitor
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"w3chttpd"
+)
+
+func TestDurationJSON(t *testing.T) {
+
+	var d Duration
+	if err := json.Unmarshal([]byte(`"1m30s"`), &d); err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Duration(d) != 90*time.Second {
+		t.Errorf("Duration differs. Want %v, got %v", 90*time.Second,
+			time.Duration(d))
+	}
+
+	data, _ := json.Marshal(d)
+	if string(data) != `"1m30s"` {
+		t.Errorf("Encoded duration differs. Want %s, got %s", `"1m30s"`, data)
+	}
+
+	for _, invalid := range []string{`90`, `"90"`, `"soon"`} {
+		if err := json.Unmarshal([]byte(invalid), &d); err == nil {
+			t.Errorf("Duration %s should fail", invalid)
+		}
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+
+	cf, err := ReadConfigFile(strings.NewReader(`{
+		"source": {"path": "/var/log/access.log", "filter": "status >= 400"},
+		"alerts": {
+			"threshold": 1000,
+			"rules": [{
+				"name": "errors",
+				"scope": "client",
+				"traffic_window": "30s",
+				"threshold": 100,
+				"filter": "status >= 500",
+				"exclude_bots": true
+			}]
+		},
+		"outputs": {"policy": "coalesce"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &Config{Delay: time.Millisecond}
+	if err := cf.Apply(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Defaults of the example command
+	if conf.ReadFrequency != time.Second ||
+		conf.MetricsFrequency != 10*time.Second ||
+		conf.TrafficWindow != 120*time.Second || conf.BufferPoolSize != 20 {
+		t.Errorf("Defaults differ. Got %+v", conf)
+	}
+
+	if conf.Threshold != 1000 || conf.Filter.String() != "status >= 400" ||
+		conf.OutputPolicy != OutputCoalesce || conf.Delay != time.Millisecond {
+		t.Errorf("Settings differ. Got %+v", conf)
+	}
+
+	if len(conf.AlertRules) != 1 {
+		t.Fatalf("Length of alert rules differs. Want %d, got %d",
+			1, len(conf.AlertRules))
+	}
+
+	rule := conf.AlertRules[0]
+	if rule.Scope != ScopeClient || rule.TrafficWindow != 30*time.Second ||
+		rule.Filter.String() != "status >= 500" || !rule.ExcludeBots {
+		t.Errorf("Alert rule differs. Got %+v", rule)
+	}
+
+	if err := conf.validate(); err != nil {
+		t.Errorf("Config should be valid: %v", err)
+	}
+
+	if _, err := ReadConfigFile(strings.NewReader(
+		`{"alerts": {"treshold": 1000}}`)); err == nil {
+		t.Errorf("Unknown setting should fail")
+	}
+}
+
+func TestConfigFileApplyInvalid(t *testing.T) {
+
+	tests := []string{
+		`{"clients": {"trusted_proxies": ["10.0.0.0/33"]}}`,
+		`{"clients": {"networks": [{"name": "lan", "prefixes": ["lan"]}]}}`,
+		`{"geoip": {}}`,
+		`{"bots": {}}`,
+		`{"outputs": {"statsd": {"addr": "localhost:8125",
+			"format": "graphite"}}}`,
+		`{"outputs": {"otlp": {"endpoint": "localhost:4318",
+			"protocol": "thrift"}}}`,
+		`{"outputs": {"webhooks": [{"name": "hook"}]}}`,
+		`{"outputs": {"webhooks": [{"name": "a", "url": "http://a"},
+			{"name": "a", "url": "http://b"}]}}`,
+		`{"outputs": {"emails": [{"name": "ops", "addr": "smtp:25",
+			"from": "httpmonitor", "to": ["ops"], "tls": "ssl"}]}}`,
+		`{"outputs": {"emails": [{"name": "ops", "addr": "smtp:25"}]}}`,
+		`{"outputs": {"alert_manager": {"routes": [{"notifier": "pager"}]}}}`,
+		`{"outputs": {"alert_manager": {"group_by": ["host"]}}}`,
+		`{"source": {"read_frequency": "0s"}}`,
+		`{"source": {"buffer_size": -1}}`,
+		`{"source": {"late_policy": "ignore"}}`,
+		`{"source": {"filter": "status >>"}}`,
+		`{"metrics": {"filter": "("}}`,
+		`{"outputs": {"policy": "spill"}}`,
+		`{"outputs": {"display": "html"}}`,
+		`{"alerts": {"rules": [{"name": "a", "scope": "resource"}]}}`,
+		`{"alerts": {"rules": [{"scope": "client"}]}}`,
+		`{"alerts": {"rules": [{"name": "a", "scope": "client"},
+			{"name": "a", "scope": "section"}]}}`,
+		`{"alerts": {"rules": [{"name": "a", "scope": "client",
+			"filter": "=="}]}}`,
+	}
+
+	for _, test := range tests {
+
+		cf, err := ReadConfigFile(strings.NewReader(test))
+		if err != nil {
+			t.Fatalf("ReadConfigFile(%s): %v", test, err)
+		}
+
+		conf := &Config{Threshold: 42}
+		if err := cf.Apply(conf); err == nil {
+			t.Errorf("Config file %s should fail", test)
+		}
+
+		if conf.Threshold != 42 || conf.file != nil {
+			t.Errorf("Config should be untouched by %s", test)
+		}
+	}
+}
+
+func TestConfigFileSections(t *testing.T) {
+
+	signatures := filepath.Join(t.TempDir(), "bots.txt")
+	err := os.WriteFile(signatures, []byte("good internalchecker\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cf, err := ReadConfigFile(strings.NewReader(`{
+		"clients": {
+			"ipv4_prefix": 24,
+			"networks": [{"name": "lan", "prefixes": ["10.0.0.0/8"],
+				"exclude": true}],
+			"trusted_proxies": ["192.168.0.0/16"],
+			"forwarded_field": 1
+		},
+		"geoip": {"country_db": "GeoLite2-Country.mmdb", "top": 5},
+		"bots": {"signatures": "` + signatures + `"},
+		"sessions": {"timeout": "15m"},
+		"top_k": {"k": 5},
+		"alerts": {
+			"rules": [{"name": "countries", "scope": "country",
+				"traffic_window": "1m", "threshold": 1000,
+				"exclude_networks": ["lan"]}]
+		},
+		"outputs": {
+			"prometheus": {"max_sections": 20},
+			"statsd": {"addr": "localhost:8125", "format": "dogstatsd"},
+			"otlp": {"endpoint": "localhost:4317", "protocol": "grpc"},
+			"webhooks": [{"name": "hook", "url": "http://localhost/hook"}],
+			"emails": [{"name": "ops", "addr": "localhost:25",
+				"from": "httpmonitor@localhost", "to": ["ops@localhost"],
+				"tls": "starttls", "digest": "5m"}],
+			"alert_manager": {"routes": [{"severity": "page",
+				"notifier": "ops"}]}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cf.Validate(); err != nil {
+		t.Errorf("Config file should be valid: %v", err)
+	}
+
+	conf := &Config{}
+	if err := cf.Apply(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Clients == nil || conf.Clients.IPv4Prefix != 24 ||
+		len(conf.Clients.Networks) != 1 ||
+		len(conf.Clients.TrustedProxies) != 1 ||
+		conf.Clients.ForwardedField != 1 {
+		t.Errorf("Clients differ. Got %+v", conf.Clients)
+	}
+
+	if conf.GeoIP == nil || conf.GeoIP.CountryDB != "GeoLite2-Country.mmdb" ||
+		conf.Bots == nil || conf.Sessions == nil ||
+		conf.Sessions.Timeout != 15*time.Minute || conf.TopK == nil ||
+		conf.TopK.K != 5 {
+		t.Errorf("Sections differ. Got %+v", conf)
+	}
+
+	if conf.Exporter == nil || conf.Exporter.MaxSections != 20 ||
+		conf.Statsd == nil || conf.Statsd.Format != FormatDogStatsd ||
+		conf.OTLP == nil || conf.OTLP.Protocol != OTLPGRPC {
+		t.Errorf("Exporters differ. Got %+v", conf)
+	}
+
+	// Routed alerts and digest metrics
+	if len(conf.AlertsSubscribers) != 1 || len(conf.MetricsSubscribers) != 1 {
+		t.Errorf("Subscribers differ. Want %d and %d, got %d and %d",
+			1, 1, len(conf.AlertsSubscribers), len(conf.MetricsSubscribers))
+	}
+
+	// Geoip, statsd, otlp, webhook and email
+	if len(conf.closers) != 5 {
+		t.Errorf("Length of closers differs. Want %d, got %d",
+			5, len(conf.closers))
+	}
+
+	// Signatures are read when the monitor starts
+	e := &w3chttpd.Entry{UserAgent: []byte("InternalChecker/1.0")}
+	if err := conf.Bots.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := conf.Bots.Classify(e); c != ClassGoodBot {
+		t.Errorf("Class differs. Want %s, got %s", ClassGoodBot, c)
+	}
+}
+
+func TestConfigFileValidate(t *testing.T) {
+
+	tests := []struct {
+		data  string
+		valid bool
+	}{
+		{`{"alerts": {"rules": [{"name": "a", "scope": "country",
+			"traffic_window": "1m"}]}}`, false},
+		{`{"geoip": {"asn_db": "GeoLite2-ASN.mmdb"},
+			"alerts": {"rules": [{"name": "a", "scope": "country",
+			"traffic_window": "1m"}]}}`, false},
+		{`{"geoip": {"country_db": "GeoLite2-Country.mmdb"},
+			"alerts": {"rules": [{"name": "a", "scope": "country",
+			"traffic_window": "1m"}]}}`, true},
+		{`{"alerts": {"rules": [{"name": "a", "scope": "client",
+			"traffic_window": "1m", "exclude_networks": ["lan"]}]}}`, false},
+		{`{"clients": {"networks": [{"name": "lan",
+			"prefixes": ["10.0.0.0/8"]}]},
+			"alerts": {"rules": [{"name": "a", "scope": "client",
+			"traffic_window": "1m", "exclude_networks": ["lan"]}]}}`, true},
+	}
+
+	for _, test := range tests {
+
+		cf, err := ReadConfigFile(strings.NewReader(test.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cf.Validate(); (err == nil) != test.valid {
+			t.Errorf("Validation of %s differs. Want valid %v, got %v",
+				test.data, test.valid, err)
+		}
+	}
+}
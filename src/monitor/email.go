@@ -0,0 +1,391 @@
+package monitor
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type TLSMode int
+
+const (
+	TLSNone     TLSMode = iota
+	TLSStartTLS TLSMode = iota
+	TLSImplicit TLSMode = iota
+)
+
+func (tm TLSMode) String() string {
+
+	switch tm {
+
+	case TLSNone:
+		return "none"
+
+	case TLSStartTLS:
+		return "starttls"
+
+	case TLSImplicit:
+		return "implicit"
+
+	default:
+		return fmt.Sprintf("tls(%d)", int(tm))
+	}
+}
+
+func ParseTLSMode(name string) (TLSMode, error) {
+
+	for tm := TLSNone; tm <= TLSImplicit; tm++ {
+		if tm.String() == name {
+			return tm, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown TLS mode %q", name)
+}
+
+const (
+	defaultEmailSubject = `[httpmonitor] {{len .Alerts}} alert(s){{if .Group}} for {{.Group}}{{end}}`
+	defaultEmailBody    = `{{range .Alerts}}{{.}}
+{{end}}`
+)
+
+// Data given to SubjectTemplate and BodyTemplate
+// Metrics is the last snapshot given to UpdateMetrics (nil if none)
+type EmailData struct {
+	Group   string
+	Alerts  []*Alert
+	Metrics *Metrics
+}
+
+// Messages are sent by a worker so Notify never blocks
+// If Digest is set, every alert notified during Digest is batched into
+// one message with the last Metrics snapshot attached
+// Timeout (30 seconds by default) bounds the connection and the whole
+// SMTP exchange of every message
+type EmailNotifier struct {
+	Addr            string
+	Username        string
+	Password        string
+	From            string
+	To              []string
+	TLS             TLSMode
+	TLSConfig       *tls.Config
+	SubjectTemplate string
+	BodyTemplate    string
+	Digest          time.Duration
+	QueueSize       int
+	Timeout         time.Duration
+
+	// Internal parameters
+	once      sync.Once
+	closeOnce sync.Once
+	err       error
+	subject   *template.Template
+	body      *template.Template
+	mu        sync.Mutex
+	metrics   *Metrics
+	pending   chan *EmailData
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func (en *EmailNotifier) start() error {
+
+	en.once.Do(func() {
+
+		subject, body := en.SubjectTemplate, en.BodyTemplate
+		if subject == "" {
+			subject = defaultEmailSubject
+		}
+		if body == "" {
+			body = defaultEmailBody
+		}
+
+		en.subject, en.err = template.New("subject").Parse(subject)
+		if en.err != nil {
+			en.err = fmt.Errorf("template.Parse: %v", en.err)
+			return
+		}
+
+		en.body, en.err = template.New("body").Parse(body)
+		if en.err != nil {
+			en.err = fmt.Errorf("template.Parse: %v", en.err)
+			return
+		}
+
+		if en.QueueSize <= 0 {
+			en.QueueSize = 100
+		}
+
+		if en.Timeout <= 0 {
+			en.Timeout = 30 * time.Second
+		}
+
+		en.pending = make(chan *EmailData, en.QueueSize)
+		en.stop = make(chan struct{})
+		en.done = make(chan struct{})
+
+		go en.run()
+	})
+
+	return en.err
+}
+
+// Subscriber keeping the last Metrics for digests (see
+// Monitor.SubscribeMetrics), only the newest Metrics being queued
+func (en *EmailNotifier) MetricsSubscriber() *MetricsSubscriber {
+
+	return &MetricsSubscriber{
+		Handler: en.UpdateMetrics,
+		Buffer:  1,
+		Policy:  OutputDropOldest,
+	}
+}
+
+func (en *EmailNotifier) UpdateMetrics(m *Metrics) {
+
+	en.mu.Lock()
+	defer en.mu.Unlock()
+
+	en.metrics = m
+}
+
+func (en *EmailNotifier) lastMetrics() *Metrics {
+
+	en.mu.Lock()
+	defer en.mu.Unlock()
+
+	return en.metrics
+}
+
+func (en *EmailNotifier) Notify(group string, alerts []*Alert) error {
+
+	if err := en.start(); err != nil {
+		return err
+	}
+
+	select {
+	case en.pending <- &EmailData{Group: group, Alerts: alerts}:
+		return nil
+	default:
+		return fmt.Errorf("email queue full, %d alerts dropped", len(alerts))
+	}
+}
+
+// Pending digest is sent before returning, closing again having no
+// effect
+func (en *EmailNotifier) Close() {
+
+	if en.start() != nil {
+		return
+	}
+
+	en.closeOnce.Do(func() { close(en.stop) })
+	<-en.done
+}
+
+func (en *EmailNotifier) run() {
+
+	defer close(en.done)
+
+	var tick <-chan time.Time
+	if en.Digest > 0 {
+		ticker := time.NewTicker(en.Digest)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	digest := &EmailData{}
+
+	flush := func() {
+
+		if len(digest.Alerts) == 0 {
+			return
+		}
+
+		digest.Metrics = en.lastMetrics()
+		if err := en.send(digest); err != nil {
+			log.Printf("EmailNotifier.send: %v", err)
+		}
+		digest = &EmailData{}
+	}
+
+	for {
+		select {
+
+		case data := <-en.pending:
+			if en.Digest <= 0 {
+				if err := en.send(data); err != nil {
+					log.Printf("EmailNotifier.send: %v", err)
+				}
+				continue
+			}
+			digest.Alerts = append(digest.Alerts, data.Alerts...)
+
+		case <-tick:
+			flush()
+
+		case <-en.stop:
+			for {
+				select {
+				case data := <-en.pending:
+					digest.Alerts = append(digest.Alerts, data.Alerts...)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (en *EmailNotifier) message(data *EmailData) ([]byte, error) {
+
+	subject := bytes.Buffer{}
+	if err := en.subject.Execute(&subject, data); err != nil {
+		return nil, fmt.Errorf("template.Execute: %v", err)
+	}
+
+	// Rule names and keys must not inject headers
+	subjectLine := strings.TrimSpace(subject.String())
+	if strings.ContainsAny(subjectLine, "\r\n") {
+		return nil, fmt.Errorf("subject %q contains a line break", subjectLine)
+	}
+
+	body := bytes.Buffer{}
+	if err := en.body.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("template.Execute: %v", err)
+	}
+
+	msg := bytes.Buffer{}
+	fmt.Fprintf(&msg, "From: %s\r\n", en.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(en.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n",
+		mime.QEncoding.Encode("utf-8", subjectLine))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+
+	if data.Metrics == nil {
+		fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		msg.Write(body.Bytes())
+		return msg.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n",
+		mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("multipart.Writer.CreatePart: %v", err)
+	}
+	part.Write(body.Bytes())
+
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"text/plain; charset=utf-8"},
+		"Content-Disposition": {`attachment; filename="metrics.txt"`},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("multipart.Writer.CreatePart: %v", err)
+	}
+	part.Write([]byte(data.Metrics.String()))
+
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("multipart.Writer.Close: %v", err)
+	}
+
+	return msg.Bytes(), nil
+}
+
+func (en *EmailNotifier) send(data *EmailData) error {
+
+	msg, err := en.message(data)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(en.Addr)
+	if err != nil {
+		return fmt.Errorf("net.SplitHostPort: %v", err)
+	}
+
+	tlsConfig := en.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	deadline := time.Now().Add(en.Timeout)
+	dialer := &net.Dialer{Deadline: deadline}
+
+	var conn net.Conn
+	if en.TLS == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", en.Addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", en.Addr)
+	}
+	if err != nil {
+		return fmt.Errorf("dial: %v", err)
+	}
+
+	// A server not answering fails the message instead of the worker
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return fmt.Errorf("net.Conn.SetDeadline: %v", err)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp.NewClient: %v", err)
+	}
+	defer c.Close()
+
+	if en.TLS == TLSStartTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("smtp.Client.StartTLS: %v", err)
+		}
+	}
+
+	if en.Username != "" {
+		auth := smtp.PlainAuth("", en.Username, en.Password, host)
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("smtp.Client.Auth: %v", err)
+		}
+	}
+
+	if err := c.Mail(en.From); err != nil {
+		return fmt.Errorf("smtp.Client.Mail: %v", err)
+	}
+
+	for _, to := range en.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("smtp.Client.Rcpt: %v", err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp.Client.Data: %v", err)
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("smtp.Client.Data.Write: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp.Client.Data.Close: %v", err)
+	}
+
+	return c.Quit()
+}
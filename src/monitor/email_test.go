@@ -0,0 +1,247 @@
+package monitor
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Minimal in-process SMTP server recording received messages
+type fakeSMTPServer struct {
+	sync.Mutex
+	ln       net.Listener
+	messages []string
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+
+	s := &fakeSMTPServer{ln: ln}
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeSMTPServer) serve() {
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+
+	defer conn.Close()
+
+	rd := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+
+		switch {
+
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+
+		case cmd == "DATA":
+			reply("354 go ahead")
+
+			msg := ""
+			for {
+				l, err := rd.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg += l
+			}
+
+			s.Lock()
+			s.messages = append(s.messages, msg)
+			s.Unlock()
+			reply("250 ok")
+
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) received() []string {
+
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]string{}, s.messages...)
+}
+
+func TestEmailNotifierNotify(t *testing.T) {
+
+	s := newFakeSMTPServer(t)
+	defer s.ln.Close()
+
+	en := &EmailNotifier{
+		Addr:            s.ln.Addr().String(),
+		From:            "monitor@example.com",
+		To:              []string{"ops@example.com"},
+		SubjectTemplate: `{{(index .Alerts 0).Rule}} alert`,
+	}
+
+	en.Notify("rule=client", []*Alert{
+		&Alert{Timestamp: time.Unix(1, 0), Total: 500, Status: StatusExceed,
+			Rule: "client", Key: "10.0.0.1"},
+	})
+	en.Close()
+
+	messages := s.received()
+	if len(messages) != 1 {
+		t.Fatalf("Messages differ. Want %d, got %d", 1, len(messages))
+	}
+
+	if !strings.Contains(messages[0], "Subject: client alert\r\n") {
+		t.Errorf("Subject not found in message \"%s\"", messages[0])
+	}
+
+	if !strings.Contains(messages[0], "High traffic generated an alert") {
+		t.Errorf("Alert not found in message \"%s\"", messages[0])
+	}
+}
+
+func TestEmailNotifierDigest(t *testing.T) {
+
+	s := newFakeSMTPServer(t)
+	defer s.ln.Close()
+
+	en := &EmailNotifier{
+		Addr:   s.ln.Addr().String(),
+		From:   "monitor@example.com",
+		To:     []string{"ops@example.com"},
+		Digest: time.Hour,
+	}
+
+	// Metrics of the monitor are kept for the digest
+	out := &output[*Metrics]{}
+	en.MetricsSubscriber().subscribe(out)
+	out.publish(&Metrics{RequestCount: 42})
+	out.flush(time.Now().Add(time.Minute))
+
+	en.Notify("rule=client", []*Alert{&Alert{Status: StatusExceed, Rule: "client"}})
+	en.Notify("rule=section", []*Alert{&Alert{Status: StatusExceed, Rule: "section"}})
+	en.Close()
+
+	// Closing again has no effect
+	en.Close()
+
+	messages := s.received()
+	if len(messages) != 1 {
+		t.Fatalf("Alerts should be batched in one message. Got %d messages",
+			len(messages))
+	}
+
+	if !strings.Contains(messages[0], "Subject: [httpmonitor] 2 alert(s)") {
+		t.Errorf("Subject not found in message \"%s\"", messages[0])
+	}
+
+	if !strings.Contains(messages[0], `filename="metrics.txt"`) ||
+		!strings.Contains(messages[0], "Requests: 42") {
+		t.Errorf("Metrics attachment not found in message \"%s\"", messages[0])
+	}
+}
+
+func TestEmailNotifierSubject(t *testing.T) {
+
+	en := &EmailNotifier{SubjectTemplate: `{{(index .Alerts 0).Key}}`}
+	if err := en.start(); err != nil {
+		t.Fatalf("EmailNotifier.start: %v", err)
+	}
+	defer en.Close()
+
+	msg, err := en.message(&EmailData{
+		Alerts: []*Alert{&Alert{Key: "/café"}},
+	})
+	if err != nil {
+		t.Fatalf("EmailNotifier.message: %v", err)
+	}
+
+	if !strings.Contains(string(msg), "Subject: =?utf-8?q?/caf=C3=A9?=\r\n") {
+		t.Errorf("Encoded subject not found in message \"%s\"", msg)
+	}
+
+	// Keys come from the log
+	_, err = en.message(&EmailData{
+		Alerts: []*Alert{&Alert{Key: "a\r\nBcc: victim@example.com"}},
+	})
+	if err == nil {
+		t.Errorf("Subject with a line break should be rejected")
+	}
+}
+
+func TestEmailNotifierTimeout(t *testing.T) {
+
+	// Accepts connections but never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	en := &EmailNotifier{
+		Addr:    ln.Addr().String(),
+		From:    "monitor@example.com",
+		To:      []string{"ops@example.com"},
+		Timeout: 50 * time.Millisecond,
+	}
+	if err := en.start(); err != nil {
+		t.Fatalf("EmailNotifier.start: %v", err)
+	}
+	defer en.Close()
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- en.send(&EmailData{Alerts: []*Alert{&Alert{}}})
+	}()
+
+	select {
+	case err := <-sent:
+		if err == nil {
+			t.Errorf("Sending to a server not answering should fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Sending did not time out")
+	}
+}
@@ -2,7 +2,6 @@ package monitor
 
 import (
 	"sync"
-	"time"
 	"w3chttpd"
 )
 
@@ -48,110 +47,40 @@ func (eq *entryQueue) add(entry *w3chttpd.Entry) {
 	eq.entries = append(eq.entries, entry)
 }
 
-func (eq *entryQueue) getEntriesInWindow(
-	start, end time.Time) []*w3chttpd.Entry {
+// The n first entries are removed and recycled
+func (eq *entryQueue) removeFirst(n int) {
 
-	eq.RLock()
-	defer eq.RUnlock()
-
-	i := 0
-	j := len(eq.entries) - 1
-
-	for i < len(eq.entries) && start.After(eq.entries[i].Timestamp) {
-		i++
-	}
-
-	if i == len(eq.entries) {
-		return nil
-	}
-
-	for j >= i && eq.entries[j].Timestamp.After(end) {
-		j--
-	}
-
-	if j < i {
-		return nil
-	}
-
-	return eq.entries[i : j+1]
-}
-
-func (eq *entryQueue) next(entry *w3chttpd.Entry) *w3chttpd.Entry {
-
-	eq.RLock()
-	defer eq.RUnlock()
-
-	if entry == nil {
-		return nil
-	}
-
-	for i, e := range eq.entries {
-
-		if e == entry {
-			if i+1 < len(eq.entries) {
-				return eq.entries[i+1]
-			}
-			return nil
-		}
-	}
-
-	return nil
-}
-
-func (eq *entryQueue) entriesWithStartEntry(
-	entry *w3chttpd.Entry) []*w3chttpd.Entry {
-
-	eq.RLock()
-	defer eq.RUnlock()
+	eq.Lock()
+	defer eq.Unlock()
 
-	if entry == nil {
-		return nil
+	for i := 0; i < n; i++ {
+		eq.epool.recycle(eq.entries[i])
+		eq.entries[i] = nil
 	}
 
-	for i, e := range eq.entries {
-
-		if e == entry {
-			return eq.entries[i:]
-		}
-
-	}
-	return nil
+	eq.entries = eq.entries[n:]
 }
 
-func (eq *entryQueue) removeOutdatedEntries(edge *w3chttpd.Entry,
-	startMetrics, startTrafficWindow time.Time) int {
-
-	var min time.Time
-
-	if edge == nil {
-		return 0
-	}
-
-	if startMetrics.Before(startTrafficWindow) {
-		min = startMetrics
-	} else {
-		min = startTrafficWindow
-	}
+// Entries from start not matching the filter are removed and recycled
+func (eq *entryQueue) filterFrom(start int, f *Filter) {
 
 	eq.Lock()
 	defer eq.Unlock()
 
-	start := 0
-	for _, e := range eq.entries {
+	kept := start
+	for _, e := range eq.entries[start:] {
 
-		if e != edge && e.Timestamp.Before(min) {
-			start++
+		if f.Match(e) {
+			eq.entries[kept] = e
+			kept++
 		} else {
-			break
+			eq.epool.recycle(e)
 		}
 	}
 
-	for i := 0; i < start; i++ {
-		eq.epool.recycle(eq.entries[i])
+	for i := kept; i < len(eq.entries); i++ {
 		eq.entries[i] = nil
 	}
 
-	eq.entries = eq.entries[start:]
-
-	return start
+	eq.entries = eq.entries[:kept]
 }
@@ -0,0 +1,396 @@
+package monitor
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"w3chttpd"
+)
+
+// Expressions over entry fields, for instance:
+// method == "POST" && section == "api" && status >= 500
+//
+// Fields: method, resource, section, protocol, ip, user (strings)
+// and status, size (integers)
+// Operators: == != < <= > >= =~ (regexp match), && || ! and parentheses
+type Filter struct {
+	expr string
+	root filterNode
+}
+
+func CompileFilter(expr string) (*Filter, error) {
+
+	p := &filterParser{}
+	if err := p.tokenize(expr); err != nil {
+		return nil, err
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+
+	return &Filter{expr, root}, nil
+}
+
+// A nil filter matches every entry
+func (f *Filter) Match(e *w3chttpd.Entry) bool {
+
+	if f == nil {
+		return true
+	}
+	return f.root.match(e)
+}
+
+func (f *Filter) String() string {
+
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+type filterNode interface {
+	match(e *w3chttpd.Entry) bool
+}
+
+type andNode struct{ left, right filterNode }
+type orNode struct{ left, right filterNode }
+type notNode struct{ node filterNode }
+
+func (n *andNode) match(e *w3chttpd.Entry) bool {
+	return n.left.match(e) && n.right.match(e)
+}
+
+func (n *orNode) match(e *w3chttpd.Entry) bool {
+	return n.left.match(e) || n.right.match(e)
+}
+
+func (n *notNode) match(e *w3chttpd.Entry) bool {
+	return !n.node.match(e)
+}
+
+type stringCompare struct {
+	field func(e *w3chttpd.Entry) string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (n *stringCompare) match(e *w3chttpd.Entry) bool {
+
+	v := n.field(e)
+
+	switch n.op {
+	case "==":
+		return v == n.value
+	case "!=":
+		return v != n.value
+	case "<":
+		return v < n.value
+	case "<=":
+		return v <= n.value
+	case ">":
+		return v > n.value
+	case ">=":
+		return v >= n.value
+	default: // =~
+		return n.re.MatchString(v)
+	}
+}
+
+type intCompare struct {
+	field func(e *w3chttpd.Entry) int
+	op    string
+	value int
+}
+
+func (n *intCompare) match(e *w3chttpd.Entry) bool {
+
+	v := n.field(e)
+
+	switch n.op {
+	case "==":
+		return v == n.value
+	case "!=":
+		return v != n.value
+	case "<":
+		return v < n.value
+	case "<=":
+		return v <= n.value
+	case ">":
+		return v > n.value
+	default: // >=
+		return v >= n.value
+	}
+}
+
+var stringFields = map[string]func(e *w3chttpd.Entry) string{
+	"method":   func(e *w3chttpd.Entry) string { return string(e.Req.Method) },
+	"resource": func(e *w3chttpd.Entry) string { return string(e.Req.Resource) },
+	"section":  func(e *w3chttpd.Entry) string { return entrySection(e) },
+	"protocol": func(e *w3chttpd.Entry) string { return string(e.Req.Protocol) },
+	"ip":       func(e *w3chttpd.Entry) string { return string(e.Ip) },
+	"user":     func(e *w3chttpd.Entry) string { return string(e.UserId) },
+}
+
+var intFields = map[string]func(e *w3chttpd.Entry) int{
+	"status": func(e *w3chttpd.Entry) int { return e.StatusCode },
+	"size":   func(e *w3chttpd.Entry) int { return e.Size },
+}
+
+type tokenKind int
+
+const (
+	tokenIdent  tokenKind = iota
+	tokenString tokenKind = iota
+	tokenNumber tokenKind = iota
+	tokenOp     tokenKind = iota
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+var filterOps = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "<", ">", "!", "(", ")"}
+
+func (p *filterParser) tokenize(expr string) error {
+
+	for i := 0; i < len(expr); {
+
+		c := rune(expr[i])
+
+		switch {
+
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '"':
+			j := i + 1
+			for j < len(expr) && expr[j] != '"' {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				return fmt.Errorf("unterminated string at %d", i)
+			}
+
+			s, err := strconv.Unquote(expr[i : j+1])
+			if err != nil {
+				return fmt.Errorf("strconv.Unquote: %v", err)
+			}
+			p.tokens = append(p.tokens, filterToken{tokenString, s})
+			i = j + 1
+
+		case unicode.IsDigit(c):
+			j := i
+			for j < len(expr) && unicode.IsDigit(rune(expr[j])) {
+				j++
+			}
+			p.tokens = append(p.tokens, filterToken{tokenNumber, expr[i:j]})
+			i = j
+
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(expr) && (unicode.IsLetter(rune(expr[j])) ||
+				unicode.IsDigit(rune(expr[j])) || expr[j] == '_') {
+				j++
+			}
+			p.tokens = append(p.tokens, filterToken{tokenIdent, expr[i:j]})
+			i = j
+
+		default:
+			found := false
+			for _, op := range filterOps {
+				if strings.HasPrefix(expr[i:], op) {
+					p.tokens = append(p.tokens, filterToken{tokenOp, op})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *filterParser) peekOp(op string) bool {
+
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOp &&
+		p.tokens[p.pos].text == op
+}
+
+func (p *filterParser) next() (filterToken, error) {
+
+	if p.pos == len(p.tokens) {
+		return filterToken{}, fmt.Errorf("unexpected end of expression")
+	}
+
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekOp("||") {
+		p.pos++
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekOp("&&") {
+		p.pos++
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+
+	if p.peekOp("!") {
+		p.pos++
+
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node}, nil
+	}
+
+	if p.peekOp("(") {
+		p.pos++
+
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.peekOp(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+
+		return node, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if field.kind != tokenIdent {
+		return nil, fmt.Errorf("expected field, got %q", field.text)
+	}
+
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.text {
+	case "==", "!=", "<", "<=", ">", ">=", "=~":
+	default:
+		return nil, fmt.Errorf("expected comparison operator, got %q", op.text)
+	}
+
+	// Quoted operators are strings
+	if op.kind != tokenOp {
+		return nil, fmt.Errorf("expected comparison operator, got string %q",
+			op.text)
+	}
+
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := stringFields[field.text]; ok {
+
+		if value.kind != tokenString {
+			return nil, fmt.Errorf("%s expects a string, got %q",
+				field.text, value.text)
+		}
+
+		node := &stringCompare{field: f, op: op.text, value: value.text}
+
+		if op.text == "=~" {
+			node.re, err = regexp.Compile(value.text)
+			if err != nil {
+				return nil, fmt.Errorf("regexp.Compile: %v", err)
+			}
+		}
+
+		return node, nil
+	}
+
+	if f, ok := intFields[field.text]; ok {
+
+		if value.kind != tokenNumber {
+			return nil, fmt.Errorf("%s expects a number, got %q",
+				field.text, value.text)
+		}
+
+		if op.text == "=~" {
+			return nil, fmt.Errorf("=~ only applies to string fields")
+		}
+
+		n, err := strconv.Atoi(value.text)
+		if err != nil {
+			return nil, fmt.Errorf("strconv.Atoi: %v", err)
+		}
+
+		return &intCompare{f, op.text, n}, nil
+	}
+
+	return nil, fmt.Errorf("unknown field %q", field.text)
+}
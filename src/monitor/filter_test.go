@@ -0,0 +1,109 @@
+package monitor
+
+import (
+	"sync"
+	"testing"
+	"w3chttpd"
+)
+
+func TestCompileFilter(t *testing.T) {
+
+	invalid := []string{
+		``,
+		`method ==`,
+		`method == 500`,
+		`status == "500"`,
+		`status =~ "5.."`,
+		`unknown == "a"`,
+		`(method == "GET"`,
+		`method == "GET" extra`,
+		`method == "GET" & status == 200`,
+		`resource =~ "("`,
+		`status "==" 500`,
+		`method "=~" "GE"`,
+	}
+
+	for _, expr := range invalid {
+		if _, err := CompileFilter(expr); err == nil {
+			t.Errorf("Expression \"%s\" should be rejected", expr)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+
+	e := &w3chttpd.Entry{
+		Ip:         []byte("10.0.0.1"),
+		Req:        w3chttpd.Request{Method: []byte("POST"), Resource: []byte("/api/users")},
+		StatusCode: 503,
+		Size:       120,
+	}
+
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{`method == "POST" && section == "api" && status >= 500`, true},
+		{`method == "GET" || status < 500`, false},
+		{`!(method == "GET") && size > 100`, true},
+		{`method == "GET" || section == "api" && status == 503`, true},
+		{`(method == "GET" || section == "api") && status != 503`, false},
+		{`resource =~ "^/api/" && ip != "10.0.0.2"`, true},
+		{`user == ""`, true},
+	}
+
+	for _, test := range tests {
+
+		f, err := CompileFilter(test.expr)
+		if err != nil {
+			t.Errorf("CompileFilter(%s): %v", test.expr, err)
+			continue
+		}
+
+		if f.Match(e) != test.expected {
+			t.Errorf("Match of \"%s\" differs. Want %v, got %v",
+				test.expr, test.expected, !test.expected)
+		}
+	}
+
+	var f *Filter
+	if !f.Match(e) {
+		t.Error("A nil filter should match every entry")
+	}
+}
+
+func TestFilterFrom(t *testing.T) {
+
+	eq := &entryQueue{
+		&sync.RWMutex{},
+		make([]*w3chttpd.Entry, 0),
+		&entryPool{},
+	}
+
+	eq.epool.init(10)
+
+	for _, status := range []int{500, 200, 404, 503, 200} {
+		eq.add(&w3chttpd.Entry{StatusCode: status})
+	}
+
+	f, _ := CompileFilter(`status >= 500`)
+	eq.filterFrom(1, f)
+
+	expected := []int{500, 503}
+	if len(eq.entries) != len(expected) {
+		t.Fatalf("Length of queue differs. Want %d, got %d",
+			len(expected), len(eq.entries))
+	}
+
+	for i, status := range expected {
+		if eq.entries[i].StatusCode != status {
+			t.Errorf("Entry differs. Want %d, got %d",
+				status, eq.entries[i].StatusCode)
+		}
+	}
+
+	if len(eq.epool.pool) != 3 {
+		t.Errorf("Filtered entries should be recycled. Got %d",
+			len(eq.epool.pool))
+	}
+}
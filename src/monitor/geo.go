@@ -0,0 +1,296 @@
+package monitor
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"w3chttpd"
+)
+
+// Key of entries without known country in ScopeCountry rules
+const unknownCountry = "unknown"
+
+// Size above which the cache of looked up addresses is reset
+const geoCacheSize = 65536
+
+type GeoRank struct {
+	HitCount int
+	Key      string
+	Name     string
+}
+
+type geoRanking []GeoRank
+
+func (r geoRanking) Len() int { return len(r) }
+func (r geoRanking) Less(i, j int) bool {
+	if r[i].HitCount != r[j].HitCount {
+		return r[i].HitCount > r[j].HitCount
+	}
+	return r[i].Key < r[j].Key
+}
+func (r geoRanking) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+
+type geoInfo struct {
+	country string
+	asn     uint64
+	org     string
+}
+
+type geoDB struct {
+	path    string
+	modTime time.Time
+	size    int64
+	r       *mmdbReader
+}
+
+// Offline enrichment of entries with the country and ASN of their client
+// from local MaxMind databases (GeoLite2 Country and ASN, both optional)
+// Files are reloaded when they change (checked every ReloadFrequency,
+// 1 minute by default), an invalid file keeping the previous database
+// Top limits the countries and ASNs ranked in Metrics (10 by default)
+type GeoIP struct {
+	CountryDB       string
+	ASNDB           string
+	ReloadFrequency time.Duration
+	Top             int
+
+	// Internal parameters
+	once    sync.Once
+	err     error
+	mu      sync.RWMutex
+	country *geoDB
+	asn     *geoDB
+	cache   map[netip.Addr]geoInfo
+	done    chan struct{}
+	closing sync.Once
+}
+
+// Loads the databases and starts watching their files,
+// returns the first loading error
+func (g *GeoIP) start() error {
+
+	g.once.Do(func() {
+
+		if g.ReloadFrequency <= 0 {
+			g.ReloadFrequency = time.Minute
+		}
+
+		if g.Top <= 0 {
+			g.Top = 10
+		}
+
+		g.cache = make(map[netip.Addr]geoInfo)
+		g.done = make(chan struct{})
+
+		if g.CountryDB != "" {
+			g.country = &geoDB{path: g.CountryDB}
+		}
+
+		if g.ASNDB != "" {
+			g.asn = &geoDB{path: g.ASNDB}
+		}
+
+		for _, db := range []*geoDB{g.country, g.asn} {
+			if db == nil {
+				continue
+			}
+
+			if _, err := g.reload(db); err != nil && g.err == nil {
+				g.err = err
+			}
+		}
+
+		go g.watch()
+	})
+
+	return g.err
+}
+
+// Returns true if the database changed
+func (g *GeoIP) reload(db *geoDB) (bool, error) {
+
+	fi, err := os.Stat(db.path)
+	if err != nil {
+		return false, fmt.Errorf("os.Stat: %v", err)
+	}
+
+	g.mu.RLock()
+	unchanged := !db.modTime.IsZero() && fi.ModTime().Equal(db.modTime) &&
+		fi.Size() == db.size
+	g.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	buf, err := os.ReadFile(db.path)
+	if err != nil {
+		return false, fmt.Errorf("os.ReadFile: %v", err)
+	}
+
+	r, err := newMMDBReader(buf)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Not retried until the file changes again
+	db.modTime = fi.ModTime()
+	db.size = fi.Size()
+
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", db.path, err)
+	}
+
+	db.r = r
+	g.cache = make(map[netip.Addr]geoInfo)
+
+	return true, nil
+}
+
+func (g *GeoIP) watch() {
+
+	ticker := time.NewTicker(g.ReloadFrequency)
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-g.done:
+			return
+
+		case <-ticker.C:
+			for _, db := range []*geoDB{g.country, g.asn} {
+				if db == nil {
+					continue
+				}
+
+				if _, err := g.reload(db); err != nil {
+					log.Printf("GeoIP: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (g *GeoIP) Close() {
+
+	g.start()
+	g.closing.Do(func() { close(g.done) })
+}
+
+func recordString(v interface{}, path ...string) string {
+
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = m[key]
+	}
+
+	s, _ := v.(string)
+	return s
+}
+
+func (g *GeoIP) lookup(addr netip.Addr) geoInfo {
+
+	g.start()
+
+	g.mu.RLock()
+	info, ok := g.cache[addr]
+	country, asn := g.country, g.asn
+	g.mu.RUnlock()
+
+	if ok {
+		return info
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if country != nil && country.r != nil {
+
+		rec, err := country.r.lookup(addr)
+		if err != nil {
+			log.Printf("GeoIP: %s: %v", country.path, err)
+		}
+
+		info.country = recordString(rec, "country", "iso_code")
+		if info.country == "" {
+			info.country = recordString(rec, "registered_country", "iso_code")
+		}
+	}
+
+	if asn != nil && asn.r != nil {
+
+		rec, err := asn.r.lookup(addr)
+		if err != nil {
+			log.Printf("GeoIP: %s: %v", asn.path, err)
+		}
+
+		if m, ok := rec.(map[string]interface{}); ok {
+			info.asn, _ = m["autonomous_system_number"].(uint64)
+			info.org, _ = m["autonomous_system_organization"].(string)
+		}
+	}
+
+	if len(g.cache) >= geoCacheSize {
+		g.cache = make(map[netip.Addr]geoInfo)
+	}
+	g.cache[addr] = info
+
+	return info
+}
+
+// Country and ASN of the entry client (see Clients)
+func (g *GeoIP) entry(e *w3chttpd.Entry, clients *Clients) geoInfo {
+
+	addr, ok := clients.addr(e)
+	if !ok {
+		return geoInfo{}
+	}
+	return g.lookup(addr)
+}
+
+func (g *GeoIP) countryKey(e *w3chttpd.Entry, clients *Clients) string {
+
+	if c := g.entry(e, clients).country; c != "" {
+		return c
+	}
+	return unknownCountry
+}
+
+// Top ranked countries and ASNs from their hit counts
+func (g *GeoIP) rank(countries map[string]int, asns map[uint64]int,
+	orgs map[uint64]string) (geoRanking, geoRanking) {
+
+	g.start()
+
+	countryRank := make(geoRanking, 0, len(countries))
+	for country, hitCount := range countries {
+		countryRank = append(countryRank, GeoRank{hitCount, country, ""})
+	}
+
+	asnRank := make(geoRanking, 0, len(asns))
+	for asn, hitCount := range asns {
+		asnRank = append(asnRank,
+			GeoRank{hitCount, fmt.Sprintf("AS%d", asn), orgs[asn]})
+	}
+
+	sort.Sort(countryRank)
+	sort.Sort(asnRank)
+
+	if len(countryRank) > g.Top {
+		countryRank = countryRank[:g.Top]
+	}
+
+	if len(asnRank) > g.Top {
+		asnRank = asnRank[:g.Top]
+	}
+
+	return countryRank, asnRank
+}
@@ -0,0 +1,134 @@
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+	"w3chttpd"
+)
+
+// Fixtures in testdata:
+// country.mmdb: 1.2.3.0/24 FR, 5.6.0.0/16 DE, 2001:db8::/32 registered in JP
+// country-updated.mmdb: 1.2.3.0/24 ES
+// asn.mmdb: 1.2.0.0/16 AS64500, 2001:db8::/32 AS64501
+
+func copyFile(t *testing.T, src, dst string) {
+
+	buf, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+
+	if err := os.WriteFile(dst, buf, 0644); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+}
+
+func TestGeoIPMetrics(t *testing.T) {
+
+	g := &GeoIP{
+		CountryDB: "testdata/country.mmdb",
+		ASNDB:     "testdata/asn.mmdb",
+		Top:       2,
+	}
+	defer g.Close()
+
+	if err := g.start(); err != nil {
+		t.Fatalf("GeoIP.start: %v", err)
+	}
+
+	entries := []*w3chttpd.Entry{
+		&w3chttpd.Entry{Ip: []byte("1.2.3.4")},
+		&w3chttpd.Entry{Ip: []byte("1.2.3.5")},
+		&w3chttpd.Entry{Ip: []byte("1.2.9.9")},
+		&w3chttpd.Entry{Ip: []byte("5.6.7.8")},
+		&w3chttpd.Entry{Ip: []byte("2001:db8::1")},
+		&w3chttpd.Entry{Ip: []byte("192.0.2.1")},
+		&w3chttpd.Entry{Ip: []byte("invalid")},
+	}
+
+	start := time.Date(2004, 3, 7, 16, 0, 0, 0, time.UTC)
+	m := aggregateMetrics(entries, nil, nil, g, start, start.Add(10*time.Second))
+
+	expectedCountries := []GeoRank{{2, "FR", ""}, {1, "DE", ""}}
+	if !reflect.DeepEqual(m.Countries, expectedCountries) {
+		t.Errorf("Countries differ. Want %+v, got %+v", expectedCountries, m.Countries)
+	}
+
+	expectedASNs := []GeoRank{{3, "AS64500", "Example Net"}, {1, "AS64501", "Documentation"}}
+	if !reflect.DeepEqual(m.ASNs, expectedASNs) {
+		t.Errorf("ASNs differ. Want %+v, got %+v", expectedASNs, m.ASNs)
+	}
+
+	rule := &AlertRule{
+		Name:          "per-country",
+		Scope:         ScopeCountry,
+		TrafficWindow: 2 * time.Minute,
+		Threshold:     500,
+	}
+
+	sw := newScopedWindows(rule, "", newTestEntryPool(10))
+	sw.geo = g
+
+	sw.add([]*w3chttpd.Entry{
+		&w3chttpd.Entry{Ip: []byte("1.2.3.4"), Timestamp: time.Unix(1, 0), Size: 300},
+		&w3chttpd.Entry{Ip: []byte("192.0.2.1"), Timestamp: time.Unix(1, 0), Size: 300},
+		&w3chttpd.Entry{Ip: []byte("1.2.3.5"), Timestamp: time.Unix(2, 0), Size: 300},
+	})
+
+	alerts := sw.getNewAlerts(time.Unix(2, 0))
+	if len(alerts) != 1 || alerts[0].Key != "FR" {
+		t.Errorf("Should want an alert for country %s. Got %v", "FR", alerts)
+	}
+
+	if _, ok := sw.windows[unknownCountry]; !ok {
+		t.Errorf("Entries without country should be keyed %s", unknownCountry)
+	}
+}
+
+func TestGeoIPReload(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	copyFile(t, "testdata/country.mmdb", path)
+
+	g := &GeoIP{CountryDB: path, ReloadFrequency: 10 * time.Millisecond}
+	defer g.Close()
+
+	e := &w3chttpd.Entry{Ip: []byte("1.2.3.4")}
+
+	if c := g.countryKey(e, nil); c != "FR" {
+		t.Fatalf("Country differs. Want %s, got %s", "FR", c)
+	}
+
+	// An invalid file keeps the previous database
+	if err := os.WriteFile(path, []byte("truncated"), 0644); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if c := g.countryKey(e, nil); c != "FR" {
+		t.Errorf("Country differs. Want %s, got %s", "FR", c)
+	}
+
+	copyFile(t, "testdata/country-updated.mmdb", path)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for g.countryKey(e, nil) != "ES" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if c := g.countryKey(e, nil); c != "ES" {
+		t.Errorf("Database should be reloaded. Want %s, got %s", "ES", c)
+	}
+
+	missing := &GeoIP{CountryDB: "testdata/missing.mmdb"}
+	defer missing.Close()
+
+	if err := missing.start(); err == nil {
+		t.Error("Missing database should be reported")
+	}
+}
@@ -0,0 +1,29 @@
+package monitor
+
+import "sync/atomic"
+
+// Internal health counters of a monitor (see Config), exposed by its
+// PrometheusExporter
+type healthCounters struct {
+	linesParsed      atomic.Int64
+	parseFailures    atomic.Int64
+	entryPoolHits    atomic.Int64
+	entryPoolMisses  atomic.Int64
+	bufferPoolHits   atomic.Int64
+	bufferPoolMisses atomic.Int64
+
+	// Out-of-order entries (see reorderQueue and LatePolicy)
+	reorderedEntries   atomic.Int64
+	lateEntries        atomic.Int64
+	lateEntriesDropped atomic.Int64
+
+	// Items dropped by full subscriber queues (see OutputPolicy)
+	outputDropped atomic.Int64
+
+	// Webhook deliveries dropped by full queues (see WebhookNotifier)
+	notificationsDropped atomic.Int64
+
+	// Configuration reloads (see Monitor.Reload)
+	configReloads        atomic.Int64
+	configReloadFailures atomic.Int64
+}
@@ -0,0 +1,459 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics are kept for Retention, merged in buckets of Step
+// (Step = 0 keeps the periods as received)
+type HistoryTier struct {
+	Step      time.Duration
+	Retention time.Duration
+
+	metrics []*Metrics
+}
+
+// Bounded in-memory history of period metrics, tiers going from the
+// finest to the coarsest (defaults to raw periods for 1h then 1m buckets
+// for 24h)
+// Merged periods sum counts and hits, UniqueVisitors being the maximum
+// of the merged periods since visitors cannot be deduplicated afterwards
+// and Rank keeping as many sections as the longest merged one
+type History struct {
+	Tiers []*HistoryTier
+
+	// Internal parameters
+	once sync.Once
+	mu   sync.RWMutex
+}
+
+func (h *History) init() {
+
+	h.once.Do(func() {
+
+		if len(h.Tiers) == 0 {
+			h.Tiers = []*HistoryTier{
+				&HistoryTier{Step: 0, Retention: time.Hour},
+				&HistoryTier{Step: time.Minute, Retention: 24 * time.Hour},
+			}
+		}
+	})
+}
+
+func copyMetrics(m *Metrics) *Metrics {
+
+	c := *m
+	c.Rank = append([]Rank{}, m.Rank...)
+	c.Classes = append([]ClassMetrics(nil), m.Classes...)
+	c.Networks = append([]NetworkMetrics(nil), m.Networks...)
+	c.Countries = append([]GeoRank(nil), m.Countries...)
+	c.ASNs = append([]GeoRank(nil), m.ASNs...)
+	if m.Sessions != nil {
+		sessions := *m.Sessions
+		c.Sessions = &sessions
+	}
+	c.HeavyHitters = mergeHeavyHitters(nil, m.HeavyHitters)
+	return &c
+}
+
+func mergeMetrics(dst, src *Metrics) {
+
+	dst.RequestCount += src.RequestCount
+	dst.ErrorCount += src.ErrorCount
+	dst.TotalTraffic += src.TotalTraffic
+
+	if src.UniqueVisitors > dst.UniqueVisitors {
+		dst.UniqueVisitors = src.UniqueVisitors
+	}
+
+	if src.PeriodStart.Before(dst.PeriodStart) {
+		dst.PeriodStart = src.PeriodStart
+	}
+
+	if src.PeriodEnd.After(dst.PeriodEnd) {
+		dst.PeriodEnd = src.PeriodEnd
+	}
+
+	dst.AvgPageViews = 0
+	if dst.UniqueVisitors != 0 {
+		dst.AvgPageViews = float32(dst.RequestCount) / float32(dst.UniqueVisitors)
+	}
+
+	for _, sc := range src.Classes {
+
+		i := 0
+		for i < len(dst.Classes) && dst.Classes[i].Class != sc.Class {
+			i++
+		}
+
+		if i == len(dst.Classes) {
+			dst.Classes = append(dst.Classes, ClassMetrics{Class: sc.Class})
+		}
+
+		dc := &dst.Classes[i]
+		dc.RequestCount += sc.RequestCount
+		dc.TotalTraffic += sc.TotalTraffic
+		if sc.UniqueVisitors > dc.UniqueVisitors {
+			dc.UniqueVisitors = sc.UniqueVisitors
+		}
+	}
+
+	for _, sn := range src.Networks {
+
+		i := 0
+		for i < len(dst.Networks) && dst.Networks[i].Name != sn.Name {
+			i++
+		}
+
+		if i == len(dst.Networks) {
+			dst.Networks = append(dst.Networks, NetworkMetrics{Name: sn.Name})
+		}
+
+		dn := &dst.Networks[i]
+		dn.RequestCount += sn.RequestCount
+		dn.TotalTraffic += sn.TotalTraffic
+		if sn.UniqueVisitors > dn.UniqueVisitors {
+			dn.UniqueVisitors = sn.UniqueVisitors
+		}
+	}
+
+	dst.Sessions = mergeSessions(dst.Sessions, src.Sessions)
+	dst.HeavyHitters = mergeHeavyHitters(dst.HeavyHitters, src.HeavyHitters)
+
+	dst.Countries = mergeGeoRanks(dst.Countries, src.Countries)
+	dst.ASNs = mergeGeoRanks(dst.ASNs, src.ASNs)
+
+	hits := make(map[string]int, len(dst.Rank)+len(src.Rank))
+	for _, r := range dst.Rank {
+		hits[r.Section] += r.HitCount
+	}
+	for _, r := range src.Rank {
+		hits[r.Section] += r.HitCount
+	}
+
+	// As long as the longest of the merged ranks, like the heavy hitters
+	k := len(dst.Rank)
+	if len(src.Rank) > k {
+		k = len(src.Rank)
+	}
+
+	rank := make([]Rank, 0, len(hits))
+	for section, hitCount := range hits {
+		rank = append(rank, Rank{hitCount, section})
+	}
+
+	sort.Slice(rank, func(i, j int) bool {
+		if rank[i].HitCount != rank[j].HitCount {
+			return rank[i].HitCount > rank[j].HitCount
+		}
+		return rank[i].Section < rank[j].Section
+	})
+
+	if len(rank) > k {
+		rank = rank[:k]
+	}
+	dst.Rank = rank
+}
+
+// Averages are weighted by ended sessions, Active being the latest value
+func mergeSessions(dst, src *SessionMetrics) *SessionMetrics {
+
+	if src == nil {
+		return dst
+	}
+
+	if dst == nil {
+		sessions := *src
+		return &sessions
+	}
+
+	ended := dst.Ended + src.Ended
+	if ended != 0 {
+		dst.AvgDuration = (dst.AvgDuration*time.Duration(dst.Ended) +
+			src.AvgDuration*time.Duration(src.Ended)) / time.Duration(ended)
+		dst.PagesPerSession = (dst.PagesPerSession*float32(dst.Ended) +
+			src.PagesPerSession*float32(src.Ended)) / float32(ended)
+		dst.BounceRate = (dst.BounceRate*float32(dst.Ended) +
+			src.BounceRate*float32(src.Ended)) / float32(ended)
+	}
+
+	dst.Started += src.Started
+	dst.Ended = ended
+	dst.Evicted += src.Evicted
+	dst.Active = src.Active
+
+	return dst
+}
+
+// Counts and errors are summed by key, an item missing from one of the
+// tops being undercounted
+func mergeTop(dst, src []HeavyHitter) []HeavyHitter {
+
+	k := len(dst)
+	if len(src) > k {
+		k = len(src)
+	}
+
+	merged := make(heavyHitters, 0, len(dst)+len(src))
+	index := make(map[string]int, len(dst)+len(src))
+
+	for _, item := range append(append([]HeavyHitter{}, dst...), src...) {
+
+		if i, ok := index[item.Key]; ok {
+			merged[i].Count += item.Count
+			merged[i].Error += item.Error
+			continue
+		}
+
+		index[item.Key] = len(merged)
+		merged = append(merged, item)
+	}
+
+	sort.Sort(merged)
+
+	if len(merged) > k {
+		merged = merged[:k]
+	}
+	return merged
+}
+
+func mergeHeavyHitters(dst, src *HeavyHitters) *HeavyHitters {
+
+	if src == nil {
+		return dst
+	}
+
+	if dst == nil {
+		dst = &HeavyHitters{}
+	}
+
+	dst.Total += src.Total
+	dst.Sections = mergeTop(dst.Sections, src.Sections)
+	dst.Resources = mergeTop(dst.Resources, src.Resources)
+	dst.Clients = mergeTop(dst.Clients, src.Clients)
+	dst.UserAgents = mergeTop(dst.UserAgents, src.UserAgents)
+
+	return dst
+}
+
+// Sums hits by key, merged periods only knowing their own top ranks
+func mergeGeoRanks(dst, src []GeoRank) []GeoRank {
+
+	if len(src) == 0 {
+		return dst
+	}
+
+	merged := make(geoRanking, 0, len(dst)+len(src))
+	index := make(map[string]int, len(dst)+len(src))
+
+	for _, r := range append(append([]GeoRank{}, dst...), src...) {
+
+		if i, ok := index[r.Key]; ok {
+			merged[i].HitCount += r.HitCount
+			continue
+		}
+
+		index[r.Key] = len(merged)
+		merged = append(merged, r)
+	}
+
+	sort.Sort(merged)
+	return merged
+}
+
+// Metrics are expected in chronological order, corrections being merged
+// into the period they correct if still held
+func (h *History) Add(m *Metrics) {
+
+	h.init()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, tier := range h.Tiers {
+
+		n := len(tier.metrics)
+
+		if m.Correction {
+
+			bucket := m.PeriodStart
+			if tier.Step > 0 {
+				bucket = bucket.Truncate(tier.Step)
+			}
+
+			for i := n - 1; i >= 0; i-- {
+				if tier.metrics[i].PeriodStart.Equal(bucket) {
+					mergeMetrics(tier.metrics[i], m)
+					break
+				}
+			}
+			continue
+		}
+
+		if tier.Step <= 0 {
+			tier.metrics = append(tier.metrics, copyMetrics(m))
+
+		} else {
+
+			bucket := m.PeriodStart.Truncate(tier.Step)
+
+			if n != 0 && tier.metrics[n-1].PeriodStart.Equal(bucket) {
+				mergeMetrics(tier.metrics[n-1], m)
+
+			} else {
+				c := copyMetrics(m)
+				c.PeriodStart = bucket
+				tier.metrics = append(tier.metrics, c)
+			}
+		}
+
+		oldest := m.PeriodEnd.Add(-tier.Retention)
+
+		expired := 0
+		for expired < len(tier.metrics) &&
+			tier.metrics[expired].PeriodEnd.Before(oldest) {
+			tier.metrics[expired] = nil
+			expired++
+		}
+		tier.metrics = tier.metrics[expired:]
+	}
+}
+
+// Metrics starting in [from, to[ from the finest tier still holding from,
+// merged in buckets of step if not 0
+// If section is not empty, only its hits are kept in Rank
+func (h *History) Query(from, to time.Time, section string,
+	step time.Duration) []*Metrics {
+
+	h.init()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	tier := h.Tiers[len(h.Tiers)-1]
+	for _, t := range h.Tiers {
+		if len(t.metrics) != 0 && !t.metrics[0].PeriodStart.After(from) {
+			tier = t
+			break
+		}
+	}
+
+	res := []*Metrics{}
+
+	for _, m := range tier.metrics {
+
+		if m.PeriodStart.Before(from) || !m.PeriodStart.Before(to) {
+			continue
+		}
+
+		if step > 0 {
+			bucket := m.PeriodStart.Truncate(step)
+			if n := len(res); n != 0 && res[n-1].PeriodStart.Equal(bucket) {
+				mergeMetrics(res[n-1], m)
+				continue
+			}
+
+			c := copyMetrics(m)
+			c.PeriodStart = bucket
+			res = append(res, c)
+			continue
+		}
+
+		res = append(res, copyMetrics(m))
+	}
+
+	if section == "" {
+		return res
+	}
+
+	for _, m := range res {
+
+		rank := []Rank{}
+		for _, r := range m.Rank {
+			if r.Section == section {
+				rank = append(rank, r)
+			}
+		}
+		m.Rank = rank
+	}
+
+	return res
+}
+
+// GET ?from=&to= (RFC 3339, defaults to the last hour)
+// &section= &step= (Go duration, e.g. 5m)
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	to := time.Now()
+	from := to.Add(-time.Hour)
+	var step time.Duration
+	var err error
+
+	parseTime := func(name string, t *time.Time) error {
+
+		if q.Get(name) == "" {
+			return nil
+		}
+
+		*t, err = time.Parse(time.RFC3339, q.Get(name))
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+		return nil
+	}
+
+	if err := parseTime("from", &from); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := parseTime("to", &to); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if q.Get("step") != "" {
+		step, err = time.ParseDuration(q.Get("step"))
+		if err != nil || step < 0 {
+			http.Error(w, "invalid step", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(h.Query(from, to, q.Get("section"), step))
+	if err != nil {
+		log.Printf("json.Encoder.Encode: %v", err)
+	}
+}
+
+// Records metrics received from in and forwards them to out (if not nil,
+// closed once in is)
+func (h *History) Run(in <-chan *Metrics, out chan<- *Metrics) {
+
+	if out != nil {
+		defer close(out)
+	}
+
+	for m := range in {
+
+		h.Add(m)
+
+		if out != nil {
+			out <- m
+		}
+	}
+}
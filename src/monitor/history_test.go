@@ -0,0 +1,169 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestHistory() *History {
+
+	h := &History{
+		Tiers: []*HistoryTier{
+			&HistoryTier{Step: 0, Retention: 5 * time.Minute},
+			&HistoryTier{Step: time.Minute, Retention: time.Hour},
+		},
+	}
+
+	// 30 minutes of 10s periods
+	start := time.Date(2004, 3, 7, 16, 0, 0, 0, time.UTC)
+	for i := 0; i < 180; i++ {
+
+		periodStart := start.Add(time.Duration(i) * 10 * time.Second)
+
+		h.Add(&Metrics{
+			Rank:           []Rank{Rank{2, "admin"}, Rank{1, "help"}},
+			RequestCount:   3,
+			ErrorCount:     1,
+			TotalTraffic:   100,
+			PeriodStart:    periodStart,
+			PeriodEnd:      periodStart.Add(9 * time.Second),
+			UniqueVisitors: 1 + i%3,
+		})
+	}
+
+	return h
+}
+
+func TestHistoryAdd(t *testing.T) {
+
+	h := newTestHistory()
+
+	// 5 minutes of raw periods (plus the boundary one)
+	if len(h.Tiers[0].metrics) != 31 {
+		t.Errorf("Raw periods differ. Want %d, got %d",
+			31, len(h.Tiers[0].metrics))
+	}
+
+	if len(h.Tiers[1].metrics) != 30 {
+		t.Errorf("Minute buckets differ. Want %d, got %d",
+			30, len(h.Tiers[1].metrics))
+	}
+
+	m := h.Tiers[1].metrics[0]
+	if m.RequestCount != 18 || m.UniqueVisitors != 3 ||
+		m.Rank[0] != (Rank{12, "admin"}) {
+		t.Errorf("Minute bucket differs. Got %+v", m)
+	}
+}
+
+func TestMergeMetricsRank(t *testing.T) {
+
+	dst := &Metrics{Rank: []Rank{Rank{2, "help"}, Rank{1, "admin"}}}
+	mergeMetrics(dst, &Metrics{Rank: []Rank{Rank{1, "team"},
+		Rank{1, "contact"}, Rank{1, "about"}}})
+
+	// Ties broken by section, capped to the longest rank
+	want := []Rank{Rank{2, "help"}, Rank{1, "about"}, Rank{1, "admin"}}
+	if !reflect.DeepEqual(dst.Rank, want) {
+		t.Errorf("Rank differs. Want %v, got %v", want, dst.Rank)
+	}
+}
+
+func TestHistoryAddCorrection(t *testing.T) {
+
+	h := newTestHistory()
+
+	last := h.Tiers[0].metrics[len(h.Tiers[0].metrics)-1]
+	raw := len(h.Tiers[0].metrics)
+
+	h.Add(&Metrics{
+		Rank:         []Rank{Rank{2, "help"}},
+		RequestCount: 2,
+		PeriodStart:  last.PeriodStart,
+		PeriodEnd:    last.PeriodEnd,
+		Correction:   true,
+	})
+
+	if len(h.Tiers[0].metrics) != raw {
+		t.Errorf("Raw periods differ. Want %d, got %d",
+			raw, len(h.Tiers[0].metrics))
+	}
+
+	if last.RequestCount != 5 || last.Rank[0] != (Rank{3, "help"}) {
+		t.Errorf("Corrected period differs. Got %+v", last)
+	}
+
+	bucket := h.Tiers[1].metrics[len(h.Tiers[1].metrics)-1]
+	if bucket.RequestCount != 20 {
+		t.Errorf("Corrected bucket differs. Want %d requests, got %d",
+			20, bucket.RequestCount)
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+
+	h := newTestHistory()
+	start := time.Date(2004, 3, 7, 16, 0, 0, 0, time.UTC)
+
+	res := h.Query(start.Add(28*time.Minute), start.Add(30*time.Minute), "", 0)
+	if len(res) != 12 {
+		t.Errorf("Recent periods should come from raw tier. Got %d", len(res))
+	}
+
+	res = h.Query(start, start.Add(10*time.Minute), "", 0)
+	if len(res) != 10 || res[0].RequestCount != 18 {
+		t.Errorf("Older periods should come from minute tier. Got %d", len(res))
+	}
+
+	res = h.Query(start, start.Add(10*time.Minute), "help", 5*time.Minute)
+	if len(res) != 2 {
+		t.Fatalf("Rollup differs. Want %d periods, got %d", 2, len(res))
+	}
+
+	if res[0].RequestCount != 90 || len(res[0].Rank) != 1 ||
+		res[0].Rank[0] != (Rank{30, "help"}) {
+		t.Errorf("Rolled up period differs. Got %+v", res[0])
+	}
+
+	// The original history must not be altered by queries
+	if len(h.Tiers[1].metrics[0].Rank) != 2 {
+		t.Error("Query should not modify the history")
+	}
+}
+
+func TestHistoryServeHTTP(t *testing.T) {
+
+	ts := httptest.NewServer(newTestHistory())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?from=2004-03-07T16:00:00Z" +
+		"&to=2004-03-07T16:30:00Z&step=10m&section=admin")
+	if err != nil {
+		t.Fatalf("http.Get: %v", err)
+	}
+	defer resp.Body.Close()
+
+	res := []*Metrics{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("json.Decoder.Decode: %v", err)
+	}
+
+	if len(res) != 3 || res[2].Rank[0] != (Rank{120, "admin"}) {
+		t.Errorf("Response differs. Got %d periods", len(res))
+	}
+
+	resp, err = http.Get(ts.URL + "?step=abc")
+	if err != nil {
+		t.Fatalf("http.Get: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Status code differs. Want %d, got %d",
+			http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -0,0 +1,342 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+)
+
+// Bumped on any incompatible change of the JSON encodings
+const SchemaVersion = 1
+
+type sectionJSON struct {
+	Section string `json:"section"`
+	Hits    int    `json:"hits"`
+}
+
+type classJSON struct {
+	Class          string `json:"class"`
+	Requests       int    `json:"requests"`
+	UniqueVisitors int    `json:"unique_visitors"`
+	Bytes          int    `json:"bytes"`
+}
+
+type networkJSON struct {
+	Name           string `json:"name"`
+	Requests       int    `json:"requests"`
+	UniqueVisitors int    `json:"unique_visitors"`
+	Bytes          int    `json:"bytes"`
+}
+
+type geoJSON struct {
+	Key  string `json:"key"`
+	Name string `json:"name,omitempty"`
+	Hits int    `json:"hits"`
+}
+
+type sessionsJSON struct {
+	Started         int     `json:"started"`
+	Ended           int     `json:"ended"`
+	Active          int     `json:"active"`
+	Evicted         int     `json:"evicted"`
+	AvgDuration     float64 `json:"avg_duration_seconds"`
+	PagesPerSession float64 `json:"pages_per_session"`
+	BounceRate      float64 `json:"bounce_rate"`
+}
+
+type heavyHitterJSON struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+	Error int    `json:"error"`
+}
+
+type heavyHittersJSON struct {
+	Total      int               `json:"total"`
+	Sections   []heavyHitterJSON `json:"sections"`
+	Resources  []heavyHitterJSON `json:"resources"`
+	Clients    []heavyHitterJSON `json:"clients"`
+	UserAgents []heavyHitterJSON `json:"user_agents"`
+}
+
+func heavyHittersToJSON(items []HeavyHitter) []heavyHitterJSON {
+
+	hj := make([]heavyHitterJSON, len(items))
+	for i, item := range items {
+		hj[i] = heavyHitterJSON{item.Key, item.Count, item.Error}
+	}
+	return hj
+}
+
+func heavyHittersFromJSON(hj []heavyHitterJSON) []HeavyHitter {
+
+	items := make([]HeavyHitter, len(hj))
+	for i, item := range hj {
+		items[i] = HeavyHitter{item.Key, item.Count, item.Error}
+	}
+	return items
+}
+
+type metricsJSON struct {
+	SchemaVersion  int               `json:"schema_version"`
+	Type           string            `json:"type"`
+	PeriodStart    time.Time         `json:"period_start"`
+	PeriodEnd      time.Time         `json:"period_end"`
+	Requests       int               `json:"requests"`
+	Errors         int               `json:"errors"`
+	Bytes          int               `json:"bytes"`
+	UniqueVisitors int               `json:"unique_visitors"`
+	AvgPageViews   float64           `json:"avg_page_views"`
+	Sections       []sectionJSON     `json:"sections"`
+	Classes        []classJSON       `json:"classes,omitempty"`
+	Networks       []networkJSON     `json:"networks,omitempty"`
+	Countries      []geoJSON         `json:"countries,omitempty"`
+	ASNs           []geoJSON         `json:"asns,omitempty"`
+	Sessions       *sessionsJSON     `json:"sessions,omitempty"`
+	HeavyHitters   *heavyHittersJSON `json:"heavy_hitters,omitempty"`
+	Correction     bool              `json:"correction,omitempty"`
+}
+
+type alertJSON struct {
+	SchemaVersion int       `json:"schema_version"`
+	Type          string    `json:"type"`
+	Timestamp     time.Time `json:"timestamp"`
+	Status        string    `json:"status"`
+	Bytes         int       `json:"bytes"`
+	Rule          string    `json:"rule"`
+	Key           string    `json:"key"`
+	Severity      string    `json:"severity"`
+}
+
+func (m *Metrics) MarshalJSON() ([]byte, error) {
+
+	avg := float64(m.AvgPageViews)
+	if math.IsNaN(avg) || math.IsInf(avg, 0) {
+		avg = 0
+	}
+
+	mj := metricsJSON{
+		SchemaVersion:  SchemaVersion,
+		Type:           "metrics",
+		PeriodStart:    m.PeriodStart,
+		PeriodEnd:      m.PeriodEnd,
+		Requests:       m.RequestCount,
+		Errors:         m.ErrorCount,
+		Bytes:          m.TotalTraffic,
+		UniqueVisitors: m.UniqueVisitors,
+		AvgPageViews:   math.Round(avg*100) / 100,
+		Sections:       make([]sectionJSON, len(m.Rank)),
+		Correction:     m.Correction,
+	}
+
+	for i, r := range m.Rank {
+		mj.Sections[i] = sectionJSON{r.Section, r.HitCount}
+	}
+
+	for _, c := range m.Classes {
+		mj.Classes = append(mj.Classes, classJSON{
+			c.Class.String(), c.RequestCount, c.UniqueVisitors, c.TotalTraffic,
+		})
+	}
+
+	for _, n := range m.Networks {
+		mj.Networks = append(mj.Networks, networkJSON{
+			n.Name, n.RequestCount, n.UniqueVisitors, n.TotalTraffic,
+		})
+	}
+
+	for _, c := range m.Countries {
+		mj.Countries = append(mj.Countries, geoJSON{c.Key, c.Name, c.HitCount})
+	}
+
+	for _, a := range m.ASNs {
+		mj.ASNs = append(mj.ASNs, geoJSON{a.Key, a.Name, a.HitCount})
+	}
+
+	if sm := m.Sessions; sm != nil {
+		mj.Sessions = &sessionsJSON{
+			Started:         sm.Started,
+			Ended:           sm.Ended,
+			Active:          sm.Active,
+			Evicted:         sm.Evicted,
+			AvgDuration:     sm.AvgDuration.Seconds(),
+			PagesPerSession: math.Round(float64(sm.PagesPerSession)*100) / 100,
+			BounceRate:      math.Round(float64(sm.BounceRate)*10000) / 10000,
+		}
+	}
+
+	if hh := m.HeavyHitters; hh != nil {
+		mj.HeavyHitters = &heavyHittersJSON{
+			Total:      hh.Total,
+			Sections:   heavyHittersToJSON(hh.Sections),
+			Resources:  heavyHittersToJSON(hh.Resources),
+			Clients:    heavyHittersToJSON(hh.Clients),
+			UserAgents: heavyHittersToJSON(hh.UserAgents),
+		}
+	}
+
+	return json.Marshal(mj)
+}
+
+func (m *Metrics) UnmarshalJSON(data []byte) error {
+
+	var mj metricsJSON
+	if err := json.Unmarshal(data, &mj); err != nil {
+		return err
+	}
+
+	if mj.Type != "metrics" || mj.SchemaVersion != SchemaVersion {
+		return fmt.Errorf("unsupported metrics encoding (type %q, version %d)",
+			mj.Type, mj.SchemaVersion)
+	}
+
+	*m = Metrics{
+		Rank:           make([]Rank, len(mj.Sections)),
+		RequestCount:   mj.Requests,
+		ErrorCount:     mj.Errors,
+		TotalTraffic:   mj.Bytes,
+		PeriodStart:    mj.PeriodStart,
+		PeriodEnd:      mj.PeriodEnd,
+		UniqueVisitors: mj.UniqueVisitors,
+		AvgPageViews:   float32(mj.AvgPageViews),
+		Correction:     mj.Correction,
+	}
+
+	for i, s := range mj.Sections {
+		m.Rank[i] = Rank{s.Hits, s.Section}
+	}
+
+	for _, cj := range mj.Classes {
+
+		c, err := parseTrafficClass(cj.Class)
+		if err != nil {
+			return err
+		}
+
+		m.Classes = append(m.Classes, ClassMetrics{
+			c, cj.Requests, cj.UniqueVisitors, cj.Bytes,
+		})
+	}
+
+	for _, nj := range mj.Networks {
+		m.Networks = append(m.Networks, NetworkMetrics{
+			nj.Name, nj.Requests, nj.UniqueVisitors, nj.Bytes,
+		})
+	}
+
+	for _, cj := range mj.Countries {
+		m.Countries = append(m.Countries, GeoRank{cj.Hits, cj.Key, cj.Name})
+	}
+
+	for _, aj := range mj.ASNs {
+		m.ASNs = append(m.ASNs, GeoRank{aj.Hits, aj.Key, aj.Name})
+	}
+
+	if sj := mj.Sessions; sj != nil {
+		m.Sessions = &SessionMetrics{
+			Started:         sj.Started,
+			Ended:           sj.Ended,
+			Active:          sj.Active,
+			Evicted:         sj.Evicted,
+			AvgDuration:     time.Duration(sj.AvgDuration * float64(time.Second)),
+			PagesPerSession: float32(sj.PagesPerSession),
+			BounceRate:      float32(sj.BounceRate),
+		}
+	}
+
+	if hj := mj.HeavyHitters; hj != nil {
+		m.HeavyHitters = &HeavyHitters{
+			Total:      hj.Total,
+			Sections:   heavyHittersFromJSON(hj.Sections),
+			Resources:  heavyHittersFromJSON(hj.Resources),
+			Clients:    heavyHittersFromJSON(hj.Clients),
+			UserAgents: heavyHittersFromJSON(hj.UserAgents),
+		}
+	}
+
+	return nil
+}
+
+func (a *Alert) MarshalJSON() ([]byte, error) {
+
+	return json.Marshal(alertJSON{
+		SchemaVersion: SchemaVersion,
+		Type:          "alert",
+		Timestamp:     a.Timestamp,
+		Status:        alertLabel(a, "status"),
+		Bytes:         a.Total,
+		Rule:          a.Rule,
+		Key:           a.Key,
+		Severity:      a.Severity,
+	})
+}
+
+func (a *Alert) UnmarshalJSON(data []byte) error {
+
+	var aj alertJSON
+	if err := json.Unmarshal(data, &aj); err != nil {
+		return err
+	}
+
+	if aj.Type != "alert" || aj.SchemaVersion != SchemaVersion {
+		return fmt.Errorf("unsupported alert encoding (type %q, version %d)",
+			aj.Type, aj.SchemaVersion)
+	}
+
+	*a = Alert{
+		Timestamp: aj.Timestamp,
+		Total:     aj.Bytes,
+		Rule:      aj.Rule,
+		Key:       aj.Key,
+		Severity:  aj.Severity,
+	}
+
+	switch aj.Status {
+	case "exceed":
+		a.Status = StatusExceed
+	case "recovered":
+		a.Status = StatusRecovered
+	default:
+		return fmt.Errorf("unknown alert status %q", aj.Status)
+	}
+
+	return nil
+}
+
+// Same as Display but writes one JSON event per line (NDJSON),
+// alerts being written only once
+func DisplayJSON(w io.Writer, alertsChan <-chan []*Alert,
+	metricsChan <-chan *Metrics) {
+
+	enc := json.NewEncoder(w)
+
+	for alertsChan != nil || metricsChan != nil {
+
+		select {
+
+		case alerts, ok := <-alertsChan:
+			if !ok {
+				alertsChan = nil
+				continue
+			}
+
+			for _, a := range alerts {
+				if err := enc.Encode(a); err != nil {
+					log.Printf("json.Encoder.Encode: %v", err)
+				}
+			}
+
+		case metrics, ok := <-metricsChan:
+			if !ok {
+				metricsChan = nil
+				continue
+			}
+
+			if err := enc.Encode(metrics); err != nil {
+				log.Printf("json.Encoder.Encode: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetricsJSON(t *testing.T) {
+
+	m := &Metrics{
+		Rank:           []Rank{Rank{3, "admin"}, Rank{1, "help"}},
+		RequestCount:   4,
+		ErrorCount:     1,
+		TotalTraffic:   120,
+		PeriodStart:    time.Date(2004, 3, 7, 16, 0, 0, 0, time.UTC),
+		PeriodEnd:      time.Date(2004, 3, 7, 16, 0, 10, 0, time.UTC),
+		UniqueVisitors: 2,
+		AvgPageViews:   2,
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	expected := `{"schema_version":1,"type":"metrics",` +
+		`"period_start":"2004-03-07T16:00:00Z","period_end":"2004-03-07T16:00:10Z",` +
+		`"requests":4,"errors":1,"bytes":120,"unique_visitors":2,"avg_page_views":2,` +
+		`"sections":[{"section":"admin","hits":3},{"section":"help","hits":1}]}`
+
+	if string(data) != expected {
+		t.Errorf("Encoding differs. Want %s, got %s", expected, string(data))
+	}
+
+	decoded := &Metrics{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, m) {
+		t.Errorf("Decoded metrics differ. Want %+v, got %+v", m, decoded)
+	}
+
+	m = &Metrics{AvgPageViews: float32(math.NaN())}
+	if _, err := json.Marshal(m); err != nil {
+		t.Errorf("Metrics without visitors should be encoded. Got %v", err)
+	}
+}
+
+func TestAlertJSON(t *testing.T) {
+
+	a := &Alert{
+		Timestamp: time.Date(2004, 3, 7, 16, 0, 0, 0, time.UTC),
+		Total:     500,
+		Status:    StatusExceed,
+		Rule:      "client",
+		Key:       "10.0.0.1",
+		Severity:  "critical",
+	}
+
+	data, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	expected := `{"schema_version":1,"type":"alert",` +
+		`"timestamp":"2004-03-07T16:00:00Z","status":"exceed","bytes":500,` +
+		`"rule":"client","key":"10.0.0.1","severity":"critical"}`
+
+	if string(data) != expected {
+		t.Errorf("Encoding differs. Want %s, got %s", expected, string(data))
+	}
+
+	decoded := &Alert{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	if *decoded != *a {
+		t.Errorf("Decoded alert differs. Want %+v, got %+v", a, decoded)
+	}
+
+	if err := json.Unmarshal([]byte(`{"schema_version":2,"type":"alert"}`),
+		decoded); err == nil {
+		t.Error("Unknown schema version should be rejected")
+	}
+}
+
+func TestDisplayJSON(t *testing.T) {
+
+	alertsChan := make(chan []*Alert)
+	metricsChan := make(chan *Metrics)
+
+	rd, w := io.Pipe()
+	go DisplayJSON(w, alertsChan, metricsChan)
+
+	go func() {
+		alertsChan <- []*Alert{&Alert{Status: StatusExceed}}
+		metricsChan <- &Metrics{}
+	}()
+
+	scanner := bufio.NewScanner(rd)
+	for _, expected := range []string{"alert", "metrics"} {
+
+		if !scanner.Scan() {
+			t.Fatalf("Missing %s event", expected)
+		}
+
+		var event struct{ Type string }
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("json.Unmarshal: %v", err)
+		}
+
+		if event.Type != expected {
+			t.Errorf("Event type differs. Want %s, got %s", expected, event.Type)
+		}
+	}
+}
+
+func TestDisplayJSONClosed(t *testing.T) {
+
+	alertsChan := make(chan []*Alert)
+	metricsChan := make(chan *Metrics)
+
+	done := make(chan struct{})
+	go func() {
+		DisplayJSON(io.Discard, alertsChan, metricsChan)
+		close(done)
+	}()
+
+	close(metricsChan)
+	alertsChan <- []*Alert{&Alert{Status: StatusExceed}}
+	close(alertsChan)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("DisplayJSON did not return once its channels were closed")
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"sort"
+	"strings"
 	"text/tabwriter"
 	"time"
 	"unicode/utf8"
@@ -16,6 +16,27 @@ type Rank struct {
 	Section  string
 }
 
+type ClassMetrics struct {
+	Class          TrafficClass
+	RequestCount   int
+	UniqueVisitors int
+	TotalTraffic   int
+}
+
+// Traffic of a named network list (see Clients)
+type NetworkMetrics struct {
+	Name           string
+	RequestCount   int
+	UniqueVisitors int
+	TotalTraffic   int
+}
+
+// Classes splits the period by traffic class (indexed by TrafficClass),
+// Networks by network list (in the order of Clients.Networks)
+// Countries and ASNs rank the top client origins (see GeoIP)
+// Sessions is only set with a SessionTracker and HeavyHitters with TopK
+// Correction Metrics only hold the late entries of an already emitted
+// period, to be merged into it (see LateCorrect)
 type Metrics struct {
 	Rank           []Rank
 	RequestCount   int
@@ -25,6 +46,13 @@ type Metrics struct {
 	PeriodEnd      time.Time
 	UniqueVisitors int
 	AvgPageViews   float32
+	Classes        []ClassMetrics
+	Networks       []NetworkMetrics
+	Countries      []GeoRank
+	ASNs           []GeoRank
+	Sessions       *SessionMetrics
+	HeavyHitters   *HeavyHitters
+	Correction     bool
 }
 
 type ranking []Rank
@@ -35,14 +63,86 @@ func (r ranking) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
 
 func (m *Metrics) String() string {
 
-	str := fmt.Sprintf("\n[%s - %s] Requests: %d | Errors: %d"+
+	correction := ""
+	if m.Correction {
+		correction = " Correction |"
+	}
+
+	str := fmt.Sprintf("\n[%s - %s]%s Requests: %d | Errors: %d"+
 		" | Traffic: %d\n", m.PeriodStart.Format("02/01/2006:15:04:05"),
-		m.PeriodEnd.Format("02/01/2006:15:04:05"), m.RequestCount,
+		m.PeriodEnd.Format("02/01/2006:15:04:05"), correction, m.RequestCount,
 		m.ErrorCount, m.TotalTraffic)
 
 	str += fmt.Sprintf("Unique visitors: %d (Avg page views per visitor: %.2f) \n",
 		m.UniqueVisitors, m.AvgPageViews)
 
+	if m.Sessions != nil {
+		str += fmt.Sprintf("Sessions: %d started, %d ended, %d active"+
+			" (avg duration: %s, pages per session: %.2f, bounce rate: %.0f%%)\n",
+			m.Sessions.Started, m.Sessions.Ended, m.Sessions.Active,
+			m.Sessions.AvgDuration.Round(time.Second),
+			m.Sessions.PagesPerSession, m.Sessions.BounceRate*100)
+	}
+
+	if len(m.Classes) != 0 {
+		classes := make([]string, len(m.Classes))
+		for i, c := range m.Classes {
+			classes[i] = fmt.Sprintf("%s: %d (visitors: %d, traffic: %d)",
+				c.Class, c.RequestCount, c.UniqueVisitors, c.TotalTraffic)
+		}
+		str += strings.Join(classes, " | ") + "\n"
+	}
+
+	if len(m.Networks) != 0 {
+		networks := make([]string, len(m.Networks))
+		for i, n := range m.Networks {
+			networks[i] = fmt.Sprintf("%s: %d (visitors: %d, traffic: %d)",
+				n.Name, n.RequestCount, n.UniqueVisitors, n.TotalTraffic)
+		}
+		str += strings.Join(networks, " | ") + "\n"
+	}
+
+	if len(m.Countries) != 0 {
+		countries := make([]string, len(m.Countries))
+		for i, c := range m.Countries {
+			countries[i] = fmt.Sprintf("%s: %d", c.Key, c.HitCount)
+		}
+		str += "Top countries: " + strings.Join(countries, " | ") + "\n"
+	}
+
+	if len(m.ASNs) != 0 {
+		asns := make([]string, len(m.ASNs))
+		for i, a := range m.ASNs {
+			asns[i] = fmt.Sprintf("%s %s: %d", a.Key, a.Name, a.HitCount)
+		}
+		str += "Top ASNs: " + strings.Join(asns, " | ") + "\n"
+	}
+
+	if hh := m.HeavyHitters; hh != nil {
+		for _, top := range []struct {
+			name  string
+			items []HeavyHitter
+		}{
+			{"sections", hh.Sections},
+			{"resources", hh.Resources},
+			{"clients", hh.Clients},
+			{"user agents", hh.UserAgents},
+		} {
+			if len(top.items) == 0 {
+				continue
+			}
+
+			items := make([]string, len(top.items))
+			for i, item := range top.items {
+				items[i] = fmt.Sprintf("%s: %d", item.Key, item.Count)
+				if item.Error != 0 {
+					items[i] += fmt.Sprintf(" (±%d)", item.Error)
+				}
+			}
+			str += "Top " + top.name + ": " + strings.Join(items, " | ") + "\n"
+		}
+	}
+
 	if len(m.Rank) == 0 {
 		return str
 	}
@@ -84,48 +184,18 @@ func (m *Metrics) String() string {
 	return str + tables.String()
 }
 
-func getMetricsForEntries(entries []*w3chttpd.Entry,
-	periodStart, periodEnd time.Time) *Metrics {
+// Entries without section are grouped under "/"
+func entrySection(e *w3chttpd.Entry) string {
 
-	m := &Metrics{
-		PeriodStart: periodStart,
-		PeriodEnd:   periodEnd,
-	}
-
-	hits := make(map[string]int, len(entries))
-	visitors := make(map[string]int, 0)
-
-	for _, e := range entries {
-
-		m.TotalTraffic += e.Size
-		m.RequestCount++
-		if e.StatusCode >= 400 {
-			m.ErrorCount++
-		}
-
-		visitors[string(e.Ip)]++
-
-		section := getSection(e.Req.Resource)
-		if section == nil {
-			continue
-		}
-
-		hits[string(section)]++
-	}
-
-	m.UniqueVisitors = len(visitors)
-	m.AvgPageViews = float32(m.RequestCount) / float32(m.UniqueVisitors)
-
-	r := make(ranking, len(hits))
-	i := 0
-	for section, hitCount := range hits {
-		r[i] = Rank{hitCount, section}
-		i++
+	section := getSection(e.Req.Resource)
+	if section == nil {
+		return "/"
 	}
+	return string(section)
+}
 
-	sort.Sort(r)
-	m.Rank = r
-	return m
+func statusClass(statusCode int) string {
+	return fmt.Sprintf("%dxx", statusCode/100)
 }
 
 func getSection(resource []byte) []byte {
@@ -6,7 +6,18 @@ import (
 	"w3chttpd"
 )
 
-func TestGetMetricsForEntries(t *testing.T) {
+// Metrics of entries folded in a single aggregate
+func aggregateMetrics(entries []*w3chttpd.Entry, bots *BotClassifier,
+	clients *Clients, geo *GeoIP, periodStart, periodEnd time.Time) *Metrics {
+
+	ma := newMetricsAggregate(bots, clients, geo)
+	for _, e := range entries {
+		ma.add(e)
+	}
+	return ma.metrics(periodStart, periodEnd)
+}
+
+func TestAggregateMetrics(t *testing.T) {
 
 	entries := []*w3chttpd.Entry{
 		&w3chttpd.Entry{
@@ -46,7 +57,7 @@ func TestGetMetricsForEntries(t *testing.T) {
 		},
 	}
 
-	metrics := getMetricsForEntries(entries, time.Now(), time.Now())
+	metrics := aggregateMetrics(entries, nil, nil, nil, time.Now(), time.Now())
 
 	if len(metrics.Rank) != 3 {
 		t.Errorf("Length of metrics differs. Want %d, got %d",
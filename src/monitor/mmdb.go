@@ -0,0 +1,358 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/netip"
+)
+
+// Reader of the MaxMind DB format (GeoLite2 databases)
+// https://maxmind.github.io/MaxMind-DB/
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const mmdbDataSeparator = 16
+
+// Nesting of maps, arrays and pointers accepted in data (as libmaxminddb)
+const mmdbMaxDepth = 512
+
+type mmdbType int
+
+const (
+	mmdbExtended  mmdbType = iota
+	mmdbPointer   mmdbType = iota
+	mmdbString    mmdbType = iota
+	mmdbDouble    mmdbType = iota
+	mmdbBytes     mmdbType = iota
+	mmdbUint16    mmdbType = iota
+	mmdbUint32    mmdbType = iota
+	mmdbMap       mmdbType = iota
+	mmdbInt32     mmdbType = iota
+	mmdbUint64    mmdbType = iota
+	mmdbUint128   mmdbType = iota
+	mmdbArray     mmdbType = iota
+	mmdbContainer mmdbType = iota
+	mmdbEndMarker mmdbType = iota
+	mmdbBool      mmdbType = iota
+	mmdbFloat     mmdbType = iota
+)
+
+type mmdbReader struct {
+	buf          []byte
+	data         []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+
+	// Node reached by IPv4 addresses in an IPv6 tree (::/96)
+	ipv4Start uint
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i == -1 {
+		return nil, fmt.Errorf("invalid MaxMind DB: metadata not found")
+	}
+
+	r := &mmdbReader{buf: buf}
+
+	d := &mmdbDecoder{buf[i+len(mmdbMetadataMarker):]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MaxMind DB metadata: %v", err)
+	}
+
+	metadata, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid MaxMind DB metadata: not a map")
+	}
+
+	nodeCount, _ := metadata["node_count"].(uint64)
+	recordSize, _ := metadata["record_size"].(uint64)
+	ipVersion, _ := metadata["ip_version"].(uint64)
+	r.databaseType, _ = metadata["database_type"].(string)
+
+	r.nodeCount = uint(nodeCount)
+	r.recordSize = uint(recordSize)
+	r.ipVersion = uint(ipVersion)
+
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("invalid MaxMind DB: record size %d", r.recordSize)
+	}
+
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("invalid MaxMind DB: ip version %d", r.ipVersion)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+mmdbDataSeparator > uint(i) {
+		return nil, fmt.Errorf("invalid MaxMind DB: search tree too large")
+	}
+	r.data = buf[treeSize+mmdbDataSeparator : i]
+
+	if r.ipVersion == 6 {
+		for n := 0; n < 96 && r.ipv4Start < r.nodeCount; n++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+
+	return r, nil
+}
+
+// Left (bit = 0) or right (bit = 1) record of a node
+func (r *mmdbReader) record(node uint, bit uint) uint {
+
+	n := r.buf[node*r.recordSize/4:]
+
+	switch r.recordSize {
+
+	case 24:
+		n = n[bit*3:]
+		return uint(n[0])<<16 | uint(n[1])<<8 | uint(n[2])
+
+	case 28:
+		if bit == 0 {
+			return uint(n[3]&0xf0)<<20 | uint(n[0])<<16 | uint(n[1])<<8 | uint(n[2])
+		}
+		return uint(n[3]&0x0f)<<24 | uint(n[4])<<16 | uint(n[5])<<8 | uint(n[6])
+
+	default:
+		return uint(binary.BigEndian.Uint32(n[bit*4:]))
+	}
+}
+
+// Record stored for addr (nil if none)
+func (r *mmdbReader) lookup(addr netip.Addr) (interface{}, error) {
+
+	addr = addr.Unmap()
+
+	var ip []byte
+	node := uint(0)
+
+	if addr.Is4() {
+		a := addr.As4()
+		ip = a[:]
+		node = r.ipv4Start
+	} else if r.ipVersion == 6 {
+		a := addr.As16()
+		ip = a[:]
+	} else {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+
+	if node == r.nodeCount {
+		return nil, nil
+	}
+
+	if node < r.nodeCount {
+		return nil, fmt.Errorf("invalid MaxMind DB: search tree too deep")
+	}
+
+	offset := node - r.nodeCount - mmdbDataSeparator
+	if offset >= uint(len(r.data)) {
+		return nil, fmt.Errorf("invalid MaxMind DB: data pointer out of range")
+	}
+
+	d := &mmdbDecoder{r.data}
+	v, _, err := d.decode(offset)
+	return v, err
+}
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d *mmdbDecoder) uint(offset, size uint) (uint64, uint, error) {
+
+	if offset+size > uint(len(d.buf)) {
+		return 0, 0, fmt.Errorf("unexpected end of data")
+	}
+
+	var v uint64
+	for _, b := range d.buf[offset : offset+size] {
+		v = v<<8 | uint64(b)
+	}
+	return v, offset + size, nil
+}
+
+// Decodes the value at offset, returns it with the offset following it
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeAt(offset, 0)
+}
+
+// Corrupt data cannot nest values deeper than mmdbMaxDepth, point to a
+// pointer or declare more values than there are bytes left
+func (d *mmdbDecoder) decodeAt(offset, depth uint) (interface{}, uint, error) {
+
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("data nested deeper than %d", mmdbMaxDepth)
+	}
+
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("unexpected end of data")
+	}
+
+	ctrl := d.buf[offset]
+	offset++
+	t := mmdbType(ctrl >> 5)
+
+	if t == mmdbPointer {
+
+		ss := uint(ctrl>>3) & 0x3
+		p, next, err := d.uint(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch ss {
+		case 0:
+			p |= uint64(ctrl&0x7) << 8
+		case 1:
+			p = (p | uint64(ctrl&0x7)<<16) + 2048
+		case 2:
+			p = (p | uint64(ctrl&0x7)<<24) + 526336
+		}
+
+		if p < uint64(len(d.buf)) && mmdbType(d.buf[p]>>5) == mmdbPointer {
+			return nil, 0, fmt.Errorf("pointer to a pointer at %d", offset-1)
+		}
+
+		v, _, err := d.decodeAt(uint(p), depth+1)
+		return v, next, err
+	}
+
+	if t == mmdbExtended {
+
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, fmt.Errorf("unexpected end of data")
+		}
+		t = mmdbType(d.buf[offset]) + 7
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+
+		n := size - 28
+		v, next, err := d.uint(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		offset = next
+		switch n {
+		case 1:
+			size = 29 + uint(v)
+		case 2:
+			size = 285 + uint(v)
+		default:
+			size = 65821 + uint(v)
+		}
+	}
+
+	// Keys and values take at least a byte each
+	left := uint(len(d.buf)) - offset
+
+	switch t {
+
+	case mmdbMap:
+		if size > left/2 {
+			return nil, 0, fmt.Errorf("map of %d entries exceeds data", size)
+		}
+
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+
+			k, next, err := d.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+
+			v, next, err := d.decodeAt(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+
+	case mmdbArray:
+		if size > left {
+			return nil, 0, fmt.Errorf("array of %d values exceeds data", size)
+		}
+
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+
+			v, next, err := d.decodeAt(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("unexpected end of data")
+	}
+	b := d.buf[offset : offset+size]
+	next := offset + size
+
+	switch t {
+
+	case mmdbString:
+		return string(b), next, nil
+
+	case mmdbBytes:
+		return append([]byte{}, b...), next, nil
+
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		if size > 8 {
+			// uint128 values do not fit, only their low 64 bits are kept
+			b = b[size-8:]
+		}
+		v, _, _ := (&mmdbDecoder{b}).uint(0, uint(len(b)))
+		return v, next, nil
+
+	case mmdbInt32:
+		v, _, _ := (&mmdbDecoder{b}).uint(0, size)
+		return int64(int32(uint32(v))), next, nil
+
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", t)
+	}
+}
@@ -0,0 +1,134 @@
+package monitor
+
+import (
+	"net/netip"
+	"os"
+	"testing"
+)
+
+func TestMMDBReaderLookup(t *testing.T) {
+
+	buf, err := os.ReadFile("testdata/country.mmdb")
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		t.Fatalf("newMMDBReader: %v", err)
+	}
+
+	if r.databaseType != "GeoLite2-Country" || r.ipVersion != 6 ||
+		r.recordSize != 24 {
+		t.Errorf("Metadata differs. Got %s, ip version %d, record size %d",
+			r.databaseType, r.ipVersion, r.recordSize)
+	}
+
+	lookupTable := []struct {
+		addr       string
+		country    string
+		registered string
+	}{
+		{"1.2.3.4", "FR", ""},
+		{"::ffff:1.2.3.4", "FR", ""},
+		{"5.6.7.8", "DE", ""},
+		{"2001:db8::1", "", "JP"},
+		{"1.2.4.1", "", ""},
+		{"2001:db9::1", "", ""},
+	}
+
+	for _, rec := range lookupTable {
+
+		v, err := r.lookup(netip.MustParseAddr(rec.addr))
+		if err != nil {
+			t.Errorf("mmdbReader.lookup(%s): %v", rec.addr, err)
+			continue
+		}
+
+		if c := recordString(v, "country", "iso_code"); c != rec.country {
+			t.Errorf("Country of %s differs. Want \"%s\", got \"%s\"",
+				rec.addr, rec.country, c)
+		}
+
+		if c := recordString(v, "registered_country", "iso_code"); c != rec.registered {
+			t.Errorf("Registered country of %s differs. Want \"%s\", got \"%s\"",
+				rec.addr, rec.registered, c)
+		}
+	}
+
+	v, _ := r.lookup(netip.MustParseAddr("5.6.7.8"))
+	if name := recordString(v, "country", "names", "en"); name != "Germany" {
+		t.Errorf("Name differs. Want %s, got %s", "Germany", name)
+	}
+}
+
+func TestMMDBDecoder(t *testing.T) {
+
+	decodeTable := []struct {
+		buf      []byte
+		expected interface{}
+	}{
+		{[]byte{0x43, 'a', 'b', 'c'}, "abc"},
+		{[]byte{0xa2, 0x01, 0x00}, uint64(256)},
+		{[]byte{0xc4, 0, 1, 0, 0}, uint64(65536)},
+		{[]byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xfe}, int64(-2)},
+		{[]byte{0x02, 0x02, 0x01, 0x02}, uint64(258)},
+		{[]byte{0x01, 0x07}, true},
+		{[]byte{0x68, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 1.5},
+		// Pointer to the string at offset 6
+		{[]byte{0xe1, 0x41, 'k', 0x20, 0x06, 0x00, 0x41, 'v'}, map[string]interface{}{"k": "v"}},
+	}
+
+	for _, rec := range decodeTable {
+
+		v, _, err := (&mmdbDecoder{rec.buf}).decode(0)
+		if err != nil {
+			t.Errorf("mmdbDecoder.decode(%x): %v", rec.buf, err)
+			continue
+		}
+
+		if m, ok := rec.expected.(map[string]interface{}); ok {
+			if vm, ok := v.(map[string]interface{}); !ok || vm["k"] != m["k"] {
+				t.Errorf("Value of %x differs. Want %v, got %v", rec.buf, m, v)
+			}
+			continue
+		}
+
+		if v != rec.expected {
+			t.Errorf("Value of %x differs. Want %v (%T), got %v (%T)",
+				rec.buf, rec.expected, rec.expected, v, v)
+		}
+	}
+
+	// Arrays nested deeper than mmdbMaxDepth
+	deep := []byte{}
+	for i := 0; i <= mmdbMaxDepth; i++ {
+		deep = append(deep, 0x01, 0x04)
+	}
+	deep = append(deep, 0x40)
+
+	invalid := [][]byte{
+		{},
+		{0x43, 'a'},
+		{0xe1, 0x41},
+		{0x00, 0x05},
+		deep,
+		// Pointer to a pointer
+		{0x20, 0x02, 0x20, 0x00},
+		// Map holding a pointer to itself
+		{0xe1, 0x41, 'k', 0x20, 0x00},
+		// Array of 16 millions values in 5 bytes
+		{0x1f, 0x04, 0xff, 0xff, 0xff},
+		{0xfd, 0xff, 0xff},
+	}
+
+	for _, buf := range invalid {
+		if _, _, err := (&mmdbDecoder{buf}).decode(0); err == nil {
+			t.Errorf("Decoding %x should fail", buf)
+		}
+	}
+
+	if _, err := newMMDBReader([]byte("not a database")); err == nil {
+		t.Error("Invalid database should be rejected")
+	}
+}
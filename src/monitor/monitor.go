@@ -5,49 +5,253 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync"
 	"time"
 	"w3chttpd"
 )
 
 // Logs are written to AccessLog in chronological order
-// MetricsFrequency must be multiple of ReadFrequency
+// MetricsFrequency must be multiple of ReadFrequency, Metrics only
+// counting entries read before the end of their period
 // Delay must be smaller than readFrequency
+// WindowGranularity (1 second by default) is the resolution of the alert
+// windows, TrafficWindow of every window being a multiple of it
+// Entries are released in chronological order once AllowedLateness
+// (multiple of ReadFrequency) has passed, delaying alerts and Metrics by as
+// much, LatePolicy handling entries read after their period was emitted
+// Metrics and alerts are delivered to MetricsChan and AlertsChan (with
+// OutputBuffer and OutputPolicy) and to every subscriber, each one through
+// its own bounded queue so that a slow consumer does not stall processing
+// unless its policy is OutputBlock
+// AlertRules are evaluated in addition to the global traffic window,
+// Source names AccessLog for ScopeSource rules
+// Exporter and OTLP (optional) are updated at every readFrequency, Statsd
+// (optional) receives every Metrics
+// Entries not matching Filter are ignored by the whole monitor,
+// MetricsFilter only applies to Metrics
+// Bots classifies traffic for Metrics and alert rules (shipped signatures
+// if nil), Clients identifies visitors and client scoped rules
+// GeoIP (optional) ranks countries and ASNs and keys ScopeCountry rules
+// Sessions (optional) reports visitor sessions in Metrics and TopK
+// (optional) heavy hitters of entries matching MetricsFilter
 type Config struct {
-	AccessLog        *io.Reader
-	ReadFrequency    time.Duration
-	MetricsFrequency time.Duration
-	TrafficWindow    time.Duration
-	Threshold        int
-	BufferPoolSize   int
-	BufferSize       int
-	EntryPoolSize    int
-	Delay            time.Duration
-	AlertsChan       chan<- []*Alert
-	MetricsChan      chan<- *Metrics
+	AccessLog          *io.Reader
+	ReadFrequency      time.Duration
+	MetricsFrequency   time.Duration
+	TrafficWindow      time.Duration
+	Threshold          int
+	BufferPoolSize     int
+	BufferSize         int
+	EntryPoolSize      int
+	Delay              time.Duration
+	AlertsChan         chan<- []*Alert
+	MetricsChan        chan<- *Metrics
+	AlertRules         []*AlertRule
+	Source             string
+	Exporter           *PrometheusExporter
+	OTLP               *OTLPExporter
+	Statsd             *StatsdSink
+	Filter             *Filter
+	MetricsFilter      *Filter
+	Bots               *BotClassifier
+	Clients            *Clients
+	GeoIP              *GeoIP
+	Sessions           *SessionTracker
+	TopK               *TopK
+	WindowGranularity  time.Duration
+	AllowedLateness    time.Duration
+	LatePolicy         LatePolicy
+	OutputBuffer       int
+	OutputPolicy       OutputPolicy
+	MetricsSubscribers []*MetricsSubscriber
+	AlertsSubscribers  []*AlertsSubscriber
 
 	// Internal parameters
-	brd   *bufio.Reader
-	bpool *bufferPool
-	w     window
+	brd     *bufio.Reader
+	bpool   *bufferPool
+	w       window
+	scopes  []*scopedWindows
+	periods *metricsPeriods
+
+	// End of the last release of entries
+	watermark time.Time
+
+	// Exposed by Exporter
+	health healthCounters
+
+	// Configuration file applied last (nil if none) and closers of the
+	// components it built
+	file    *ConfigFile
+	closers []func()
+
+	outputsOnce    sync.Once
+	metricsChanSub *MetricsSubscriber
+	alertsChanSub  *AlertsSubscriber
+	metricsOut     output[*Metrics]
+	alertsOut      output[[]*Alert]
+	entriesOut     output[[]*w3chttpd.Entry]
+	parseErrorsOut output[[]*ParseError]
 }
 
-func Monitor(conf *Config) {
+// Monitor of Config (validated by Start or Run, returning an error if
+// invalid)
+// Subscribers can be added before or while it runs and unsubscribed at
+// any time, each one receiving every item independently of the others
+type Monitor struct {
+	Config *Config
 
-	if conf.MetricsFrequency%conf.ReadFrequency != 0 {
-		panic(fmt.Errorf("MetricsFrequency should be a multiple of ReadFrequency"))
+	// Internal parameters
+	mu       sync.Mutex
+	started  bool
+	stopInit sync.Once
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// Subscribers without C nor Handler are rejected
+func (m *Monitor) SubscribeMetrics(s *MetricsSubscriber) error {
+
+	if err := checkSubscriber(s.C, s.Handler); err != nil {
+		return fmt.Errorf("monitor.Monitor.SubscribeMetrics: %v", err)
 	}
 
-	if conf.Delay >= conf.ReadFrequency {
-		panic(fmt.Errorf("Delay must be smaller than ReadFrequency"))
+	m.Config.initOutputs()
+	s.subscribe(&m.Config.metricsOut)
+	return nil
+}
+
+func (m *Monitor) SubscribeAlerts(s *AlertsSubscriber) error {
+
+	if err := checkSubscriber(s.C, s.Handler); err != nil {
+		return fmt.Errorf("monitor.Monitor.SubscribeAlerts: %v", err)
+	}
+
+	m.Config.initOutputs()
+	s.subscribe(&m.Config.alertsOut)
+	return nil
+}
+
+func (m *Monitor) SubscribeEntries(s *EntriesSubscriber) error {
+
+	if err := checkSubscriber(s.C, s.Handler); err != nil {
+		return fmt.Errorf("monitor.Monitor.SubscribeEntries: %v", err)
+	}
+
+	m.Config.initOutputs()
+	s.subscribe(&m.Config.entriesOut)
+	return nil
+}
+
+func (m *Monitor) SubscribeParseErrors(s *ParseErrorsSubscriber) error {
+
+	if err := checkSubscriber(s.C, s.Handler); err != nil {
+		return fmt.Errorf("monitor.Monitor.SubscribeParseErrors: %v", err)
+	}
+
+	m.Config.initOutputs()
+	s.subscribe(&m.Config.parseErrorsOut)
+	return nil
+}
+
+// Prepares conf for processing
+func (conf *Config) start() error {
+
+	if err := conf.validate(); err != nil {
+		return err
+	}
+
+	if conf.GeoIP != nil {
+		if err := conf.GeoIP.start(); err != nil {
+			return err
+		}
+	}
+
+	if err := conf.Bots.start(); err != nil {
+		return err
 	}
 
 	conf.brd = bufio.NewReaderSize(*conf.AccessLog,
 		conf.BufferPoolSize*conf.BufferSize)
 	conf.w.init(conf.TrafficWindow, conf.Threshold, conf.EntryPoolSize)
+	conf.w.setGranularity(conf.WindowGranularity)
+	conf.w.queue.epool.health = &conf.health
 
-	conf.bpool = &bufferPool{}
+	conf.bpool = &bufferPool{health: &conf.health}
 	conf.bpool.init(conf.BufferPoolSize, conf.BufferSize)
 
+	if conf.Exporter != nil {
+		conf.Exporter.setHealth(&conf.health)
+	}
+
+	if conf.Sessions != nil {
+		conf.Sessions.clients = conf.Clients
+	}
+
+	if conf.TopK != nil {
+		conf.TopK.clients = conf.Clients
+	}
+
+	conf.scopes = make([]*scopedWindows, 0, len(conf.AlertRules))
+	for _, rule := range conf.AlertRules {
+		conf.scopes = append(conf.scopes, conf.newScopedWindows(rule))
+	}
+
+	return nil
+}
+
+func (m *Monitor) stopChan() chan struct{} {
+
+	m.stopInit.Do(func() { m.stop = make(chan struct{}) })
+	return m.stop
+}
+
+// Run returns after the current read, once the items queued for
+// subscribers are delivered (see flushTimeout), their channels being
+// closed
+func (m *Monitor) Stop() {
+
+	stop := m.stopChan()
+	m.stopOnce.Do(func() { close(stop) })
+}
+
+func (m *Monitor) start() error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.started {
+		return nil
+	}
+
+	if err := m.Config.start(); err != nil {
+		return err
+	}
+
+	m.started = true
+	return nil
+}
+
+// Validates Config and starts its components (e.g. loading the GeoIP
+// databases) so that errors are known before Run, which starts the
+// monitor itself otherwise
+func (m *Monitor) Start() error {
+
+	if err := m.start(); err != nil {
+		return fmt.Errorf("monitor.Monitor.Start: %v", err)
+	}
+	return nil
+}
+
+// Reads AccessLog at every ReadFrequency until Stop is called
+func (m *Monitor) Run() error {
+
+	conf := m.Config
+	stop := m.stopChan()
+
+	if err := m.start(); err != nil {
+		return fmt.Errorf("monitor.Monitor.Run: %v", err)
+	}
+
 	unprocessedBytes := []byte{}
 	frequency := conf.ReadFrequency
 	var previousRun int64 = -1
@@ -55,7 +259,14 @@ func Monitor(conf *Config) {
 	for {
 		now := time.Now().UnixNano()
 		nextRun := now - (now % int64(frequency)) + int64(frequency)
-		time.Sleep(time.Duration(nextRun - now))
+
+		select {
+		case <-time.After(time.Duration(nextRun - now)):
+		case <-stop:
+			conf.closeOutputs()
+			conf.closeComponents()
+			return nil
+		}
 
 		if previousRun != -1 && now-previousRun >= int64(frequency) {
 			log.Println("Potentially missing logs! Please adjust parameters")
@@ -64,65 +275,255 @@ func Monitor(conf *Config) {
 		// ProcessLog is blocking and should take less time
 		// to execute than readFrequency,
 		// otherwise parameters need adjustment
+		// Reloads are applied between two reads
+		m.mu.Lock()
 		unprocessedBytes = processLog(nextRun, unprocessedBytes, conf)
+		m.mu.Unlock()
 
 		time.Sleep(conf.Delay)
 		previousRun = nextRun
 	}
 }
 
+// WindowGranularity defaults to 1 second
+func (conf *Config) validate() error {
+
+	if conf.ReadFrequency <= 0 {
+		return fmt.Errorf("ReadFrequency must be positive")
+	}
+
+	if conf.MetricsFrequency%conf.ReadFrequency != 0 {
+		return fmt.Errorf("MetricsFrequency should be a multiple of ReadFrequency")
+	}
+
+	if conf.AllowedLateness < 0 ||
+		conf.AllowedLateness%conf.ReadFrequency != 0 {
+		return fmt.Errorf("AllowedLateness should be a multiple of ReadFrequency")
+	}
+
+	if conf.Delay >= conf.ReadFrequency {
+		return fmt.Errorf("Delay must be smaller than ReadFrequency")
+	}
+
+	if conf.WindowGranularity <= 0 {
+		conf.WindowGranularity = time.Second
+	}
+
+	if conf.TrafficWindow%conf.WindowGranularity != 0 {
+		return fmt.Errorf("TrafficWindow should be a multiple of WindowGranularity")
+	}
+
+	if err := conf.Clients.validate(); err != nil {
+		return err
+	}
+
+	for _, s := range conf.MetricsSubscribers {
+		if err := checkSubscriber(s.C, s.Handler); err != nil {
+			return fmt.Errorf("MetricsSubscribers: %v", err)
+		}
+	}
+
+	for _, s := range conf.AlertsSubscribers {
+		if err := checkSubscriber(s.C, s.Handler); err != nil {
+			return fmt.Errorf("AlertsSubscribers: %v", err)
+		}
+	}
+
+	for _, rule := range conf.AlertRules {
+
+		if rule.TrafficWindow <= 0 {
+			return fmt.Errorf("TrafficWindow of alert rule %q must be positive",
+				rule.Name)
+		}
+
+		if rule.TrafficWindow%conf.WindowGranularity != 0 {
+			return fmt.Errorf("TrafficWindow of alert rule %q should be a "+
+				"multiple of WindowGranularity", rule.Name)
+		}
+
+		if rule.Scope == ScopeCountry &&
+			(conf.GeoIP == nil || conf.GeoIP.CountryDB == "") {
+			return fmt.Errorf("Alert rule %q scoped by country requires a "+
+				"GeoIP country database", rule.Name)
+		}
+
+		for _, name := range rule.ExcludeNetworks {
+			if !conf.Clients.hasNetwork(name) {
+				return fmt.Errorf("Alert rule %q excludes unknown network "+
+					"list %q", rule.Name, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (conf *Config) newScopedWindows(rule *AlertRule) *scopedWindows {
+
+	// Rules share the entry pool of the global window, so that neither a
+	// rule nor a reload allocates another EntryPoolSize entries
+	sw := newScopedWindows(rule, conf.Source, conf.w.queue.epool)
+	sw.bots = conf.Bots
+	sw.clients = conf.Clients
+	sw.geo = conf.GeoIP
+	sw.granularity = conf.WindowGranularity
+	return sw
+}
+
 func processLog(now int64, unprocessedBytes []byte, conf *Config) []byte {
 
+	started := time.Now()
+
+	conf.initOutputs()
+
+	processed := len(conf.w.queue.entries)
+	errs := &parseErrors{}
 	unprocessedBytes = processBuffer(conf.brd, conf.bpool,
-		conf.w.queue, unprocessedBytes)
+		conf.w.queue, unprocessedBytes, errs)
+
+	conf.health.linesParsed.Add(int64(len(conf.w.queue.entries) - processed))
+	conf.health.parseFailures.Add(int64(len(errs.errs)))
+
+	if len(errs.errs) != 0 {
+		for _, pe := range errs.errs {
+			pe.Time = time.Unix(0, now)
+		}
+		conf.parseErrorsOut.publish(errs.errs)
+	}
+
+	if conf.Filter != nil {
+		conf.w.queue.filterFrom(processed, conf.Filter)
+	}
+
+	// Entries are copied for subscribers before being reordered
+	if conf.entriesOut.subscribed() && processed < len(conf.w.queue.entries) {
+		entries := make([]*w3chttpd.Entry, 0,
+			len(conf.w.queue.entries)-processed)
+		for _, e := range conf.w.queue.entries[processed:] {
+			entries = append(entries, copyEntry(e))
+		}
+		conf.entriesOut.publish(entries)
+	}
 
-	startMetrics := time.Unix(0, now-int64(conf.MetricsFrequency))
-	startTrafficWindow := time.Unix(0, now-int64(conf.TrafficWindow))
+	if conf.Exporter != nil {
+		conf.Exporter.observeEntries(conf.w.queue.entries[processed:])
+	}
+
+	if conf.OTLP != nil {
+		conf.OTLP.observeEntries(conf.w.queue.entries[processed:],
+			time.Unix(0, now))
+	}
 
-	// Period = [ start - now [
-	end := time.Unix(-1, now)
+	// Entries are released once AllowedLateness has passed
+	horizon := now - int64(conf.AllowedLateness)
 
-	// Remove outdated entries
-	deleted := conf.w.queue.removeOutdatedEntries(conf.w.edge,
-		startMetrics, startTrafficWindow)
+	startMetrics := time.Unix(0, horizon-int64(conf.MetricsFrequency))
+
+	// Period = [ start - horizon [
+	end := time.Unix(-1, horizon)
+
+	n := reorderQueue(conf.w.queue, processed, conf.watermark, end,
+		&conf.health)
+	released := conf.w.queue.entries[:n]
+	conf.watermark = end
+
+	// Feed scoped windows before released entries get recycled
+	for _, sw := range conf.scopes {
+		sw.add(released)
+	}
+
+	// Metrics are folded as entries are released
+	if conf.periods == nil {
+		conf.periods = newMetricsPeriods(conf)
+	}
+	conf.periods.fold(horizon, released)
+
+	if conf.Sessions != nil {
+		conf.Sessions.observe(released)
+	}
+
+	for _, correction := range conf.periods.takeCorrections() {
+		conf.metricsOut.publish(correction)
+	}
 
 	// Trigger metrics computation if needed
-	if (now % int64(conf.MetricsFrequency)) == 0 {
-		entries := conf.w.queue.getEntriesInWindow(startMetrics, end)
+	if (horizon % int64(conf.MetricsFrequency)) == 0 {
+		partials := conf.periods.take(horizon)
 
-		copied := make([]*w3chttpd.Entry, len(entries))
-		copy(copied, entries)
+		var sessions *SessionMetrics
+		if conf.Sessions != nil {
+			sessions = conf.Sessions.report(end)
+		}
 
-		go func() {
-			conf.MetricsChan <- getMetricsForEntries(copied, startMetrics, end)
-		}()
+		var heavyHitters *HeavyHitters
+		if conf.TopK != nil {
+			heavyHitters = conf.TopK.report(startMetrics.UnixNano())
+		}
+
+		metrics := conf.periods.metrics(partials, startMetrics, end)
+		metrics.Sessions = sessions
+		metrics.HeavyHitters = heavyHitters
+		if conf.OTLP != nil {
+			conf.OTLP.publish(metrics)
+		}
+		if conf.Statsd != nil {
+			if err := conf.Statsd.Publish(metrics); err != nil {
+				log.Printf("StatsdSink.Publish: %v", err)
+			}
+		}
+		conf.metricsOut.publish(metrics)
 	}
 
 	// Check Alerts at every readFrequency
-	alerts := conf.w.getNewAlerts(end, deleted)
+	// Released entries are recycled by the global window
+	alerts := conf.w.getNewAlerts(end)
+	for _, sw := range conf.scopes {
+		alerts = append(alerts, sw.getNewAlerts(end)...)
+	}
+
+	if conf.OTLP != nil {
+		conf.OTLP.observeWindows(windowStates(conf))
+	}
+
+	if conf.Exporter != nil {
+		conf.Exporter.observeWindows(windowStates(conf))
+		conf.Exporter.observeProcessLog(time.Since(started))
+	}
+
 	if len(alerts) != 0 {
-		conf.AlertsChan <- alerts
+		conf.alertsOut.publish(alerts)
 	}
 
 	return unprocessedBytes
 }
 
+// Returns once both channels are closed
 func Display(w io.Writer, alertsChan <-chan []*Alert,
 	metricsChan <-chan *Metrics) {
 
 	alertHistory := []*Alert{}
 
-	for {
+	for alertsChan != nil || metricsChan != nil {
 
 		select {
 
-		case alerts := <-alertsChan:
+		case alerts, ok := <-alertsChan:
+			if !ok {
+				alertsChan = nil
+				continue
+			}
+
 			alertHistory = append(alertHistory, alerts...)
 			for _, a := range alerts {
 				fmt.Fprintln(w, a)
 			}
 
-		case metrics := <-metricsChan:
+		case metrics, ok := <-metricsChan:
+			if !ok {
+				metricsChan = nil
+				continue
+			}
+
 			fmt.Fprintln(w, metrics)
 			for _, alert := range alertHistory {
 				fmt.Fprintln(w, alert)
@@ -78,3 +78,23 @@ func TestProccessLog(t *testing.T) {
 	}
 
 }
+
+func TestMonitorRunInvalid(t *testing.T) {
+
+	accessLog := io.Reader(strings.NewReader(""))
+	m := &Monitor{Config: &Config{
+		AccessLog:      &accessLog,
+		ReadFrequency:  -time.Second,
+		BufferPoolSize: 1,
+		BufferSize:     100,
+		EntryPoolSize:  10,
+	}}
+
+	if err := m.Start(); err == nil {
+		t.Errorf("Start with a negative read frequency should fail")
+	}
+
+	if err := m.Run(); err == nil {
+		t.Errorf("Run with a negative read frequency should fail")
+	}
+}
@@ -0,0 +1,207 @@
+package monitor
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"w3chttpd"
+)
+
+// Named list of CIDR ranges (internal ranges, health checkers, partners...)
+// Entries from an Exclude list are ignored by Metrics, the others being
+// broken out in Metrics.Networks
+type NetworkList struct {
+	Name     string
+	Prefixes []netip.Prefix
+	Exclude  bool
+}
+
+func (nl *NetworkList) contains(addr netip.Addr) bool {
+
+	for _, p := range nl.Prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client identification from Entry.Ip (IPv4 or IPv6)
+// Behind proxies, ForwardedField is the position (1 being the first) of the
+// Entry.Extra field holding the forwarded chain (e.g. X-Forwarded-For): the
+// chain followed by Entry.Ip is walked from right to left while addresses
+// belong to TrustedProxies, the first untrusted one being the client
+// Clients are grouped by IPv4Prefix / IPv6Prefix bits (e.g. 24 or 64) so
+// NATed or rotating clients count as one, 0 keeping full addresses
+// An entry belongs to the first of Networks containing its address
+// The zero value (or a nil Clients) keys clients by address
+type Clients struct {
+	IPv4Prefix     int
+	IPv6Prefix     int
+	Networks       []*NetworkList
+	TrustedProxies []netip.Prefix
+	ForwardedField int
+}
+
+func (c *Clients) validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 {
+		return fmt.Errorf("IPv4Prefix must be between 0 and 32")
+	}
+
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return fmt.Errorf("IPv6Prefix must be between 0 and 128")
+	}
+
+	if c.ForwardedField < 0 {
+		return fmt.Errorf("ForwardedField must be positive")
+	}
+
+	names := make(map[string]bool, len(c.Networks))
+	for _, nl := range c.Networks {
+
+		if nl.Name == "" || names[nl.Name] {
+			return fmt.Errorf("network lists need a unique name (got %q)", nl.Name)
+		}
+		names[nl.Name] = true
+	}
+
+	return nil
+}
+
+func (c *Clients) hasNetwork(name string) bool {
+
+	if c == nil {
+		return false
+	}
+
+	for _, nl := range c.Networks {
+		if nl.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Addresses with a port (e.g. "[2001:db8::1]:443") are accepted as well
+func parseAddr(ip string) (netip.Addr, bool) {
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+
+		addrPort, err := netip.ParseAddrPort(ip)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = addrPort.Addr()
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+func (c *Clients) trusted(addr netip.Addr) bool {
+
+	for _, p := range c.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client address, resolved through trusted proxies if configured
+// IPv4-mapped IPv6 addresses are unmapped, invalid addresses return false
+func (c *Clients) addr(e *w3chttpd.Entry) (netip.Addr, bool) {
+
+	addr, ok := parseAddr(string(e.Ip))
+	if !ok || c == nil || c.ForwardedField == 0 || !c.trusted(addr) ||
+		c.ForwardedField > len(e.Extra) {
+		return addr, ok
+	}
+
+	chain := strings.Split(string(e.Extra[c.ForwardedField-1]), ",")
+
+	// An unparsable hop cannot be trusted, the last trusted proxy
+	// is then the best known client
+	for i := len(chain) - 1; i >= 0; i-- {
+
+		hop := strings.TrimSpace(chain[i])
+		if hop == "" || hop == "-" {
+			continue
+		}
+
+		hopAddr, ok := parseAddr(hop)
+		if !ok {
+			return addr, true
+		}
+
+		addr = hopAddr
+		if !c.trusted(addr) {
+			break
+		}
+	}
+
+	return addr, true
+}
+
+// Grouped client address (e.g. 10.0.0.0/24), the raw Entry.Ip if invalid
+func (c *Clients) key(e *w3chttpd.Entry) string {
+
+	addr, ok := c.addr(e)
+	if !ok {
+		return string(e.Ip)
+	}
+
+	bits := 0
+	if c != nil && addr.Is4() {
+		bits = c.IPv4Prefix
+	} else if c != nil {
+		bits = c.IPv6Prefix
+	}
+
+	if bits == 0 {
+		return addr.String()
+	}
+
+	return netip.PrefixFrom(addr, bits).Masked().String()
+}
+
+// First network list containing the client address (nil if none)
+func (c *Clients) network(e *w3chttpd.Entry) *NetworkList {
+
+	if c == nil || len(c.Networks) == 0 {
+		return nil
+	}
+
+	addr, ok := c.addr(e)
+	if !ok {
+		return nil
+	}
+
+	for _, nl := range c.Networks {
+		if nl.contains(addr) {
+			return nl
+		}
+	}
+
+	return nil
+}
+
+// Entries in one of the named network lists
+func (c *Clients) inNetworks(e *w3chttpd.Entry, names []string) bool {
+
+	nl := c.network(e)
+	if nl == nil {
+		return false
+	}
+
+	for _, name := range names {
+		if nl.Name == name {
+			return true
+		}
+	}
+	return false
+}
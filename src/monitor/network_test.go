@@ -0,0 +1,251 @@
+package monitor
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+	"w3chttpd"
+)
+
+func newTestClients() *Clients {
+
+	return &Clients{
+		IPv4Prefix: 24,
+		IPv6Prefix: 64,
+		Networks: []*NetworkList{
+			&NetworkList{
+				Name:     "healthcheck",
+				Prefixes: []netip.Prefix{netip.MustParsePrefix("10.9.0.0/16")},
+				Exclude:  true,
+			},
+			&NetworkList{
+				Name: "internal",
+				Prefixes: []netip.Prefix{
+					netip.MustParsePrefix("10.0.0.0/8"),
+					netip.MustParsePrefix("fd00::/8"),
+				},
+			},
+		},
+	}
+}
+
+func TestClientsKey(t *testing.T) {
+
+	keyTable := []struct {
+		ip      string
+		grouped string
+		full    string
+	}{
+		{"10.0.0.17", "10.0.0.0/24", "10.0.0.17"},
+		{"::ffff:10.0.0.17", "10.0.0.0/24", "10.0.0.17"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64", "2001:db8:1:2:3:4:5:6"},
+		{"2001:DB8::1", "2001:db8::/64", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::/64", "fe80::1"},
+		{"not-an-ip", "not-an-ip", "not-an-ip"},
+	}
+
+	c := newTestClients()
+	var nilClients *Clients
+
+	for _, rec := range keyTable {
+
+		e := &w3chttpd.Entry{Ip: []byte(rec.ip)}
+
+		if key := c.key(e); key != rec.grouped {
+			t.Errorf("Grouped key of %s differs. Want %s, got %s",
+				rec.ip, rec.grouped, key)
+		}
+
+		if key := nilClients.key(e); key != rec.full {
+			t.Errorf("Key of %s differs. Want %s, got %s", rec.ip, rec.full, key)
+		}
+	}
+}
+
+func TestClientsValidate(t *testing.T) {
+
+	invalid := []*Clients{
+		&Clients{IPv4Prefix: 33},
+		&Clients{IPv6Prefix: -1},
+		&Clients{Networks: []*NetworkList{&NetworkList{}}},
+		&Clients{Networks: []*NetworkList{
+			&NetworkList{Name: "a"}, &NetworkList{Name: "a"},
+		}},
+	}
+
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Errorf("%+v should be rejected", c)
+		}
+	}
+
+	if err := newTestClients().validate(); err != nil {
+		t.Errorf("Clients.validate: %v", err)
+	}
+}
+
+func TestConfigValidateNetworks(t *testing.T) {
+
+	conf := &Config{
+		ReadFrequency: time.Second,
+		Clients:       newTestClients(),
+		AlertRules: []*AlertRule{&AlertRule{
+			Name:            "external",
+			TrafficWindow:   time.Minute,
+			ExcludeNetworks: []string{"internal"},
+		}},
+	}
+
+	if err := conf.validate(); err != nil {
+		t.Errorf("Config.validate: %v", err)
+	}
+
+	// A typo would silently exclude nothing
+	conf.AlertRules[0].ExcludeNetworks = []string{"intenral"}
+	if err := conf.validate(); err == nil {
+		t.Errorf("Unknown network list should be rejected")
+	}
+
+	conf.Clients = nil
+	conf.AlertRules[0].ExcludeNetworks = []string{"internal"}
+	if err := conf.validate(); err == nil {
+		t.Errorf("Network lists should be required")
+	}
+}
+
+func TestMetricsNetworks(t *testing.T) {
+
+	entries := []*w3chttpd.Entry{
+		&w3chttpd.Entry{Ip: []byte("10.0.0.1"), Size: 100},
+		&w3chttpd.Entry{Ip: []byte("10.0.0.2"), Size: 100},
+		&w3chttpd.Entry{Ip: []byte("10.1.0.2"), Size: 100},
+		&w3chttpd.Entry{Ip: []byte("10.9.0.1"), Size: 1000},
+		&w3chttpd.Entry{Ip: []byte("192.0.2.1"), Size: 10},
+	}
+
+	start := time.Date(2004, 3, 7, 16, 0, 0, 0, time.UTC)
+	m := aggregateMetrics(entries, nil, newTestClients(), nil,
+		start, start.Add(10*time.Second))
+
+	if m.RequestCount != 4 || m.TotalTraffic != 310 {
+		t.Errorf("Excluded networks should be ignored. Got %d requests, %d bytes",
+			m.RequestCount, m.TotalTraffic)
+	}
+
+	// 10.0.0.1 and 10.0.0.2 are grouped in 10.0.0.0/24
+	if m.UniqueVisitors != 3 {
+		t.Errorf("UniqueVisitors differs. Want %d, got %d", 3, m.UniqueVisitors)
+	}
+
+	expected := []NetworkMetrics{{"internal", 3, 2, 300}}
+	if !reflect.DeepEqual(m.Networks, expected) {
+		t.Errorf("Networks differ. Want %+v, got %+v", expected, m.Networks)
+	}
+}
+
+func TestAlertRuleNetworks(t *testing.T) {
+
+	entries := []*w3chttpd.Entry{
+		&w3chttpd.Entry{Ip: []byte("10.0.0.1"), Timestamp: time.Unix(1, 0), Size: 300},
+		&w3chttpd.Entry{Ip: []byte("10.0.0.2"), Timestamp: time.Unix(1, 0), Size: 300},
+		&w3chttpd.Entry{Ip: []byte("192.0.2.1"), Timestamp: time.Unix(2, 0), Size: 300},
+	}
+
+	rule := &AlertRule{
+		Name:          "per-network",
+		Scope:         ScopeNetwork,
+		TrafficWindow: 2 * time.Minute,
+		Threshold:     500,
+	}
+
+	sw := newScopedWindows(rule, "", newTestEntryPool(10))
+	sw.clients = newTestClients()
+	sw.add(entries)
+
+	alerts := sw.getNewAlerts(time.Unix(2, 0))
+	if len(alerts) != 1 || alerts[0].Key != "internal" || alerts[0].Total != 600 {
+		t.Errorf("Should want an alert for network %s. Got %v", "internal", alerts)
+	}
+
+	rule = &AlertRule{
+		Name:            "external",
+		TrafficWindow:   2 * time.Minute,
+		Threshold:       500,
+		ExcludeNetworks: []string{"internal"},
+	}
+
+	sw = newScopedWindows(rule, "", newTestEntryPool(10))
+	sw.clients = newTestClients()
+	sw.add(entries)
+
+	if alerts := sw.getNewAlerts(time.Unix(2, 0)); len(alerts) != 0 {
+		t.Errorf("Excluded networks should not trigger alerts. Got %v", alerts)
+	}
+
+	rule = &AlertRule{
+		Name:          "per-client",
+		Scope:         ScopeClient,
+		TrafficWindow: 2 * time.Minute,
+		Threshold:     500,
+	}
+
+	sw = newScopedWindows(rule, "", newTestEntryPool(10))
+	sw.clients = newTestClients()
+	sw.add(entries)
+
+	alerts = sw.getNewAlerts(time.Unix(2, 0))
+	if len(alerts) != 1 || alerts[0].Key != "10.0.0.0/24" {
+		t.Errorf("Should want an alert for client %s. Got %v", "10.0.0.0/24", alerts)
+	}
+}
+
+func TestClientsForwarded(t *testing.T) {
+
+	c := &Clients{
+		TrustedProxies: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("2001:db8:ffff::/48"),
+		},
+		ForwardedField: 1,
+	}
+
+	addrTable := []struct {
+		ip        string
+		forwarded string
+		client    string
+	}{
+		// Direct clients cannot spoof their address
+		{"198.51.100.1", "203.0.113.7", "198.51.100.1"},
+		{"10.0.0.1", "203.0.113.7", "203.0.113.7"},
+		{"10.0.0.1", "198.51.100.9, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"10.0.0.1", "203.0.113.7:51234, 2001:db8:ffff::1", "203.0.113.7"},
+		{"10.0.0.1", "[2001:db8::5]:443", "2001:db8::5"},
+		{"10.0.0.1", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1", "203.0.113.7, garbage, 10.0.0.2", "10.0.0.2"},
+		{"10.0.0.1", "-", "10.0.0.1"},
+	}
+
+	for _, rec := range addrTable {
+
+		e := &w3chttpd.Entry{
+			Ip:    []byte(rec.ip),
+			Extra: [][]byte{[]byte(rec.forwarded)},
+		}
+
+		if key := c.key(e); key != rec.client {
+			t.Errorf("Client of %s (forwarded for \"%s\") differs. Want %s, got %s",
+				rec.ip, rec.forwarded, rec.client, key)
+		}
+	}
+
+	// Missing field
+	e := &w3chttpd.Entry{Ip: []byte("10.0.0.1")}
+	if key := c.key(e); key != "10.0.0.1" {
+		t.Errorf("Client differs. Want %s, got %s", "10.0.0.1", key)
+	}
+
+	if err := (&Clients{ForwardedField: -1}).validate(); err == nil {
+		t.Error("Negative ForwardedField should be rejected")
+	}
+}
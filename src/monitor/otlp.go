@@ -0,0 +1,537 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"w3chttpd"
+)
+
+type OTLPProtocol int
+
+const (
+	OTLPHTTP OTLPProtocol = iota
+	OTLPGRPC OTLPProtocol = iota
+)
+
+func (p OTLPProtocol) String() string {
+
+	switch p {
+
+	case OTLPHTTP:
+		return "http"
+
+	case OTLPGRPC:
+		return "grpc"
+
+	default:
+		return fmt.Sprintf("protocol(%d)", int(p))
+	}
+}
+
+func ParseOTLPProtocol(name string) (OTLPProtocol, error) {
+
+	for p := OTLPHTTP; p <= OTLPGRPC; p++ {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown OTLP protocol %q", name)
+}
+
+const (
+	otlpHTTPPath = "/v1/metrics"
+	otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+	// AggregationTemporality
+	otlpDelta      = 1
+	otlpCumulative = 2
+)
+
+var (
+	otlpSizeBounds      = []float64{100, 1000, 10000, 100000, 1000000}
+	otlpIngestLagBounds = []float64{.1, .5, 1, 5, 10, 30, 60}
+)
+
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) snapshot() *histogram {
+
+	c := *h
+	c.counts = append([]uint64{}, h.counts...)
+	return &c
+}
+
+type otlpBatch struct {
+	metrics    *Metrics
+	sizes      *histogram
+	ingestLags *histogram
+	windows    map[windowLabels]windowState
+}
+
+// Exports each period Metrics (as delta sums and gauges), the alert
+// windows state and cumulative histograms of response sizes and ingest lag
+// (delay between an entry timestamp and its processing, access logs
+// carrying no request latency) to an OTLP collector when set in
+// Config.OTLP
+// Endpoint is the collector base URL, for instance http://localhost:4318
+// for OTLPHTTP or http://localhost:4317 for OTLPGRPC (h2c unless https)
+// Exports are done by a worker so processLog never blocks: when QueueSize
+// batches are already waiting, new ones are dropped
+type OTLPExporter struct {
+	Endpoint           string
+	Protocol           OTLPProtocol
+	Headers            map[string]string
+	ServiceName        string
+	Source             string
+	ResourceAttributes map[string]string
+	Timeout            time.Duration
+	QueueSize          int
+
+	// Internal parameters
+	once       sync.Once
+	client     *http.Client
+	started    time.Time
+	mu         sync.Mutex
+	sizes      *histogram
+	ingestLags *histogram
+	windows    map[windowLabels]windowState
+	closed     bool
+	pending    chan *otlpBatch
+	done       chan struct{}
+}
+
+func (oe *OTLPExporter) start() {
+
+	oe.once.Do(func() {
+
+		if oe.ServiceName == "" {
+			oe.ServiceName = "httpmonitor"
+		}
+
+		if oe.Timeout <= 0 {
+			oe.Timeout = 10 * time.Second
+		}
+
+		if oe.QueueSize <= 0 {
+			oe.QueueSize = 10
+		}
+
+		transport := &http.Transport{}
+		if oe.Protocol == OTLPGRPC {
+			transport.Protocols = &http.Protocols{}
+			transport.Protocols.SetHTTP2(true)
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+
+		oe.client = &http.Client{Transport: transport, Timeout: oe.Timeout}
+		oe.started = time.Now()
+		oe.sizes = newHistogram(otlpSizeBounds)
+		oe.ingestLags = newHistogram(otlpIngestLagBounds)
+		oe.pending = make(chan *otlpBatch, oe.QueueSize)
+		oe.done = make(chan struct{})
+
+		go oe.run()
+	})
+}
+
+func (oe *OTLPExporter) observeEntries(entries []*w3chttpd.Entry,
+	now time.Time) {
+
+	oe.start()
+
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+
+	for _, e := range entries {
+		oe.sizes.observe(float64(e.Size))
+		oe.ingestLags.observe(now.Sub(e.Timestamp).Seconds())
+	}
+}
+
+func (oe *OTLPExporter) observeWindows(windows map[windowLabels]windowState) {
+
+	oe.start()
+
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+
+	oe.windows = windows
+}
+
+// Metrics published after Close are ignored
+func (oe *OTLPExporter) publish(m *Metrics) {
+
+	oe.start()
+
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+
+	if oe.closed {
+		return
+	}
+
+	batch := &otlpBatch{m, oe.sizes.snapshot(), oe.ingestLags.snapshot(),
+		oe.windows}
+
+	select {
+	case oe.pending <- batch:
+	default:
+		log.Printf("OTLPExporter: queue full, metrics dropped")
+	}
+}
+
+// Pending batches are exported before returning, closing again having no
+// effect
+func (oe *OTLPExporter) Close() {
+
+	oe.start()
+
+	oe.mu.Lock()
+	if !oe.closed {
+		oe.closed = true
+		close(oe.pending)
+	}
+	oe.mu.Unlock()
+
+	<-oe.done
+}
+
+func (oe *OTLPExporter) run() {
+
+	defer close(oe.done)
+
+	for batch := range oe.pending {
+		if err := oe.export(oe.encode(batch)); err != nil {
+			log.Printf("OTLPExporter.export: %v", err)
+		}
+	}
+}
+
+func (oe *OTLPExporter) export(msg []byte) error {
+
+	endpoint := strings.TrimSuffix(oe.Endpoint, "/")
+
+	var req *http.Request
+	var err error
+
+	if oe.Protocol == OTLPGRPC {
+
+		// Length-prefixed message, uncompressed
+		frame := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		frame = append(frame, msg...)
+
+		req, err = http.NewRequest(http.MethodPost, endpoint+otlpGRPCPath,
+			bytes.NewReader(frame))
+		if err != nil {
+			return fmt.Errorf("http.NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+
+	} else {
+
+		req, err = http.NewRequest(http.MethodPost, endpoint+otlpHTTPPath,
+			bytes.NewReader(msg))
+		if err != nil {
+			return fmt.Errorf("http.NewRequest: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+
+	for k, v := range oe.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := oe.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("http.Client.Do: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if oe.Protocol == OTLPGRPC {
+		status := resp.Trailer.Get("Grpc-Status")
+		if status == "" {
+			status = resp.Header.Get("Grpc-Status")
+		}
+		if status != "0" {
+			return fmt.Errorf("grpc status %s: %s", status,
+				resp.Trailer.Get("Grpc-Message"))
+		}
+	}
+
+	return nil
+}
+
+// Protocol buffers encoding of an ExportMetricsServiceRequest
+// (opentelemetry/proto/collector/metrics/v1)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func appendTag(b []byte, field, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wire))
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendStringField(b []byte, field int, v string) []byte {
+	return appendBytesField(b, field, []byte(v))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	return binary.AppendUvarint(appendTag(b, field, wireVarint), v)
+}
+
+func appendFixed64Field(b []byte, field int, v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(appendTag(b, field, wireFixed64), v)
+}
+
+func appendDoubleField(b []byte, field int, v float64) []byte {
+	return appendFixed64Field(b, field, math.Float64bits(v))
+}
+
+// KeyValue with a string AnyValue
+func appendAttribute(b []byte, field int, key, value string) []byte {
+
+	kv := appendStringField(nil, 1, key)
+	kv = appendBytesField(kv, 2, appendStringField(nil, 1, value))
+	return appendBytesField(b, field, kv)
+}
+
+func appendAttributes(b []byte, field int, attributes map[string]string) []byte {
+
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		b = appendAttribute(b, field, k, attributes[k])
+	}
+	return b
+}
+
+// NumberDataPoint, v being an int64 or a float64
+func numberDataPoint(attributes map[string]string, start, end time.Time,
+	v interface{}) []byte {
+
+	dp := appendAttributes(nil, 7, attributes)
+	if !start.IsZero() {
+		dp = appendFixed64Field(dp, 2, uint64(start.UnixNano()))
+	}
+	dp = appendFixed64Field(dp, 3, uint64(end.UnixNano()))
+
+	switch n := v.(type) {
+	case int64:
+		dp = appendFixed64Field(dp, 6, uint64(n))
+	case float64:
+		dp = appendDoubleField(dp, 4, n)
+	}
+
+	return dp
+}
+
+func metric(name, description, unit string, field int, data []byte) []byte {
+
+	m := appendStringField(nil, 1, name)
+	m = appendStringField(m, 2, description)
+	m = appendStringField(m, 3, unit)
+	return appendBytesField(m, field, data)
+}
+
+func gaugeMetric(name, description, unit string, points ...[]byte) []byte {
+
+	g := []byte{}
+	for _, dp := range points {
+		g = appendBytesField(g, 1, dp)
+	}
+	return metric(name, description, unit, 5, g)
+}
+
+func sumMetric(name, description, unit string, temporality int,
+	points ...[]byte) []byte {
+
+	s := []byte{}
+	for _, dp := range points {
+		s = appendBytesField(s, 1, dp)
+	}
+	s = appendVarintField(s, 2, uint64(temporality))
+	s = appendVarintField(s, 3, 1) // monotonic
+	return metric(name, description, unit, 7, s)
+}
+
+func histogramMetric(name, description, unit string, h *histogram,
+	start, end time.Time) []byte {
+
+	dp := appendFixed64Field(nil, 2, uint64(start.UnixNano()))
+	dp = appendFixed64Field(dp, 3, uint64(end.UnixNano()))
+	dp = appendFixed64Field(dp, 4, h.count)
+	dp = appendDoubleField(dp, 5, h.sum)
+
+	counts := []byte{}
+	for _, c := range h.counts {
+		counts = binary.LittleEndian.AppendUint64(counts, c)
+	}
+	dp = appendBytesField(dp, 6, counts)
+
+	bounds := []byte{}
+	for _, bound := range h.bounds {
+		bounds = binary.LittleEndian.AppendUint64(bounds, math.Float64bits(bound))
+	}
+	dp = appendBytesField(dp, 7, bounds)
+
+	hist := appendBytesField(nil, 1, dp)
+	hist = appendVarintField(hist, 2, otlpCumulative)
+	return metric(name, description, unit, 9, hist)
+}
+
+func (oe *OTLPExporter) resource() []byte {
+
+	attributes := map[string]string{"service.name": oe.ServiceName}
+
+	if hostname, err := os.Hostname(); err == nil {
+		attributes["host.name"] = hostname
+	}
+
+	if oe.Source != "" {
+		attributes["log.source"] = oe.Source
+	}
+
+	for k, v := range oe.ResourceAttributes {
+		attributes[k] = v
+	}
+
+	return appendAttributes(nil, 1, attributes)
+}
+
+func (oe *OTLPExporter) encode(batch *otlpBatch) []byte {
+
+	m := batch.metrics
+	start, end := m.PeriodStart, m.PeriodEnd
+
+	metrics := [][]byte{
+		sumMetric("httpmonitor.requests", "Number of requests.", "{request}",
+			otlpDelta, numberDataPoint(nil, start, end, int64(m.RequestCount))),
+		sumMetric("httpmonitor.errors", "Number of requests with status >= 400.",
+			"{request}", otlpDelta,
+			numberDataPoint(nil, start, end, int64(m.ErrorCount))),
+		sumMetric("httpmonitor.traffic", "Number of bytes sent.", "By",
+			otlpDelta, numberDataPoint(nil, start, end, int64(m.TotalTraffic))),
+		gaugeMetric("httpmonitor.unique_visitors", "Unique visitors for the period.",
+			"{visitor}", numberDataPoint(nil, time.Time{}, end,
+				int64(m.UniqueVisitors))),
+		gaugeMetric("httpmonitor.avg_page_views", "Average page views per visitor.",
+			"{request}", numberDataPoint(nil, time.Time{}, end,
+				float64(m.AvgPageViews))),
+	}
+
+	hits := [][]byte{}
+	for _, r := range m.Rank {
+		hits = append(hits, numberDataPoint(map[string]string{
+			"section": r.Section}, start, end, int64(r.HitCount)))
+	}
+	if len(hits) != 0 {
+		metrics = append(metrics, sumMetric("httpmonitor.section.hits",
+			"Number of requests per section.", "{request}", otlpDelta, hits...))
+	}
+
+	labels := make([]windowLabels, 0, len(batch.windows))
+	for l := range batch.windows {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].rule != labels[j].rule {
+			return labels[i].rule < labels[j].rule
+		}
+		return labels[i].key < labels[j].key
+	})
+
+	sizes, states := [][]byte{}, [][]byte{}
+	for _, l := range labels {
+
+		attributes := map[string]string{"rule": l.rule, "key": l.key}
+		w := batch.windows[l]
+
+		state := int64(0)
+		if w.status == StatusExceed {
+			state = 1
+		}
+
+		sizes = append(sizes, numberDataPoint(attributes, time.Time{}, end,
+			int64(w.size)))
+		states = append(states, numberDataPoint(attributes, time.Time{}, end,
+			state))
+	}
+
+	if len(labels) != 0 {
+		metrics = append(metrics,
+			gaugeMetric("httpmonitor.window.traffic",
+				"Bytes in the current alert sliding window.", "By", sizes...),
+			gaugeMetric("httpmonitor.alert.state",
+				"1 if the alert is firing, 0 if recovered.", "1", states...))
+	}
+
+	metrics = append(metrics,
+		histogramMetric("httpmonitor.response.size", "Response sizes.", "By",
+			batch.sizes, oe.started, end),
+		histogramMetric("httpmonitor.ingest_lag",
+			"Delay between an entry timestamp and its processing.", "s",
+			batch.ingestLags, oe.started, end))
+
+	scope := appendStringField(nil, 1, "httpmonitor")
+	scopeMetrics := appendBytesField(nil, 1, scope)
+	for _, metric := range metrics {
+		scopeMetrics = appendBytesField(scopeMetrics, 2, metric)
+	}
+
+	resourceMetrics := appendBytesField(nil, 1, oe.resource())
+	resourceMetrics = appendBytesField(resourceMetrics, 2, scopeMetrics)
+
+	return appendBytesField(nil, 1, resourceMetrics)
+}
@@ -0,0 +1,217 @@
+package monitor
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"w3chttpd"
+)
+
+// Length-delimited fields of a protocol buffers message, by field number
+func decodeProtoFields(msg []byte) map[int][][]byte {
+
+	fields := map[int][][]byte{}
+
+	for len(msg) > 0 {
+
+		tag, n := binary.Uvarint(msg)
+		msg = msg[n:]
+
+		switch tag & 7 {
+
+		case wireVarint:
+			_, n = binary.Uvarint(msg)
+			msg = msg[n:]
+
+		case wireFixed64:
+			msg = msg[8:]
+
+		case wireBytes:
+			size, n := binary.Uvarint(msg)
+			msg = msg[n:]
+			fields[int(tag>>3)] = append(fields[int(tag>>3)], msg[:size])
+			msg = msg[size:]
+
+		default:
+			return fields
+		}
+	}
+
+	return fields
+}
+
+// Mock collector recording metric names and resource attributes
+type otlpCollector struct {
+	sync.Mutex
+	grpc       bool
+	names      []string
+	attributes map[string]string
+}
+
+func (oc *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	body, _ := io.ReadAll(r.Body)
+
+	if oc.grpc {
+		if r.URL.Path != otlpGRPCPath || r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body = body[5:]
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+
+	} else if r.URL.Path != otlpHTTPPath ||
+		r.Header.Get("Content-Type") != "application/x-protobuf" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	oc.Lock()
+	defer oc.Unlock()
+
+	oc.attributes = map[string]string{}
+
+	rm := decodeProtoFields(decodeProtoFields(body)[1][0])
+
+	for _, kv := range decodeProtoFields(rm[1][0])[1] {
+		fields := decodeProtoFields(kv)
+		value := decodeProtoFields(fields[2][0])[1][0]
+		oc.attributes[string(fields[1][0])] = string(value)
+	}
+
+	for _, m := range decodeProtoFields(rm[2][0])[2] {
+		oc.names = append(oc.names, string(decodeProtoFields(m)[1][0]))
+	}
+
+	if oc.grpc {
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", "0")
+	}
+}
+
+func (oc *otlpCollector) received() []string {
+
+	oc.Lock()
+	defer oc.Unlock()
+
+	return append([]string{}, oc.names...)
+}
+
+func testOTLPExporter(t *testing.T, oc *otlpCollector, url string,
+	protocol OTLPProtocol) {
+
+	oe := &OTLPExporter{
+		Endpoint: url,
+		Protocol: protocol,
+		Source:   "access.log",
+	}
+
+	oe.observeEntries([]*w3chttpd.Entry{
+		&w3chttpd.Entry{Timestamp: time.Unix(0, 0), Size: 120},
+	}, time.Unix(1, 0))
+	oe.observeWindows(map[windowLabels]windowState{
+		{"global", ""}: {120, StatusRecovered},
+	})
+	oe.publish(&Metrics{
+		Rank:         []Rank{Rank{1, "admin"}},
+		RequestCount: 1,
+		PeriodStart:  time.Unix(0, 0),
+		PeriodEnd:    time.Unix(10, 0),
+	})
+	oe.Close()
+
+	expected := []string{
+		"httpmonitor.requests",
+		"httpmonitor.errors",
+		"httpmonitor.traffic",
+		"httpmonitor.unique_visitors",
+		"httpmonitor.avg_page_views",
+		"httpmonitor.section.hits",
+		"httpmonitor.window.traffic",
+		"httpmonitor.alert.state",
+		"httpmonitor.response.size",
+		"httpmonitor.ingest_lag",
+	}
+
+	names := oc.received()
+	if len(names) != len(expected) {
+		t.Fatalf("Metrics differ. Want %v, got %v", expected, names)
+	}
+
+	for i, name := range expected {
+		if names[i] != name {
+			t.Errorf("Metric differs. Want %s, got %s", name, names[i])
+		}
+	}
+
+	if oc.attributes["log.source"] != "access.log" ||
+		oc.attributes["service.name"] != "httpmonitor" ||
+		oc.attributes["host.name"] == "" {
+		t.Errorf("Resource attributes differ. Got %v", oc.attributes)
+	}
+}
+
+func TestOTLPExporterHTTP(t *testing.T) {
+
+	oc := &otlpCollector{}
+	ts := httptest.NewServer(oc)
+	defer ts.Close()
+
+	testOTLPExporter(t, oc, ts.URL, OTLPHTTP)
+}
+
+func TestOTLPExporterGRPC(t *testing.T) {
+
+	oc := &otlpCollector{grpc: true}
+	ts := httptest.NewUnstartedServer(oc)
+	ts.Config.Protocols = &http.Protocols{}
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+
+	testOTLPExporter(t, oc, ts.URL, OTLPGRPC)
+}
+
+func TestHistogramObserve(t *testing.T) {
+
+	h := newHistogram([]float64{1, 10})
+
+	for _, v := range []float64{0.5, 1, 5, 20} {
+		h.observe(v)
+	}
+
+	expected := []uint64{2, 1, 1}
+	for i, c := range expected {
+		if h.counts[i] != c {
+			t.Errorf("Bucket %d differs. Want %d, got %d", i, c, h.counts[i])
+		}
+	}
+
+	if h.count != 4 || h.sum != 26.5 {
+		t.Errorf("Count and sum differ. Want %d and %v, got %d and %v",
+			4, 26.5, h.count, h.sum)
+	}
+}
+
+func TestOTLPExporterClose(t *testing.T) {
+
+	oc := &otlpCollector{}
+	ts := httptest.NewServer(oc)
+	defer ts.Close()
+
+	oe := &OTLPExporter{Endpoint: ts.URL}
+
+	oe.publish(&Metrics{PeriodEnd: time.Unix(10, 0)})
+	oe.Close()
+	oe.Close()
+	oe.publish(&Metrics{PeriodEnd: time.Unix(20, 0)})
+
+	if len(oc.received()) == 0 {
+		t.Errorf("Metrics differ. Want exported before Close, got none")
+	}
+}
@@ -0,0 +1,698 @@
+package monitor
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+	"w3chttpd"
+)
+
+// What happens when a subscriber queue is full
+type OutputPolicy int
+
+const (
+	// The oldest queued item is dropped
+	OutputDropOldest OutputPolicy = iota
+	// The new item is dropped
+	OutputDropNewest OutputPolicy = iota
+	// Processing waits for the subscriber (a slow one stalls log reading)
+	OutputBlock OutputPolicy = iota
+	// The new item is merged into the newest queued one (metrics periods
+	// merged as in History, alert batches concatenated)
+	OutputCoalesce OutputPolicy = iota
+)
+
+func (op OutputPolicy) String() string {
+
+	switch op {
+
+	case OutputDropOldest:
+		return "drop-oldest"
+
+	case OutputDropNewest:
+		return "drop-newest"
+
+	case OutputBlock:
+		return "block"
+
+	case OutputCoalesce:
+		return "coalesce"
+
+	default:
+		return fmt.Sprintf("policy(%d)", int(op))
+	}
+}
+
+func ParseOutputPolicy(name string) (OutputPolicy, error) {
+
+	for op := OutputDropOldest; op <= OutputCoalesce; op++ {
+		if op.String() == name {
+			return op, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown output policy %q", name)
+}
+
+// Default number of items queued for a subscriber
+const defaultOutputBuffer = 64
+
+// Time given to subscribers to receive their queued items when the monitor
+// stops
+const flushTimeout = 5 * time.Second
+
+// Bounded queue of a subscriber, delivered to its channel (or handler) by
+// its own goroutine so processing never waits for it (except with
+// OutputBlock)
+type outputQueue[T any] struct {
+	out      chan<- T
+	handler  func(T)
+	filter   func(T) (T, bool)
+	buffer   int
+	policy   OutputPolicy
+	coalesce func(dst, src T) T
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	idle     *sync.Cond
+	items    []T
+	sending  bool
+	closed   bool
+	done     chan struct{}
+	exited   chan struct{}
+	dropped  atomic.Int64
+	health   *healthCounters
+}
+
+func newOutputQueue[T any](out chan<- T, handler func(T), buffer int,
+	policy OutputPolicy, coalesce func(dst, src T) T) *outputQueue[T] {
+
+	if buffer <= 0 {
+		buffer = defaultOutputBuffer
+	}
+
+	q := &outputQueue[T]{
+		out:      out,
+		handler:  handler,
+		buffer:   buffer,
+		policy:   policy,
+		coalesce: coalesce,
+		items:    make([]T, 0, buffer),
+		done:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	q.idle = sync.NewCond(&q.mu)
+
+	go q.run()
+
+	return q
+}
+
+func (q *outputQueue[T]) drop() {
+
+	q.dropped.Add(1)
+	if q.health != nil {
+		q.health.outputDropped.Add(1)
+	}
+}
+
+func (q *outputQueue[T]) push(item T) {
+
+	if q.filter != nil {
+		var ok bool
+		if item, ok = q.filter(item); !ok {
+			return
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.policy == OutputBlock {
+		for len(q.items) == q.buffer && !q.closed {
+			q.notFull.Wait()
+		}
+	}
+
+	if q.closed {
+		return
+	}
+
+	if len(q.items) == q.buffer {
+
+		switch q.policy {
+
+		case OutputDropNewest:
+			q.drop()
+			return
+
+		case OutputCoalesce:
+			q.items[len(q.items)-1] = q.coalesce(q.items[len(q.items)-1], item)
+			return
+
+		default:
+			var zero T
+			q.items[0] = zero
+			q.items = append(q.items[:0], q.items[1:]...)
+			q.drop()
+		}
+	}
+
+	q.items = append(q.items, item)
+	q.notEmpty.Signal()
+}
+
+func (q *outputQueue[T]) run() {
+
+	defer close(q.exited)
+
+	for {
+
+		q.mu.Lock()
+		for len(q.items) == 0 && !q.closed {
+			q.notEmpty.Wait()
+		}
+
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+
+		item := q.items[0]
+		var zero T
+		q.items[0] = zero
+		q.items = append(q.items[:0], q.items[1:]...)
+		q.sending = true
+		q.notFull.Signal()
+		q.mu.Unlock()
+
+		if q.handler != nil {
+			q.handler(item)
+
+		} else {
+			select {
+			case q.out <- item:
+			case <-q.done:
+			}
+		}
+
+		q.mu.Lock()
+		q.sending = false
+		if len(q.items) == 0 {
+			q.idle.Broadcast()
+		}
+		q.mu.Unlock()
+	}
+}
+
+// Waits until the queued items are delivered (or the queue closed), at
+// most until deadline, returning false if they were not
+func (q *outputQueue[T]) flush(deadline time.Time) bool {
+
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		q.mu.Lock()
+		q.idle.Broadcast()
+		q.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for (len(q.items) != 0 || q.sending) && !q.closed {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		q.idle.Wait()
+	}
+	return true
+}
+
+func (q *outputQueue[T]) pending() int {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.items)
+}
+
+// Items beyond the new buffer are dropped, oldest first
+func (q *outputQueue[T]) configure(buffer int, policy OutputPolicy) {
+
+	if buffer <= 0 {
+		buffer = defaultOutputBuffer
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) > buffer {
+		var zero T
+		q.items[0] = zero
+		q.items = append(q.items[:0], q.items[1:]...)
+		q.drop()
+	}
+
+	q.buffer = buffer
+	q.policy = policy
+	q.notFull.Broadcast()
+}
+
+// Queued items are discarded
+func (q *outputQueue[T]) close() {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	q.closed = true
+	close(q.done)
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	q.idle.Broadcast()
+}
+
+// Fan-out of items to independent subscriber queues, their drops being
+// counted in health (not counted if nil)
+type output[T any] struct {
+	coalesce func(dst, src T) T
+	health   *healthCounters
+
+	mu     sync.RWMutex
+	queues []*outputQueue[T]
+	closed bool
+}
+
+// Items are sent to out or passed to handler, filter (optional) selecting
+// them before they are queued
+func (o *output[T]) subscribe(out chan<- T, handler func(T),
+	filter func(T) (T, bool), buffer int, policy OutputPolicy) *outputQueue[T] {
+
+	q := newOutputQueue(out, handler, buffer, policy, o.coalesce)
+	q.filter = filter
+	q.health = o.health
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Nothing is published anymore
+	if o.closed {
+		q.close()
+		return q
+	}
+
+	o.queues = append(o.queues, q)
+	return q
+}
+
+func (o *output[T]) unsubscribe(q *outputQueue[T]) {
+
+	o.mu.Lock()
+	for i, sq := range o.queues {
+		if sq == q {
+			o.queues = append(o.queues[:i:i], o.queues[i+1:]...)
+			break
+		}
+	}
+	o.mu.Unlock()
+
+	q.close()
+}
+
+// Subscribers not done by deadline are logged
+func (o *output[T]) flush(deadline time.Time) {
+
+	o.mu.RLock()
+	queues := o.queues
+	o.mu.RUnlock()
+
+	for _, q := range queues {
+		if !q.flush(deadline) {
+			log.Printf("Subscriber not receiving, %d items discarded",
+				q.pending())
+		}
+	}
+}
+
+// Closes the queues of the subscribers and their channels (once even if
+// shared), the items still queued being counted as dropped
+func (o *output[T]) close() {
+
+	o.mu.Lock()
+	queues := o.queues
+	o.queues = nil
+	o.closed = true
+	o.mu.Unlock()
+
+	closed := map[chan<- T]bool{}
+
+	for _, q := range queues {
+
+		q.mu.Lock()
+		for range q.items {
+			q.drop()
+		}
+		q.mu.Unlock()
+
+		q.close()
+
+		if q.out != nil && !closed[q.out] {
+			// No send can be pending on it
+			<-q.exited
+			close(q.out)
+			closed[q.out] = true
+		}
+	}
+}
+
+func (o *output[T]) subscribed() bool {
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return len(o.queues) != 0
+}
+
+// Blocking subscribers can still be unsubscribed while publish waits
+func (o *output[T]) publish(item T) {
+
+	o.mu.RLock()
+	queues := o.queues
+	o.mu.RUnlock()
+
+	for _, q := range queues {
+		q.push(item)
+	}
+}
+
+func coalesceMetrics(dst, src *Metrics) *Metrics {
+
+	merged := copyMetrics(dst)
+	mergeMetrics(merged, src)
+	merged.Correction = dst.Correction && src.Correction
+	return merged
+}
+
+// Batches (alerts, entries, parse errors) are concatenated
+func coalesceBatch[E any](dst, src []E) []E {
+
+	return append(dst[:len(dst):len(dst)], src...)
+}
+
+// Batch filter keeping the elements matching keep (nil if keep is nil),
+// empty batches being dropped
+func filterBatch[E any](keep func(E) bool) func([]E) ([]E, bool) {
+
+	if keep == nil {
+		return nil
+	}
+
+	return func(batch []E) ([]E, bool) {
+
+		kept := make([]E, 0, len(batch))
+		for _, e := range batch {
+			if keep(e) {
+				kept = append(kept, e)
+			}
+		}
+		return kept, len(kept) != 0
+	}
+}
+
+// Subscribers deliver to a channel or a handler
+func checkSubscriber[T any](c chan<- T, handler func(T)) error {
+
+	if c == nil && handler == nil {
+		return fmt.Errorf("subscriber needs C or Handler")
+	}
+	return nil
+}
+
+// MetricsChan and AlertsChan are subscribed with OutputBuffer and
+// OutputPolicy, in addition to the subscribers of the Config (invalid ones
+// being reported by validate)
+func (conf *Config) initOutputs() {
+
+	conf.outputsOnce.Do(func() {
+
+		conf.metricsOut.coalesce = coalesceMetrics
+		conf.alertsOut.coalesce = coalesceBatch[*Alert]
+		conf.entriesOut.coalesce = coalesceBatch[*w3chttpd.Entry]
+		conf.parseErrorsOut.coalesce = coalesceBatch[*ParseError]
+
+		conf.metricsOut.health = &conf.health
+		conf.alertsOut.health = &conf.health
+		conf.entriesOut.health = &conf.health
+		conf.parseErrorsOut.health = &conf.health
+
+		if conf.MetricsChan != nil {
+			conf.metricsChanSub = &MetricsSubscriber{
+				C:      conf.MetricsChan,
+				Buffer: conf.OutputBuffer,
+				Policy: conf.OutputPolicy,
+			}
+			conf.MetricsSubscribers = append(conf.MetricsSubscribers,
+				conf.metricsChanSub)
+		}
+
+		if conf.AlertsChan != nil {
+			conf.alertsChanSub = &AlertsSubscriber{
+				C:      conf.AlertsChan,
+				Buffer: conf.OutputBuffer,
+				Policy: conf.OutputPolicy,
+			}
+			conf.AlertsSubscribers = append(conf.AlertsSubscribers,
+				conf.alertsChanSub)
+		}
+
+		for _, s := range conf.MetricsSubscribers {
+			if checkSubscriber(s.C, s.Handler) == nil {
+				s.subscribe(&conf.metricsOut)
+			}
+		}
+
+		for _, s := range conf.AlertsSubscribers {
+			if checkSubscriber(s.C, s.Handler) == nil {
+				s.subscribe(&conf.alertsOut)
+			}
+		}
+	})
+}
+
+// Waits until every subscriber got its items, for flushTimeout at most
+// (a channel subscriber may have stopped receiving), then closes their
+// queues and channels
+func (conf *Config) closeOutputs() {
+
+	deadline := time.Now().Add(flushTimeout)
+
+	conf.metricsOut.flush(deadline)
+	conf.alertsOut.flush(deadline)
+	conf.entriesOut.flush(deadline)
+	conf.parseErrorsOut.flush(deadline)
+
+	conf.metricsOut.close()
+	conf.alertsOut.close()
+	conf.entriesOut.close()
+	conf.parseErrorsOut.close()
+}
+
+// Subscriber of the Metrics of every period, sent to C or passed to
+// Handler (called by a goroutine of the subscriber), with its own bounded
+// queue (Buffer items, 64 by default) and Policy
+// Filter (optional) selects the Metrics delivered
+type MetricsSubscriber struct {
+	C       chan<- *Metrics
+	Handler func(*Metrics)
+	Filter  func(*Metrics) bool
+	Buffer  int
+	Policy  OutputPolicy
+
+	// Internal parameters
+	q   *outputQueue[*Metrics]
+	out *output[*Metrics]
+}
+
+func (s *MetricsSubscriber) subscribe(out *output[*Metrics]) {
+
+	var filter func(*Metrics) (*Metrics, bool)
+	if s.Filter != nil {
+		filter = func(m *Metrics) (*Metrics, bool) { return m, s.Filter(m) }
+	}
+
+	s.q = out.subscribe(s.C, s.Handler, filter, s.Buffer, s.Policy)
+	s.out = out
+}
+
+// Queued Metrics are discarded
+func (s *MetricsSubscriber) Unsubscribe() {
+
+	if s.q != nil {
+		s.out.unsubscribe(s.q)
+	}
+}
+
+// Number of Metrics dropped because the queue was full
+func (s *MetricsSubscriber) Dropped() int64 {
+
+	if s.q == nil {
+		return 0
+	}
+	return s.q.dropped.Load()
+}
+
+// Subscriber of alert batches, sent to C or passed to Handler, with its
+// own bounded queue (Buffer batches, 64 by default) and Policy
+// Filter (optional) selects the alerts of every batch
+type AlertsSubscriber struct {
+	C       chan<- []*Alert
+	Handler func([]*Alert)
+	Filter  func(*Alert) bool
+	Buffer  int
+	Policy  OutputPolicy
+
+	// Internal parameters
+	q   *outputQueue[[]*Alert]
+	out *output[[]*Alert]
+}
+
+func (s *AlertsSubscriber) subscribe(out *output[[]*Alert]) {
+
+	s.q = out.subscribe(s.C, s.Handler, filterBatch(s.Filter), s.Buffer,
+		s.Policy)
+	s.out = out
+}
+
+// Queued alerts are discarded
+func (s *AlertsSubscriber) Unsubscribe() {
+
+	if s.q != nil {
+		s.out.unsubscribe(s.q)
+	}
+}
+
+// Number of alert batches dropped because the queue was full
+func (s *AlertsSubscriber) Dropped() int64 {
+
+	if s.q == nil {
+		return 0
+	}
+	return s.q.dropped.Load()
+}
+
+// Subscriber of the entries read at every ReadFrequency (entries not
+// matching Config.Filter excluded), sent to C or passed to Handler, with
+// its own bounded queue (Buffer batches, 64 by default) and Policy
+// Entries are copies owned by the subscriber, Filter (optional) selecting
+// the ones delivered
+type EntriesSubscriber struct {
+	C       chan<- []*w3chttpd.Entry
+	Handler func([]*w3chttpd.Entry)
+	Filter  *Filter
+	Buffer  int
+	Policy  OutputPolicy
+
+	// Internal parameters
+	q   *outputQueue[[]*w3chttpd.Entry]
+	out *output[[]*w3chttpd.Entry]
+}
+
+func (s *EntriesSubscriber) subscribe(out *output[[]*w3chttpd.Entry]) {
+
+	var keep func(*w3chttpd.Entry) bool
+	if s.Filter != nil {
+		keep = s.Filter.Match
+	}
+
+	s.q = out.subscribe(s.C, s.Handler, filterBatch(keep), s.Buffer, s.Policy)
+	s.out = out
+}
+
+// Queued entries are discarded
+func (s *EntriesSubscriber) Unsubscribe() {
+
+	if s.q != nil {
+		s.out.unsubscribe(s.q)
+	}
+}
+
+// Number of entry batches dropped because the queue was full
+func (s *EntriesSubscriber) Dropped() int64 {
+
+	if s.q == nil {
+		return 0
+	}
+	return s.q.dropped.Load()
+}
+
+// Subscriber of the lines that could not be parsed at every ReadFrequency,
+// sent to C or passed to Handler, with its own bounded queue (Buffer
+// batches, 64 by default) and Policy
+// Filter (optional) selects the parse errors delivered
+type ParseErrorsSubscriber struct {
+	C       chan<- []*ParseError
+	Handler func([]*ParseError)
+	Filter  func(*ParseError) bool
+	Buffer  int
+	Policy  OutputPolicy
+
+	// Internal parameters
+	q   *outputQueue[[]*ParseError]
+	out *output[[]*ParseError]
+}
+
+func (s *ParseErrorsSubscriber) subscribe(out *output[[]*ParseError]) {
+
+	s.q = out.subscribe(s.C, s.Handler, filterBatch(s.Filter), s.Buffer,
+		s.Policy)
+	s.out = out
+}
+
+// Queued parse errors are discarded
+func (s *ParseErrorsSubscriber) Unsubscribe() {
+
+	if s.q != nil {
+		s.out.unsubscribe(s.q)
+	}
+}
+
+// Number of parse error batches dropped because the queue was full
+func (s *ParseErrorsSubscriber) Dropped() int64 {
+
+	if s.q == nil {
+		return 0
+	}
+	return s.q.dropped.Load()
+}
+
+// Copy of e whose fields do not share memory with it (entries are
+// recycled once processed)
+func copyEntry(e *w3chttpd.Entry) *w3chttpd.Entry {
+
+	c := *e
+	c.Ip = append([]byte(nil), e.Ip...)
+	c.ProtocolId = append([]byte(nil), e.ProtocolId...)
+	c.UserId = append([]byte(nil), e.UserId...)
+	c.Req = w3chttpd.Request{
+		Method:   append([]byte(nil), e.Req.Method...),
+		Resource: append([]byte(nil), e.Req.Resource...),
+		Protocol: append([]byte(nil), e.Req.Protocol...),
+	}
+	c.Referer = append([]byte(nil), e.Referer...)
+	c.UserAgent = append([]byte(nil), e.UserAgent...)
+
+	c.Extra = nil
+	for _, extra := range e.Extra {
+		c.Extra = append(c.Extra, append([]byte(nil), extra...))
+	}
+
+	return &c
+}
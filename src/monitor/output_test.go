@@ -0,0 +1,498 @@
+package monitor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	"w3chttpd"
+)
+
+func TestParseOutputPolicy(t *testing.T) {
+
+	for _, op := range []OutputPolicy{OutputDropOldest, OutputDropNewest,
+		OutputBlock, OutputCoalesce} {
+
+		parsed, err := ParseOutputPolicy(op.String())
+		if err != nil || parsed != op {
+			t.Errorf("Parsed policy differs. Want %v, got %v (%v)",
+				op, parsed, err)
+		}
+	}
+
+	if _, err := ParseOutputPolicy("ignore"); err == nil {
+		t.Errorf("Unknown policy should fail")
+	}
+}
+
+// Waits for the delivery goroutine to hold the first item (blocked on the
+// unread channel) so that the queue is full after buffer pushes
+func waitOutputQueueEmpty[T any](t *testing.T, q *outputQueue[T]) {
+
+	for i := 0; i < 1000; i++ {
+
+		q.mu.Lock()
+		n := len(q.items)
+		q.mu.Unlock()
+
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Queue was not emptied")
+}
+
+func receiveInts(t *testing.T, out chan int, n int) []int {
+
+	got := []int{}
+	for i := 0; i < n; i++ {
+		select {
+		case v := <-out:
+			got = append(got, v)
+		case <-time.After(time.Second):
+			t.Fatalf("Item %d not received", i)
+		}
+	}
+	return got
+}
+
+func TestOutputQueuePolicies(t *testing.T) {
+
+	sum := func(dst, src int) int { return dst + src }
+
+	tests := []struct {
+		policy  OutputPolicy
+		want    []int
+		dropped int64
+	}{
+		{OutputDropOldest, []int{1, 3, 4}, 1},
+		{OutputDropNewest, []int{1, 2, 3}, 1},
+		{OutputCoalesce, []int{1, 2, 7}, 0},
+	}
+
+	for _, test := range tests {
+
+		out := make(chan int)
+		q := newOutputQueue(out, nil, 2, test.policy, sum)
+		q.health = &healthCounters{}
+
+		q.push(1)
+		waitOutputQueueEmpty(t, q)
+
+		for _, v := range []int{2, 3, 4} {
+			q.push(v)
+		}
+
+		if got := receiveInts(t, out, 3); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Items with policy %v differ. Want %v, got %v",
+				test.policy, test.want, got)
+		}
+
+		if n := q.dropped.Load(); n != test.dropped {
+			t.Errorf("Dropped items with policy %v differ. Want %d, got %d",
+				test.policy, test.dropped, n)
+		}
+
+		if n := q.health.outputDropped.Load(); n != test.dropped {
+			t.Errorf("Dropped items with policy %v differ. Want %d, got %d",
+				test.policy, test.dropped, n)
+		}
+
+		q.close()
+	}
+}
+
+func TestOutputQueueBlock(t *testing.T) {
+
+	out := make(chan int)
+	q := newOutputQueue(out, nil, 1, OutputBlock, nil)
+
+	q.push(1)
+	waitOutputQueueEmpty(t, q)
+	q.push(2)
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(3)
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatalf("Push should wait for the subscriber")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if got := receiveInts(t, out, 3); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Errorf("Items differ. Want %v, got %v", []int{1, 2, 3}, got)
+	}
+	<-pushed
+
+	if n := q.dropped.Load(); n != 0 {
+		t.Errorf("Dropped items differ. Want %d, got %d", 0, n)
+	}
+
+	// Closing releases a waiting push
+	q.push(4)
+	waitOutputQueueEmpty(t, q)
+	q.push(5)
+
+	pushed = make(chan struct{})
+	go func() {
+		q.push(6)
+		close(pushed)
+	}()
+
+	q.close()
+	<-pushed
+}
+
+func TestOutputSubscribers(t *testing.T) {
+
+	o := &output[int]{}
+
+	fast := make(chan int, 10)
+	slow := make(chan int)
+
+	fq := o.subscribe(fast, nil, nil, 10, OutputDropOldest)
+	sq := o.subscribe(slow, nil, nil, 1, OutputDropNewest)
+
+	o.publish(1)
+	waitOutputQueueEmpty(t, sq)
+	for _, v := range []int{2, 3, 4} {
+		o.publish(v)
+	}
+
+	// A slow subscriber does not hold back the other ones
+	if got := receiveInts(t, fast, 4); !reflect.DeepEqual(got, []int{1, 2, 3, 4}) {
+		t.Errorf("Fast subscriber items differ. Want %v, got %v",
+			[]int{1, 2, 3, 4}, got)
+	}
+
+	if got := receiveInts(t, slow, 2); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("Slow subscriber items differ. Want %v, got %v",
+			[]int{1, 2}, got)
+	}
+
+	if fq.dropped.Load() != 0 || sq.dropped.Load() != 2 {
+		t.Errorf("Dropped items differ. Want %d and %d, got %d and %d",
+			0, 2, fq.dropped.Load(), sq.dropped.Load())
+	}
+
+	o.unsubscribe(sq)
+	o.publish(5)
+
+	if got := receiveInts(t, fast, 1); got[0] != 5 {
+		t.Errorf("Item differs. Want %d, got %d", 5, got[0])
+	}
+
+	select {
+	case v := <-slow:
+		t.Errorf("Unsubscribed channel received %d", v)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if len(o.queues) != 1 {
+		t.Errorf("Length of queues differs. Want %d, got %d", 1, len(o.queues))
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+
+	dst := &Metrics{
+		RequestCount: 2,
+		PeriodStart:  time.Unix(0, 0),
+		PeriodEnd:    time.Unix(9, 0),
+		Correction:   true,
+	}
+	src := &Metrics{
+		RequestCount: 3,
+		PeriodStart:  time.Unix(10, 0),
+		PeriodEnd:    time.Unix(19, 0),
+	}
+
+	m := coalesceMetrics(dst, src)
+
+	if m.RequestCount != 5 || m.Correction {
+		t.Errorf("Coalesced metrics differ. Want %d requests, got %+v", 5, m)
+	}
+
+	if dst.RequestCount != 2 {
+		t.Errorf("Queued metrics were modified")
+	}
+
+	a := []*Alert{&Alert{}}
+	alerts := coalesceBatch(a, []*Alert{&Alert{}, &Alert{}})
+
+	if len(alerts) != 3 || len(a) != 1 {
+		t.Errorf("Coalesced alerts differ. Want %d, got %d", 3, len(alerts))
+	}
+}
+
+func TestProcessLogSubscribers(t *testing.T) {
+
+	conf, metricsChan := newLatenessTestConfig(LateDrop)
+
+	extra := make(chan *Metrics, 10)
+	sub := &MetricsSubscriber{C: extra, Policy: OutputDropNewest}
+	conf.MetricsSubscribers = []*MetricsSubscriber{sub}
+
+	readLatenessTestLogs(conf, int64(10*time.Second),
+		`10.0.0.1 - - [01/Jan/1970:00:00:03 +0000] "GET /toto HTTP/1.1" 200 100`)
+	readLatenessTestLogs(conf, int64(20*time.Second),
+		`10.0.0.1 - - [01/Jan/1970:00:00:15 +0000] "GET /toto HTTP/1.1" 200 100`)
+
+	for _, c := range []chan *Metrics{metricsChan, extra} {
+
+		for _, want := range []int{0, 1} {
+
+			select {
+			case m := <-c:
+				if m.RequestCount != want {
+					t.Errorf("Request count differs. Want %d, got %d",
+						want, m.RequestCount)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Metrics not received")
+			}
+		}
+	}
+
+	if len(conf.MetricsSubscribers) != 2 || sub.Dropped() != 0 {
+		t.Errorf("Subscribers differ. Want %d, got %d (%d dropped)",
+			2, len(conf.MetricsSubscribers), sub.Dropped())
+	}
+}
+
+func TestMonitorSubscribers(t *testing.T) {
+
+	conf, _ := newLatenessTestConfig(LateDrop)
+	m := &Monitor{Config: conf}
+
+	errorsFilter, _ := CompileFilter(`status >= 500`)
+	entries := make(chan []*w3chttpd.Entry, 10)
+	es := &EntriesSubscriber{C: entries, Filter: errorsFilter}
+	m.SubscribeEntries(es)
+
+	parseErrors := make(chan []*ParseError, 10)
+	m.SubscribeParseErrors(&ParseErrorsSubscriber{
+		Handler: func(errs []*ParseError) { parseErrors <- errs },
+	})
+
+	requests := make(chan int, 10)
+	m.SubscribeMetrics(&MetricsSubscriber{
+		Handler: func(m *Metrics) { requests <- m.RequestCount },
+		Filter:  func(m *Metrics) bool { return m.RequestCount != 0 },
+	})
+
+	readLatenessTestLogs(conf, int64(10*time.Second),
+		`10.0.0.1 - - [01/Jan/1970:00:00:03 +0000] "GET /toto HTTP/1.1" 500 100`,
+		`not a log line`,
+		`10.0.0.1 - - [01/Jan/1970:00:00:05 +0000] "GET /toto HTTP/1.1" 200 100`)
+
+	select {
+	case batch := <-entries:
+		if len(batch) != 1 || batch[0].StatusCode != 500 {
+			t.Errorf("Entries differ. Want 1 entry with status %d, got %v",
+				500, batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Entries not received")
+	}
+
+	select {
+	case errs := <-parseErrors:
+		if len(errs) != 1 || errs[0].Line != "not a log line" ||
+			errs[0].Time.UnixNano() != int64(10*time.Second) {
+			t.Errorf("Parse errors differ. Want %q, got %+v",
+				"not a log line", errs)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Parse errors not received")
+	}
+
+	// Entries are no longer delivered once unsubscribed
+	es.Unsubscribe()
+
+	readLatenessTestLogs(conf, int64(20*time.Second),
+		`10.0.0.1 - - [01/Jan/1970:00:00:15 +0000] "GET /toto HTTP/1.1" 500 100`)
+
+	// The empty period [-10s - 0s[ is filtered out
+	select {
+	case n := <-requests:
+		if n != 2 {
+			t.Errorf("Request count differs. Want %d, got %d", 2, n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Metrics not received")
+	}
+
+	select {
+	case batch := <-entries:
+		t.Errorf("Unsubscribed channel received %v", batch)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestCopyEntry(t *testing.T) {
+
+	e := &w3chttpd.Entry{}
+	err := w3chttpd.ParseLine([]byte(
+		`10.0.0.1 - - [01/Jan/1970:00:00:03 +0000] "GET /toto HTTP/1.1" 500 100`),
+		e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := copyEntry(e)
+	if !reflect.DeepEqual(c, e) {
+		t.Errorf("Copy differs. Want %v, got %v", e, c)
+	}
+
+	c.Req.Resource[0] = 'x'
+	if string(e.Req.Resource) != "/toto" {
+		t.Errorf("Copy shares memory with the entry")
+	}
+}
+
+func TestOutputQueueFlush(t *testing.T) {
+
+	out := make(chan int)
+	q := newOutputQueue(out, nil, 10, OutputBlock, nil)
+
+	q.push(1)
+	q.push(2)
+
+	flushed := make(chan struct{})
+	go func() {
+		q.flush(time.Now().Add(time.Minute))
+		close(flushed)
+	}()
+
+	if got := receiveInts(t, out, 2); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("Items differ. Want %v, got %v", []int{1, 2}, got)
+	}
+
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Fatalf("Flush did not return")
+	}
+
+	// Receivers that stopped are waited for until the deadline
+	q.push(3)
+	if q.flush(time.Now().Add(10 * time.Millisecond)) {
+		t.Errorf("Flush should fail when the item is not received")
+	}
+
+	// Closed queues are not waited for
+	q.close()
+	if !q.flush(time.Now().Add(time.Minute)) {
+		t.Errorf("Flush of a closed queue should succeed")
+	}
+}
+
+func TestAlertsChanPolicy(t *testing.T) {
+
+	alertsChan := make(chan []*Alert)
+	conf := &Config{
+		AlertsChan:   alertsChan,
+		OutputBuffer: 1,
+		OutputPolicy: OutputDropNewest,
+	}
+	conf.initOutputs()
+
+	if conf.alertsChanSub.Policy != OutputDropNewest {
+		t.Errorf("Policy of AlertsChan differs. Want %v, got %v",
+			OutputDropNewest, conf.alertsChanSub.Policy)
+	}
+
+	// Neither received nor queued
+	conf.alertsOut.publish([]*Alert{&Alert{Total: 1}})
+	conf.alertsOut.publish([]*Alert{&Alert{Total: 2}})
+	conf.alertsOut.publish([]*Alert{&Alert{Total: 3}})
+
+	if n := conf.alertsChanSub.Dropped(); n == 0 {
+		t.Errorf("Alert batches should be dropped by a full queue")
+	}
+}
+
+func TestCloseOutputs(t *testing.T) {
+
+	metricsChan := make(chan *Metrics, 10)
+	alertsChan := make(chan []*Alert, 10)
+	conf := &Config{MetricsChan: metricsChan, AlertsChan: alertsChan}
+	conf.initOutputs()
+
+	// Subscribed twice to the same channel
+	shared := make(chan *Metrics, 10)
+	s := &MetricsSubscriber{C: shared}
+	s.subscribe(&conf.metricsOut)
+	s = &MetricsSubscriber{C: shared}
+	s.subscribe(&conf.metricsOut)
+
+	conf.metricsOut.publish(&Metrics{RequestCount: 1})
+	conf.closeOutputs()
+
+	if m := <-metricsChan; m == nil || m.RequestCount != 1 {
+		t.Errorf("Queued metrics should be delivered before closing")
+	}
+
+	if _, ok := <-metricsChan; ok {
+		t.Errorf("MetricsChan should be closed")
+	}
+
+	if _, ok := <-alertsChan; ok {
+		t.Errorf("AlertsChan should be closed")
+	}
+
+	<-shared
+	<-shared
+	if _, ok := <-shared; ok {
+		t.Errorf("Shared channel should be closed")
+	}
+
+	// Nothing is published to later subscribers
+	s = &MetricsSubscriber{Handler: func(*Metrics) {}}
+	s.subscribe(&conf.metricsOut)
+	conf.metricsOut.publish(&Metrics{})
+	if conf.metricsOut.subscribed() {
+		t.Errorf("Subscribers should not be added once closed")
+	}
+}
+
+func TestSubscriberWithoutOutput(t *testing.T) {
+
+	conf, _ := newLatenessTestConfig(LateDrop)
+	m := &Monitor{Config: conf}
+
+	if err := m.SubscribeMetrics(&MetricsSubscriber{}); err == nil {
+		t.Errorf("Metrics subscriber without C nor Handler should be rejected")
+	}
+
+	if err := m.SubscribeAlerts(&AlertsSubscriber{}); err == nil {
+		t.Errorf("Alerts subscriber without C nor Handler should be rejected")
+	}
+
+	if err := m.SubscribeEntries(&EntriesSubscriber{}); err == nil {
+		t.Errorf("Entries subscriber without C nor Handler should be rejected")
+	}
+
+	if err := m.SubscribeParseErrors(&ParseErrorsSubscriber{}); err == nil {
+		t.Errorf("Parse errors subscriber without C nor Handler should be " +
+			"rejected")
+	}
+
+	conf = &Config{
+		ReadFrequency:     time.Second,
+		AlertsSubscribers: []*AlertsSubscriber{&AlertsSubscriber{}},
+	}
+
+	if err := conf.validate(); err == nil {
+		t.Errorf("Config subscriber without C nor Handler should be rejected")
+	}
+
+	// Not subscribed, so that flushing does not wait for it
+	conf.initOutputs()
+	conf.closeOutputs()
+}
@@ -2,8 +2,10 @@ package monitor
 
 import "w3chttpd"
 
+// Hits and misses are counted in health (not counted if nil)
 type entryPool struct {
-	pool chan *w3chttpd.Entry
+	pool   chan *w3chttpd.Entry
+	health *healthCounters
 }
 
 func (ep *entryPool) init(poolSize int) {
@@ -17,7 +19,13 @@ func (ep *entryPool) get() *w3chttpd.Entry {
 
 	select {
 	case e = <-ep.pool:
+		if ep.health != nil {
+			ep.health.entryPoolHits.Add(1)
+		}
 	default:
+		if ep.health != nil {
+			ep.health.entryPoolMisses.Add(1)
+		}
 		e = &w3chttpd.Entry{}
 	}
 
@@ -32,10 +40,12 @@ func (ep *entryPool) recycle(e *w3chttpd.Entry) {
 	}
 }
 
+// Hits and misses are counted in health (not counted if nil)
 type bufferPool struct {
 	bufferSize     int
 	pool           chan []byte
 	recyclingQueue [][]byte
+	health         *healthCounters
 }
 
 func (bp *bufferPool) init(poolSize, bufferSize int) {
@@ -50,7 +60,13 @@ func (bp *bufferPool) get() []byte {
 
 	select {
 	case buf = <-bp.pool:
+		if bp.health != nil {
+			bp.health.bufferPoolHits.Add(1)
+		}
 	default:
+		if bp.health != nil {
+			bp.health.bufferPoolMisses.Add(1)
+		}
 		buf = make([]byte, bp.bufferSize)
 	}
 
@@ -0,0 +1,307 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"w3chttpd"
+)
+
+var processLogBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5}
+
+type trafficLabels struct {
+	section string
+	class   string
+}
+
+type trafficCounters struct {
+	requests int64
+	bytes    int64
+	errors   int64
+}
+
+// Serves the Prometheus text exposition format, values are updated by
+// processLog when set in Config.Exporter
+// The global traffic window is exposed with rule="global"
+// Only the first MaxSections sections seen (10 if not positive) are
+// labelled, the requests of later ones being counted in section="other"
+// so that untrusted URLs cannot grow the label set
+type PrometheusExporter struct {
+	MaxSections int
+
+	// Internal parameters
+	mu                 sync.RWMutex
+	health             *healthCounters
+	sections           map[string]bool
+	traffic            map[trafficLabels]*trafficCounters
+	windows            map[windowLabels]windowState
+	processLogBuckets  []int64
+	processLogCount    int64
+	processLogDuration time.Duration
+}
+
+func (pe *PrometheusExporter) init() {
+
+	if pe.traffic == nil {
+		pe.sections = make(map[string]bool)
+		pe.traffic = make(map[trafficLabels]*trafficCounters)
+		pe.windows = make(map[windowLabels]windowState)
+		pe.processLogBuckets = make([]int64, len(processLogBuckets))
+	}
+}
+
+func (pe *PrometheusExporter) observeEntries(entries []*w3chttpd.Entry) {
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	pe.init()
+
+	maxSections := pe.MaxSections
+	if maxSections <= 0 {
+		maxSections = 10
+	}
+
+	for _, e := range entries {
+
+		// Admitted sections are kept for the counters to stay monotonic
+		section := entrySection(e)
+		if !pe.sections[section] {
+			if len(pe.sections) < maxSections {
+				pe.sections[section] = true
+			} else {
+				section = "other"
+			}
+		}
+
+		labels := trafficLabels{section, statusClass(e.StatusCode)}
+
+		c, ok := pe.traffic[labels]
+		if !ok {
+			c = &trafficCounters{}
+			pe.traffic[labels] = c
+		}
+
+		c.requests++
+		c.bytes += int64(e.Size)
+		if e.StatusCode >= 400 {
+			c.errors++
+		}
+	}
+}
+
+// Health counters of the monitor the exporter is set in
+func (pe *PrometheusExporter) setHealth(health *healthCounters) {
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	pe.health = health
+}
+
+// Evicted keys disappear from the exposition
+func (pe *PrometheusExporter) observeWindows(
+	windows map[windowLabels]windowState) {
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	pe.init()
+	pe.windows = windows
+}
+
+func (pe *PrometheusExporter) observeProcessLog(d time.Duration) {
+
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	pe.init()
+
+	for i, bound := range processLogBuckets {
+		if d.Seconds() <= bound {
+			pe.processLogBuckets[i]++
+		}
+	}
+
+	pe.processLogCount++
+	pe.processLogDuration += d
+}
+
+func escapeLabelValue(value string) string {
+
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func writeMetricHeader(w *bufio.Writer, name, help, kind string) {
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func (pe *PrometheusExporter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	w := bufio.NewWriter(rw)
+	defer w.Flush()
+
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	pe.writeTraffic(w)
+	pe.writeWindows(w)
+	pe.writeProcessLog(w)
+	writeHealth(w, pe.health)
+}
+
+func (pe *PrometheusExporter) writeTraffic(w *bufio.Writer) {
+
+	labels := make([]trafficLabels, 0, len(pe.traffic))
+	for l := range pe.traffic {
+		labels = append(labels, l)
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].section != labels[j].section {
+			return labels[i].section < labels[j].section
+		}
+		return labels[i].class < labels[j].class
+	})
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(*trafficCounters) int64
+	}{
+		{"httpmonitor_requests_total", "Number of requests.",
+			func(c *trafficCounters) int64 { return c.requests }},
+		{"httpmonitor_bytes_total", "Number of bytes sent.",
+			func(c *trafficCounters) int64 { return c.bytes }},
+		{"httpmonitor_errors_total", "Number of requests with status >= 400.",
+			func(c *trafficCounters) int64 { return c.errors }},
+	}
+
+	for _, counter := range counters {
+
+		writeMetricHeader(w, counter.name, counter.help, "counter")
+
+		for _, l := range labels {
+			fmt.Fprintf(w, "%s{section=\"%s\",status_class=\"%s\"} %d\n",
+				counter.name, escapeLabelValue(l.section), l.class,
+				counter.value(pe.traffic[l]))
+		}
+	}
+}
+
+func (pe *PrometheusExporter) writeWindows(w *bufio.Writer) {
+
+	labels := make([]windowLabels, 0, len(pe.windows))
+	for l := range pe.windows {
+		labels = append(labels, l)
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].rule != labels[j].rule {
+			return labels[i].rule < labels[j].rule
+		}
+		return labels[i].key < labels[j].key
+	})
+
+	writeMetricHeader(w, "httpmonitor_window_bytes",
+		"Bytes in the current alert sliding window.", "gauge")
+
+	for _, l := range labels {
+		fmt.Fprintf(w, "httpmonitor_window_bytes{rule=\"%s\",key=\"%s\"} %d\n",
+			escapeLabelValue(l.rule), escapeLabelValue(l.key), pe.windows[l].size)
+	}
+
+	writeMetricHeader(w, "httpmonitor_alert_state",
+		"1 if the alert is firing, 0 if recovered.", "gauge")
+
+	for _, l := range labels {
+
+		state := 0
+		if pe.windows[l].status == StatusExceed {
+			state = 1
+		}
+
+		fmt.Fprintf(w, "httpmonitor_alert_state{rule=\"%s\",key=\"%s\"} %d\n",
+			escapeLabelValue(l.rule), escapeLabelValue(l.key), state)
+	}
+}
+
+func (pe *PrometheusExporter) writeProcessLog(w *bufio.Writer) {
+
+	name := "httpmonitor_process_log_duration_seconds"
+	writeMetricHeader(w, name, "Duration of each log processing.", "histogram")
+
+	for i, bound := range processLogBuckets {
+
+		var count int64
+		if pe.processLogBuckets != nil {
+			count = pe.processLogBuckets[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, count)
+	}
+
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, pe.processLogCount)
+	fmt.Fprintf(w, "%s_sum %g\n", name, pe.processLogDuration.Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, pe.processLogCount)
+}
+
+// Counters are zero if health is nil (exporter not set in a Config)
+func writeHealth(w *bufio.Writer, health *healthCounters) {
+
+	if health == nil {
+		health = &healthCounters{}
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"httpmonitor_lines_parsed_total", "Number of log lines parsed.",
+			health.linesParsed.Load()},
+		{"httpmonitor_parse_failures_total", "Number of log lines failing to parse.",
+			health.parseFailures.Load()},
+		{"httpmonitor_entry_pool_hits_total", "Entries reused from the pool.",
+			health.entryPoolHits.Load()},
+		{"httpmonitor_entry_pool_misses_total", "Entries allocated outside the pool.",
+			health.entryPoolMisses.Load()},
+		{"httpmonitor_buffer_pool_hits_total", "Buffers reused from the pool.",
+			health.bufferPoolHits.Load()},
+		{"httpmonitor_buffer_pool_misses_total", "Buffers allocated outside the pool.",
+			health.bufferPoolMisses.Load()},
+		{"httpmonitor_reordered_entries_total",
+			"Entries read out of order within the allowed lateness.",
+			health.reorderedEntries.Load()},
+		{"httpmonitor_late_entries_total",
+			"Entries read after the allowed lateness.",
+			health.lateEntries.Load()},
+		{"httpmonitor_late_entries_dropped_total",
+			"Entries ignored by metrics because their period was emitted.",
+			health.lateEntriesDropped.Load()},
+		{"httpmonitor_output_dropped_total",
+			"Items dropped by full subscriber queues.",
+			health.outputDropped.Load()},
+		{"httpmonitor_notifications_dropped_total",
+			"Webhook deliveries dropped by full queues.",
+			health.notificationsDropped.Load()},
+		{"httpmonitor_config_reloads_total",
+			"Configuration reloads applied.",
+			health.configReloads.Load()},
+		{"httpmonitor_config_reload_failures_total",
+			"Configuration reloads rejected as invalid.",
+			health.configReloadFailures.Load()},
+	}
+
+	for _, c := range counters {
+		writeMetricHeader(w, c.name, c.help, "counter")
+		fmt.Fprintf(w, "%s %d\n", c.name, c.value)
+	}
+}
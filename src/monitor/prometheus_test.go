@@ -0,0 +1,173 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"w3chttpd"
+)
+
+func TestPrometheusExporter(t *testing.T) {
+
+	logSamples := [][]byte{
+		[]byte(`127.0.0.1 - - [07/Mar/2004:16:00:00 -0800] "GET /twiki/ HTTP/1.1" 401 12846`),
+		[]byte(`127.0.0.1 - - [07/Mar/2004:16:00:01 -0800] "GET /twiki HTTP/1.1" 200 4523`),
+		[]byte(`10.0.2.50 - - [07/Mar/2004:16:00:02 -0800] "POST /mailman/listinfo/ HTTP/2.0" 200 6291`),
+		[]byte(``),
+	}
+
+	buffer := bytes.Join(logSamples, []byte("\n"))
+	var rd io.Reader = bytes.NewReader(buffer)
+
+	pe := &PrometheusExporter{}
+	alertsChan := make(chan []*Alert, 10)
+
+	conf := &Config{
+		MetricsFrequency: 10 * time.Second,
+		TrafficWindow:    2 * time.Minute,
+		Threshold:        500,
+		BufferPoolSize:   10,
+		BufferSize:       100,
+		EntryPoolSize:    10,
+		AlertsChan:       alertsChan,
+		MetricsChan:      make(chan *Metrics, 10),
+		AlertRules: []*AlertRule{
+			&AlertRule{Name: "client", Scope: ScopeClient,
+				TrafficWindow: 2 * time.Minute, Threshold: 10000},
+		},
+		Exporter: pe,
+	}
+
+	conf.bpool = &bufferPool{}
+	conf.bpool.init(conf.BufferPoolSize, conf.BufferSize)
+	pe.setHealth(&conf.health)
+	conf.brd = bufio.NewReaderSize(rd, conf.BufferSize)
+	conf.w.init(conf.TrafficWindow, conf.Threshold, conf.EntryPoolSize)
+	conf.scopes = []*scopedWindows{
+		newScopedWindows(conf.AlertRules[0], "", conf.w.queue.epool),
+	}
+
+	ts := httptest.NewServer(pe)
+	defer ts.Close()
+
+	scrape := func() string {
+
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Errorf("http.Get: %v", err)
+			return ""
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// Scrapes run concurrently with processLog
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			scrape()
+		}
+	}()
+
+	end := time.Date(2004, 3, 7, 16, 0, 3, 0, time.FixedZone("", -8*3600))
+	processLog(end.UnixNano(), nil, conf)
+	wg.Wait()
+
+	body := scrape()
+
+	expected := []string{
+		`httpmonitor_requests_total{section="twiki",status_class="2xx"} 1`,
+		`httpmonitor_requests_total{section="twiki",status_class="4xx"} 1`,
+		`httpmonitor_bytes_total{section="mailman",status_class="2xx"} 6291`,
+		`httpmonitor_errors_total{section="twiki",status_class="4xx"} 1`,
+		`httpmonitor_window_bytes{rule="global",key=""} 23660`,
+		`httpmonitor_alert_state{rule="global",key=""} 1`,
+		`httpmonitor_window_bytes{rule="client",key="127.0.0.1"} 17369`,
+		`httpmonitor_alert_state{rule="client",key="127.0.0.1"} 1`,
+		`httpmonitor_alert_state{rule="client",key="10.0.2.50"} 0`,
+		`httpmonitor_process_log_duration_seconds_count 1`,
+		`# TYPE httpmonitor_lines_parsed_total counter`,
+		`httpmonitor_lines_parsed_total 3`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Line \"%s\" not found in exposition:\n%s", line, body)
+		}
+	}
+}
+
+func TestPrometheusExporterMaxSections(t *testing.T) {
+
+	entries := []*w3chttpd.Entry{}
+	for _, resource := range []string{"/a/1", "/a/2", "/b/1", "/c/1"} {
+		entries = append(entries, &w3chttpd.Entry{
+			Req:        w3chttpd.Request{Resource: []byte(resource)},
+			StatusCode: 200,
+			Size:       100,
+		})
+	}
+
+	pe := &PrometheusExporter{MaxSections: 1}
+	pe.observeEntries(entries)
+
+	rec := httptest.NewRecorder()
+	pe.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	expected := []string{
+		`httpmonitor_requests_total{section="a",status_class="2xx"} 2`,
+		`httpmonitor_requests_total{section="other",status_class="2xx"} 2`,
+		`httpmonitor_bytes_total{section="other",status_class="2xx"} 200`,
+		`httpmonitor_lines_parsed_total 0`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Line \"%s\" not found in exposition:\n%s", line, body)
+		}
+	}
+
+	if strings.Contains(body, `section="b"`) {
+		t.Errorf("Section b should be summed in other:\n%s", body)
+	}
+
+	// Admitted sections are kept whatever their traffic, other only
+	// growing
+	pe.observeEntries(entries[2:])
+
+	rec = httptest.NewRecorder()
+	pe.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body = rec.Body.String()
+
+	expected = []string{
+		`httpmonitor_requests_total{section="a",status_class="2xx"} 2`,
+		`httpmonitor_requests_total{section="other",status_class="2xx"} 4`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Line \"%s\" not found in exposition:\n%s", line, body)
+		}
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+
+	value := escapeLabelValue("a\"b\\c\nd")
+	expected := `a\"b\\c\nd`
+
+	if value != expected {
+		t.Errorf("Escaped value differs. Want %s, got %s", expected, value)
+	}
+}
@@ -0,0 +1,278 @@
+package monitor
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// Alert rules differing at most by Threshold and Severity keep their windows
+func (r *AlertRule) sameWindows(other *AlertRule) bool {
+
+	return r.Name == other.Name &&
+		r.Scope == other.Scope &&
+		r.TrafficWindow == other.TrafficWindow &&
+		r.Filter.String() == other.Filter.String() &&
+		r.ExcludeBots == other.ExcludeBots &&
+		slices.Equal(r.ExcludeNetworks, other.ExcludeNetworks) &&
+		r.IdleTimeout == other.IdleTimeout &&
+		r.MaxKeys == other.MaxKeys
+}
+
+// Settings of next requiring a restart must be the same as those of conf
+func (conf *Config) checkReload(next *Config) error {
+
+	granularity := conf.WindowGranularity
+	if granularity <= 0 {
+		granularity = time.Second
+	}
+
+	switch {
+
+	case next.ReadFrequency != conf.ReadFrequency:
+		return fmt.Errorf("read frequency cannot be changed without restart")
+
+	case next.MetricsFrequency != conf.MetricsFrequency:
+		return fmt.Errorf("metrics frequency cannot be changed without restart")
+
+	case next.WindowGranularity != granularity:
+		return fmt.Errorf("window granularity cannot be changed without restart")
+
+	case next.AllowedLateness != conf.AllowedLateness:
+		return fmt.Errorf("allowed lateness cannot be changed without restart")
+
+	case next.BufferPoolSize != conf.BufferPoolSize ||
+		next.BufferSize != conf.BufferSize ||
+		next.EntryPoolSize != conf.EntryPoolSize:
+		return fmt.Errorf("pool and buffer sizes cannot be changed without restart")
+
+	case next.Source != conf.Source:
+		return fmt.Errorf("source name cannot be changed without restart")
+	}
+
+	if conf.file == nil {
+		return nil
+	}
+
+	// Outputs other than the display queue are read at startup only
+	outputs := conf.file.Outputs
+	outputs.Buffer = next.file.Outputs.Buffer
+	outputs.Policy = next.file.Outputs.Policy
+
+	switch {
+
+	case next.file.Source.Path != conf.file.Source.Path:
+		return fmt.Errorf("source path cannot be changed without restart")
+
+	case !reflect.DeepEqual(next.file.Clients, conf.file.Clients) ||
+		!reflect.DeepEqual(next.file.GeoIP, conf.file.GeoIP) ||
+		!reflect.DeepEqual(next.file.Bots, conf.file.Bots) ||
+		!reflect.DeepEqual(next.file.Sessions, conf.file.Sessions) ||
+		!reflect.DeepEqual(next.file.TopK, conf.file.TopK):
+		return fmt.Errorf("clients, geoip, bots, sessions and top_k cannot " +
+			"be changed without restart")
+
+	case !reflect.DeepEqual(next.file.Outputs, outputs):
+		return fmt.Errorf("display, HTTP address, exporters and notifiers " +
+			"cannot be changed without restart")
+	}
+
+	return nil
+}
+
+// Swaps the reloadable settings of next into conf, the windows of the
+// global traffic window and of the alert rules being kept unless their
+// traffic window or the definition of their rule changed
+// Alerts firing in the windows restarted or removed are recovered (at the
+// end of the last release) so that none is left firing
+func (conf *Config) reload(next *Config) {
+
+	conf.Filter = next.Filter
+	conf.MetricsFilter = next.MetricsFilter
+	conf.LatePolicy = next.LatePolicy
+
+	if conf.periods != nil {
+		conf.periods.filter = next.MetricsFilter
+		conf.periods.late = next.LatePolicy
+	}
+
+	alerts := []*Alert{}
+
+	if next.TrafficWindow != conf.w.trafficWindow &&
+		conf.w.status == StatusExceed {
+
+		alerts = append(alerts, &Alert{
+			Timestamp: conf.watermark,
+			Total:     conf.w.size,
+			Status:    StatusRecovered,
+		})
+	}
+
+	conf.TrafficWindow = next.TrafficWindow
+	conf.Threshold = next.Threshold
+	conf.w.setTrafficWindow(next.TrafficWindow)
+	conf.w.threshold = next.Threshold
+
+	previous := make(map[string]*scopedWindows, len(conf.scopes))
+	for _, sw := range conf.scopes {
+		previous[sw.rule.Name] = sw
+	}
+
+	kept := make(map[*scopedWindows]bool, len(conf.scopes))
+	scopes := make([]*scopedWindows, 0, len(next.AlertRules))
+	for _, rule := range next.AlertRules {
+
+		sw, ok := previous[rule.Name]
+		if !ok || !sw.rule.sameWindows(rule) {
+			scopes = append(scopes, conf.newScopedWindows(rule))
+			continue
+		}
+
+		sw.rule = rule
+		for _, kw := range sw.windows {
+			kw.w.threshold = rule.Threshold
+		}
+		scopes = append(scopes, sw)
+		kept[sw] = true
+	}
+
+	for _, sw := range conf.scopes {
+		if !kept[sw] {
+			alerts = append(alerts, sw.release(conf.watermark)...)
+		}
+	}
+
+	conf.AlertRules = next.AlertRules
+	conf.scopes = scopes
+
+	if len(alerts) != 0 {
+		conf.alertsOut.publish(alerts)
+	}
+
+	conf.OutputBuffer = next.OutputBuffer
+	conf.OutputPolicy = next.OutputPolicy
+
+	if conf.metricsChanSub != nil && conf.metricsChanSub.q != nil {
+		conf.metricsChanSub.q.configure(next.OutputBuffer, next.OutputPolicy)
+	}
+
+	if conf.alertsChanSub != nil && conf.alertsChanSub.q != nil {
+		conf.alertsChanSub.q.configure(next.OutputBuffer, next.OutputPolicy)
+	}
+
+	conf.file = next.file
+}
+
+// Validates cf and swaps it in between two reads, the monitor being left
+// untouched if cf is invalid or changes settings requiring a restart
+// (read and metrics frequencies, window granularity, allowed lateness,
+// pools, source, optional sections, outputs other than the display queue)
+// The components of the optional sections are not built again, being kept
+// by the monitor
+// Rules keep their windows unless their traffic window or definition
+// changes, firing alerts of restarted or removed rules being recovered
+func (m *Monitor) Reload(cf *ConfigFile) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conf := m.Config
+
+	next := &Config{
+		Delay:   conf.Delay,
+		Clients: conf.Clients,
+		GeoIP:   conf.GeoIP,
+	}
+
+	if err := cf.apply(next, false); err != nil {
+		conf.health.configReloadFailures.Add(1)
+		return err
+	}
+
+	if err := next.validate(); err != nil {
+		conf.health.configReloadFailures.Add(1)
+		return fmt.Errorf("monitor.Monitor.Reload: %v", err)
+	}
+
+	if err := conf.checkReload(next); err != nil {
+		conf.health.configReloadFailures.Add(1)
+		return fmt.Errorf("monitor.Monitor.Reload: %v", err)
+	}
+
+	conf.reload(next)
+	conf.health.configReloads.Add(1)
+
+	return nil
+}
+
+func (m *Monitor) ReloadFile(path string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		m.Config.health.configReloadFailures.Add(1)
+		return fmt.Errorf("monitor.Monitor.ReloadFile: %v", err)
+	}
+	defer f.Close()
+
+	cf, err := ReadConfigFile(f)
+	if err != nil {
+		m.Config.health.configReloadFailures.Add(1)
+		return err
+	}
+
+	return m.Reload(cf)
+}
+
+// Reloads the configuration file at path when a signal is received on
+// signals (e.g. SIGHUP) or when its modification time or size changes
+// (checked every interval if positive), failed reloads being logged
+// Returns once Stop is called
+func (m *Monitor) WatchConfigFile(path string, interval time.Duration,
+	signals <-chan os.Signal) {
+
+	stop := m.stopChan()
+
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+
+	modTime, size := stat()
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+
+		select {
+
+		case <-stop:
+			return
+
+		case <-signals:
+
+		case <-tick:
+			mt, s := stat()
+			if mt.Equal(modTime) && s == size {
+				continue
+			}
+			modTime, size = mt, s
+		}
+
+		if err := m.ReloadFile(path); err != nil {
+			log.Printf("Configuration not reloaded: %v", err)
+			continue
+		}
+		log.Printf("Configuration reloaded from %s", path)
+	}
+}
@@ -0,0 +1,334 @@
+package monitor
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reloadTestConfig = `{
+	"source": {
+		"read_frequency": "10s",
+		"buffer_pool_size": 10,
+		"buffer_size": 1000,
+		"entry_pool_size": 10
+	},
+	"alerts": {
+		"traffic_window": "10s",
+		"threshold": 150,
+		"rules": [
+			{"name": "sections", "scope": "section", "traffic_window": "10s",
+				"threshold": 150},
+			{"name": "clients", "scope": "client", "traffic_window": "10s",
+				"threshold": 150}
+		]
+	},
+	"metrics": {"frequency": "10s"}
+}`
+
+func readTestConfigFile(t *testing.T, data string) *ConfigFile {
+
+	cf, err := ReadConfigFile(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cf
+}
+
+// Monitor set up from data like Run does, without reading
+func newReloadTestMonitor(t *testing.T,
+	data string) (*Monitor, chan []*Alert) {
+
+	alertsChan := make(chan []*Alert, 10)
+
+	conf := &Config{
+		AlertsChan:  alertsChan,
+		MetricsChan: make(chan *Metrics, 10),
+	}
+
+	if err := readTestConfigFile(t, data).Apply(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf.bpool = &bufferPool{}
+	conf.bpool.init(conf.BufferPoolSize, conf.BufferSize)
+	conf.w.init(conf.TrafficWindow, conf.Threshold, conf.EntryPoolSize)
+	conf.w.setGranularity(conf.WindowGranularity)
+
+	for _, rule := range conf.AlertRules {
+		conf.scopes = append(conf.scopes, conf.newScopedWindows(rule))
+	}
+
+	return &Monitor{Config: conf}, alertsChan
+}
+
+func TestMonitorReload(t *testing.T) {
+
+	m, alertsChan := newReloadTestMonitor(t, reloadTestConfig)
+	conf := m.Config
+
+	rd := strings.NewReader(
+		`10.0.0.1 - - [01/Jan/1970:00:00:03 +0000] "GET /toto HTTP/1.1" 200 200` +
+			"\n")
+	conf.brd = bufio.NewReaderSize(rd, conf.BufferSize)
+	processLog(int64(10*time.Second), nil, conf)
+	<-alertsChan
+
+	sections := conf.scopes[0]
+
+	// Thresholds changed, the clients window lengthened and a rule added
+	err := m.Reload(readTestConfigFile(t, strings.NewReplacer(
+		`"threshold": 150,
+		"rules"`, `"threshold": 1000,
+		"rules"`,
+		`"section", "traffic_window": "10s",
+				"threshold": 150`, `"section", "traffic_window": "10s",
+				"threshold": 1000, "severity": "page"`,
+		`"client", "traffic_window": "10s"`, `"client", "traffic_window": "20s"`,
+		`"threshold": 150}
+		]`, `"threshold": 150},
+			{"name": "statuses", "scope": "status", "traffic_window": "10s",
+				"threshold": 150}
+		]`,
+	).Replace(reloadTestConfig)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := conf.health.configReloads.Load(); n != 1 {
+		t.Errorf("Reloads differ. Want %d, got %d", 1, n)
+	}
+
+	if conf.w.size != 200 || conf.w.status != StatusExceed ||
+		conf.w.threshold != 1000 {
+		t.Errorf("Global window differs. Want size %d, got %d (threshold %d)",
+			200, conf.w.size, conf.w.threshold)
+	}
+
+	if len(conf.scopes) != 3 {
+		t.Fatalf("Length of scopes differs. Want %d, got %d", 3, len(conf.scopes))
+	}
+
+	// Untouched windows keep their state
+	if conf.scopes[0] != sections || conf.scopes[0].rule.Severity != "page" {
+		t.Errorf("Scope of rule %q should be kept", "sections")
+	}
+
+	kw := sections.windows["toto"]
+	if kw == nil || kw.w.size != 200 || kw.w.threshold != 1000 {
+		t.Errorf("Window of section %q differs. Got %+v", "toto", kw)
+	}
+
+	if len(conf.scopes[1].windows) != 0 ||
+		conf.scopes[1].rule.TrafficWindow != 20*time.Second {
+		t.Errorf("Scope of rule %q should be rebuilt", "clients")
+	}
+
+	// The firing client of the rebuilt rule is recovered
+	alerts := <-alertsChan
+	if len(alerts) != 1 || alerts[0].Status != StatusRecovered ||
+		alerts[0].Rule != "clients" || alerts[0].Key != "10.0.0.1" ||
+		alerts[0].Total != 200 {
+		t.Errorf("Alerts differ. Want client %q recovered, got %v",
+			"10.0.0.1", alerts)
+	}
+
+	// The global window recovers with the new threshold
+	rd = strings.NewReader("")
+	conf.brd = bufio.NewReaderSize(rd, conf.BufferSize)
+	processLog(int64(20*time.Second), nil, conf)
+
+	alerts = <-alertsChan
+	if len(alerts) == 0 || alerts[0].Status != StatusRecovered ||
+		alerts[0].Rule != "" {
+		t.Errorf("Alerts differ. Want the global window recovered, got %v",
+			alerts)
+	}
+}
+
+func TestMonitorReloadRecovers(t *testing.T) {
+
+	m, alertsChan := newReloadTestMonitor(t, reloadTestConfig)
+	conf := m.Config
+
+	rd := strings.NewReader(
+		`10.0.0.1 - - [01/Jan/1970:00:00:03 +0000] "GET /toto HTTP/1.1" 200 200` +
+			"\n")
+	conf.brd = bufio.NewReaderSize(rd, conf.BufferSize)
+	processLog(int64(10*time.Second), nil, conf)
+	<-alertsChan
+
+	// The global window lengthened and the sections rule removed
+	err := m.Reload(readTestConfigFile(t, strings.NewReplacer(
+		`"traffic_window": "10s",
+		"threshold"`, `"traffic_window": "20s",
+		"threshold"`,
+		`{"name": "sections", "scope": "section", "traffic_window": "10s",
+				"threshold": 150},`, ``,
+	).Replace(reloadTestConfig)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Recovered at the end of the last release
+	expected := []*Alert{
+		&Alert{Timestamp: conf.watermark, Total: 200,
+			Status: StatusRecovered},
+		&Alert{Timestamp: conf.watermark, Total: 200,
+			Status: StatusRecovered, Rule: "sections", Key: "toto"},
+	}
+
+	alerts := <-alertsChan
+	if len(alerts) != len(expected) {
+		t.Fatalf("Alerts differ. Want %v, got %v", expected, alerts)
+	}
+
+	for i, a := range expected {
+		if *alerts[i] != *a {
+			t.Errorf("Alert differs. Want %v, got %v", a, alerts[i])
+		}
+	}
+
+	if conf.w.status != StatusRecovered || len(conf.scopes) != 1 {
+		t.Errorf("Global window and scopes should be reset")
+	}
+}
+
+func TestMonitorReloadRejected(t *testing.T) {
+
+	tests := []struct {
+		old, new string
+	}{
+		// Invalid
+		{`"threshold": 150,
+		"rules"`, `"threshold": 150, "treshold": 1,
+		"rules"`},
+		{`"client"`, `"clients"`},
+		{`"traffic_window": "10s",
+		"threshold"`, `"traffic_window": "1500ms",
+		"threshold"`},
+		// Requiring a restart
+		{`"read_frequency": "10s"`, `"read_frequency": "5s"`},
+		{`"frequency": "10s"`, `"frequency": "20s"`},
+		{`"buffer_size": 1000`, `"buffer_size": 2000`},
+		{`"source": {`, `"source": {"allowed_lateness": "10s",`},
+		{`"source": {`, `"source": {"path": "other.log",`},
+		{`"source": {`, `"top_k": {"k": 5}, "source": {`},
+		{`"metrics"`, `"outputs": {"statsd": {"addr": "localhost:8125"}},
+	"metrics"`},
+	}
+
+	for _, test := range tests {
+
+		m, _ := newReloadTestMonitor(t, reloadTestConfig)
+
+		data := strings.Replace(reloadTestConfig, test.old, test.new, 1)
+		if data == reloadTestConfig {
+			t.Fatalf("Test config not modified by %q", test.new)
+		}
+
+		err := m.ReloadFile(writeTestConfigFile(t, data))
+		if err == nil {
+			t.Errorf("Reload with %q should fail", test.new)
+		}
+
+		if n := m.Config.health.configReloadFailures.Load(); n != 1 {
+			t.Errorf("Reload failures differ. Want %d, got %d", 1, n)
+		}
+
+		if m.Config.Threshold != 150 || len(m.Config.scopes) != 2 ||
+			m.Config.file.Source.Path != "access.log" {
+			t.Errorf("Monitor should be untouched by %q", test.new)
+		}
+	}
+}
+
+func TestMonitorReloadComponents(t *testing.T) {
+
+	signatures := filepath.Join(t.TempDir(), "bots.txt")
+	err := os.WriteFile(signatures, []byte("good checker\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := strings.Replace(reloadTestConfig, `"source": {`,
+		`"bots": {"signatures": "`+signatures+`"},
+	"outputs": {"webhooks": [{"name": "hook", "url": "http://localhost/"}]},
+	"source": {`, 1)
+
+	m, _ := newReloadTestMonitor(t, data)
+	conf := m.Config
+	bots, closers := conf.Bots, len(conf.closers)
+
+	// Neither read nor built by a reload
+	os.Remove(signatures)
+
+	data = strings.Replace(data, `"threshold": 150`, `"threshold": 300`, 1)
+	if err := m.Reload(readTestConfigFile(t, data)); err != nil {
+		t.Fatalf("Monitor.Reload: %v", err)
+	}
+
+	if conf.Threshold != 300 || conf.Bots != bots ||
+		len(conf.closers) != closers {
+		t.Errorf("Components should be kept by a reload. Got %+v", conf)
+	}
+}
+
+func writeTestConfigFile(t *testing.T, data string) string {
+
+	path := filepath.Join(t.TempDir(), "httpmonitor.json")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWatchConfigFile(t *testing.T) {
+
+	m, _ := newReloadTestMonitor(t, reloadTestConfig)
+	path := writeTestConfigFile(t, reloadTestConfig)
+
+	signals := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		m.WatchConfigFile(path, 0, signals)
+		close(done)
+	}()
+
+	data := strings.Replace(reloadTestConfig, `"threshold": 150,
+		"rules"`, `"threshold": 300,
+		"rules"`, 1)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	signals <- os.Interrupt
+
+	threshold := 0
+	for i := 0; i < 1000 && threshold != 300; i++ {
+
+		time.Sleep(time.Millisecond)
+
+		m.mu.Lock()
+		threshold = m.Config.Threshold
+		m.mu.Unlock()
+	}
+
+	if threshold != 300 {
+		t.Errorf("Configuration not reloaded")
+	}
+
+	m.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("WatchConfigFile should return once stopped")
+	}
+}
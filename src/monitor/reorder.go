@@ -0,0 +1,89 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Handling of entries arriving after the Metrics of their period were
+// emitted (later than AllowedLateness)
+type LatePolicy int
+
+const (
+	// Ignored by Metrics
+	LateDrop LatePolicy = iota
+	// Counted in the Metrics of the period being aggregated
+	LateCount LatePolicy = iota
+	// Emitted as correction Metrics of their period (see Metrics.Correction)
+	LateCorrect LatePolicy = iota
+)
+
+func (lp LatePolicy) String() string {
+
+	switch lp {
+
+	case LateDrop:
+		return "drop"
+
+	case LateCount:
+		return "count"
+
+	case LateCorrect:
+		return "correct"
+
+	default:
+		return fmt.Sprintf("policy(%d)", int(lp))
+	}
+}
+
+func ParseLatePolicy(name string) (LatePolicy, error) {
+
+	for lp := LateDrop; lp <= LateCorrect; lp++ {
+		if lp.String() == name {
+			return lp, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown late policy %q", name)
+}
+
+// Reorder buffer: the entries read from processed (sorted by
+// processBuffer) are merged with the queued ones not released yet, the
+// number of entries up to end (to be released) being returned
+// Entries not after watermark (the end of the previous release) are late,
+// the other ones older than a queued entry being reordered (both counted
+// in health)
+func reorderQueue(queue *entryQueue, processed int,
+	watermark, end time.Time, health *healthCounters) int {
+
+	entries := queue.entries
+
+	if processed < len(entries) {
+
+		var newest time.Time
+		if processed > 0 {
+			newest = entries[processed-1].Timestamp
+		}
+
+		for _, e := range entries[processed:] {
+
+			if !watermark.IsZero() && !e.Timestamp.After(watermark) {
+				health.lateEntries.Add(1)
+
+			} else if e.Timestamp.Before(newest) {
+				health.reorderedEntries.Add(1)
+			}
+		}
+
+		if processed > 0 && entries[processed].Timestamp.Before(newest) {
+			sort.Stable(queue)
+		}
+	}
+
+	released := 0
+	for released < len(entries) && !entries[released].Timestamp.After(end) {
+		released++
+	}
+
+	return released
+}
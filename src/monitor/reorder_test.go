@@ -0,0 +1,172 @@
+package monitor
+
+import (
+	"bufio"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"w3chttpd"
+)
+
+func TestParseLatePolicy(t *testing.T) {
+
+	for _, lp := range []LatePolicy{LateDrop, LateCount, LateCorrect} {
+
+		parsed, err := ParseLatePolicy(lp.String())
+		if err != nil || parsed != lp {
+			t.Errorf("Parsed policy differs. Want %v, got %v (%v)",
+				lp, parsed, err)
+		}
+	}
+
+	if _, err := ParseLatePolicy("ignore"); err == nil {
+		t.Errorf("Unknown policy should fail")
+	}
+}
+
+func TestReorderQueue(t *testing.T) {
+
+	eq := &entryQueue{
+		&sync.RWMutex{},
+		[]*w3chttpd.Entry{
+			// Not released yet
+			&w3chttpd.Entry{Timestamp: time.Unix(10, 0)},
+			&w3chttpd.Entry{Timestamp: time.Unix(12, 0)},
+			// Read batch
+			&w3chttpd.Entry{Timestamp: time.Unix(5, 0)},
+			&w3chttpd.Entry{Timestamp: time.Unix(11, 0)},
+			&w3chttpd.Entry{Timestamp: time.Unix(13, 0)},
+		},
+		&entryPool{},
+	}
+
+	health := &healthCounters{}
+	released := reorderQueue(eq, 2, time.Unix(8, 0), time.Unix(11, 0), health)
+
+	if released != 3 {
+		t.Errorf("Released entries differ. Want %d, got %d", 3, released)
+	}
+
+	for i, sec := range []int64{5, 10, 11, 12, 13} {
+		if eq.entries[i].Timestamp.Unix() != sec {
+			t.Errorf("Entry %d differs. Want %d, got %d",
+				i, sec, eq.entries[i].Timestamp.Unix())
+		}
+	}
+
+	if n := health.lateEntries.Load(); n != 1 {
+		t.Errorf("Late entries differ. Want %d, got %d", 1, n)
+	}
+
+	if n := health.reorderedEntries.Load(); n != 1 {
+		t.Errorf("Reordered entries differ. Want %d, got %d", 1, n)
+	}
+}
+
+func newLatenessTestConfig(policy LatePolicy) (*Config, chan *Metrics) {
+
+	metricsChan := make(chan *Metrics, 10)
+
+	conf := &Config{
+		MetricsFrequency: 10 * time.Second,
+		TrafficWindow:    10 * time.Second,
+		Threshold:        500,
+		BufferPoolSize:   10,
+		BufferSize:       1000,
+		EntryPoolSize:    10,
+		AllowedLateness:  10 * time.Second,
+		LatePolicy:       policy,
+		AlertsChan:       make(chan []*Alert, 10),
+		MetricsChan:      metricsChan,
+	}
+
+	conf.bpool = &bufferPool{}
+	conf.bpool.init(conf.BufferPoolSize, conf.BufferSize)
+	conf.w.init(conf.TrafficWindow, conf.Threshold, conf.EntryPoolSize)
+
+	return conf, metricsChan
+}
+
+func readLatenessTestLogs(conf *Config, now int64, logs ...string) {
+
+	rd := strings.NewReader(strings.Join(logs, "\n") + "\n")
+	conf.brd = bufio.NewReaderSize(rd, conf.BufferSize)
+	processLog(now, nil, conf)
+}
+
+func TestProcessLogAllowedLateness(t *testing.T) {
+
+	conf, metricsChan := newLatenessTestConfig(LateCorrect)
+
+	readLatenessTestLogs(conf, int64(10*time.Second),
+		`10.0.0.1 - - [01/Jan/1970:00:00:03 +0000] "GET /toto HTTP/1.1" 200 100`,
+		`10.0.0.1 - - [01/Jan/1970:00:00:09 +0000] "GET /toto HTTP/1.1" 200 100`)
+
+	// Period [-10s - 0s[ emitted 10s late
+	if m := <-metricsChan; m.RequestCount != 0 {
+		t.Errorf("Request count differs. Want %d, got %d", 0, m.RequestCount)
+	}
+
+	// Out of order but within the allowed lateness
+	readLatenessTestLogs(conf, int64(20*time.Second),
+		`10.0.0.2 - - [01/Jan/1970:00:00:07 +0000] "GET /toto HTTP/1.1" 200 100`,
+		`10.0.0.2 - - [01/Jan/1970:00:00:15 +0000] "GET /toto HTTP/1.1" 200 100`)
+
+	m := <-metricsChan
+	if m.RequestCount != 3 || m.PeriodStart.Unix() != 0 || m.Correction {
+		t.Errorf("Metrics differ. Want %d requests from %d, got %d from %d",
+			3, 0, m.RequestCount, m.PeriodStart.Unix())
+	}
+
+	if len(conf.w.queue.entries) != 1 {
+		t.Errorf("Length of queue differs. Want %d, got %d",
+			1, len(conf.w.queue.entries))
+	}
+
+	// After the period was emitted
+	readLatenessTestLogs(conf, int64(21*time.Second),
+		`10.0.0.3 - - [01/Jan/1970:00:00:04 +0000] "GET /toto HTTP/1.1" 200 100`)
+
+	m = <-metricsChan
+	if m.RequestCount != 1 || m.PeriodStart.Unix() != 0 || !m.Correction {
+		t.Errorf("Correction differs. Want %d requests from %d, got %+v",
+			1, 0, m)
+	}
+}
+
+func TestProcessLogLatePolicies(t *testing.T) {
+
+	tests := []struct {
+		policy   LatePolicy
+		requests int
+		dropped  int64
+	}{
+		{LateDrop, 1, 1},
+		{LateCount, 2, 0},
+	}
+
+	for _, test := range tests {
+
+		conf, metricsChan := newLatenessTestConfig(test.policy)
+
+		readLatenessTestLogs(conf, int64(20*time.Second),
+			`10.0.0.1 - - [01/Jan/1970:00:00:03 +0000] "GET /toto HTTP/1.1" 200 100`)
+		<-metricsChan
+
+		readLatenessTestLogs(conf, int64(30*time.Second),
+			`10.0.0.1 - - [01/Jan/1970:00:00:04 +0000] "GET /toto HTTP/1.1" 200 100`,
+			`10.0.0.1 - - [01/Jan/1970:00:00:12 +0000] "GET /toto HTTP/1.1" 200 100`)
+
+		m := <-metricsChan
+		if m.RequestCount != test.requests {
+			t.Errorf("Requests with policy %v differ. Want %d, got %d",
+				test.policy, test.requests, m.RequestCount)
+		}
+
+		if n := conf.health.lateEntriesDropped.Load(); n != test.dropped {
+			t.Errorf("Dropped entries with policy %v differ. Want %d, got %d",
+				test.policy, test.dropped, n)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"w3chttpd"
+)
+
+type Scope int
+
+const (
+	ScopeGlobal      Scope = iota
+	ScopeSection     Scope = iota
+	ScopeClient      Scope = iota
+	ScopeStatusClass Scope = iota
+	ScopeSource      Scope = iota
+	ScopeNetwork     Scope = iota
+	ScopeCountry     Scope = iota
+)
+
+func (s Scope) String() string {
+
+	switch s {
+
+	case ScopeGlobal:
+		return "global"
+
+	case ScopeSection:
+		return "section"
+
+	case ScopeClient:
+		return "client"
+
+	case ScopeStatusClass:
+		return "status"
+
+	case ScopeSource:
+		return "source"
+
+	case ScopeNetwork:
+		return "network"
+
+	case ScopeCountry:
+		return "country"
+
+	default:
+		return fmt.Sprintf("scope(%d)", int(s))
+	}
+}
+
+func ParseScope(name string) (Scope, error) {
+
+	for s := ScopeGlobal; s <= ScopeCountry; s++ {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scope %q", name)
+}
+
+// An independent sliding window is kept for each active key of the scope
+// Only entries matching Filter (if set) are counted, ExcludeBots ignoring
+// good bots and suspicious automation (see BotClassifier) and
+// ExcludeNetworks the named network lists (see Clients)
+// ScopeNetwork keys entries by network list, ignoring the others,
+// ScopeCountry by ISO code ("unknown" if not found, see GeoIP)
+// IdleTimeout defaults to TrafficWindow
+// MaxKeys = 0 means no limit on the number of tracked keys
+type AlertRule struct {
+	Name            string
+	Scope           Scope
+	TrafficWindow   time.Duration
+	Threshold       int
+	Severity        string
+	Filter          *Filter
+	ExcludeBots     bool
+	ExcludeNetworks []string
+	IdleTimeout     time.Duration
+	MaxKeys         int
+}
+
+type windowLabels struct {
+	rule string
+	key  string
+}
+
+type windowState struct {
+	size   int
+	status AlertStatus
+}
+
+// Snapshot of every alert window, the global one having rule "global"
+func windowStates(conf *Config) map[windowLabels]windowState {
+
+	windows := map[windowLabels]windowState{
+		{"global", ""}: {conf.w.size, conf.w.status},
+	}
+
+	for _, sw := range conf.scopes {
+		for key, kw := range sw.windows {
+			windows[windowLabels{sw.rule.Name, key}] =
+				windowState{kw.w.size, kw.w.status}
+		}
+	}
+
+	return windows
+}
+
+type keyWindow struct {
+	w        window
+	lastSeen time.Time
+}
+
+type scopedWindows struct {
+	rule        *AlertRule
+	source      string
+	epool       *entryPool
+	bots        *BotClassifier
+	clients     *Clients
+	geo         *GeoIP
+	granularity time.Duration
+	windows     map[string]*keyWindow
+
+	// Entries ignored because MaxKeys was reached
+	dropped int
+}
+
+// The windows of every key take their entries from epool, usually shared
+// with the global window
+func newScopedWindows(rule *AlertRule, source string,
+	epool *entryPool) *scopedWindows {
+
+	return &scopedWindows{
+		rule:    rule,
+		source:  source,
+		epool:   epool,
+		windows: make(map[string]*keyWindow),
+	}
+}
+
+func (sw *scopedWindows) keyFor(e *w3chttpd.Entry) string {
+
+	switch sw.rule.Scope {
+
+	case ScopeSection:
+		return entrySection(e)
+
+	case ScopeClient:
+		return sw.clients.key(e)
+
+	case ScopeStatusClass:
+		return statusClass(e.StatusCode)
+
+	case ScopeSource:
+		return sw.source
+
+	case ScopeNetwork:
+		return sw.clients.network(e).Name
+
+	case ScopeCountry:
+		return sw.geo.countryKey(e, sw.clients)
+
+	default:
+		return ""
+	}
+}
+
+func (sw *scopedWindows) idleTimeout() time.Duration {
+
+	if sw.rule.IdleTimeout > 0 {
+		return sw.rule.IdleTimeout
+	}
+	return sw.rule.TrafficWindow
+}
+
+// Only keys in recovered status can be evicted,
+// returns false if the key cannot be tracked
+func (sw *scopedWindows) track(key string) (*keyWindow, bool) {
+
+	if kw, ok := sw.windows[key]; ok {
+		return kw, true
+	}
+
+	if sw.rule.MaxKeys > 0 && len(sw.windows) >= sw.rule.MaxKeys {
+
+		oldest := ""
+		var kwOldest *keyWindow
+
+		for k, kw := range sw.windows {
+
+			if kw.w.status != StatusRecovered {
+				continue
+			}
+
+			if kwOldest == nil || kw.lastSeen.Before(kwOldest.lastSeen) {
+				oldest = k
+				kwOldest = kw
+			}
+		}
+
+		if kwOldest == nil {
+			return nil, false
+		}
+		sw.evict(oldest)
+	}
+
+	kw := &keyWindow{}
+	kw.w.initWithPool(sw.rule.TrafficWindow, sw.rule.Threshold, sw.epool)
+	kw.w.setGranularity(sw.granularity)
+	sw.windows[key] = kw
+
+	return kw, true
+}
+
+func (sw *scopedWindows) evict(key string) {
+
+	kw := sw.windows[key]
+
+	for _, e := range kw.w.queue.entries {
+		sw.epool.recycle(e)
+	}
+
+	delete(sw.windows, key)
+}
+
+// Evicts every key, the alerts still firing being recovered at t
+func (sw *scopedWindows) release(t time.Time) []*Alert {
+
+	alerts := []*Alert{}
+
+	keys := make([]string, 0, len(sw.windows))
+	for key := range sw.windows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		kw := sw.windows[key]
+
+		if kw.w.status == StatusExceed {
+			alerts = append(alerts, &Alert{
+				Timestamp: t,
+				Total:     kw.w.size,
+				Status:    StatusRecovered,
+				Rule:      sw.rule.Name,
+				Key:       key,
+				Severity:  sw.rule.Severity,
+			})
+		}
+
+		sw.evict(key)
+	}
+
+	return alerts
+}
+
+// Entries are copied (timestamp and size only) since the global
+// queue recycles its own entries independently
+func (sw *scopedWindows) add(entries []*w3chttpd.Entry) {
+
+	for _, e := range entries {
+
+		if !sw.rule.Filter.Match(e) {
+			continue
+		}
+
+		if sw.rule.ExcludeBots && sw.bots.Classify(e) != ClassHuman {
+			continue
+		}
+
+		if len(sw.rule.ExcludeNetworks) != 0 &&
+			sw.clients.inNetworks(e, sw.rule.ExcludeNetworks) {
+			continue
+		}
+
+		if sw.rule.Scope == ScopeNetwork && sw.clients.network(e) == nil {
+			continue
+		}
+
+		kw, ok := sw.track(sw.keyFor(e))
+		if !ok {
+			sw.dropped++
+			continue
+		}
+
+		c := sw.epool.get()
+		c.Timestamp = e.Timestamp
+		c.Size = e.Size
+		kw.w.queue.add(c)
+
+		if e.Timestamp.After(kw.lastSeen) {
+			kw.lastSeen = e.Timestamp
+		}
+	}
+}
+
+func (sw *scopedWindows) getNewAlerts(end time.Time) []*Alert {
+
+	alerts := []*Alert{}
+
+	keys := make([]string, 0, len(sw.windows))
+	for key := range sw.windows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		kw := sw.windows[key]
+
+		for _, a := range kw.w.getNewAlerts(end) {
+			a.Rule = sw.rule.Name
+			a.Key = key
+			a.Severity = sw.rule.Severity
+			alerts = append(alerts, a)
+		}
+
+		if kw.w.status == StatusRecovered &&
+			end.Sub(kw.lastSeen) >= sw.idleTimeout() {
+
+			sw.evict(key)
+		}
+	}
+
+	return alerts
+}
@@ -0,0 +1,189 @@
+package monitor
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"w3chttpd"
+)
+
+func newTestEntryPool(size int) *entryPool {
+
+	ep := &entryPool{}
+	ep.init(size)
+	return ep
+}
+
+func TestKeyFor(t *testing.T) {
+
+	e := &w3chttpd.Entry{
+		Ip:         []byte("10.0.0.1"),
+		Req:        w3chttpd.Request{Resource: []byte("/admin/users")},
+		StatusCode: 503,
+	}
+
+	tests := []struct {
+		scope    Scope
+		expected string
+	}{
+		{ScopeGlobal, ""},
+		{ScopeSection, "admin"},
+		{ScopeClient, "10.0.0.1"},
+		{ScopeStatusClass, "5xx"},
+		{ScopeSource, "access.log"},
+	}
+
+	for _, test := range tests {
+
+		sw := newScopedWindows(&AlertRule{Scope: test.scope}, "access.log",
+			newTestEntryPool(10))
+
+		if key := sw.keyFor(e); key != test.expected {
+			t.Errorf("Key differs for scope %s. Want \"%s\", got \"%s\"",
+				test.scope, test.expected, key)
+		}
+	}
+}
+
+func TestScopedWindowsGetNewAlerts(t *testing.T) {
+
+	rule := &AlertRule{
+		Name:          "per-client",
+		Scope:         ScopeClient,
+		TrafficWindow: 2 * time.Minute,
+		Threshold:     400,
+	}
+
+	sw := newScopedWindows(rule, "", newTestEntryPool(10))
+
+	sw.add([]*w3chttpd.Entry{
+		&w3chttpd.Entry{Ip: []byte("10.0.0.1"), Timestamp: time.Unix(1, 0), Size: 300},
+		&w3chttpd.Entry{Ip: []byte("10.0.0.2"), Timestamp: time.Unix(1, 0), Size: 300},
+		&w3chttpd.Entry{Ip: []byte("10.0.0.1"), Timestamp: time.Unix(2, 0), Size: 200},
+	})
+
+	alerts := sw.getNewAlerts(time.Unix(2, 0))
+
+	if len(alerts) != 1 {
+		t.Fatalf("Should want %d alerts. Got %d", 1, len(alerts))
+	}
+
+	expected := &Alert{
+		Timestamp: time.Unix(2, 0),
+		Total:     500,
+		Status:    StatusExceed,
+		Rule:      "per-client",
+		Key:       "10.0.0.1",
+	}
+
+	if *alerts[0] != *expected {
+		t.Errorf("Alert differs. Want %+v, got %+v", expected, alerts[0])
+	}
+
+	if len(sw.windows) != 2 {
+		t.Errorf("Number of tracked keys differs. Want %d, got %d",
+			2, len(sw.windows))
+	}
+
+	alerts = sw.getNewAlerts(time.Unix(200, 0))
+
+	if len(alerts) != 1 || alerts[0].Status != StatusRecovered ||
+		alerts[0].Key != "10.0.0.1" {
+		t.Errorf("Should want a recovery alert for key %s. Got %v",
+			"10.0.0.1", alerts)
+	}
+
+	if len(sw.windows) != 0 {
+		t.Errorf("Idle keys should be evicted. Got %d keys", len(sw.windows))
+	}
+}
+
+func TestScopedWindowsMaxKeys(t *testing.T) {
+
+	rule := &AlertRule{
+		Name:          "per-section",
+		Scope:         ScopeSection,
+		TrafficWindow: 2 * time.Minute,
+		Threshold:     400,
+		MaxKeys:       2,
+	}
+
+	sw := newScopedWindows(rule, "", newTestEntryPool(10))
+
+	sw.add([]*w3chttpd.Entry{
+		&w3chttpd.Entry{Req: w3chttpd.Request{Resource: []byte("/a")},
+			Timestamp: time.Unix(1, 0), Size: 500},
+		&w3chttpd.Entry{Req: w3chttpd.Request{Resource: []byte("/b")},
+			Timestamp: time.Unix(2, 0), Size: 10},
+	})
+	sw.getNewAlerts(time.Unix(2, 0))
+
+	// "a" is exceeding and cannot be evicted, "b" is the only candidate
+	sw.add([]*w3chttpd.Entry{
+		&w3chttpd.Entry{Req: w3chttpd.Request{Resource: []byte("/c")},
+			Timestamp: time.Unix(3, 0), Size: 10},
+	})
+
+	if _, ok := sw.windows["b"]; ok {
+		t.Error("Key b should have been evicted")
+	}
+
+	if len(sw.windows) != 2 {
+		t.Errorf("Number of tracked keys differs. Want %d, got %d",
+			2, len(sw.windows))
+	}
+
+	sw.windows["c"].w.status = StatusExceed
+	sw.add([]*w3chttpd.Entry{
+		&w3chttpd.Entry{Req: w3chttpd.Request{Resource: []byte("/d")},
+			Timestamp: time.Unix(4, 0), Size: 10},
+	})
+
+	if sw.dropped != 1 {
+		t.Errorf("Dropped entries differ. Want %d, got %d", 1, sw.dropped)
+	}
+}
+
+func TestParseScope(t *testing.T) {
+
+	for s := ScopeGlobal; s <= ScopeCountry; s++ {
+
+		parsed, err := ParseScope(s.String())
+		if err != nil || parsed != s {
+			t.Errorf("Parsed scope differs. Want %v, got %v (%v)", s, parsed, err)
+		}
+	}
+
+	if _, err := ParseScope("resource"); err == nil {
+		t.Errorf("Unknown scope should fail")
+	}
+}
+
+func TestScopedWindowsEntryPool(t *testing.T) {
+
+	accessLog := io.Reader(strings.NewReader(""))
+	conf := &Config{
+		AccessLog:      &accessLog,
+		ReadFrequency:  time.Second,
+		BufferPoolSize: 1,
+		BufferSize:     100,
+		EntryPoolSize:  10,
+		AlertRules: []*AlertRule{
+			&AlertRule{Name: "a", TrafficWindow: time.Minute},
+			&AlertRule{Name: "b", TrafficWindow: time.Minute},
+		},
+	}
+
+	if err := conf.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rules do not allocate their own EntryPoolSize entries
+	for _, sw := range conf.scopes {
+		if sw.epool != conf.w.queue.epool {
+			t.Errorf("Rule %q should share the entry pool of the global "+
+				"window", sw.rule.Name)
+		}
+	}
+}
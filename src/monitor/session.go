@@ -0,0 +1,158 @@
+package monitor
+
+import (
+	"container/list"
+	"sync"
+	"time"
+	"w3chttpd"
+)
+
+// Sessions of the period: ended ones (including the evicted ones) give
+// the average duration, pages per session and bounce rate (share of
+// sessions with a single page)
+type SessionMetrics struct {
+	Started         int
+	Ended           int
+	Active          int
+	Evicted         int
+	AvgDuration     time.Duration
+	PagesPerSession float32
+	BounceRate      float32
+}
+
+type session struct {
+	key       string
+	start     time.Time
+	lastSeen  time.Time
+	pageViews int
+}
+
+// Tracks visitor sessions keyed by client (see Clients) and User-Agent
+// across metrics periods, a session ending after Timeout of inactivity
+// (30 minutes by default)
+// At most MaxSessions (100000 by default) are kept, the least recently
+// active session being ended early when a new one starts
+type SessionTracker struct {
+	Timeout     time.Duration
+	MaxSessions int
+
+	// Internal parameters
+	once     sync.Once
+	mu       sync.Mutex
+	clients  *Clients
+	sessions map[string]*list.Element
+	lru      *list.List
+	period   SessionMetrics
+	duration time.Duration
+	pages    int
+	bounces  int
+}
+
+func (st *SessionTracker) init() {
+
+	st.once.Do(func() {
+
+		if st.Timeout <= 0 {
+			st.Timeout = 30 * time.Minute
+		}
+
+		if st.MaxSessions <= 0 {
+			st.MaxSessions = 100000
+		}
+
+		st.sessions = make(map[string]*list.Element)
+		st.lru = list.New()
+	})
+}
+
+func (st *SessionTracker) end(el *list.Element) {
+
+	s := st.lru.Remove(el).(*session)
+	delete(st.sessions, s.key)
+
+	st.period.Ended++
+	st.duration += s.lastSeen.Sub(s.start)
+	st.pages += s.pageViews
+	if s.pageViews == 1 {
+		st.bounces++
+	}
+}
+
+func (st *SessionTracker) observe(entries []*w3chttpd.Entry) {
+
+	st.init()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, e := range entries {
+
+		key := st.clients.key(e) + "\x00" + string(e.UserAgent)
+
+		if el, ok := st.sessions[key]; ok {
+
+			s := el.Value.(*session)
+
+			if e.Timestamp.Sub(s.lastSeen) < st.Timeout {
+
+				s.pageViews++
+				if e.Timestamp.After(s.lastSeen) {
+					s.lastSeen = e.Timestamp
+				}
+				st.lru.MoveToBack(el)
+				continue
+			}
+
+			st.end(el)
+		}
+
+		if len(st.sessions) >= st.MaxSessions {
+			st.end(st.lru.Front())
+			st.period.Evicted++
+		}
+
+		st.sessions[key] = st.lru.PushBack(&session{
+			key:       key,
+			start:     e.Timestamp,
+			lastSeen:  e.Timestamp,
+			pageViews: 1,
+		})
+		st.period.Started++
+	}
+}
+
+// Ends sessions inactive since Timeout at end and returns the metrics
+// of the period since the previous report
+// Sessions being in LRU order, the walk stops at the first active one (a
+// session seen out of order may then end at a later report)
+func (st *SessionTracker) report(end time.Time) *SessionMetrics {
+
+	st.init()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for el := st.lru.Front(); el != nil; el = st.lru.Front() {
+
+		if end.Sub(el.Value.(*session).lastSeen) < st.Timeout {
+			break
+		}
+		st.end(el)
+	}
+
+	sm := st.period
+	sm.Active = len(st.sessions)
+
+	if sm.Ended != 0 {
+		sm.AvgDuration = st.duration / time.Duration(sm.Ended)
+		sm.PagesPerSession = float32(st.pages) / float32(sm.Ended)
+		sm.BounceRate = float32(st.bounces) / float32(sm.Ended)
+	}
+
+	st.period = SessionMetrics{}
+	st.duration = 0
+	st.pages = 0
+	st.bounces = 0
+
+	return &sm
+}
@@ -0,0 +1,167 @@
+package monitor
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+	"w3chttpd"
+)
+
+func newSessionEntry(ip, userAgent string, sec int64) *w3chttpd.Entry {
+
+	return &w3chttpd.Entry{
+		Ip:        []byte(ip),
+		UserAgent: []byte(userAgent),
+		Timestamp: time.Unix(sec, 0),
+	}
+}
+
+func TestSessionTracker(t *testing.T) {
+
+	st := &SessionTracker{Timeout: time.Minute}
+
+	st.observe([]*w3chttpd.Entry{
+		newSessionEntry("10.0.0.1", "firefox", 0),
+		newSessionEntry("10.0.0.1", "firefox", 20),
+		newSessionEntry("10.0.0.1", "curl", 20),
+		newSessionEntry("10.0.0.2", "firefox", 30),
+		newSessionEntry("10.0.0.1", "firefox", 70),
+	})
+
+	sm := st.report(time.Unix(75, 0))
+	expected := &SessionMetrics{Started: 3, Active: 3}
+
+	if !reflect.DeepEqual(sm, expected) {
+		t.Errorf("Sessions differ. Want %+v, got %+v", expected, sm)
+	}
+
+	// Sessions persist across periods
+	st.observe([]*w3chttpd.Entry{
+		newSessionEntry("10.0.0.2", "firefox", 85),
+	})
+
+	sm = st.report(time.Unix(140, 0))
+	expected = &SessionMetrics{
+		Started:         0,
+		Ended:           2,
+		Active:          1,
+		AvgDuration:     35 * time.Second,
+		PagesPerSession: 2,
+		BounceRate:      0.5,
+	}
+
+	if !reflect.DeepEqual(sm, expected) {
+		t.Errorf("Sessions differ. Want %+v, got %+v", expected, sm)
+	}
+
+	// A visit after the timeout starts a new session
+	st.observe([]*w3chttpd.Entry{
+		newSessionEntry("10.0.0.2", "firefox", 150),
+	})
+
+	sm = st.report(time.Unix(150, 0))
+	if sm.Started != 1 || sm.Ended != 1 || sm.Active != 1 {
+		t.Errorf("Sessions differ. Got %+v", sm)
+	}
+}
+
+func TestSessionTrackerMaxSessions(t *testing.T) {
+
+	st := &SessionTracker{Timeout: time.Minute, MaxSessions: 2}
+
+	st.observe([]*w3chttpd.Entry{
+		newSessionEntry("10.0.0.1", "", 0),
+		newSessionEntry("10.0.0.2", "", 1),
+		newSessionEntry("10.0.0.1", "", 2),
+		newSessionEntry("10.0.0.3", "", 3),
+	})
+
+	if len(st.sessions) != 2 {
+		t.Errorf("Number of sessions differs. Want %d, got %d", 2, len(st.sessions))
+	}
+
+	// 10.0.0.2 is the least recently active
+	for _, key := range []string{"10.0.0.1\x00", "10.0.0.3\x00"} {
+		if _, ok := st.sessions[key]; !ok {
+			t.Errorf("Session %q should be kept", key)
+		}
+	}
+
+	sm := st.report(time.Unix(3, 0))
+	if sm.Evicted != 1 || sm.Ended != 1 || sm.BounceRate != 1 {
+		t.Errorf("Evicted session should be ended. Got %+v", sm)
+	}
+}
+
+func TestSessionMetricsJSON(t *testing.T) {
+
+	m := &Metrics{
+		Sessions: &SessionMetrics{
+			Started:         4,
+			Ended:           2,
+			Active:          3,
+			AvgDuration:     90 * time.Second,
+			PagesPerSession: 2.5,
+			BounceRate:      0.25,
+		},
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	decoded := &Metrics{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded.Sessions, m.Sessions) {
+		t.Errorf("Decoded sessions differ. Want %+v, got %+v",
+			m.Sessions, decoded.Sessions)
+	}
+
+	merged := copyMetrics(m)
+	mergeMetrics(merged, &Metrics{
+		Sessions: &SessionMetrics{Started: 1, Ended: 2, Active: 1,
+			AvgDuration: 30 * time.Second, PagesPerSession: 1.5, BounceRate: 0.75},
+	})
+
+	expected := &SessionMetrics{Started: 5, Ended: 4, Active: 1,
+		AvgDuration: time.Minute, PagesPerSession: 2, BounceRate: 0.5}
+
+	if !reflect.DeepEqual(merged.Sessions, expected) {
+		t.Errorf("Merged sessions differ. Want %+v, got %+v",
+			expected, merged.Sessions)
+	}
+
+	if m.Sessions.Started != 4 {
+		t.Error("Merging should not modify the original metrics")
+	}
+}
+
+func TestSessionTrackerReport(t *testing.T) {
+
+	st := &SessionTracker{Timeout: time.Minute}
+
+	// 10.0.0.3 arrives out of order, after the more recent 10.0.0.2
+	st.observe([]*w3chttpd.Entry{
+		newSessionEntry("10.0.0.1", "", 0),
+		newSessionEntry("10.0.0.2", "", 50),
+		newSessionEntry("10.0.0.3", "", 5),
+	})
+
+	// The walk stops at 10.0.0.2, still active
+	sm := st.report(time.Unix(70, 0))
+	if sm.Ended != 1 || sm.Active != 2 {
+		t.Errorf("Sessions differ. Want %d ended and %d active, got %+v",
+			1, 2, sm)
+	}
+
+	sm = st.report(time.Unix(110, 0))
+	if sm.Ended != 2 || sm.Active != 0 {
+		t.Errorf("Sessions differ. Want %d ended and %d active, got %+v",
+			2, 0, sm)
+	}
+}
@@ -0,0 +1,238 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type StatsdFormat int
+
+const (
+	FormatStatsd    StatsdFormat = iota
+	FormatDogStatsd StatsdFormat = iota
+)
+
+func (f StatsdFormat) String() string {
+
+	switch f {
+
+	case FormatStatsd:
+		return "statsd"
+
+	case FormatDogStatsd:
+		return "dogstatsd"
+
+	default:
+		return fmt.Sprintf("format(%d)", int(f))
+	}
+}
+
+func ParseStatsdFormat(name string) (StatsdFormat, error) {
+
+	for f := FormatStatsd; f <= FormatDogStatsd; f++ {
+		if f.String() == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown statsd format %q", name)
+}
+
+// Metrics given to Publish are sent over UDP by a worker so Publish never
+// blocks: when QueueSize metrics are already waiting, new ones are dropped
+// Lines are batched in packets of at most MaxPacketSize bytes
+// Tags are only sent with FormatDogStatsd, sections being embedded in
+// metric names with FormatStatsd
+type StatsdSink struct {
+	Addr          string
+	Format        StatsdFormat
+	Prefix        string
+	Tags          []string
+	MaxPacketSize int
+	QueueSize     int
+
+	// Internal parameters
+	once    sync.Once
+	err     error
+	conn    net.Conn
+	mu      sync.Mutex
+	closed  bool
+	pending chan *Metrics
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+func (ss *StatsdSink) start() error {
+
+	ss.once.Do(func() {
+
+		if ss.Prefix == "" {
+			ss.Prefix = "httpmonitor"
+		}
+
+		if ss.MaxPacketSize <= 0 {
+			ss.MaxPacketSize = 1432
+		}
+
+		if ss.QueueSize <= 0 {
+			ss.QueueSize = 10
+		}
+
+		ss.conn, ss.err = net.Dial("udp", ss.Addr)
+		if ss.err != nil {
+			ss.err = fmt.Errorf("net.Dial: %v", ss.err)
+			return
+		}
+
+		ss.pending = make(chan *Metrics, ss.QueueSize)
+		ss.done = make(chan struct{})
+
+		go ss.run()
+	})
+
+	return ss.err
+}
+
+// Metrics published after Close are ignored
+func (ss *StatsdSink) Publish(m *Metrics) error {
+
+	if err := ss.start(); err != nil {
+		return err
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.closed {
+		return nil
+	}
+
+	select {
+	case ss.pending <- m:
+	default:
+		ss.dropped.Add(1)
+	}
+
+	return nil
+}
+
+// Number of metrics dropped because the queue was full
+func (ss *StatsdSink) Dropped() int64 {
+	return ss.dropped.Load()
+}
+
+// Pending metrics are sent before returning, closing again having no effect
+func (ss *StatsdSink) Close() {
+
+	if ss.start() != nil {
+		return
+	}
+
+	ss.mu.Lock()
+	closed := ss.closed
+	if !closed {
+		ss.closed = true
+		close(ss.pending)
+	}
+	ss.mu.Unlock()
+
+	<-ss.done
+	if !closed {
+		ss.conn.Close()
+	}
+}
+
+func (ss *StatsdSink) run() {
+
+	defer close(ss.done)
+
+	for m := range ss.pending {
+		for _, packet := range ss.packets(ss.lines(m)) {
+			if _, err := ss.conn.Write(packet); err != nil {
+				log.Printf("StatsdSink.Write: %v", err)
+			}
+		}
+	}
+}
+
+func sanitizeStatsdName(name string) string {
+
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func (ss *StatsdSink) line(name, value, kind string, tags ...string) string {
+
+	line := fmt.Sprintf("%s.%s:%s|%s", ss.Prefix, name, value, kind)
+
+	if ss.Format != FormatDogStatsd {
+		return line
+	}
+
+	tags = append(append([]string{}, ss.Tags...), tags...)
+	if len(tags) != 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+
+	return line
+}
+
+func (ss *StatsdSink) lines(m *Metrics) []string {
+
+	lines := []string{
+		ss.line("requests", fmt.Sprint(m.RequestCount), "c"),
+		ss.line("errors", fmt.Sprint(m.ErrorCount), "c"),
+		ss.line("bytes", fmt.Sprint(m.TotalTraffic), "c"),
+		ss.line("unique_visitors", fmt.Sprint(m.UniqueVisitors), "g"),
+		ss.line("avg_page_views", fmt.Sprintf("%.2f", m.AvgPageViews), "g"),
+	}
+
+	for _, r := range m.Rank {
+
+		if ss.Format == FormatDogStatsd {
+			lines = append(lines, ss.line("section.hits", fmt.Sprint(r.HitCount),
+				"c", "section:"+sanitizeStatsdName(r.Section)))
+			continue
+		}
+
+		lines = append(lines, ss.line("section."+sanitizeStatsdName(r.Section)+
+			".hits", fmt.Sprint(r.HitCount), "c"))
+	}
+
+	return lines
+}
+
+// A line longer than MaxPacketSize is sent alone
+func (ss *StatsdSink) packets(lines []string) [][]byte {
+
+	packets := [][]byte{}
+	packet := bytes.Buffer{}
+
+	for _, line := range lines {
+
+		if packet.Len() != 0 && packet.Len()+1+len(line) > ss.MaxPacketSize {
+			packets = append(packets, append([]byte{}, packet.Bytes()...))
+			packet.Reset()
+		}
+
+		if packet.Len() != 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	if packet.Len() != 0 {
+		packets = append(packets, packet.Bytes())
+	}
+
+	return packets
+}
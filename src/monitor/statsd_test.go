@@ -0,0 +1,154 @@
+package monitor
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readStatsdPackets(t *testing.T, pc net.PacketConn, n int) []string {
+
+	packets := []string{}
+	buf := make([]byte, 65536)
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for len(packets) < n {
+		size, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("net.PacketConn.ReadFrom: %v", err)
+		}
+		packets = append(packets, string(buf[:size]))
+	}
+
+	return packets
+}
+
+func TestStatsdSinkPublish(t *testing.T) {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket: %v", err)
+	}
+	defer pc.Close()
+
+	m := &Metrics{
+		Rank:           []Rank{Rank{3, "admin"}, Rank{1, "help.me"}},
+		RequestCount:   4,
+		ErrorCount:     1,
+		TotalTraffic:   120,
+		UniqueVisitors: 2,
+		AvgPageViews:   2,
+	}
+
+	ss := &StatsdSink{Addr: pc.LocalAddr().String()}
+	ss.Publish(m)
+	ss.Close()
+
+	expected := strings.Join([]string{
+		"httpmonitor.requests:4|c",
+		"httpmonitor.errors:1|c",
+		"httpmonitor.bytes:120|c",
+		"httpmonitor.unique_visitors:2|g",
+		"httpmonitor.avg_page_views:2.00|g",
+		"httpmonitor.section.admin.hits:3|c",
+		"httpmonitor.section.help_me.hits:1|c",
+	}, "\n")
+
+	packets := readStatsdPackets(t, pc, 1)
+	if packets[0] != expected {
+		t.Errorf("Packet differs. Want \"%s\", got \"%s\"", expected, packets[0])
+	}
+
+	ss = &StatsdSink{
+		Addr:   pc.LocalAddr().String(),
+		Format: FormatDogStatsd,
+		Tags:   []string{"env:prod"},
+	}
+	ss.Publish(m)
+	ss.Close()
+
+	packets = readStatsdPackets(t, pc, 1)
+	if !strings.Contains(packets[0],
+		"httpmonitor.section.hits:3|c|#env:prod,section:admin\n") {
+		t.Errorf("Tagged section hits not found in \"%s\"", packets[0])
+	}
+}
+
+func TestStatsdSinkPackets(t *testing.T) {
+
+	ss := &StatsdSink{MaxPacketSize: 10}
+
+	packets := ss.packets([]string{"aaaa", "bbbb", "cccc", "dddddddddddd"})
+
+	expected := []string{"aaaa\nbbbb", "cccc", "dddddddddddd"}
+	if len(packets) != len(expected) {
+		t.Fatalf("Number of packets differs. Want %d, got %d",
+			len(expected), len(packets))
+	}
+
+	for i, packet := range packets {
+		if string(packet) != expected[i] {
+			t.Errorf("Packet differs. Want \"%s\", got \"%s\"",
+				expected[i], string(packet))
+		}
+	}
+}
+
+func TestStatsdSinkClose(t *testing.T) {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket: %v", err)
+	}
+	defer pc.Close()
+
+	ss := &StatsdSink{Addr: pc.LocalAddr().String()}
+	ss.Close()
+	ss.Close()
+
+	if err := ss.Publish(&Metrics{}); err != nil {
+		t.Errorf("Publish after Close differs. Want nil, got %v", err)
+	}
+}
+
+func TestStatsdSinkConfig(t *testing.T) {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket: %v", err)
+	}
+	defer pc.Close()
+
+	accessLog := io.Reader(strings.NewReader(
+		`127.0.0.1 - - [07/Mar/2004:16:00:00 -0800] "GET /twiki/ HTTP/1.1" ` +
+			"200 4523\n"))
+	metricsChan := make(chan *Metrics, 10)
+	ss := &StatsdSink{Addr: pc.LocalAddr().String()}
+	conf := &Config{
+		AccessLog:        &accessLog,
+		ReadFrequency:    time.Second,
+		MetricsFrequency: 10 * time.Second,
+		BufferPoolSize:   1,
+		BufferSize:       100,
+		EntryPoolSize:    10,
+		MetricsChan:      metricsChan,
+		Statsd:           ss,
+	}
+
+	if err := conf.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2004, 3, 7, 16, 0, 0, 0, time.FixedZone("", -8*3600))
+	processLog(start.Add(time.Second).UnixNano(), nil, conf)
+	processLog(start.Add(10*time.Second).UnixNano(), nil, conf)
+	ss.Close()
+
+	packets := readStatsdPackets(t, pc, 1)
+	if !strings.Contains(packets[0], "httpmonitor.requests:1|c") {
+		t.Errorf("Requests not found in \"%s\"", packets[0])
+	}
+}
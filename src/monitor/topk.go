@@ -0,0 +1,244 @@
+package monitor
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"w3chttpd"
+)
+
+// Count overestimates the real count by at most Error
+type HeavyHitter struct {
+	Key   string
+	Count int
+	Error int
+}
+
+type heavyHitters []HeavyHitter
+
+func (h heavyHitters) Len() int { return len(h) }
+func (h heavyHitters) Less(i, j int) bool {
+	if h[i].Count != h[j].Count {
+		return h[i].Count > h[j].Count
+	}
+	return h[i].Key < h[j].Key
+}
+func (h heavyHitters) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+// Top items of the period, Total being the number of counted requests
+// (errors are bounded by Total / Capacity, see TopK)
+type HeavyHitters struct {
+	Total      int
+	Sections   []HeavyHitter
+	Resources  []HeavyHitter
+	Clients    []HeavyHitter
+	UserAgents []HeavyHitter
+}
+
+type ssCounter struct {
+	key   string
+	count int
+	err   int
+	index int
+}
+
+// Min-heap of counters
+type ssHeap []*ssCounter
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *ssHeap) Push(x interface{}) {
+	c := x.(*ssCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+func (h *ssHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// Space-Saving algorithm (Metwally et al.): at most capacity counters, a
+// new item replacing the smallest counter and inheriting its count as error
+type spaceSaving struct {
+	capacity int
+	counters map[string]*ssCounter
+	heap     ssHeap
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+
+	return &spaceSaving{
+		capacity: capacity,
+		counters: make(map[string]*ssCounter, capacity),
+		heap:     make(ssHeap, 0, capacity),
+	}
+}
+
+func (ss *spaceSaving) add(key []byte, n int) {
+
+	if c, ok := ss.counters[string(key)]; ok {
+		c.count += n
+		heap.Fix(&ss.heap, c.index)
+		return
+	}
+
+	if len(ss.heap) < ss.capacity {
+		c := &ssCounter{key: string(key), count: n}
+		ss.counters[c.key] = c
+		heap.Push(&ss.heap, c)
+		return
+	}
+
+	c := ss.heap[0]
+	delete(ss.counters, c.key)
+
+	c.key = string(key)
+	c.err = c.count
+	c.count += n
+	ss.counters[c.key] = c
+	heap.Fix(&ss.heap, 0)
+}
+
+func (ss *spaceSaving) top(k int) []HeavyHitter {
+
+	top := make(heavyHitters, 0, len(ss.heap))
+	for _, c := range ss.heap {
+		top = append(top, HeavyHitter{c.key, c.count, c.err})
+	}
+
+	sort.Sort(top)
+
+	if len(top) > k {
+		top = top[:k]
+	}
+	return top
+}
+
+// Heavy hitters of each period for sections, full resources, clients (see
+// Clients) and user agents, with Capacity counters per dimension (10 * K by
+// default) whatever the number of distinct items
+// Counts overestimate by at most Total / Capacity, items more frequent
+// than that being guaranteed to be tracked
+// K (10 by default) limits the reported items
+// Entries are counted like Metrics: in the period of their timestamp,
+// excluded networks being ignored (late entries are only counted with
+// LateCount, corrections having no heavy hitters)
+type TopK struct {
+	K        int
+	Capacity int
+
+	// Internal parameters
+	once    sync.Once
+	mu      sync.Mutex
+	clients *Clients
+	periods map[int64]*topKPeriod
+}
+
+type topKPeriod struct {
+	total      int
+	sections   *spaceSaving
+	resources  *spaceSaving
+	visitors   *spaceSaving
+	userAgents *spaceSaving
+}
+
+func (tk *TopK) init() {
+
+	tk.once.Do(func() {
+
+		if tk.K <= 0 {
+			tk.K = 10
+		}
+
+		if tk.Capacity < tk.K {
+			tk.Capacity = 10 * tk.K
+		}
+
+		tk.periods = make(map[int64]*topKPeriod)
+	})
+}
+
+func (tk *TopK) newPeriod() *topKPeriod {
+
+	return &topKPeriod{
+		sections:   newSpaceSaving(tk.Capacity),
+		resources:  newSpaceSaving(tk.Capacity),
+		visitors:   newSpaceSaving(tk.Capacity),
+		userAgents: newSpaceSaving(tk.Capacity),
+	}
+}
+
+// Entries are folded in as they are released (see metricsPeriods.fold),
+// start being the period they are counted in, so periods never get
+// rescanned
+func (tk *TopK) observe(start int64, entries []*w3chttpd.Entry) {
+
+	tk.init()
+
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	p, ok := tk.periods[start]
+	if !ok {
+		p = tk.newPeriod()
+		tk.periods[start] = p
+	}
+
+	for _, e := range entries {
+
+		if nl := tk.clients.network(e); nl != nil && nl.Exclude {
+			continue
+		}
+
+		p.total++
+
+		section := getSection(e.Req.Resource)
+		if section == nil {
+			section = []byte("/")
+		}
+
+		p.sections.add(section, 1)
+		p.resources.add(e.Req.Resource, 1)
+		p.visitors.add([]byte(tk.clients.key(e)), 1)
+
+		if e.UserAgent != nil {
+			p.userAgents.add(e.UserAgent, 1)
+		}
+	}
+}
+
+// Heavy hitters of the period starting at start, dropped with the older
+// ones
+func (tk *TopK) report(start int64) *HeavyHitters {
+
+	tk.init()
+
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	p, ok := tk.periods[start]
+	if !ok {
+		p = tk.newPeriod()
+	}
+
+	for s := range tk.periods {
+		if s <= start {
+			delete(tk.periods, s)
+		}
+	}
+
+	return &HeavyHitters{
+		Total:      p.total,
+		Sections:   p.sections.top(tk.K),
+		Resources:  p.resources.top(tk.K),
+		Clients:    p.visitors.top(tk.K),
+		UserAgents: p.userAgents.top(tk.K),
+	}
+}
@@ -0,0 +1,184 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+	"w3chttpd"
+)
+
+func TestSpaceSaving(t *testing.T) {
+
+	ss := newSpaceSaving(5)
+	real := map[string]int{}
+
+	// a: 20, b: 10 among 20 items seen once (N = 50)
+	for i := 0; i < 20; i++ {
+		keys := []string{"a", fmt.Sprintf("rare-%d", i)}
+		if i%2 == 0 {
+			keys = append(keys, "b")
+		}
+
+		for _, key := range keys {
+			ss.add([]byte(key), 1)
+			real[key]++
+		}
+	}
+
+	if len(ss.counters) != 5 || len(ss.heap) != 5 {
+		t.Fatalf("Number of counters differs. Want %d, got %d", 5, len(ss.counters))
+	}
+
+	// Items more frequent than N / capacity are tracked
+	top := ss.top(5)
+	if top[0].Key != "a" {
+		t.Errorf("Top item differs. Want %s, got %+v", "a", top)
+	}
+
+	// Counts overestimate by at most Error, itself bounded by N / capacity
+	for _, item := range top {
+		if item.Count < real[item.Key] || item.Count-item.Error > real[item.Key] ||
+			item.Error > 50/5 {
+			t.Errorf("Bounds of %s differ. Real count %d, got %+v",
+				item.Key, real[item.Key], item)
+		}
+	}
+
+	// Exact counts while under capacity
+	ss = newSpaceSaving(10)
+	ss.add([]byte("x"), 2)
+	ss.add([]byte("y"), 1)
+	ss.add([]byte("x"), 1)
+
+	expected := []HeavyHitter{{"x", 3, 0}, {"y", 1, 0}}
+	if top := ss.top(5); !reflect.DeepEqual(top, expected) {
+		t.Errorf("Top differs. Want %+v, got %+v", expected, top)
+	}
+}
+
+func TestTopK(t *testing.T) {
+
+	tk := &TopK{K: 2}
+
+	entries := []*w3chttpd.Entry{}
+	for i := 0; i < 5; i++ {
+		for j := 0; j <= i; j++ {
+			entries = append(entries, &w3chttpd.Entry{
+				Ip:        []byte(fmt.Sprintf("10.0.0.%d", j)),
+				UserAgent: []byte("firefox"),
+				Req: w3chttpd.Request{
+					Method:   []byte("GET"),
+					Resource: []byte(fmt.Sprintf("/section%d/page", j%2)),
+				},
+			})
+		}
+	}
+
+	// Folded in over several reads
+	tk.observe(0, entries[:7])
+	tk.observe(0, entries[7:])
+
+	hh := tk.report(0)
+	expected := &HeavyHitters{
+		Total:      15,
+		Sections:   []HeavyHitter{{"section0", 9, 0}, {"section1", 6, 0}},
+		Resources:  []HeavyHitter{{"/section0/page", 9, 0}, {"/section1/page", 6, 0}},
+		Clients:    []HeavyHitter{{"10.0.0.0", 5, 0}, {"10.0.0.1", 4, 0}},
+		UserAgents: []HeavyHitter{{"firefox", 15, 0}},
+	}
+
+	if !reflect.DeepEqual(hh, expected) {
+		t.Errorf("Heavy hitters differ. Want %+v, got %+v", expected, hh)
+	}
+
+	if hh := tk.report(0); hh.Total != 0 || len(hh.Sections) != 0 {
+		t.Errorf("Heavy hitters should be reset after a report. Got %+v", hh)
+	}
+
+	m := &Metrics{HeavyHitters: expected}
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	decoded := &Metrics{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded.HeavyHitters, expected) {
+		t.Errorf("Decoded heavy hitters differ. Want %+v, got %+v",
+			expected, decoded.HeavyHitters)
+	}
+
+	merged := copyMetrics(m)
+	mergeMetrics(merged, m)
+
+	if merged.HeavyHitters.Total != 30 ||
+		merged.HeavyHitters.Sections[0] != (HeavyHitter{"section0", 18, 0}) ||
+		m.HeavyHitters.Total != 15 {
+		t.Errorf("Merged heavy hitters differ. Got %+v", merged.HeavyHitters)
+	}
+}
+
+func TestTopKPeriods(t *testing.T) {
+
+	f, _ := CompileFilter(`method == "GET"`)
+	conf := &Config{
+		MetricsFrequency: 10 * time.Second,
+		MetricsFilter:    f,
+		Clients:          newTestClients(),
+		TopK:             &TopK{K: 2},
+	}
+	conf.TopK.clients = conf.Clients
+
+	entry := func(ip, method string, sec int64) *w3chttpd.Entry {
+		return &w3chttpd.Entry{
+			Ip:        []byte(ip),
+			Timestamp: time.Unix(sec, 0),
+			Req: w3chttpd.Request{
+				Method:   []byte(method),
+				Resource: []byte("/toto"),
+			},
+		}
+	}
+
+	mp := newMetricsPeriods(conf)
+
+	// Released at 10s, the entries of the next period included
+	mp.fold(int64(10*time.Second), []*w3chttpd.Entry{
+		entry("192.0.2.1", "GET", 5),
+		entry("192.0.2.2", "GET", 12),
+		entry("192.0.2.3", "POST", 6),
+		// Excluded network
+		entry("10.9.0.1", "GET", 7),
+	})
+
+	// Late for the first period, dropped
+	mp.fold(int64(20*time.Second), []*w3chttpd.Entry{
+		entry("192.0.2.4", "GET", 8),
+		entry("192.0.2.5", "GET", 15),
+	})
+
+	for _, test := range []struct {
+		start   int64
+		total   int
+		metrics int
+	}{
+		{0, 1, 1},
+		{int64(10 * time.Second), 2, 2},
+	} {
+
+		ms := mp.metrics(mp.take(test.start+int64(10*time.Second)),
+			time.Unix(0, test.start), time.Unix(0, test.start))
+		hh := conf.TopK.report(test.start)
+
+		if hh.Total != test.total || ms.RequestCount != test.metrics {
+			t.Errorf("Heavy hitters of period %v should match metrics. "+
+				"Want %d, got %d (%d requests)", time.Unix(0, test.start),
+				test.total, hh.Total, ms.RequestCount)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	ansiClear   = "\x1b[H\x1b[2J"
+	ansiBold    = "\x1b[1m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiReverse = "\x1b[7m"
+	ansiReset   = "\x1b[0m"
+
+	// Lines end with \r\n since the terminal is expected in raw mode
+	crlf = "\r\n"
+)
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// Escapes the control characters (C0, DEL and C1) of s, coming from the
+// log, so that it cannot send sequences to the terminal
+func terminalSafe(s string) string {
+
+	b := strings.Builder{}
+	for _, r := range s {
+		if r < 0x20 || (r >= 0x7f && r <= 0x9f) {
+			fmt.Fprintf(&b, "\\x%02x", r)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type SortKey int
+
+const (
+	SortByHits    SortKey = iota
+	SortBySection SortKey = iota
+)
+
+// Full-screen dashboard redrawn at every metrics period and alert,
+// keyboard shortcuts being read from Run keys:
+// s: switch sort key, r: reverse order, p or space: pause, q: quit
+// Periods is the number of periods kept for sparklines (defaults to 30),
+// Sections and History limit the number of sections and alerts shown
+type Dashboard struct {
+	Periods  int
+	Sections int
+	History  int
+
+	// Internal parameters
+	metrics  []*Metrics
+	alerts   []*Alert
+	firing   map[string]*Alert
+	sortKey  SortKey
+	reversed bool
+	paused   bool
+}
+
+func (d *Dashboard) init() {
+
+	if d.firing != nil {
+		return
+	}
+
+	if d.Periods <= 0 {
+		d.Periods = 30
+	}
+
+	if d.Sections <= 0 {
+		d.Sections = 10
+	}
+
+	if d.History <= 0 {
+		d.History = 10
+	}
+
+	d.firing = make(map[string]*Alert)
+}
+
+func (d *Dashboard) addMetrics(m *Metrics) {
+
+	d.metrics = append(d.metrics, m)
+	if len(d.metrics) > d.Periods {
+		d.metrics = d.metrics[len(d.metrics)-d.Periods:]
+	}
+}
+
+func (d *Dashboard) addAlerts(alerts []*Alert) {
+
+	for _, a := range alerts {
+
+		fingerprint := a.Rule + "\x00" + a.Key
+		if a.Status == StatusExceed {
+			d.firing[fingerprint] = a
+		} else {
+			delete(d.firing, fingerprint)
+		}
+
+		d.alerts = append(d.alerts, a)
+	}
+
+	if len(d.alerts) > d.History {
+		d.alerts = d.alerts[len(d.alerts)-d.History:]
+	}
+}
+
+// Returns false when the dashboard should quit
+func (d *Dashboard) handleKey(key byte) bool {
+
+	switch key {
+
+	case 's':
+		d.sortKey = (d.sortKey + 1) % 2
+
+	case 'r':
+		d.reversed = !d.reversed
+
+	case 'p', ' ':
+		d.paused = !d.paused
+
+	case 'q', 3: // Ctrl-C in raw mode
+		return false
+	}
+
+	return true
+}
+
+func sparkline(values []int) string {
+
+	max := 0
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+
+	res := make([]rune, len(values))
+	for i, v := range values {
+
+		level := 0
+		if max > 0 {
+			level = v * (len(sparkBlocks) - 1) / max
+		}
+		res[i] = sparkBlocks[level]
+	}
+
+	return string(res)
+}
+
+func (d *Dashboard) sortedRank(m *Metrics) []Rank {
+
+	r := append([]Rank{}, m.Rank...)
+
+	sort.SliceStable(r, func(i, j int) bool {
+
+		less := r[i].HitCount > r[j].HitCount
+		if d.sortKey == SortBySection {
+			less = r[i].Section < r[j].Section
+		}
+
+		if d.reversed {
+			return !less
+		}
+		return less
+	})
+
+	return r
+}
+
+func (d *Dashboard) render(w io.Writer) {
+
+	buf := bytes.Buffer{}
+	buf.WriteString(ansiClear)
+
+	status := ""
+	if d.paused {
+		status = ansiReverse + " PAUSED " + ansiReset
+	}
+
+	fmt.Fprintf(&buf, "%shttpmonitor%s %s%s", ansiBold, ansiReset, status, crlf)
+	buf.WriteString(crlf)
+
+	if len(d.metrics) == 0 {
+		buf.WriteString("Waiting for metrics..." + crlf)
+	} else {
+		d.renderMetrics(&buf)
+	}
+
+	buf.WriteString(crlf)
+	d.renderAlerts(&buf)
+
+	sortKey := "hits"
+	if d.sortKey == SortBySection {
+		sortKey = "section"
+	}
+
+	fmt.Fprintf(&buf, "%s[s] sort: %s  [r] reverse  [p] pause  [q] quit%s",
+		crlf, sortKey, crlf)
+
+	w.Write(buf.Bytes())
+}
+
+func (d *Dashboard) renderMetrics(buf *bytes.Buffer) {
+
+	m := d.metrics[len(d.metrics)-1]
+
+	fmt.Fprintf(buf, "[%s - %s]%s", m.PeriodStart.Format("02/01/2006:15:04:05"),
+		m.PeriodEnd.Format("02/01/2006:15:04:05"), crlf)
+
+	requests := make([]int, len(d.metrics))
+	traffic := make([]int, len(d.metrics))
+	errors := make([]int, len(d.metrics))
+
+	for i, pm := range d.metrics {
+		requests[i] = pm.RequestCount
+		traffic[i] = pm.TotalTraffic
+		errors[i] = pm.ErrorCount
+	}
+
+	fmt.Fprintf(buf, "Requests %10d %s%s", m.RequestCount, sparkline(requests), crlf)
+	fmt.Fprintf(buf, "Bytes    %10d %s%s", m.TotalTraffic, sparkline(traffic), crlf)
+	fmt.Fprintf(buf, "Errors   %10d %s%s", m.ErrorCount, sparkline(errors), crlf)
+	fmt.Fprintf(buf, "Unique visitors: %d (Avg page views per visitor: %.2f)%s",
+		m.UniqueVisitors, m.AvgPageViews, crlf)
+
+	buf.WriteString(crlf)
+	fmt.Fprintf(buf, "%s%-60s %10s%s%s", ansiBold, "SECTION", "HITS", ansiReset, crlf)
+
+	for i, r := range d.sortedRank(m) {
+
+		if i == d.Sections {
+			fmt.Fprintf(buf, "... %d more%s", len(m.Rank)-d.Sections, crlf)
+			break
+		}
+
+		// Truncated by rune, not to cut a multi-byte character
+		section := terminalSafe(r.Section)
+		if runes := []rune(section); len(runes) > 60 {
+			section = string(runes[:57]) + "..."
+		}
+		fmt.Fprintf(buf, "%-60s %10d%s", section, r.HitCount, crlf)
+	}
+}
+
+func (d *Dashboard) renderAlerts(buf *bytes.Buffer) {
+
+	fingerprints := make([]string, 0, len(d.firing))
+	for f := range d.firing {
+		fingerprints = append(fingerprints, f)
+	}
+	sort.Strings(fingerprints)
+
+	fmt.Fprintf(buf, "%sALERTS%s (%d firing)%s", ansiBold, ansiReset,
+		len(fingerprints), crlf)
+
+	for _, f := range fingerprints {
+		fmt.Fprintf(buf, "%s%s%s%s", ansiRed, terminalSafe(d.firing[f].String()),
+			ansiReset, crlf)
+	}
+
+	buf.WriteString(crlf + "History:" + crlf)
+
+	for i := len(d.alerts) - 1; i >= 0; i-- {
+
+		color := ansiGreen
+		if d.alerts[i].Status == StatusExceed {
+			color = ansiRed
+		}
+
+		line := terminalSafe(strings.TrimSpace(d.alerts[i].String()))
+		fmt.Fprintf(buf, "%s%s%s%s", color, line, ansiReset, crlf)
+	}
+}
+
+// Returns when q is pressed or keys is closed, the last state being kept
+// once the channels are closed
+// The terminal should be in raw mode for keys to be read unbuffered
+func (d *Dashboard) Run(w io.Writer, keys io.Reader,
+	alertsChan <-chan []*Alert, metricsChan <-chan *Metrics) {
+
+	d.init()
+
+	keysChan := make(chan byte)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+
+		defer close(keysChan)
+
+		buf := make([]byte, 1)
+		for {
+			if _, err := keys.Read(buf); err != nil {
+				return
+			}
+
+			select {
+			case keysChan <- buf[0]:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	d.render(w)
+
+	for {
+
+		select {
+
+		case alerts, ok := <-alertsChan:
+			if !ok {
+				alertsChan = nil
+				continue
+			}
+			d.addAlerts(alerts)
+
+		case metrics, ok := <-metricsChan:
+			if !ok {
+				metricsChan = nil
+				continue
+			}
+			d.addMetrics(metrics)
+
+		case key, ok := <-keysChan:
+			if !ok || !d.handleKey(key) {
+				return
+			}
+			d.render(w)
+			continue
+		}
+
+		if !d.paused {
+			d.render(w)
+		}
+	}
+}
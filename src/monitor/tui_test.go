@@ -0,0 +1,158 @@
+package monitor
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSparkline(t *testing.T) {
+
+	res := sparkline([]int{0, 1, 7, 14})
+	expected := "▁▁▄█"
+
+	if res != expected {
+		t.Errorf("Sparkline differs. Want %s, got %s", expected, res)
+	}
+
+	if sparkline([]int{0, 0}) != "▁▁" {
+		t.Errorf("Sparkline of zeros differs. Got %s", sparkline([]int{0, 0}))
+	}
+}
+
+func TestDashboardRender(t *testing.T) {
+
+	d := &Dashboard{Periods: 2, Sections: 2}
+	d.init()
+
+	d.addMetrics(&Metrics{RequestCount: 1})
+	d.addMetrics(&Metrics{RequestCount: 2})
+	d.addMetrics(&Metrics{
+		Rank:         []Rank{Rank{3, "b"}, Rank{2, "c"}, Rank{1, "a"}},
+		RequestCount: 6,
+	})
+
+	if len(d.metrics) != 2 {
+		t.Errorf("Periods kept differ. Want %d, got %d", 2, len(d.metrics))
+	}
+
+	d.addAlerts([]*Alert{
+		&Alert{Status: StatusExceed, Rule: "client", Key: "10.0.0.1"},
+		&Alert{Status: StatusExceed, Rule: "client", Key: "10.0.0.2"},
+		&Alert{Status: StatusRecovered, Rule: "client", Key: "10.0.0.1"},
+	})
+
+	if len(d.firing) != 1 {
+		t.Errorf("Firing alerts differ. Want %d, got %d", 1, len(d.firing))
+	}
+
+	buf := bytes.Buffer{}
+	d.render(&buf)
+	out := buf.String()
+
+	for _, expected := range []string{"Requests          6", "(1 firing)",
+		"client: 10.0.0.2", "... 1 more"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("\"%s\" not found in output:\n%s", expected, out)
+		}
+	}
+
+	if strings.Index(out, "\r\nb ") > strings.Index(out, "\r\nc ") {
+		t.Error("Sections should be sorted by hits")
+	}
+
+	d.handleKey('s')
+	buf.Reset()
+	d.render(&buf)
+	out = buf.String()
+
+	if strings.Index(out, "\r\na ") > strings.Index(out, "\r\nb ") {
+		t.Error("Sections should be sorted by name")
+	}
+}
+
+func TestDashboardRun(t *testing.T) {
+
+	alertsChan := make(chan []*Alert)
+	metricsChan := make(chan *Metrics)
+	keys, keysWriter := io.Pipe()
+
+	d := &Dashboard{}
+	buf := &bytes.Buffer{}
+	done := make(chan struct{})
+
+	go func() {
+		d.Run(buf, keys, alertsChan, metricsChan)
+		close(done)
+	}()
+
+	keysWriter.Write([]byte("p"))
+	metricsChan <- &Metrics{RequestCount: 1}
+	keysWriter.Write([]byte("q"))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dashboard should quit on q")
+	}
+
+	if !d.paused || len(d.metrics) != 1 {
+		t.Errorf("Metrics should be kept while paused. Got %d", len(d.metrics))
+	}
+}
+
+func TestDashboardLongSection(t *testing.T) {
+
+	d := &Dashboard{}
+	d.init()
+
+	d.addMetrics(&Metrics{
+		Rank:         []Rank{Rank{1, strings.Repeat("é", 70)}},
+		RequestCount: 1,
+	})
+
+	buf := bytes.Buffer{}
+	d.render(&buf)
+	out := buf.String()
+
+	if !utf8.ValidString(out) {
+		t.Errorf("Output is not valid UTF-8:\n%s", out)
+	}
+
+	if !strings.Contains(out, strings.Repeat("é", 57)+"...") {
+		t.Errorf("Section should be truncated to %d runes:\n%s", 57, out)
+	}
+}
+
+func TestDashboardControlCharacters(t *testing.T) {
+
+	d := &Dashboard{Sections: 10}
+	d.init()
+
+	d.addMetrics(&Metrics{
+		Rank: []Rank{Rank{1, "a\x1b]0;title\x07"}, Rank{1, "b\u009b2J"}},
+	})
+	d.addAlerts([]*Alert{
+		&Alert{Status: StatusExceed, Rule: "section", Key: "c\x1b[2J\r\n"},
+	})
+
+	buf := bytes.Buffer{}
+	d.render(&buf)
+	out := buf.String()
+
+	for _, expected := range []string{`a\x1b]0;title\x07`, `b\x9b2J`,
+		`c\x1b[2J\x0d\x0a`} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("\"%s\" not found in output:\n%q", expected, out)
+		}
+	}
+
+	for _, injected := range []string{"\x1b]", "\x07", "\u009b", "\x1b[2J\r"} {
+		if strings.Contains(out, injected) {
+			t.Errorf("%q should be escaped in output:\n%q", injected, out)
+		}
+	}
+}
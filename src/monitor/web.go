@@ -0,0 +1,302 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Serves an HTML dashboard on /, the recent metrics and alerts on /state
+// and pushes them as Server-Sent Events on /events
+// Periods and History bound the metrics and alerts kept (30 and 100 by
+// default), ClientBuffer the events queued per client before it misses some
+type WebDashboard struct {
+	Periods      int
+	History      int
+	ClientBuffer int
+
+	// Internal parameters
+	once    sync.Once
+	mux     *http.ServeMux
+	mu      sync.RWMutex
+	metrics []*Metrics
+	alerts  []*Alert
+	clients map[chan []byte]struct{}
+}
+
+type webState struct {
+	Periods int        `json:"periods"`
+	History int        `json:"history"`
+	Metrics []*Metrics `json:"metrics"`
+	Alerts  []*Alert   `json:"alerts"`
+}
+
+func (wd *WebDashboard) init() {
+
+	wd.once.Do(func() {
+
+		if wd.Periods <= 0 {
+			wd.Periods = 30
+		}
+
+		if wd.History <= 0 {
+			wd.History = 100
+		}
+
+		if wd.ClientBuffer <= 0 {
+			wd.ClientBuffer = 16
+		}
+
+		wd.clients = make(map[chan []byte]struct{})
+
+		wd.mux = http.NewServeMux()
+		wd.mux.HandleFunc("/", wd.serveIndex)
+		wd.mux.HandleFunc("/state", wd.serveState)
+		wd.mux.HandleFunc("/events", wd.serveEvents)
+	})
+}
+
+func (wd *WebDashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	wd.init()
+	wd.mux.ServeHTTP(w, r)
+}
+
+// Consumes the channels Display would read and pushes updates to clients
+// until both are closed
+func (wd *WebDashboard) Run(alertsChan <-chan []*Alert,
+	metricsChan <-chan *Metrics) {
+
+	wd.init()
+
+	for alertsChan != nil || metricsChan != nil {
+
+		select {
+
+		case alerts, ok := <-alertsChan:
+			if !ok {
+				alertsChan = nil
+				continue
+			}
+
+			wd.mu.Lock()
+			wd.alerts = append(wd.alerts, alerts...)
+			if len(wd.alerts) > wd.History {
+				wd.alerts = wd.alerts[len(wd.alerts)-wd.History:]
+			}
+			wd.mu.Unlock()
+
+			for _, a := range alerts {
+				wd.broadcast("alert", a)
+			}
+
+		case metrics, ok := <-metricsChan:
+			if !ok {
+				metricsChan = nil
+				continue
+			}
+
+			wd.mu.Lock()
+			wd.metrics = append(wd.metrics, metrics)
+			if len(wd.metrics) > wd.Periods {
+				wd.metrics = wd.metrics[len(wd.metrics)-wd.Periods:]
+			}
+			wd.mu.Unlock()
+
+			wd.broadcast("metrics", metrics)
+		}
+	}
+}
+
+// Slow clients miss events rather than blocking the dashboard
+func (wd *WebDashboard) broadcast(event string, v interface{}) {
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("json.Marshal: %v", err)
+		return
+	}
+
+	msg := []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, data))
+
+	wd.mu.RLock()
+	defer wd.mu.RUnlock()
+
+	for c := range wd.clients {
+		select {
+		case c <- msg:
+		default:
+		}
+	}
+}
+
+func (wd *WebDashboard) serveState(w http.ResponseWriter, r *http.Request) {
+
+	wd.mu.RLock()
+	state := webState{
+		Periods: wd.Periods,
+		History: wd.History,
+		Metrics: append([]*Metrics{}, wd.metrics...),
+		Alerts:  append([]*Alert{}, wd.alerts...),
+	}
+	wd.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		log.Printf("json.Encoder.Encode: %v", err)
+	}
+}
+
+func (wd *WebDashboard) serveEvents(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	c := make(chan []byte, wd.ClientBuffer)
+
+	wd.mu.Lock()
+	wd.clients[c] = struct{}{}
+	wd.mu.Unlock()
+
+	defer func() {
+		wd.mu.Lock()
+		delete(wd.clients, c)
+		wd.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+
+		case msg := <-c:
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (wd *WebDashboard) serveIndex(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, webDashboardHTML)
+}
+
+const webDashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>httpmonitor</title>
+<style>
+body { font-family: monospace; margin: 2em; background: #fafafa; color: #222; }
+h2 { margin-top: 1.5em; }
+table { border-collapse: collapse; min-width: 30em; }
+td, th { padding: 0.2em 1em; border-bottom: 1px solid #ddd; text-align: left; }
+td.num { text-align: right; }
+canvas { background: #fff; border: 1px solid #ddd; }
+.exceed { color: #c00; }
+.recovered { color: #080; }
+</style>
+</head>
+<body>
+<h1>httpmonitor</h1>
+<div id="summary">Waiting for metrics...</div>
+
+<h2>Recent periods</h2>
+<canvas id="requests" width="600" height="80"></canvas> requests<br>
+<canvas id="bytes" width="600" height="80"></canvas> bytes<br>
+<canvas id="errors" width="600" height="80"></canvas> errors
+
+<h2>Top sections</h2>
+<table><thead><tr><th>Section</th><th>Hits</th></tr></thead>
+<tbody id="sections"></tbody></table>
+
+<h2>Alerts</h2>
+<ul id="alerts"></ul>
+
+<script>
+var state = {periods: 0, history: 0, metrics: [], alerts: []};
+
+function text(s) {
+	return String(s).replace(/[&<>"]/g, function(c) {
+		return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c];
+	});
+}
+
+function chart(id, values) {
+	var c = document.getElementById(id), ctx = c.getContext("2d");
+	var max = Math.max.apply(null, values.concat([1]));
+	var w = c.width / Math.max(values.length, 1);
+	ctx.clearRect(0, 0, c.width, c.height);
+	ctx.fillStyle = "#4a7";
+	values.forEach(function(v, i) {
+		var h = v / max * (c.height - 2);
+		ctx.fillRect(i * w, c.height - h, w - 1, h);
+	});
+}
+
+function render() {
+	var ms = state.metrics;
+	if (ms.length > 0) {
+		var m = ms[ms.length - 1];
+		document.getElementById("summary").innerHTML =
+			"[" + text(m.period_start) + " - " + text(m.period_end) + "] " +
+			"Requests: " + m.requests + " | Errors: " + m.errors +
+			" | Traffic: " + m.bytes + " | Unique visitors: " + m.unique_visitors +
+			" (Avg page views per visitor: " + m.avg_page_views + ")";
+		document.getElementById("sections").innerHTML = m.sections.slice(0, 20)
+			.map(function(s) {
+				return "<tr><td>" + text(s.section) + "</td><td class=num>" +
+					s.hits + "</td></tr>";
+			}).join("");
+	}
+	chart("requests", ms.map(function(m) { return m.requests; }));
+	chart("bytes", ms.map(function(m) { return m.bytes; }));
+	chart("errors", ms.map(function(m) { return m.errors; }));
+	document.getElementById("alerts").innerHTML = state.alerts.slice().reverse()
+		.map(function(a) {
+			var scope = a.rule ? " [" + text(a.rule) + ": " + text(a.key) + "]" : "";
+			return "<li class=" + a.status + ">" + text(a.timestamp) + " " +
+				a.status + scope + " - " + a.bytes + " bytes</li>";
+		}).join("");
+}
+
+fetch("state").then(function(r) { return r.json(); }).then(function(s) {
+	state = s;
+	render();
+
+	var events = new EventSource("events");
+	events.addEventListener("metrics", function(e) {
+		state.metrics.push(JSON.parse(e.data));
+		state.metrics = state.metrics.slice(-state.periods);
+		render();
+	});
+	events.addEventListener("alert", function(e) {
+		state.alerts.push(JSON.parse(e.data));
+		state.alerts = state.alerts.slice(-state.history);
+		render();
+	});
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,93 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebDashboard(t *testing.T) {
+
+	alertsChan := make(chan []*Alert)
+	metricsChan := make(chan *Metrics)
+
+	wd := &WebDashboard{Periods: 2}
+	go wd.Run(alertsChan, metricsChan)
+
+	ts := httptest.NewServer(wd)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("http.Get: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if !strings.Contains(string(body), "EventSource") {
+		t.Error("Dashboard page should subscribe to events")
+	}
+
+	resp, err = http.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatalf("http.Get: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Content type differs. Want %s, got %s",
+			"text/event-stream", resp.Header.Get("Content-Type"))
+	}
+
+	rd := bufio.NewReader(resp.Body)
+	rd.ReadString('\n') // ": connected"
+	rd.ReadString('\n')
+
+	for i := 1; i <= 3; i++ {
+		metricsChan <- &Metrics{RequestCount: i}
+	}
+	alertsChan <- []*Alert{&Alert{Status: StatusExceed, Total: 500}}
+
+	events := []string{}
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(events) < 4 && time.Now().Before(deadline) {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatalf("bufio.Reader.ReadString: %v", err)
+		}
+		if strings.HasPrefix(line, "event: ") {
+			events = append(events, strings.TrimSpace(line[7:]))
+		}
+	}
+
+	expected := []string{"metrics", "metrics", "metrics", "alert"}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Errorf("Events differ. Want %v, got %v", expected, events)
+	}
+
+	resp, err = http.Get(ts.URL + "/state")
+	if err != nil {
+		t.Fatalf("http.Get: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var state webState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		t.Fatalf("json.Decoder.Decode: %v", err)
+	}
+
+	if len(state.Metrics) != 2 || state.Metrics[1].RequestCount != 3 {
+		t.Errorf("Only the last %d periods should be kept. Got %d",
+			2, len(state.Metrics))
+	}
+
+	if len(state.Alerts) != 1 || state.Alerts[0].Total != 500 {
+		t.Errorf("Alert timeline differs. Got %v", state.Alerts)
+	}
+}
@@ -0,0 +1,339 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+const webhookFileExt = ".webhook"
+
+// Payload sent for every alert transition,
+// also the data given to BodyTemplate
+type WebhookPayload struct {
+	Group     string    `json:"group"`
+	Rule      string    `json:"rule"`
+	Key       string    `json:"key"`
+	Severity  string    `json:"severity"`
+	Status    string    `json:"status"`
+	Total     int       `json:"total"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Deliveries are queued (and persisted in QueueDir if set) so Notify
+// never blocks, then POSTed in order by a single worker retrying with
+// exponential backoff between InitialBackoff and MaxBackoff
+// Client errors (4xx except 429) are not retried
+// Without QueueDir, at most MaxQueue deliveries (1000 if not positive) are
+// kept in memory, the oldest ones being dropped
+type WebhookNotifier struct {
+	URL            string
+	Headers        map[string]string
+	BodyTemplate   string
+	QueueDir       string
+	MaxQueue       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Client         *http.Client
+
+	// Internal parameters
+	once      sync.Once
+	closeOnce sync.Once
+	err       error
+	tmpl      *template.Template
+	mu        sync.Mutex
+	queue     []*webhookDelivery
+	seq       int
+	wake      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	dropped   atomic.Int64
+
+	// Health counters of the monitor (not counted if nil)
+	health *healthCounters
+}
+
+type webhookDelivery struct {
+	path string
+	body []byte
+}
+
+func (wn *WebhookNotifier) start() error {
+
+	wn.once.Do(func() {
+
+		if wn.InitialBackoff <= 0 {
+			wn.InitialBackoff = time.Second
+		}
+
+		if wn.MaxBackoff < wn.InitialBackoff {
+			wn.MaxBackoff = 64 * wn.InitialBackoff
+		}
+
+		if wn.MaxQueue <= 0 {
+			wn.MaxQueue = 1000
+		}
+
+		if wn.Client == nil {
+			wn.Client = &http.Client{Timeout: 10 * time.Second}
+		}
+
+		if wn.BodyTemplate != "" {
+			wn.tmpl, wn.err = template.New("webhook").Parse(wn.BodyTemplate)
+			if wn.err != nil {
+				wn.err = fmt.Errorf("template.Parse: %v", wn.err)
+				return
+			}
+		}
+
+		if wn.QueueDir != "" {
+			if wn.err = wn.loadQueue(); wn.err != nil {
+				return
+			}
+		}
+
+		wn.wake = make(chan struct{}, 1)
+		wn.stop = make(chan struct{})
+		wn.done = make(chan struct{})
+
+		go wn.run()
+	})
+
+	return wn.err
+}
+
+// Deliveries persisted by a previous run are sent first
+func (wn *WebhookNotifier) loadQueue() error {
+
+	if err := os.MkdirAll(wn.QueueDir, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll: %v", err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(wn.QueueDir, "*"+webhookFileExt))
+	if err != nil {
+		return fmt.Errorf("filepath.Glob: %v", err)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("os.ReadFile: %v", err)
+		}
+
+		wn.queue = append(wn.queue, &webhookDelivery{path, body})
+
+		name := strings.TrimSuffix(filepath.Base(path), webhookFileExt)
+		if seq, err := strconv.Atoi(name); err == nil && seq >= wn.seq {
+			wn.seq = seq + 1
+		}
+	}
+
+	return nil
+}
+
+func (wn *WebhookNotifier) render(payload *WebhookPayload) ([]byte, error) {
+
+	if wn.tmpl == nil {
+		return json.Marshal(payload)
+	}
+
+	buf := bytes.Buffer{}
+	if err := wn.tmpl.Execute(&buf, payload); err != nil {
+		return nil, fmt.Errorf("template.Execute: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (wn *WebhookNotifier) Notify(group string, alerts []*Alert) error {
+
+	if err := wn.start(); err != nil {
+		return err
+	}
+
+	wn.mu.Lock()
+	defer wn.mu.Unlock()
+
+	for _, a := range alerts {
+
+		body, err := wn.render(&WebhookPayload{
+			Group:     group,
+			Rule:      a.Rule,
+			Key:       a.Key,
+			Severity:  a.Severity,
+			Status:    alertLabel(a, "status"),
+			Total:     a.Total,
+			Timestamp: a.Timestamp,
+		})
+		if err != nil {
+			return err
+		}
+
+		d := &webhookDelivery{body: body}
+
+		if wn.QueueDir != "" {
+			d.path = filepath.Join(wn.QueueDir,
+				fmt.Sprintf("%020d%s", wn.seq, webhookFileExt))
+
+			if err := os.WriteFile(d.path, body, 0644); err != nil {
+				return fmt.Errorf("os.WriteFile: %v", err)
+			}
+		}
+
+		wn.seq++
+		wn.queue = append(wn.queue, d)
+	}
+
+	// The worker notices when the delivery it sends was dropped
+	if n := len(wn.queue) - wn.MaxQueue; wn.QueueDir == "" && n > 0 {
+
+		for i := 0; i < n; i++ {
+			wn.queue[i] = nil
+		}
+		wn.queue = wn.queue[n:]
+
+		wn.dropped.Add(int64(n))
+		if wn.health != nil {
+			wn.health.notificationsDropped.Add(int64(n))
+		}
+	}
+
+	select {
+	case wn.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Pending deliveries stay in QueueDir, closing again having no effect
+func (wn *WebhookNotifier) Close() {
+
+	if wn.start() != nil {
+		return
+	}
+
+	wn.closeOnce.Do(func() { close(wn.stop) })
+	<-wn.done
+}
+
+func (wn *WebhookNotifier) Pending() int {
+
+	wn.mu.Lock()
+	defer wn.mu.Unlock()
+
+	return len(wn.queue)
+}
+
+// Number of deliveries dropped because the queue was full
+func (wn *WebhookNotifier) Dropped() int64 {
+
+	return wn.dropped.Load()
+}
+
+func (wn *WebhookNotifier) run() {
+
+	defer close(wn.done)
+
+	backoff := wn.InitialBackoff
+
+	for {
+
+		wn.mu.Lock()
+		var d *webhookDelivery
+		if len(wn.queue) != 0 {
+			d = wn.queue[0]
+		}
+		wn.mu.Unlock()
+
+		if d == nil {
+			select {
+			case <-wn.wake:
+			case <-wn.stop:
+				return
+			}
+			continue
+		}
+
+		retry, err := wn.send(d.body)
+		if err != nil && retry {
+
+			log.Printf("WebhookNotifier.send: %v (retrying in %v)", err, backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-wn.stop:
+				return
+			}
+
+			backoff *= 2
+			if backoff > wn.MaxBackoff {
+				backoff = wn.MaxBackoff
+			}
+			continue
+		}
+
+		if err != nil {
+			log.Printf("WebhookNotifier.send: %v (dropped)", err)
+		}
+
+		backoff = wn.InitialBackoff
+
+		if d.path != "" {
+			if err := os.Remove(d.path); err != nil {
+				log.Printf("os.Remove: %v", err)
+			}
+		}
+
+		wn.mu.Lock()
+		if len(wn.queue) != 0 && wn.queue[0] == d {
+			wn.queue[0] = nil
+			wn.queue = wn.queue[1:]
+		}
+		wn.mu.Unlock()
+	}
+}
+
+// Returns whether the delivery should be retried on error
+func (wn *WebhookNotifier) send(body []byte) (bool, error) {
+
+	req, err := http.NewRequest(http.MethodPost, wn.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("http.NewRequest: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range wn.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := wn.Client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("http.Client.Do: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 ||
+		resp.StatusCode == http.StatusTooManyRequests
+
+	return retry, fmt.Errorf("unexpected status %s", resp.Status)
+}
@@ -0,0 +1,216 @@
+package monitor
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookRecorder struct {
+	sync.Mutex
+	failures int
+	bodies   []string
+	headers  []http.Header
+}
+
+func (wr *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	wr.Lock()
+	defer wr.Unlock()
+
+	if wr.failures > 0 {
+		wr.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	wr.bodies = append(wr.bodies, string(body))
+	wr.headers = append(wr.headers, r.Header)
+}
+
+func (wr *webhookRecorder) received() int {
+
+	wr.Lock()
+	defer wr.Unlock()
+
+	return len(wr.bodies)
+}
+
+func waitForDeliveries(t *testing.T, wr *webhookRecorder, n int) {
+
+	deadline := time.Now().Add(5 * time.Second)
+	for wr.received() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Deliveries differ. Want %d, got %d", n, wr.received())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookNotifierNotify(t *testing.T) {
+
+	wr := &webhookRecorder{failures: 2}
+	ts := httptest.NewServer(wr)
+	defer ts.Close()
+
+	wn := &WebhookNotifier{
+		URL:            ts.URL,
+		Headers:        map[string]string{"Authorization": "Bearer token"},
+		InitialBackoff: time.Millisecond,
+	}
+	defer wn.Close()
+
+	err := wn.Notify("rule=client", []*Alert{
+		&Alert{Timestamp: time.Unix(1, 0), Total: 500, Status: StatusExceed,
+			Rule: "client", Key: "10.0.0.1"},
+		&Alert{Timestamp: time.Unix(2, 0), Total: 10, Status: StatusRecovered,
+			Rule: "client", Key: "10.0.0.1"},
+	})
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	waitForDeliveries(t, wr, 2)
+
+	var payload WebhookPayload
+	if err := json.Unmarshal([]byte(wr.bodies[0]), &payload); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+
+	if payload.Status != "exceed" || payload.Key != "10.0.0.1" ||
+		payload.Total != 500 || payload.Group != "rule=client" {
+		t.Errorf("Payload differs. Got %+v", payload)
+	}
+
+	if wr.headers[0].Get("Authorization") != "Bearer token" {
+		t.Errorf("Header differs. Want \"%s\", got \"%s\"",
+			"Bearer token", wr.headers[0].Get("Authorization"))
+	}
+}
+
+func TestWebhookNotifierBodyTemplate(t *testing.T) {
+
+	wr := &webhookRecorder{}
+	ts := httptest.NewServer(wr)
+	defer ts.Close()
+
+	wn := &WebhookNotifier{
+		URL:          ts.URL,
+		BodyTemplate: `{"text":"{{.Rule}} {{.Key}} {{.Status}}"}`,
+	}
+	defer wn.Close()
+
+	wn.Notify("", []*Alert{
+		&Alert{Status: StatusExceed, Rule: "section", Key: "admin"},
+	})
+
+	waitForDeliveries(t, wr, 1)
+
+	expected := `{"text":"section admin exceed"}`
+	if wr.bodies[0] != expected {
+		t.Errorf("Body differs. Want %s, got %s", expected, wr.bodies[0])
+	}
+}
+
+func TestWebhookNotifierPersistentQueue(t *testing.T) {
+
+	dir := t.TempDir()
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+
+	wn := &WebhookNotifier{
+		URL:            ts.URL,
+		QueueDir:       dir,
+		InitialBackoff: time.Hour,
+	}
+
+	wn.Notify("", []*Alert{&Alert{Status: StatusExceed}})
+	wn.Notify("", []*Alert{&Alert{Status: StatusRecovered}})
+	wn.Close()
+
+	// Closing again has no effect
+	wn.Close()
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "*"+webhookFileExt))
+	if len(paths) != 2 {
+		t.Fatalf("Persisted deliveries differ. Want %d, got %d", 2, len(paths))
+	}
+
+	wr := &webhookRecorder{}
+	ts = httptest.NewServer(wr)
+	defer ts.Close()
+
+	wn = &WebhookNotifier{URL: ts.URL, QueueDir: dir}
+	defer wn.Close()
+
+	wn.Notify("", []*Alert{&Alert{Status: StatusExceed}})
+	waitForDeliveries(t, wr, 3)
+
+	var payload WebhookPayload
+	json.Unmarshal([]byte(wr.bodies[1]), &payload)
+	if payload.Status != "recovered" {
+		t.Errorf("Deliveries should be sent in order. Got %+v", payload)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for wn.Pending() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Delivered payloads should be removed. Got %d files",
+			len(entries))
+	}
+}
+
+func TestWebhookNotifierMaxQueue(t *testing.T) {
+
+	// Endpoint down, nothing being delivered
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+
+	health := &healthCounters{}
+	wn := &WebhookNotifier{
+		URL:            ts.URL,
+		MaxQueue:       2,
+		InitialBackoff: time.Hour,
+		health:         health,
+	}
+	defer wn.Close()
+
+	for i := 0; i < 5; i++ {
+		wn.Notify("", []*Alert{&Alert{Status: StatusExceed, Total: i}})
+	}
+
+	if n := wn.Pending(); n != 2 {
+		t.Errorf("Pending deliveries differ. Want %d, got %d", 2, n)
+	}
+
+	if n := wn.Dropped(); n != 3 {
+		t.Errorf("Dropped deliveries differ. Want %d, got %d", 3, n)
+	}
+
+	if n := health.notificationsDropped.Load(); n != 3 {
+		t.Errorf("Health counter differs. Want %d, got %d", 3, n)
+	}
+
+	// The newest ones are kept
+	wn.mu.Lock()
+	var payload WebhookPayload
+	json.Unmarshal(wn.queue[0].body, &payload)
+	wn.mu.Unlock()
+
+	if payload.Total != 3 {
+		t.Errorf("Oldest kept delivery differs. Want %d, got %d", 3,
+			payload.Total)
+	}
+}
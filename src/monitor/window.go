@@ -14,216 +14,264 @@ const (
 	StatusExceed    AlertStatus = iota
 )
 
+// Rule, Key and Severity are empty for the global traffic window
 type Alert struct {
 	Timestamp time.Time
 	Total     int
 	Status    AlertStatus
+	Rule      string
+	Key       string
+	Severity  string
 }
 
 func (a *Alert) String() string {
 
+	scope := ""
+	if a.Rule != "" {
+		scope = fmt.Sprintf(" [%s: %s]", a.Rule, a.Key)
+	}
+
 	switch a.Status {
 
 	case StatusExceed:
 		return fmt.Sprintf(
-			"High traffic generated an alert - hits = %d, triggered at %s",
-			a.Total, a.Timestamp.Format("02/01/2006:15:04:05"))
+			"High traffic generated an alert%s - hits = %d, triggered at %s",
+			scope, a.Total, a.Timestamp.Format("02/01/2006:15:04:05"))
 
 	case StatusRecovered:
-		return fmt.Sprintf("Traffic recovered at %s",
-			a.Timestamp.Format("02/01/2006:15:04:05"))
+		return fmt.Sprintf("Traffic recovered%s at %s",
+			scope, a.Timestamp.Format("02/01/2006:15:04:05"))
 
 	default:
 		panic("Wrong alert status!")
 	}
 }
 
+// Traffic summed over a granularity slot
+type bucket struct {
+	start time.Time
+	size  int
+}
+
+// Sliding traffic window made of per granularity buckets (1 second by
+// default, alert timestamps having the same resolution) in a ring buffer,
+// so memory is O(trafficWindow / granularity) and updates are O(1)
+// The queue only holds entries not processed yet (after the end of the
+// last getNewAlerts), processed ones being recycled
+// Entries older than the last processed bucket are counted in it
 type window struct {
 	queue *entryQueue
 
-	// Left element closest to the window
-	// elt1 elt2 elt3 edge [window] ...
-	edge    *w3chttpd.Entry
-	edgePos int
-
-	lastProcessed    *w3chttpd.Entry
-	lastProcessedPos int
-	size             int
-	trafficWindow    time.Duration
-	status           AlertStatus
-	threshold        int
-	alerts           []*Alert
+	// Buckets of the window, oldest first
+	// edge [head ... newest] ...
+	buckets []bucket
+	head    int
+	count   int
+
+	// Start of the last bucket that left the window (zero if none)
+	edge time.Time
+
+	size          int
+	trafficWindow time.Duration
+	granularity   time.Duration
+	status        AlertStatus
+	threshold     int
+	alerts        []*Alert
 }
 
 func (w *window) init(tw time.Duration, th int, poolSize int) {
 
+	epool := &entryPool{}
+	epool.init(poolSize)
+
+	w.initWithPool(tw, th, epool)
+}
+
+// Several windows can share the same entry pool
+func (w *window) initWithPool(tw time.Duration, th int, epool *entryPool) {
+
 	w.queue = &entryQueue{
 		&sync.RWMutex{},
 		make([]*w3chttpd.Entry, 0),
-		&entryPool{},
+		epool,
 	}
 
-	w.queue.epool.init(poolSize)
-
-	w.edge = nil
-	w.edgePos = -1
-	w.lastProcessed = nil
-	w.lastProcessedPos = -1
+	w.buckets = nil
+	w.head = 0
+	w.count = 0
+	w.edge = time.Time{}
 	w.size = 0
 	w.trafficWindow = tw
+	w.granularity = time.Second
 	w.status = StatusRecovered
 	w.threshold = th
 	w.alerts = nil
 }
 
-func (w *window) updateEdge(timestamp time.Time) {
+// Must be called before the first entry is processed
+func (w *window) setGranularity(granularity time.Duration) {
 
-	if len(w.queue.entries) == 0 {
+	if granularity > 0 {
+		w.granularity = granularity
+	}
+}
+
+// The window restarts empty if its length changes, its queue being kept
+func (w *window) setTrafficWindow(tw time.Duration) {
 
-		w.edge = nil
-		w.edgePos = -1
-		w.size = 0
+	if tw == w.trafficWindow {
 		return
 	}
 
-	for _, we := range w.queue.entries[w.edgePos+1:] {
+	w.buckets = nil
+	w.head = 0
+	w.count = 0
+	w.edge = time.Time{}
+	w.size = 0
+	w.trafficWindow = tw
+	w.status = StatusRecovered
+}
 
-		if timestamp.Sub(we.Timestamp) >= w.trafficWindow {
+func (w *window) oldest() *bucket {
+	return &w.buckets[w.head]
+}
 
-			w.size -= we.Size
-			w.edge = we
-			w.edgePos++
+func (w *window) newest() *bucket {
+	return &w.buckets[(w.head+w.count-1)%len(w.buckets)]
+}
 
-		} else {
-			break
-		}
-	}
+func (w *window) expireOldest() {
+
+	b := w.oldest()
+	w.size -= b.size
+	w.edge = b.start
+	w.head = (w.head + 1) % len(w.buckets)
+	w.count--
 }
 
-func (w *window) getNextEntryToProcess() *w3chttpd.Entry {
+// Buckets leaving the window ending at timestamp are expired
+func (w *window) updateEdge(timestamp time.Time) {
 
-	if w.lastProcessedPos+1 < len(w.queue.entries) {
-		return w.queue.entries[w.lastProcessedPos+1]
+	for w.count > 0 && timestamp.Sub(w.oldest().start) >= w.trafficWindow {
+		w.expireOldest()
 	}
-	return nil
 }
 
-func (w *window) processStatusExceedForEntry(e *w3chttpd.Entry) {
+// Adds size to the bucket starting at start (the newest one or a new one)
+func (w *window) add(start time.Time, size int) {
 
-	w.updateEdge(e.Timestamp)
+	if w.buckets == nil {
+		n := int((w.trafficWindow + w.granularity - 1) / w.granularity)
+		w.buckets = make([]bucket, n+1)
+	}
+
+	w.size += size
 
-	if w.edge == nil {
+	if w.count != 0 && !w.newest().start.Before(start) {
+		w.newest().size += size
 		return
 	}
 
-	delta := e.Timestamp.Sub(w.edge.Timestamp)
+	if w.count == len(w.buckets) {
+		w.expireOldest()
+	}
 
-	if delta >= w.trafficWindow && w.size < w.threshold {
+	w.buckets[(w.head+w.count)%len(w.buckets)] = bucket{start, size}
+	w.count++
+}
+
+func (w *window) processStatusExceedForBucket(start time.Time) {
+
+	w.updateEdge(start)
+
+	if !w.edge.IsZero() && w.size < w.threshold {
 
 		w.status = StatusRecovered
 		w.alerts = append(w.alerts, &Alert{
-			Timestamp: e.Timestamp,
+			Timestamp: start,
 			Total:     w.size,
 			Status:    w.status,
 		})
 	}
 }
 
-func (w *window) processStatusRecoveredForEntry(e *w3chttpd.Entry) {
+func (w *window) processStatusRecoveredForBucket(start time.Time) {
 
-	w.updateEdge(e.Timestamp)
+	w.updateEdge(start)
 
 	if w.size > w.threshold {
 
 		w.status = StatusExceed
 		w.alerts = append(w.alerts, &Alert{
-			Timestamp: e.Timestamp,
+			Timestamp: start,
 			Total:     w.size,
 			Status:    w.status,
 		})
 	}
 }
 
-func (w *window) getNewAlerts(end time.Time, deleted int) []*Alert {
+// Processes the queued entries until end
+func (w *window) getNewAlerts(end time.Time) []*Alert {
 
-	w.lastProcessedPos -= deleted
-	w.edgePos -= deleted
 	w.alerts = []*Alert{}
 
-	e := w.getNextEntryToProcess()
-
-	for e != nil && !e.Timestamp.After(end) {
+	entries := w.queue.entries
+	processed := 0
 
-		if w.status == StatusExceed {
+	for processed < len(entries) && !entries[processed].Timestamp.After(end) {
 
-			previousSec := e.Timestamp.Add(-time.Second)
-			w.processStatusExceedForTime(previousSec)
+		start := entries[processed].Timestamp.Truncate(w.granularity)
+		if w.count != 0 && start.Before(w.newest().start) {
+			start = w.newest().start
 		}
 
-		w.size += e.Size
-		w.lastProcessedPos++
+		size := 0
+		for processed < len(entries) &&
+			!entries[processed].Timestamp.After(end) &&
+			!entries[processed].Timestamp.Truncate(w.granularity).After(start) {
 
-		next := w.getNextEntryToProcess()
-		for next != nil && next.Timestamp == e.Timestamp {
+			size += entries[processed].Size
+			processed++
+		}
 
-			w.size += next.Size
-			w.lastProcessedPos++
-			next = w.getNextEntryToProcess()
+		if w.status == StatusExceed {
+			w.processStatusExceedForTime(start.Add(-w.granularity))
 		}
 
-		w.lastProcessed = w.queue.entries[w.lastProcessedPos]
+		w.updateEdge(start)
+		w.add(start, size)
 
 		switch w.status {
 
 		case StatusRecovered:
-			w.processStatusRecoveredForEntry(e)
+			w.processStatusRecoveredForBucket(start)
 
 		case StatusExceed:
-			w.processStatusExceedForEntry(e)
+			w.processStatusExceedForBucket(start)
 		}
-
-		e = w.getNextEntryToProcess()
 	}
 
+	w.queue.removeFirst(processed)
+
 	if w.status == StatusExceed {
-		w.processStatusExceedForTime(end.Add(-time.Second))
+		w.processStatusExceedForTime(end.Add(-w.granularity))
 	}
 
 	return w.alerts
 }
 
+// Recovery is looked for at t, the buckets leaving the window one by one
 func (w *window) processStatusExceedForTime(t time.Time) {
 
-	pos := w.edgePos + 1
-
-	if t.Sub(w.queue.entries[pos].Timestamp) < w.trafficWindow {
+	if w.count == 0 || t.Sub(w.oldest().start) < w.trafficWindow {
 		return
 	}
 
-	// At least one element in the queue:
-	// Last element processed still in the queue OR
-	// edge + at least last processed element still in the queue
+	for w.count > 0 && t.Sub(w.oldest().start) >= w.trafficWindow {
 
-	for pos <= w.lastProcessedPos &&
-		t.Sub(w.queue.entries[pos].Timestamp) >= w.trafficWindow {
-
-		w.size -= w.queue.entries[pos].Size
-		w.edgePos = pos
-		w.edge = w.queue.entries[pos]
-		pos++
+		w.expireOldest()
 
 		if w.size <= w.threshold {
-
-			timestamp := w.queue.entries[pos-1].Timestamp
-
-			for pos <= w.lastProcessedPos &&
-				w.queue.entries[pos].Timestamp == timestamp {
-
-				w.size -= w.queue.entries[pos].Size
-				w.edgePos = pos
-				w.edge = w.queue.entries[pos]
-				pos++
-			}
 			break
 		}
 	}
@@ -232,13 +280,10 @@ func (w *window) processStatusExceedForTime(t time.Time) {
 		return
 	}
 
-	// edge in the queue
-	timestamp := w.edge.Timestamp.Add(w.trafficWindow)
-
 	w.status = StatusRecovered
 
 	w.alerts = append(w.alerts, &Alert{
-		Timestamp: timestamp,
+		Timestamp: w.edge.Add(w.trafficWindow),
 		Total:     w.size,
 		Status:    w.status,
 	})
@@ -6,11 +6,14 @@ import (
 	"w3chttpd"
 )
 
-func testUpdateEdge(t *testing.T, w window, wepos int) {
+func testUpdateEdge(t *testing.T, w window, edge time.Time, size int) {
 
-	if w.edgePos != wepos {
-		t.Errorf("edgePos field differs. Want %v, got %v",
-			wepos, w.edgePos)
+	if !w.edge.Equal(edge) {
+		t.Errorf("edge field differs. Want %v, got %v", edge, w.edge)
+	}
+
+	if w.size != size {
+		t.Errorf("size field differs. Want %d, got %d", size, w.size)
 	}
 }
 
@@ -22,45 +25,50 @@ func TestUpdateEdge(t *testing.T) {
 	}
 
 	conf.w.init(conf.TrafficWindow, 0, conf.EntryPoolSize)
-	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(2, 0), Size: 100})
-	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(2, 0), Size: 120})
-	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(3, 0), Size: 300})
-	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(122, 0), Size: 7})
-	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(180, 0), Size: 8})
-	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(250, 0), Size: 11})
-
-	eq := conf.w.queue
-
-	conf.w.updateEdge(eq.entries[0].Timestamp)
-	testUpdateEdge(t, conf.w, -1)
 
-	conf.w.updateEdge(eq.entries[1].Timestamp)
-	testUpdateEdge(t, conf.w, -1)
-
-	conf.w.updateEdge(eq.entries[2].Timestamp)
-	testUpdateEdge(t, conf.w, -1)
+	buckets := []bucket{
+		{time.Unix(2, 0), 220},
+		{time.Unix(3, 0), 300},
+		{time.Unix(122, 0), 7},
+		{time.Unix(180, 0), 8},
+		{time.Unix(250, 0), 11},
+	}
 
-	conf.w.updateEdge(eq.entries[3].Timestamp)
-	testUpdateEdge(t, conf.w, 1)
+	expected := []struct {
+		edge time.Time
+		size int
+	}{
+		{time.Time{}, 220},
+		{time.Time{}, 520},
+		{time.Unix(2, 0), 307},
+		{time.Unix(3, 0), 15},
+		{time.Unix(122, 0), 19},
+	}
 
-	conf.w.updateEdge(eq.entries[4].Timestamp)
-	testUpdateEdge(t, conf.w, 2)
+	for i, b := range buckets {
+		conf.w.updateEdge(b.start)
+		conf.w.add(b.start, b.size)
+		testUpdateEdge(t, conf.w, expected[i].edge, expected[i].size)
+	}
 
-	conf.w.updateEdge(eq.entries[5].Timestamp)
-	testUpdateEdge(t, conf.w, 3)
+	// The ring never holds more than the window
+	if conf.w.count != 2 || len(conf.w.buckets) != 121 {
+		t.Errorf("Buckets differ. Want %d of %d, got %d of %d",
+			2, 121, conf.w.count, len(conf.w.buckets))
+	}
 }
 
 func testGetNewAlerts(t *testing.T, w window, expectedAlerts []*Alert,
-	expectedSize, expectedEdgePos int) {
+	expectedSize int, expectedEdge time.Time) {
 
 	if w.size != expectedSize {
 		t.Errorf("size value differs. Want %d, got %d",
 			expectedSize, w.size)
 	}
 
-	if w.edgePos != expectedEdgePos {
-		t.Errorf("edgePos value differs. Want %d, got %d",
-			expectedEdgePos, w.edgePos)
+	if !w.edge.Equal(expectedEdge) {
+		t.Errorf("edge value differs. Want %v, got %v",
+			expectedEdge, w.edge)
 	}
 
 	if len(w.alerts) != len(expectedAlerts) {
@@ -98,9 +106,9 @@ func TestGetNewAlerts(t *testing.T) {
 	conf.w.init(conf.TrafficWindow, conf.Threshold, conf.EntryPoolSize)
 	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(0, 0), Size: 200})
 
-	conf.w.getNewAlerts(time.Unix(200, 0), 0)
+	conf.w.getNewAlerts(time.Unix(200, 0))
 	expectedAlerts := []*Alert{}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 200, -1)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 200, time.Time{})
 
 	conf = &Config{
 		TrafficWindow: 2 * time.Minute,
@@ -114,12 +122,12 @@ func TestGetNewAlerts(t *testing.T) {
 	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(1, 0), Size: 300})
 	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(2, 0), Size: 10})
 
-	conf.w.getNewAlerts(time.Unix(2, 0), 0)
+	conf.w.getNewAlerts(time.Unix(2, 0))
 
 	expectedAlerts = []*Alert{
-		&Alert{time.Unix(1, 0), 500, StatusExceed},
+		&Alert{Timestamp: time.Unix(1, 0), Total: 500, Status: StatusExceed},
 	}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 510, -1)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 510, time.Time{})
 
 	conf = &Config{
 		TrafficWindow: 2 * time.Minute,
@@ -134,13 +142,13 @@ func TestGetNewAlerts(t *testing.T) {
 	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(6, 0), Size: 1})
 	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(125, 0), Size: 15})
 
-	conf.w.getNewAlerts(time.Unix(125, 0), 0)
+	conf.w.getNewAlerts(time.Unix(125, 0))
 
 	expectedAlerts = []*Alert{
-		&Alert{time.Unix(5, 0), 401, StatusExceed},
-		&Alert{time.Unix(122, 0), 11, StatusRecovered},
+		&Alert{Timestamp: time.Unix(5, 0), Total: 401, Status: StatusExceed},
+		&Alert{Timestamp: time.Unix(122, 0), Total: 11, Status: StatusRecovered},
 	}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 16, 1)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 16, time.Unix(5, 0))
 
 	conf = &Config{
 		TrafficWindow: 2 * time.Minute,
@@ -162,15 +170,15 @@ func TestGetNewAlerts(t *testing.T) {
 	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(124, 0), Size: 1500}) // exceed window size 1605
 	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(125, 0), Size: 15})
 
-	conf.w.getNewAlerts(time.Unix(360, 0), 0) // recover 244
+	conf.w.getNewAlerts(time.Unix(360, 0)) // recover 244
 
 	expectedAlerts = []*Alert{
-		&Alert{time.Unix(2, 0), 406, StatusExceed},
-		&Alert{time.Unix(122, 0), 90, StatusRecovered},
-		&Alert{time.Unix(124, 0), 1605, StatusExceed},
-		&Alert{time.Unix(124+120, 0), 15, StatusRecovered},
+		&Alert{Timestamp: time.Unix(2, 0), Total: 406, Status: StatusExceed},
+		&Alert{Timestamp: time.Unix(122, 0), Total: 90, Status: StatusRecovered},
+		&Alert{Timestamp: time.Unix(124, 0), Total: 1605, Status: StatusExceed},
+		&Alert{Timestamp: time.Unix(124+120, 0), Total: 15, Status: StatusRecovered},
 	}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 15, 9)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 15, time.Unix(124, 0))
 
 	conf = &Config{
 		TrafficWindow: 5 * time.Second,
@@ -196,54 +204,54 @@ func TestGetNewAlerts(t *testing.T) {
 	conf.w.init(conf.TrafficWindow, conf.Threshold, conf.EntryPoolSize)
 
 	conf.w.queue.add(toAdd[0])
-	conf.w.getNewAlerts(time.Unix(1, 0), 0)
+	conf.w.getNewAlerts(time.Unix(1, 0))
 	expectedAlerts = []*Alert{}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 1, -1)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 1, time.Time{})
 
 	conf.w.queue.add(toAdd[1])
-	conf.w.getNewAlerts(time.Unix(2, 0), 0)
+	conf.w.getNewAlerts(time.Unix(2, 0))
 	expectedAlerts = []*Alert{
-		&Alert{time.Unix(2, 0), 541, StatusExceed},
+		&Alert{Timestamp: time.Unix(2, 0), Total: 541, Status: StatusExceed},
 	}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 541, -1)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 541, time.Time{})
 
 	conf.w.queue.add(toAdd[2])
-	conf.w.getNewAlerts(time.Unix(3, 0), 0)
+	conf.w.getNewAlerts(time.Unix(3, 0))
 	expectedAlerts = []*Alert{}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 542, -1)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 542, time.Time{})
 
 	conf.w.queue.add(toAdd[3])
-	conf.w.getNewAlerts(time.Unix(4, 0), 0)
+	conf.w.getNewAlerts(time.Unix(4, 0))
 	expectedAlerts = []*Alert{}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 543, -1)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 543, time.Time{})
 
 	conf.w.queue.add(toAdd[4])
-	conf.w.getNewAlerts(time.Unix(5, 0), 0)
+	conf.w.getNewAlerts(time.Unix(5, 0))
 	expectedAlerts = []*Alert{}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 544, -1)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 544, time.Time{})
 
 	conf.w.queue.add(toAdd[5])
 	conf.w.queue.add(toAdd[6])
-	conf.w.getNewAlerts(time.Unix(6, 0), 0)
+	conf.w.getNewAlerts(time.Unix(6, 0))
 	expectedAlerts = []*Alert{}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 545, 0)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 545, time.Unix(1, 0))
 
 	conf.w.queue.add(toAdd[7])
 	conf.w.queue.add(toAdd[8])
-	conf.w.getNewAlerts(time.Unix(7, 0), 0)
+	conf.w.getNewAlerts(time.Unix(7, 0))
 	expectedAlerts = []*Alert{
-		&Alert{time.Unix(7, 0), 11, StatusRecovered},
+		&Alert{Timestamp: time.Unix(7, 0), Total: 11, Status: StatusRecovered},
 	}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 11, 1)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 11, time.Unix(2, 0))
 
 	conf.w.queue.add(toAdd[9])
 	conf.w.queue.add(toAdd[10])
 	conf.w.queue.add(toAdd[11])
-	conf.w.getNewAlerts(time.Unix(11, 0), 0)
+	conf.w.getNewAlerts(time.Unix(11, 0))
 	expectedAlerts = []*Alert{
-		&Alert{time.Unix(11, 0), 408, StatusExceed},
+		&Alert{Timestamp: time.Unix(11, 0), Total: 408, Status: StatusExceed},
 	}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 408, 6)
+	testGetNewAlerts(t, conf.w, expectedAlerts, 408, time.Unix(6, 0))
 
 	conf = &Config{
 		TrafficWindow: 5 * time.Second,
@@ -285,11 +293,73 @@ func TestGetNewAlerts(t *testing.T) {
 	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(60, 0), Size: 32})
 	conf.w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(60, 0), Size: 1}) // s = 238, ws = 226 + 238 -27 = 437
 
-	conf.w.getNewAlerts(time.Unix(60, 0), 0)
+	conf.w.getNewAlerts(time.Unix(60, 0))
+	expectedAlerts = []*Alert{
+		&Alert{Timestamp: time.Unix(58, 0), Total: 298, Status: StatusExceed},
+		&Alert{Timestamp: time.Unix(59, 0), Total: 226, Status: StatusRecovered},
+		&Alert{Timestamp: time.Unix(60, 0), Total: 437, Status: StatusExceed},
+	}
+	testGetNewAlerts(t, conf.w, expectedAlerts, 437, time.Unix(55, 0))
+}
+
+func TestWindowGranularity(t *testing.T) {
+
+	var w window
+	w.init(10*time.Second, 100, 10)
+	w.setGranularity(5 * time.Second)
+
+	w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(1, 0), Size: 60})
+	w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(3, 0), Size: 50})
+	w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(12, 0), Size: 10})
+
+	// Alerts have the resolution of the buckets
+	w.getNewAlerts(time.Unix(12, 0))
+	expectedAlerts := []*Alert{
+		&Alert{Timestamp: time.Unix(0, 0), Total: 110, Status: StatusExceed},
+		&Alert{Timestamp: time.Unix(10, 0), Total: 10, Status: StatusRecovered},
+	}
+	testGetNewAlerts(t, w, expectedAlerts, 10, time.Unix(0, 0))
+
+	if len(w.buckets) != 3 {
+		t.Errorf("Number of buckets differs. Want %d, got %d",
+			3, len(w.buckets))
+	}
+
+	if len(w.queue.entries) != 0 {
+		t.Errorf("Length of queue differs. Want %d, got %d",
+			0, len(w.queue.entries))
+	}
+}
+
+func TestWindowPendingAndLateEntries(t *testing.T) {
+
+	var w window
+	w.init(10*time.Second, 100, 10)
+
+	w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(5, 0), Size: 10})
+	w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(8, 0), Size: 10})
+
+	// Entries after end wait in the queue
+	w.getNewAlerts(time.Unix(6, 0))
+	testGetNewAlerts(t, w, []*Alert{}, 10, time.Time{})
+
+	if len(w.queue.entries) != 1 {
+		t.Errorf("Length of queue differs. Want %d, got %d",
+			1, len(w.queue.entries))
+	}
+
+	// Late entries are counted in the last processed bucket
+	w.queue.add(&w3chttpd.Entry{Timestamp: time.Unix(3, 0), Size: 95})
+	w.getNewAlerts(time.Unix(9, 0))
+	expectedAlerts := []*Alert{
+		&Alert{Timestamp: time.Unix(8, 0), Total: 115, Status: StatusExceed},
+	}
+	testGetNewAlerts(t, w, expectedAlerts, 115, time.Time{})
+
+	// The late entry leaves the window with the bucket of 8
+	w.getNewAlerts(time.Unix(19, 0))
 	expectedAlerts = []*Alert{
-		&Alert{time.Unix(58, 0), 298, StatusExceed},
-		&Alert{time.Unix(59, 0), 226, StatusRecovered},
-		&Alert{time.Unix(60, 0), 437, StatusExceed},
+		&Alert{Timestamp: time.Unix(18, 0), Total: 0, Status: StatusRecovered},
 	}
-	testGetNewAlerts(t, conf.w, expectedAlerts, 437, 4)
+	testGetNewAlerts(t, w, expectedAlerts, 0, time.Unix(8, 0))
 }
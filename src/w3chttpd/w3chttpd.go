@@ -8,6 +8,9 @@ import (
 
 // https://en.wikipedia.org/wiki/Common_Log_Format
 // using []byte instead of string to avoid multiple memory allocations
+// Referer and UserAgent are only set for the Combined Log Format
+// (nil otherwise), Extra holding the quoted fields following the user agent
+// (e.g. "$http_x_forwarded_for")
 
 type Request struct {
 	Method   []byte
@@ -24,6 +27,9 @@ type Entry struct {
 	Req        Request
 	StatusCode int
 	Size       int
+	Referer    []byte
+	UserAgent  []byte
+	Extra      [][]byte
 }
 
 func (e *Entry) String() string {
@@ -33,6 +39,15 @@ func (e *Entry) String() string {
 		e.Timestamp.String(), string(e.Req.Method), string(e.Req.Resource),
 		string(e.Req.Protocol), e.StatusCode, e.Size)
 
+	if e.UserAgent != nil {
+		str += fmt.Sprintf(" \"%s\" \"%s\"",
+			string(e.Referer), string(e.UserAgent))
+	}
+
+	for _, field := range e.Extra {
+		str += fmt.Sprintf(" \"%s\"", string(field))
+	}
+
 	return str
 }
 
@@ -114,8 +129,56 @@ func ParseLine(line []byte, e *Entry) error {
 	e.StatusCode = val
 	start = i + s
 
-	val = convertByteToInt(e.line[start:])
-	e.Size = val
+	e.Referer = nil
+	e.UserAgent = nil
+	e.Extra = e.Extra[:0]
+
+	// size, followed by referer and user agent in the combined format
+	i, s = parseField(e.line, start, ' ')
+	if i == -1 {
+		e.Size = convertByteToInt(e.line[start:])
+		return nil
+	}
+	e.Size = convertByteToInt(e.line[start:i])
+	start = i + s
+
+	// referer
+	start += 1 // eating '"'
+	i, s = parseField(e.line, start, '"')
+	if i == -1 || e.line[start-1] != '"' {
+		return fmt.Errorf("parseField: wrong format: \"%s\"", string(e.line))
+	}
+	e.Referer = e.line[start:i]
+	start = i + s
+
+	// user agent
+	start += 2 // eating ' "'
+	if start > len(e.line) || e.line[start-1] != '"' {
+		return fmt.Errorf("parseField: wrong format: \"%s\"", string(e.line))
+	}
+	i, s = parseField(e.line, start, '"')
+	if i == -1 {
+		return fmt.Errorf("parseField: wrong format: \"%s\"", string(e.line))
+	}
+	e.UserAgent = e.line[start:i]
+	start = i + s
+
+	// extra quoted fields
+	for start < len(e.line) {
+
+		start += 2 // eating ' "'
+		if start > len(e.line) || e.line[start-2] != ' ' ||
+			e.line[start-1] != '"' {
+			return fmt.Errorf("parseField: wrong format: \"%s\"", string(e.line))
+		}
+
+		i, s = parseField(e.line, start, '"')
+		if i == -1 {
+			return fmt.Errorf("parseField: wrong format: \"%s\"", string(e.line))
+		}
+		e.Extra = append(e.Extra, e.line[start:i])
+		start = i + s
+	}
 
 	return nil
 }
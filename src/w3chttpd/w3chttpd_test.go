@@ -125,6 +125,67 @@ func TestParseLine(t *testing.T) {
 
 }
 
+func TestParseLineCombined(t *testing.T) {
+
+	e := &Entry{}
+	line := []byte(`66.249.66.1 - - [07/Mar/2004:16:05:49 -0800] "GET /twiki/ HTTP/1.1" 200 12846 "-" "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"`)
+
+	if err := ParseLine(line, e); err != nil {
+		t.Fatalf("[%s] An error occured: %v", string(line), err)
+	}
+
+	if e.Size != 12846 {
+		t.Errorf("size field differs. Want %d, got %d", 12846, e.Size)
+	}
+
+	if string(e.Referer) != "-" {
+		t.Errorf("referer field differs. Want \"%s\", got \"%s\"", "-", e.Referer)
+	}
+
+	ua := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	if string(e.UserAgent) != ua {
+		t.Errorf("userAgent field differs. Want \"%s\", got \"%s\"",
+			ua, e.UserAgent)
+	}
+
+	if len(e.Extra) != 0 {
+		t.Errorf("[%s] should not have extra fields. Got %q", string(line), e.Extra)
+	}
+
+	line = []byte(`10.0.0.1 - - [07/Mar/2004:16:05:49 -0800] "GET / HTTP/1.1" 200 12 "-" "curl/8.4.0" "203.0.113.7, 10.0.0.2" "-"`)
+	if err := ParseLine(line, e); err != nil {
+		t.Fatalf("[%s] An error occured: %v", string(line), err)
+	}
+
+	if len(e.Extra) != 2 || string(e.Extra[0]) != "203.0.113.7, 10.0.0.2" ||
+		string(e.Extra[1]) != "-" {
+		t.Errorf("extra fields differ. Got %q", e.Extra)
+	}
+
+	// Entries are reused, so fields of the combined format must be reset
+	line = []byte(`127.0.0.1 - - [07/Mar/2004:16:06:51 -0800] "GET /twiki HTTP/1.1" 200 4523`)
+	if err := ParseLine(line, e); err != nil {
+		t.Fatalf("[%s] An error occured: %v", string(line), err)
+	}
+
+	if e.Referer != nil || e.UserAgent != nil || len(e.Extra) != 0 {
+		t.Errorf("[%s] should not have a referer or user agent", string(line))
+	}
+
+	invalid := [][]byte{
+		[]byte(`127.0.0.1 - - [07/Mar/2004:16:06:51 -0800] "GET /twiki HTTP/1.1" 200 4523 "-`),
+		[]byte(`127.0.0.1 - - [07/Mar/2004:16:06:51 -0800] "GET /twiki HTTP/1.1" 200 4523 "-" curl`),
+		[]byte(`127.0.0.1 - - [07/Mar/2004:16:06:51 -0800] "GET /twiki HTTP/1.1" 200 4523 "-" "curl" x`),
+		[]byte(`127.0.0.1 - - [07/Mar/2004:16:06:51 -0800] "GET /twiki HTTP/1.1" 200 4523 "-" "curl" "1.2.3.4`),
+	}
+
+	for _, line := range invalid {
+		if err := ParseLine(line, e); err == nil {
+			t.Errorf("[%s] should return an error", string(line))
+		}
+	}
+}
+
 func BenchmarkParseLine(b *testing.B) {
 
 	e := &Entry{}